@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"flag"
+	"github.com/bodgit/sevenzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Also hash the members of .zip, .tar, .tar.gz and .7z files.
+var archives bool
+
+func init() {
+	flag.BoolVar(&archives, "archives", false, "also hash each file inside .zip, .tar, .tar.gz and .7z archives, recording it as ARCHIVE!/MEMBER")
+}
+
+// What separates the path of an archive from that of a member inside it.
+const archiveSeparator = "!/"
+
+// Check the -archives options. Members are always hashed whole, which a
+// -fingerprint scan promises not to do.
+func checkArchives() error {
+	if archives && fingerprintBytes > 0 {
+		return errors.New("-archives cannot be used with -fingerprint")
+	}
+	return nil
+}
+
+// Check whether a file is an archive whose members -archives hashes.
+func isArchive(name string) bool {
+	if !archives {
+		return false
+	}
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz", ".7z"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash the regular files inside an archive. The contents are data if the
+// archive was read whole, otherwise the archive is read from disk. Members
+// are not opened as archives in turn. Returns the records of the members
+// hashed before any error.
+func archiveMembers(archive string, data []byte) ([]*record, error) {
+	var ra io.ReaderAt
+	var size int64
+	if data != nil {
+		ra, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		f, err := os.Open(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		ra, size = f, info.Size()
+	}
+
+	stored := storedPath(archive)
+	members := []*record{}
+	var each memberFunc = func(name string, info fs.FileInfo, open func() (io.ReadCloser, error)) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rc, err := open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		r := memberRecord(stored, name, info)
+		if r.sha1, r.hashes, err = hashReaderAll(rc); err != nil {
+			return err
+		}
+		members = append(members, r)
+		return nil
+	}
+
+	var err error
+	name := strings.ToLower(archive)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = eachZipMember(ra, size, each)
+	case strings.HasSuffix(name, ".7z"):
+		err = each7zMember(ra, size, each)
+	default:
+		var r io.Reader = io.NewSectionReader(ra, 0, size)
+		if !strings.HasSuffix(name, ".tar") {
+			gz, gzErr := gzip.NewReader(r)
+			if gzErr != nil {
+				return nil, gzErr
+			}
+			defer gz.Close()
+			r = gz
+		}
+		err = eachTarMember(r, each)
+	}
+	return members, err
+}
+
+// Called for each member of an archive with its name, stat and a way to read
+// its contents.
+type memberFunc func(name string, info fs.FileInfo, open func() (io.ReadCloser, error)) error
+
+func eachZipMember(ra io.ReaderAt, size int64, each memberFunc) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := each(f.Name, f.FileInfo(), f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func each7zMember(ra io.ReaderAt, size int64, each memberFunc) error {
+	zr, err := sevenzip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := each(f.Name, f.FileInfo(), f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eachTarMember(r io.Reader, each memberFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// The member is read from the archive as it is walked
+		open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		if err := each(hdr.Name, hdr.FileInfo(), open); err != nil {
+			return err
+		}
+	}
+}
+
+// Create the record of an archive member, without its hash. Names are made
+// relative so that every member is under ARCHIVE!/, whatever the archive
+// recorded.
+func memberRecord(archive, name string, info fs.FileInfo) *record {
+	name = strings.TrimPrefix(path.Clean("/"+strings.Replace(name, "\\", "/", -1)), "/")
+	base := path.Base(name)
+	ext := path.Ext(base)
+
+	return &record{
+		extless: strings.Replace(base, ext, "", -1),
+		ext:     ext,
+		path:    archive + archiveSeparator + name,
+		size:    info.Size(),
+		mtime:   info.ModTime().Unix(),
+		mode:    int64(info.Mode().Perm()),
+		seen:    time.Now().Unix(),
+		job:     jobLabel,
+		archive: archive,
+	}
+}
+
+// Send the record of an archive then those of its members. The archive's
+// row replaces the members recorded by earlier scans, see forgetMembers, so
+// it must be committed before them. Errors reading the archive are logged
+// and the members read until then are kept.
+func sendArchive(result *record, file string, data []byte, out chan<- *record) {
+	members, err := archiveMembers(file, data)
+	if err != nil {
+		fileError(result.path, "Error reading archive: %s: %s\n", file, err)
+	}
+	result.membersRead = true
+
+	out <- result
+	for _, m := range members {
+		out <- m
+	}
+}
+
+// Delete the rows of the members of the archives that were read again, so
+// that members since removed from them don't linger.
+func forgetMembers(tx *sql.Tx, records []*record) error {
+	for _, r := range records {
+		if !r.membersRead {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM files WHERE archive = ?", r.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"os"
+)
+
+// Build the database under a temporary name and swap it in when done.
+var atomicSwap bool
+
+func init() {
+	flag.BoolVar(&atomicSwap, "atomic", false, "scan into a copy of the db and rename it over the original only if the run succeeds")
+}
+
+// Create the database an -atomic scan writes to, next to the real one so
+// the final rename stays on one filesystem. It starts as a copy of the
+// current database, taken with VACUUM INTO so that it is consistent even if
+// another process is writing. A copy left by a failed run is replaced.
+func prepareAtomic(path string) (string, error) {
+	tmp := path + ".atomic"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return tmp, nil
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("VACUUM INTO ?", tmp)
+	return tmp, err
+}
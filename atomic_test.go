@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Number of rows in the files table of the database at path.
+func countRows(t *testing.T, path string) int {
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestAtomic(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "files")
+	writeTree(t, root, map[string]string{"a.txt": "alpha"})
+	dbFile := filepath.Join(dir, "files.db")
+
+	if out, err := runMain(t, "-quiet", "-db", dbFile, root); err != nil {
+		t.Fatalf("first scan: %s\n%s", err, out)
+	}
+
+	// The run fails after the scan, writing the summary to a directory
+	writeTree(t, root, map[string]string{"b.txt": "beta"})
+	if out, err := runMain(t, "-quiet", "-atomic", "-db", dbFile, "-summary-json", dir, root); err == nil {
+		t.Fatalf("scan with a bad -summary-json succeeded\n%s", out)
+	}
+	if n := countRows(t, dbFile); n != 1 {
+		t.Errorf("the failed -atomic scan left %d rows, want 1", n)
+	}
+
+	// A run that succeeds swaps in the new database
+	if out, err := runMain(t, "-quiet", "-atomic", "-db", dbFile, root); err != nil {
+		t.Fatalf("-atomic scan: %s\n%s", err, out)
+	}
+	if n := countRows(t, dbFile); n != 2 {
+		t.Errorf("the -atomic scan left %d rows, want 2", n)
+	}
+	if _, err := os.Stat(dbFile + ".atomic"); !os.IsNotExist(err) {
+		t.Errorf("the temporary database is still there: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Copy every scanned file under this directory, mirroring the tree.
+var backupTo string
+
+func init() {
+	flag.StringVar(&backupTo, "backup-to", "", "copy each scanned file under `DIR`, mirroring its absolute path, and check the copy's hash")
+}
+
+// Check that -backup-to can be used with the other options, making it
+// absolute so the walk can recognise and skip it.
+func checkBackup() error {
+	if backupTo == "" {
+		return nil
+	}
+
+	// The copy is written from the contents read for hashing
+	if fingerprintBytes > 0 {
+		return errors.New("-backup-to cannot be used with -fingerprint, which only reads part of each file")
+	}
+	if sparseMode == "extents" {
+		return errors.New("-backup-to cannot be used with -sparse extents, which only reads the allocated data")
+	}
+	if includeStreams {
+		return errors.New("-backup-to cannot be used with -include-streams")
+	}
+
+	abs, err := filepath.Abs(backupTo)
+	if err != nil {
+		return err
+	}
+	backupTo = abs
+	return nil
+}
+
+// Location of the backup copy of a scanned file, under its absolute path
+// since paths are relative with -no-abs. The volume name is dropped so that
+// Windows paths can be joined. A location outside -backup-to is refused
+// rather than written to.
+func backupPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(backupTo, strings.TrimPrefix(abs, filepath.VolumeName(abs)))
+	if _, ok := relativeDir(backupTo, dest); !ok {
+		return "", fmt.Errorf("backup of %s would be outside %s", path, backupTo)
+	}
+	return dest, nil
+}
+
+// The backup copy of a scanned file, written as the file is read.
+type backupCopy struct {
+	dest string
+	info os.FileInfo
+	f    *os.File
+
+	// First error writing the copy, returned by finish so that a failed
+	// backup doesn't fail the hash
+	err error
+}
+
+// Create the backup copy of a scanned file at its backup location.
+func createBackup(path string, info os.FileInfo) (*backupCopy, error) {
+	dest, err := backupPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	return &backupCopy{dest: dest, info: info, f: f}, nil
+}
+
+func (b *backupCopy) Write(p []byte) (int, error) {
+	if b.err == nil {
+		_, b.err = b.f.Write(p)
+	}
+	return len(p), nil
+}
+
+// Close the copy and give it the original's mtime, then rehash it and
+// compare it to the hash of the original so that a bad write is noticed now
+// rather than at restore time.
+func (b *backupCopy) finish(sha1 string) error {
+	if err := b.f.Close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if err := os.Chtimes(b.dest, b.info.ModTime(), b.info.ModTime()); err != nil {
+		return err
+	}
+
+	got, err := calcSha1(b.dest)
+	if err != nil {
+		return err
+	}
+	if got != sha1 {
+		return fmt.Errorf("copy %s has hash %s, want %s", b.dest, got, sha1)
+	}
+	return nil
+}
+
+// Remove the copy of a file that could not be hashed.
+func (b *backupCopy) abort() {
+	b.f.Close()
+	os.Remove(b.dest)
+}
+
+// Write the contents of a scanned file read whole to its backup location and
+// check the copy.
+func backupFile(path string, info os.FileInfo, data []byte, sha1 string) error {
+	b, err := createBackup(path, info)
+	if err != nil {
+		return err
+	}
+	b.Write(data)
+	return b.finish(sha1)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupTo(t *testing.T) {
+	defer func(saved string) { backupTo = saved }(backupTo)
+	defer func(saved int) { bufSize = saved }(bufSize)
+	defer func(saved bool) { fuzzyHashes = saved }(fuzzyHashes)
+
+	// Several reads of the larger file
+	bufSize = 16
+
+	// Files are copied as they are hashed, or from memory when -fuzzy
+	// reads them whole
+	for _, fuzzyHashes = range []bool{false, true} {
+		root, backups := t.TempDir(), t.TempDir()
+		files := map[string]string{
+			"a.txt":        "alpha",
+			"sub/b.txt":    "beta",
+			"sub/deeper/c": "",
+			"large.bin":    strings.Repeat("0123456789", 100),
+		}
+		writeTree(t, root, files)
+
+		backupTo = backups
+		if err := checkBackup(); err != nil {
+			t.Fatal(err)
+		}
+		scanPaths(t, root)
+
+		for name, contents := range files {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			dest := filepath.Join(backups, path)
+
+			got, err := ioutil.ReadFile(dest)
+			if err != nil {
+				t.Errorf("-fuzzy=%t: %s was not backed up: %s", fuzzyHashes, name, err)
+				continue
+			}
+			if string(got) != contents {
+				t.Errorf("-fuzzy=%t: backup of %s has %q, want %q", fuzzyHashes, name, got, contents)
+			}
+			if hashBytes(got) != hashBytes([]byte(contents)) {
+				t.Errorf("-fuzzy=%t: backup of %s has a different hash", fuzzyHashes, name)
+			}
+
+			orig, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(orig.ModTime()) {
+				t.Errorf("-fuzzy=%t: backup of %s has mtime %s, want %s", fuzzyHashes, name, info.ModTime(), orig.ModTime())
+			}
+		}
+	}
+}
+
+func TestBackupToExcluded(t *testing.T) {
+	defer func(saved string) { backupTo = saved }(backupTo)
+	defer func(saved stringList) { excludeMimes = saved }(excludeMimes)
+
+	root, backups := t.TempDir(), t.TempDir()
+	writeTree(t, root, map[string]string{"image.png": "\x89PNG\r\n\x1a\nrest of the image"})
+
+	backupTo, excludeMimes = backups, stringList{"image/png"}
+	if err := checkBackup(); err != nil {
+		t.Fatal(err)
+	}
+	scanPaths(t, root)
+
+	if _, err := os.Stat(filepath.Join(backups, root, "image.png")); !os.IsNotExist(err) {
+		t.Errorf("an excluded file was backed up: %v", err)
+	}
+}
+
+func TestBackupPath(t *testing.T) {
+	defer func(saved string) { backupTo = saved }(backupTo)
+	backupTo = filepath.FromSlash("/backups")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Relative paths, as stored with -no-abs, are mirrored by where they are
+	// now, so even one climbing out of the working directory stays inside
+	tests := []struct {
+		path, want string
+	}{
+		{"/home/me/a.txt", "/backups/home/me/a.txt"},
+		{"/home/me/../you/b.txt", "/backups/home/you/b.txt"},
+		{"a.txt", filepath.Join("/backups", wd, "a.txt")},
+		{"./sub/b.txt", filepath.Join("/backups", wd, "sub/b.txt")},
+		{"../c.txt", filepath.Join("/backups", filepath.Dir(wd), "c.txt")},
+		{"../../../../../../../../../../d.txt", "/backups/d.txt"},
+	}
+
+	for _, tt := range tests {
+		got, err := backupPath(filepath.FromSlash(tt.path))
+		if err != nil {
+			t.Errorf("backupPath(%q): %s", tt.path, err)
+			continue
+		}
+		if want := filepath.FromSlash(tt.want); got != want {
+			t.Errorf("backupPath(%q) = %q, want %q", tt.path, got, want)
+		}
+		if _, ok := relativeDir(backupTo, got); !ok {
+			t.Errorf("backupPath(%q) = %q, outside %s", tt.path, got, backupTo)
+		}
+	}
+}
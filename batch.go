@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"time"
+)
+
+var (
+	// Number of records committed together.
+	batchSize int
+
+	// Commit once the files in the pending batch add up to this many bytes,
+	// 0 for no limit.
+	batchBytes int64
+
+	// Commit latency to tune the batch size towards, 0 to keep it fixed.
+	batchTarget time.Duration
+
+	// Bounds for the adaptive batch size.
+	batchMin, batchMax int
+
+	// Split each batch into transactions of this many records, 0 to commit
+	// it whole.
+	commitChunk int
+
+	// Pause between the transactions of a split batch.
+	commitPause time.Duration
+
+	// Commit the pending records once the oldest has waited this long, 0 for
+	// no limit.
+	commitEvery time.Duration
+)
+
+func init() {
+	flag.IntVar(&batchSize, "batch", 100000, "commit the records to the db in batches of `N`")
+	flag.Int64Var(&batchBytes, "batch-bytes", 0, "also commit once the pending files total `BYTES` (0 for no limit)")
+	flag.DurationVar(&batchTarget, "batch-target", 0, "adapt the batch size so each commit takes about this long (0 for a fixed size)")
+	flag.IntVar(&batchMin, "batch-min", 1000, "smallest batch size with -batch-target")
+	flag.IntVar(&batchMax, "batch-max", 1000000, "largest batch size with -batch-target")
+	flag.IntVar(&commitChunk, "commit-chunk", 0, "commit each batch as several transactions of `N` records to smooth out writes (0 for one)")
+	flag.DurationVar(&commitPause, "commit-pause", 0, "with -commit-chunk, sleep this long between the transactions of a batch")
+	flag.DurationVar(&commitEvery, "commit-every", 0, "also commit the pending records once the oldest has waited `DURATION`, so slow scans lose little on a crash (0 for no limit)")
+}
+
+// How often to check whether -commit-every is due, a fraction of it so
+// records don't wait much longer than asked.
+func commitTickInterval() time.Duration {
+	interval := commitEvery / 10
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// Accumulates records and commits them to the database in batches, either
+// when size records are pending, when they represent batchBytes of file
+// contents or when the oldest has waited commitEvery, whichever comes first.
+type batcher struct {
+	store   Store
+	records []*record
+	bytes   int64
+	size    int
+
+	// When the oldest pending record was added
+	started time.Time
+
+	// A commit failed for lack of space, the pending records are only kept
+	// for the checkpoint
+	full bool
+}
+
+// Check the -batch size.
+func checkBatch() error {
+	if batchSize < 1 {
+		return errors.New("-batch must be at least 1")
+	}
+	return nil
+}
+
+func newBatcher(db *sql.DB) *batcher {
+	return newStoreBatcher(sqliteStore{db})
+}
+
+func newStoreBatcher(store Store) *batcher {
+	return &batcher{store: store, size: batchSize}
+}
+
+// Add a record to the batch, committing the batch if it is full.
+func (b *batcher) add(r *record) error {
+	if len(b.records) == 0 {
+		b.started = time.Now()
+	}
+	b.records = append(b.records, r)
+	b.bytes += r.size
+
+	if b.full {
+		return nil
+	}
+
+	if len(b.records) >= b.size || (batchBytes > 0 && b.bytes >= batchBytes) {
+		return b.flush()
+	}
+	return b.tick(time.Now())
+}
+
+// Commit the pending records if the oldest has waited -commit-every. A batch
+// committed because it filled up leaves nothing pending, so it is never
+// committed twice.
+func (b *batcher) tick(now time.Time) error {
+	if b.full || commitEvery <= 0 || len(b.records) == 0 || now.Sub(b.started) < commitEvery {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *batcher) write(r *record) error {
+	return b.add(r)
+}
+
+// Commit the final, partial batch.
+func (b *batcher) Close() error {
+	if b.full {
+		return errDiskFull
+	}
+	return b.flush()
+}
+
+// Commit any pending records. With -commit-chunk the batch is committed in
+// smaller transactions with -commit-pause between them, trading a longer
+// flush for a steadier write load on shared storage.
+func (b *batcher) flush() error {
+	if len(b.records) == 0 {
+		return nil
+	}
+
+	// Only the commits count towards -batch-target, not the pauses
+	var elapsed time.Duration
+	for pending := b.records; len(pending) > 0; {
+		n := len(pending)
+		if commitChunk > 0 && n > commitChunk {
+			n = commitChunk
+		}
+
+		start := time.Now()
+		if err := b.store.Commit(pending[:n]); isDiskFull(err) {
+			// Stop the scan rather than hash files that can't be stored
+			errorf("Error committing records, stopping the scan: %s\n", err)
+			b.full = true
+			b.records = pending
+			setDiskFull()
+			return nil
+		} else if err != nil {
+			return err
+		}
+		elapsed += time.Since(start)
+
+		pending = pending[n:]
+		if len(pending) > 0 && commitPause > 0 {
+			time.Sleep(commitPause)
+		}
+	}
+
+	rate := float64(len(b.records)) / (elapsed + time.Millisecond).Seconds()
+	logEvent(levelInfo, logFields{"event": "commit", "records": len(b.records), "ms": elapsed.Milliseconds()},
+		"Committed batch of %d records in %s (%.0f records/s)\n", len(b.records), elapsed.Truncate(time.Millisecond), rate)
+
+	if batchTarget > 0 {
+		b.adapt(len(b.records), elapsed)
+	}
+
+	b.records = []*record{}
+	b.bytes = 0
+	return nil
+}
+
+// Scale the batch size by how far a commit of n records was from the target
+// latency. The change is capped at a factor of two per commit so one slow or
+// fast outlier does not swing the size wildly.
+func (b *batcher) adapt(n int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+
+	factor := float64(batchTarget) / float64(elapsed)
+	if factor > 2 {
+		factor = 2
+	} else if factor < 0.5 {
+		factor = 0.5
+	}
+
+	size := int(float64(n) * factor)
+	if size < batchMin {
+		size = batchMin
+	} else if size > batchMax {
+		size = batchMax
+	}
+
+	if size != b.size {
+		infof("Commit of %d records took %s, batch size now %d\n", n, elapsed.Truncate(time.Millisecond), size)
+		b.size = size
+	}
+}
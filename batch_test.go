@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A store that records the size of each commit, taking perRecord for each
+// record committed.
+type commitCounter struct {
+	Store
+	commits   []int
+	perRecord time.Duration
+}
+
+func (s *commitCounter) Commit(records []*record) error {
+	s.commits = append(s.commits, len(records))
+	time.Sleep(time.Duration(len(records)) * s.perRecord)
+	return nil
+}
+
+func TestBatchBytes(t *testing.T) {
+	defer func(saved int) { batchSize = saved }(batchSize)
+	defer func(saved int64) { batchBytes = saved }(batchBytes)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	sizes := []int64{40, 40, 40, 500, 10, 10}
+
+	tests := []struct {
+		size  int
+		bytes int64
+		want  []int
+	}{
+		// Committed once the pending files reach 100 bytes
+		{100, 100, []int{3, 1, 2}},
+		// Or the count is reached, whichever comes first
+		{2, 100, []int{2, 2, 2}},
+		{100, 0, []int{6}},
+	}
+
+	for _, tt := range tests {
+		batchSize, batchBytes = tt.size, tt.bytes
+
+		store := &commitCounter{}
+		b := newStoreBatcher(store)
+		for _, size := range sizes {
+			if err := b.add(&record{size: size}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(store.commits, tt.want) {
+			t.Errorf("-batch %d -batch-bytes %d committed %v, want %v", tt.size, tt.bytes, store.commits, tt.want)
+		}
+	}
+}
+
+func TestBatchTarget(t *testing.T) {
+	defer func(saved int) { batchSize = saved }(batchSize)
+	defer func(saved time.Duration) { batchTarget = saved }(batchTarget)
+	defer func(min, max int) { batchMin, batchMax = min, max }(batchMin, batchMax)
+	defer func(saved bool) { quiet = saved }(quiet)
+	batchTarget, batchMin, batchMax, quiet = 20*time.Millisecond, 4, 256, true
+
+	tests := []struct {
+		name      string
+		size      int
+		perRecord time.Duration
+
+		// Bounds of the batch size it settles on
+		min, max int
+	}{
+		// About 20 records a commit, from either side
+		{"from small", 4, time.Millisecond, 10, 30},
+		{"from large", 128, time.Millisecond, 10, 30},
+		// Never below -batch-min or above -batch-max
+		{"slow", 16, 5 * time.Millisecond, 4, 4},
+		{"fast", 4, 0, 256, 256},
+	}
+
+	for _, tt := range tests {
+		batchSize = tt.size
+
+		store := &commitCounter{perRecord: tt.perRecord}
+		b := newStoreBatcher(store)
+		for len(store.commits) < 10 {
+			if err := b.add(&record{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if b.size < tt.min || b.size > tt.max {
+			t.Errorf("%s: batch size %d after commits of %v, want between %d and %d", tt.name, b.size, store.commits, tt.min, tt.max)
+		}
+	}
+}
+
+func TestCommitChunk(t *testing.T) {
+	defer func(saved int) { batchSize = saved }(batchSize)
+	defer func(saved int) { commitChunk = saved }(commitChunk)
+	defer func(saved time.Duration) { commitPause = saved }(commitPause)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	tests := []struct {
+		chunk int
+		pause time.Duration
+		want  []int
+	}{
+		{0, 0, []int{10, 10, 5}},
+		{4, 10 * time.Millisecond, []int{4, 4, 2, 4, 4, 2, 4, 1}},
+		{20, 0, []int{10, 10, 5}},
+	}
+
+	for _, tt := range tests {
+		batchSize, commitChunk, commitPause = 10, tt.chunk, tt.pause
+
+		store := &commitCounter{}
+		b := newStoreBatcher(store)
+		start := time.Now()
+		for i := 0; i < 25; i++ {
+			if err := b.add(&record{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(store.commits, tt.want) {
+			t.Errorf("-commit-chunk %d committed %v, want %v", tt.chunk, store.commits, tt.want)
+		}
+		// A pause between the transactions of each batch, not after the last
+		if elapsed, want := time.Since(start), 5*tt.pause; elapsed < want {
+			t.Errorf("-commit-pause %s took %s, want at least %s", tt.pause, elapsed, want)
+		}
+	}
+}
+
+func TestCommitEvery(t *testing.T) {
+	defer func(saved int) { batchSize = saved }(batchSize)
+	defer func(saved time.Duration) { commitEvery = saved }(commitEvery)
+	defer func(saved bool) { quiet = saved }(quiet)
+	batchSize, commitEvery, quiet = 3, time.Minute, true
+
+	store := &commitCounter{}
+	b := newStoreBatcher(store)
+	add := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.add(&record{size: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tick := func(after time.Duration) {
+		if err := b.tick(b.started.Add(after)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two records are below -batch, so only the duration commits them
+	add(2)
+	tick(30 * time.Second)
+	if len(store.commits) != 0 {
+		t.Fatalf("committed %v before -commit-every", store.commits)
+	}
+	tick(time.Minute)
+	if want := []int{2}; !reflect.DeepEqual(store.commits, want) {
+		t.Fatalf("committed %v after -commit-every, want %v", store.commits, want)
+	}
+
+	// A batch committed as it filled up isn't committed again by a tick
+	add(3)
+	tick(time.Minute)
+	tick(2 * time.Minute)
+	if want := []int{2, 3}; !reflect.DeepEqual(store.commits, want) {
+		t.Fatalf("committed %v, want %v", store.commits, want)
+	}
+
+	// The wait starts over with each commit
+	add(1)
+	tick(59 * time.Second)
+	tick(time.Minute)
+	if want := []int{2, 3, 1}; !reflect.DeepEqual(store.commits, want) {
+		t.Errorf("committed %v, want %v", store.commits, want)
+	}
+
+	// Adding a record after the duration commits too, without a tick
+	commitEvery = 10 * time.Millisecond
+	add(1)
+	time.Sleep(2 * commitEvery)
+	add(1)
+	if want := []int{2, 3, 1, 2}; !reflect.DeepEqual(store.commits, want) {
+		t.Errorf("committed %v, want %v", store.commits, want)
+	}
+}
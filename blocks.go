@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"github.com/jcrussell/sha1files/sha1files"
+	"os"
+	"strings"
+)
+
+// Size of the blocks hashed individually for files larger than one block, 0
+// to only hash whole files.
+var blockSize int64
+
+func init() {
+	flag.Int64Var(&blockSize, "block-size", 0, "also store a hash per `BYTES` block of files larger than one block, so -verify can report which blocks changed")
+}
+
+// Hash each blockSize chunk of data, returning the hex digests concatenated.
+func hashBlocks(data []byte, blockSize int64) string {
+	var sb strings.Builder
+	for start := int64(0); start < int64(len(data)); start += blockSize {
+		end := start + blockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sb.WriteString(hashBytes(data[start:end]))
+	}
+	return sb.String()
+}
+
+// Hashes what is written to it blockSize bytes at a time, for the block
+// digests of contents hashed as they are read.
+type blockHasher struct {
+	blockSize int64
+	block     []byte
+	blocks    strings.Builder
+}
+
+func newBlockHasher(blockSize int64) *blockHasher {
+	return &blockHasher{blockSize: blockSize}
+}
+
+func (b *blockHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := int(b.blockSize) - len(b.block)
+		if take > len(p) {
+			take = len(p)
+		}
+		b.block = append(b.block, p[:take]...)
+		p = p[take:]
+
+		if int64(len(b.block)) == b.blockSize {
+			b.blocks.WriteString(hashBytes(b.block))
+			b.block = b.block[:0]
+		}
+	}
+	return n, nil
+}
+
+// The concatenated hex digests of the blocks written, the last one possibly
+// short, as hashBlocks returns them.
+func (b *blockHasher) sums() string {
+	if len(b.block) > 0 {
+		b.blocks.WriteString(hashBytes(b.block))
+		b.block = b.block[:0]
+	}
+	return b.blocks.String()
+}
+
+// Read a file -bufsize bytes at a time, returning its hash and the
+// concatenated hex digests of its blocks.
+func calcBlocks(path string, blockSize int64) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	blocks := newBlockHasher(blockSize)
+	d, err := (&sha1files.Hasher{BufSize: bufSize}).Sum(path, f, blocks)
+	if err != nil {
+		return "", "", err
+	}
+	return d.SHA1, blocks.sums(), nil
+}
+
+// Compare two sets of concatenated block digests and describe the blocks
+// that differ, e.g. "blocks 2, 7 changed". Blocks present in only one set
+// (the file grew or shrank) count as changed.
+func changedBlocks(want, got string) string {
+	const digest = 2 * sha1.Size
+
+	changed := []string{}
+	for i := 0; i*digest < len(want) || i*digest < len(got); i++ {
+		start, end := i*digest, (i+1)*digest
+		if end > len(want) || end > len(got) || want[start:end] != got[start:end] {
+			changed = append(changed, fmt.Sprint(i))
+		}
+	}
+
+	if len(changed) == 1 {
+		return "block " + changed[0] + " changed"
+	}
+	return "blocks " + strings.Join(changed, ", ") + " changed"
+}
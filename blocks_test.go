@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyChangedBlocks(t *testing.T) {
+	defer func(saved int64) { blockSize = saved }(blockSize)
+	defer func(saved bool) { quiet = saved }(quiet)
+	blockSize, quiet = 16, true
+
+	// Ten blocks of 16 bytes
+	contents := []byte(strings.Repeat("0123456789abcdef", 10))
+
+	tests := []struct {
+		name   string
+		change func([]byte) []byte
+		want   string
+	}{
+		{"one byte", func(b []byte) []byte { b[3*16+5] = 'x'; return b }, "CHANGED (block 3 changed)"},
+		{"two blocks", func(b []byte) []byte { b[0], b[9*16] = 'x', 'x'; return b }, "CHANGED (blocks 0, 9 changed)"},
+		{"grown", func(b []byte) []byte { return append(b, "more"...) }, "CHANGED (block 10 changed)"},
+		{"unchanged", func(b []byte) []byte { return b }, "OK"},
+	}
+
+	for _, tt := range tests {
+		root := t.TempDir()
+		path := filepath.Join(root, "disk.img")
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		db := testDB(t, scanRecords(t, root)["disk.img"])
+
+		changed := tt.change(append([]byte{}, contents...))
+		if err := ioutil.WriteFile(path, changed, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		printed := captureStdout(t, func() { _, err = verify(db, nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := path + ": " + tt.want + "\n"; printed != want {
+			t.Errorf("%s: printed %q, want %q", tt.name, printed, want)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"flag"
+)
+
+// Store the creation time of files where the platform records one.
+var readBtime bool
+
+func init() {
+	flag.BoolVar(&readBtime, "btime", false, "store the birth (creation) time of files in btime where the platform and filesystem provide it")
+}
@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Birth time of a file in Unix seconds, or 0 if it is unknown.
+func birthTime(path string, info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		sec, _ := st.Birthtimespec.Unix()
+		return sec
+	}
+	return 0
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Birth time of a file in Unix seconds, or 0 if the filesystem doesn't
+// record it. Stat doesn't report it on Linux, so this costs a statx call.
+func birthTime(path string, info os.FileInfo) int64 {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil {
+		return 0
+	}
+
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return 0
+	}
+	return stx.Btime.Sec
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+import (
+	"os"
+)
+
+// Birth times are not available on this platform.
+func birthTime(path string, info os.FileInfo) int64 {
+	return 0
+}
@@ -0,0 +1,42 @@
+//go:build linux || darwin || freebsd || netbsd || windows
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBtime(t *testing.T) {
+	defer func(saved bool) { readBtime = saved }(readBtime)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	start := time.Now().Unix()
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha"})
+	path := filepath.Join(root, "a.txt")
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if birthTime(path, info) == 0 {
+		t.Skip("the filesystem doesn't record birth times")
+	}
+
+	for _, readBtime = range []bool{false, true} {
+		db := testDB(t, scanRecords(t, root)["a.txt"])
+
+		var btime sql.NullInt64
+		if err := db.QueryRow("SELECT btime FROM files WHERE path = ?", path).Scan(&btime); err != nil {
+			t.Fatal(err)
+		}
+		if btime.Valid != readBtime || (readBtime && (btime.Int64 < start-1 || btime.Int64 > time.Now().Unix()+1)) {
+			t.Errorf("-btime=%t: stored btime %v, want the time a.txt was created", readBtime, btime)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Creation time of a file in Unix seconds, or 0 if it is unknown.
+func birthTime(path string, info os.FileInfo) int64 {
+	if attrs, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return attrs.CreationTime.Nanoseconds() / 1e9
+	}
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of directories recorded as a single unit, e.g. .app.
+var bundleExts stringList
+
+func init() {
+	flag.Var(&bundleExts, "bundle-ext", "record directories with this extension, e.g. .app, as one row hashed over their contents (repeatable)")
+}
+
+// Check that -bundle-ext can be used with the other options.
+func checkBundles() error {
+	if len(bundleExts) == 0 {
+		return nil
+	}
+
+	// Bundles are hashed from whole files and aren't files themselves
+	if fingerprintBytes > 0 {
+		return errors.New("-bundle-ext cannot be used with -fingerprint")
+	}
+	if backupTo != "" {
+		return errors.New("-bundle-ext cannot be used with -backup-to")
+	}
+	return nil
+}
+
+// Check whether a directory is a bundle to record as a single unit.
+func isBundleDir(info os.FileInfo) bool {
+	return len(bundleExts) > 0 && info.IsDir() && hasExt(info.Name(), bundleExts)
+}
+
+// Check whether a stored path is that of a bundle, for rehashing it.
+func isBundle(path string) bool {
+	if len(bundleExts) == 0 || !hasExt(filepath.Base(path), bundleExts) {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Describe the contents of a bundle with one line per entry, in walk order:
+// "f HASH PATH" for files and "l TARGET PATH" for symlinks, with PATH
+// relative to the bundle and slash-separated. The SHA1 of this is the
+// bundle's hash, so it changes when any file inside is added, removed,
+// renamed or changed. Hidden files are included since they are part of the
+// bundle. Also returns the total size of the files.
+func bundleManifest(dir string) ([]byte, int64, error) {
+	lines := &strings.Builder{}
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(lines, "l %s %s\n", target, rel)
+		case info.Mode().IsRegular():
+			hash, err := calcSha1(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(lines, "f %s %s\n", hash, rel)
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return []byte(lines.String()), size, err
+}
+
+// Total size of the files in a bundle, from their stats, for -max-bytes and
+// -dedup-scan before the bundle is hashed.
+func bundleSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Compute the hash of a bundle directory.
+func bundleSha1(dir string) (string, error) {
+	manifest, _, err := bundleManifest(dir)
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(manifest), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBundleScan(t *testing.T) {
+	defer func(saved stringList) { bundleExts = saved }(bundleExts)
+	defer func(saved bool) { noHash = saved }(noHash)
+	defer func(saved bool) { dedupScan = saved }(dedupScan)
+	defer func(saved int64) { maxBytes = saved }(maxBytes)
+	defer func() { bytesQueued, budgetSpent, lastQueued = 0, false, checkpoint{} }()
+	bundleExts = stringList{".app"}
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"Tool.app/Contents/Info.plist":    "plist",
+		"Tool.app/Contents/MacOS/tool":    "binary",
+		"Tool.app/Contents/.hidden/state": "state",
+		"z.txt":                           "z",
+	})
+	manifest, size, err := bundleManifest(filepath.Join(root, "Tool.app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := hashBytes(manifest)
+
+	tests := []struct {
+		name      string
+		noHash    bool
+		dedupScan bool
+		maxBytes  int64
+
+		want []string
+		sha1 string
+	}{
+		{name: "hashed", want: []string{"Tool.app", "z.txt"}, sha1: sum},
+		{name: "no-hash", noHash: true, want: []string{"Tool.app", "z.txt"}},
+		{name: "dedup-scan", dedupScan: true, want: []string{"Tool.app", "z.txt"}},
+		{name: "max-bytes", maxBytes: 10, want: []string{"Tool.app"}, sha1: sum},
+	}
+
+	for _, tt := range tests {
+		noHash, dedupScan, maxBytes = tt.noHash, tt.dedupScan, tt.maxBytes
+		bytesQueued, budgetSpent, lastQueued = 0, false, checkpoint{}
+
+		records := scanRecords(t, root)
+		got := []string{}
+		for _, name := range []string{"Tool.app", "z.txt"} {
+			if _, ok := records[name]; ok {
+				got = append(got, name)
+			}
+		}
+		if len(records) != len(got) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: recorded %d rows %v, want %v", tt.name, len(records), got, tt.want)
+			continue
+		}
+
+		r := records["Tool.app"]
+		if r.sha1 != tt.sha1 || r.size != size {
+			t.Errorf("%s: Tool.app has %q and size %d, want %q and %d", tt.name, r.sha1, r.size, tt.sha1, size)
+		}
+		if tt.maxBytes > 0 && (!budgetSpent || lastQueued.path != filepath.Join(root, "Tool.app")) {
+			t.Errorf("%s: stopped with budgetSpent=%t at %s", tt.name, budgetSpent, lastQueued)
+		}
+
+		// -rescan-only-missing-hashes hashes the bundle recorded by -no-hash
+		if tt.noHash {
+			db := testDB(t, r)
+			if _, err := rescanMissingHashes(db); err != nil {
+				t.Fatal(err)
+			}
+			if got := storedSha1(t, db, r.path); got != sum {
+				t.Errorf("%s: rescanned Tool.app has %q, want %q", tt.name, got, sum)
+			}
+		}
+	}
+}
+
+func TestBundleHash(t *testing.T) {
+	defer func(saved stringList) { bundleExts = saved }(bundleExts)
+	bundleExts = stringList{".app"}
+
+	contents := map[string]string{"Contents/Info.plist": "plist", "Contents/MacOS/tool": "binary"}
+
+	tests := []struct {
+		name   string
+		change map[string]string
+		same   bool
+	}{
+		// A copy elsewhere, under another name, is a duplicate
+		{"copy", nil, true},
+		{"changed file", map[string]string{"Contents/MacOS/tool": "patched"}, false},
+		{"added file", map[string]string{"Contents/Resources/icon": "icon"}, false},
+	}
+
+	root := t.TempDir()
+	writeTree(t, filepath.Join(root, "Tool.app"), contents)
+	for _, tt := range tests {
+		writeTree(t, filepath.Join(root, tt.name, "Other.app"), contents)
+		writeTree(t, filepath.Join(root, tt.name, "Other.app"), tt.change)
+	}
+
+	records := scanRecords(t, root)
+	if len(records) != 1+len(tests) {
+		t.Errorf("recorded %d rows, want one per bundle", len(records))
+	}
+	want := records["Tool.app"].sha1
+	for _, tt := range tests {
+		r := records[tt.name+"/Other.app"]
+		if r == nil || (r.sha1 == want) != tt.same {
+			t.Errorf("%s: recorded %+v, Tool.app has %s", tt.name, r, want)
+		}
+	}
+}
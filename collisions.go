@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Report paths that differ only by case.
+var checkCaseCollisions bool
+
+func init() {
+	flag.BoolVar(&checkCaseCollisions, "check-case-collisions", false, "print groups of paths that differ only by case (after the scan if DIRs are given)")
+}
+
+// Find the groups of recorded paths that would refer to the same file on a
+// case-insensitive filesystem. Each group and the groups themselves are
+// sorted.
+func findCaseCollisions(db *sql.DB) ([][]string, error) {
+	rows, err := db.Query("SELECT path FROM files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folded := map[string][]string{}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+
+		key := strings.ToLower(path)
+		folded[key] = append(folded[key], path)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := [][]string{}
+	for _, paths := range folded {
+		if len(paths) > 1 {
+			sort.Strings(paths)
+			groups = append(groups, paths)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+
+	return groups, nil
+}
+
+// Print each group of paths that differ only by case, separated by blank
+// lines. Copying such a tree to a case-insensitive filesystem (the default on
+// Windows and macOS) would leave only one file of each group.
+func printCaseCollisions(w io.Writer, db *sql.DB) error {
+	groups, err := findCaseCollisions(db)
+	if err != nil {
+		return err
+	}
+
+	for i, paths := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		for _, path := range paths {
+			fmt.Fprintf(w, "%s\n", path)
+		}
+	}
+
+	return nil
+}
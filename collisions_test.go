@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintCaseCollisions(t *testing.T) {
+	db := testDB(t,
+		&record{path: "/data/Foo.txt", sha1: emptySha1},
+		&record{path: "/data/foo.txt", sha1: emptySha1},
+		&record{path: "/data/bar.txt", sha1: emptySha1},
+		&record{path: "/data/Photos/a.JPG", sha1: emptySha1},
+		&record{path: "/data/photos/a.jpg", sha1: emptySha1},
+		&record{path: "/data/PHOTOS/A.jpg", sha1: emptySha1},
+	)
+
+	want := "/data/Foo.txt\n/data/foo.txt\n\n/data/PHOTOS/A.jpg\n/data/Photos/a.JPG\n/data/photos/a.jpg\n"
+
+	var buf bytes.Buffer
+	if err := printCaseCollisions(&buf, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+}
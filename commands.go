@@ -0,0 +1,371 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// A subcommand, standing for the mode flag of the action it runs. A command
+// takes the flags listed, which are shown in its help, and those no command
+// lists; commands that scan their DIRs first take the flags of scan too.
+type command struct {
+	name    string
+	args    string
+	summary string
+
+	// Set the command's mode from its arguments, nil for a plain scan
+	apply func(args []string) ([]string, error)
+
+	// The mode flag the command stands for, and whether it scans its DIRs
+	mode  string
+	scans bool
+
+	flags []string
+}
+
+// The subcommands, in the order of the help.
+var commands = []*command{
+	{
+		name: "scan", args: "DIR [DIR]...",
+		summary: "hash the files under the DIRs into the database, the same as giving the DIRs alone",
+		flags: []string{"db", "incremental", "hash", "workers", "filter", "include-ext", "skip-empty", "one-filesystem",
+			"prune-dir", "max-bytes", "resume", "out", "also-json", "summary-json", "atomic", "exclude", "include",
+			"ignore-file", "fuzzy", "bufsize", "hash-workers", "normalized", "override"},
+	},
+	{
+		name: "watch", args: "DIR [DIR]...",
+		summary: "scan the DIRs, then keep hashing the files created or changed under them and forgetting removed ones",
+		apply:   setMode(&watchMode),
+		mode:    "watch",
+		scans:   true,
+		flags:   []string{"db", "watch-delay", "incremental", "hash", "exclude", "include", "ignore-file"},
+	},
+	{
+		name: "verify", args: "[DIR]...",
+		summary: "rehash the recorded files and report those that changed or went missing, and new files under the DIRs",
+		apply:   setMode(&verifyMode),
+		mode:    "verify",
+		scans:   true,
+		flags:   []string{"db", "check-only-new", "verify-fix", "prune-missing", "verify-workers", "bufsize"},
+	},
+	{
+		name: "dupes", args: "[DIR]...",
+		summary: "print the groups of files with identical content, scanning the DIRs first",
+		apply:   setMode(&dupesMode),
+		mode:    "dupes",
+		scans:   true,
+		flags:   []string{"db", "dupes-format", "dupes-sort", "keep-rule", "keep-prefix", "include-empty", "hide-known"},
+	},
+	{
+		name: "dedupe", args: "ACTION",
+		summary: "delete the duplicates of each -dupes group but the copy kept, or replace them with hardlinks or reflinks",
+		apply:   setValue(&dedupeAction, "an ACTION (delete, hardlink or reflink)"),
+		mode:    "dedupe",
+		flags:   []string{"db", "dedupe-apply", "keep-rule", "keep-prefix", "include-empty", "hide-known"},
+	},
+	{
+		name: "similar", args: "[DIR]...",
+		summary: "print clusters of files with similar fuzzy hashes, scanning the DIRs with -fuzzy first",
+		apply:   setSimilar,
+		mode:    "similar",
+		scans:   true,
+		flags:   []string{"db", "similarity", "fuzzy", "hide-known"},
+	},
+	{
+		name: "stats", args: "[DIR]...",
+		summary: "print the totals by extension and top-level directory, duplicates, largest files and sizes of the database",
+		apply:   setMode(&statsMode),
+		mode:    "stats",
+		scans:   true,
+		flags:   []string{"db", "stats-format", "stats-top", "include-empty"},
+	},
+	{
+		name: "query", args: "[PREFIX]",
+		summary: "print the files whose hash starts with PREFIX, or those of -lookup-path or -lookup-name",
+		apply:   setQuery,
+		mode:    "lookup",
+		flags:   []string{"db", "lookup-path", "lookup-name", "query-format"},
+	},
+	{
+		name: "serve", args: "[ADDR]",
+		summary: "answer lookups by hash, path or name, duplicate groups and stats as an HTTP JSON API on ADDR",
+		apply:   setServe,
+		mode:    "serve",
+		flags:   []string{"db", "dupes-sort", "include-empty"},
+	},
+	{
+		name:    "promote",
+		summary: "compute the full hash of the files whose -quick fingerprint another file shares",
+		apply:   setMode(&promoteMode),
+		mode:    "promote",
+		flags:   []string{"db", "hash-workers"},
+	},
+	{
+		name: "prune", args: "[DIR]...",
+		summary: "delete the rows of files that no longer exist, after scanning the DIRs",
+		apply:   setMode(&pruneMissing),
+		mode:    "prune-missing",
+		scans:   true,
+		flags:   []string{"db", "dry-run", "prune-under"},
+	},
+	{
+		name: "diff", args: "OLD NEW",
+		summary: "print the files added, removed, modified or moved between two databases",
+		apply:   setMode(&diffDBs),
+		mode:    "diff-dbs",
+		flags:   []string{"override"},
+	},
+	{
+		name: "merge", args: "OUT IN [IN]...",
+		summary: "merge the rows of the databases IN into OUT, keeping the newest row of each path",
+		apply:   setMode(&mergeDBs),
+		mode:    "merge-dbs",
+		flags:   []string{"merge-host", "merge-prefix", "normalized", "override"},
+	},
+	{
+		name: "validate", args: "DB",
+		summary: "check the integrity and schema of the database DB and print its row counts and metadata, exiting non-zero on any problem",
+		apply:   setValue(&validateDB, "a DB to check"),
+		mode:    "validate-db",
+	},
+	{
+		name: "export", args: "FILE",
+		summary: "write every row to FILE as JSON lines, a sha1sum manifest or hashdeep file, resuming an interrupted export",
+		apply:   setValue(&exportPath, "an output FILE"),
+		mode:    "export",
+		flags:   []string{"db", "export-format", "hash"},
+	},
+	{
+		name: "import", args: "FILE [FILE]...",
+		summary: "add the files listed in sha1sum-style, hashdeep or JSON lines manifests without hashing them",
+		apply:   setMode(&importMode),
+		mode:    "import",
+		flags:   []string{"db", "import-hash"},
+	},
+	{
+		name: "known", args: "FILE [FILE]...",
+		summary: "load NSRL RDS or plain lists of SHA1s into the known_hashes table for -known and -hide-known",
+		apply:   setMode(&loadKnown),
+		mode:    "load-known",
+		flags:   []string{"db", "known-set"},
+	},
+}
+
+// Set a mode flag, keeping the arguments.
+func setMode(mode *bool) func([]string) ([]string, error) {
+	return func(args []string) ([]string, error) {
+		*mode = true
+		return args, nil
+	}
+}
+
+// Set a flag to the first argument, which the command needs.
+func setValue(value *string, what string) func([]string) ([]string, error) {
+	return func(args []string) ([]string, error) {
+		if len(args) == 0 || args[0] == "" {
+			return nil, fmt.Errorf("needs %s", what)
+		}
+		*value = args[0]
+		return args[1:], nil
+	}
+}
+
+// Set -lookup to the hash prefix, which query needs unless a path or name
+// is looked up instead.
+func setQuery(args []string) ([]string, error) {
+	if len(args) > 0 && args[0] != "" {
+		lookupHash = args[0]
+		return args[1:], nil
+	}
+	if lookupPath == "" && lookupName == "" {
+		return nil, fmt.Errorf("needs a hash PREFIX, -lookup-path or -lookup-name")
+	}
+	return args, nil
+}
+
+// Set -similar, and -fuzzy if there are DIRs to scan since the clusters
+// need fuzzy hashes.
+func setSimilar(args []string) ([]string, error) {
+	similarMode = true
+	if len(args) > 0 {
+		fuzzyHashes = true
+	}
+	return args, nil
+}
+
+// Set -serve to the address, localhost:8080 unless one is given.
+func setServe(args []string) ([]string, error) {
+	serveAddr = "localhost:8080"
+	if len(args) > 0 && args[0] != "" {
+		serveAddr = args[0]
+		return args[1:], nil
+	}
+	return args, nil
+}
+
+// Find a subcommand by name.
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Parse the command line, which may start with a subcommand. A directory
+// named like a command can be scanned as ./NAME.
+func parseCommandLine() {
+	if len(os.Args) < 2 {
+		flag.Parse()
+		return
+	}
+
+	if os.Args[1] == "help" {
+		if len(os.Args) > 2 {
+			if c := findCommand(os.Args[2]); c != nil {
+				c.usage()
+				os.Exit(0)
+			}
+		}
+
+		// Without arguments main prints the general usage
+		flag.CommandLine.Parse(nil)
+		return
+	}
+
+	c := findCommand(os.Args[1])
+	if c == nil {
+		if looksLikeCommand(os.Args[1]) {
+			log.Fatalf("unknown command %q, see sha1files help (give a directory named like a command as ./%s)", os.Args[1], os.Args[1])
+		}
+		flag.Parse()
+		return
+	}
+
+	flag.Usage = c.usage
+	args, err := parseCommand(c, os.Args[2:])
+	if err != nil {
+		log.Fatalf("%s %s", c.name, err)
+	}
+	// Left for flag.Args, even those that look like flags
+	flag.CommandLine.Parse(append([]string{"--"}, args...))
+}
+
+// Parse the flags and arguments of a command, in any order, e.g. sha1files
+// scan DIR -db x.db -quiet, and apply them. Everything after -- is an
+// argument. Returns the arguments left for the action.
+func parseCommand(c *command, args []string) ([]string, error) {
+	// The flags of the command line, less those set before
+	flags := flag.NewFlagSet(c.name, flag.ExitOnError)
+	flags.Usage = c.usage
+	flag.VisitAll(func(f *flag.Flag) { flags.Var(f.Value, f.Name, f.Usage) })
+
+	positional := []string{}
+	for {
+		flags.Parse(args)
+		rest := flags.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+
+	foreign := []string{}
+	flags.Visit(func(f *flag.Flag) {
+		if !c.takes(f.Name) {
+			foreign = append(foreign, "-"+f.Name)
+		}
+	})
+	if len(foreign) > 0 {
+		return nil, fmt.Errorf("doesn't take %s, see sha1files help %s", strings.Join(foreign, ", "), c.name)
+	}
+
+	if c.apply == nil {
+		return positional, nil
+	}
+	return c.apply(positional)
+}
+
+// Check whether a flag is the command's own: its mode or one it lists.
+func (c *command) owns(name string) bool {
+	if name == c.mode {
+		return true
+	}
+	for _, f := range c.flags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a command takes a flag: one of its own, one of scan's if it
+// scans its DIRs, or one that belongs to no command.
+func (c *command) takes(name string) bool {
+	if c.owns(name) || c.scans && findCommand("scan").owns(name) {
+		return true
+	}
+	for _, other := range commands {
+		if other.owns(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check whether the first argument is a mistyped or unknown command rather
+// than a directory to scan: a bare lowercase word naming nothing on disk.
+func looksLikeCommand(arg string) bool {
+	if arg == "" || strings.HasPrefix(arg, "-") {
+		return false
+	}
+	for _, c := range arg {
+		if (c < 'a' || c > 'z') && c != '-' {
+			return false
+		}
+	}
+	_, err := os.Lstat(arg)
+	return os.IsNotExist(err)
+}
+
+// Print the usage of a command with the flags that matter most to it.
+func (c *command) usage() {
+	fmt.Fprintf(os.Stderr, "USAGE: sha1files %s [OPTIONS] %s\n\n", c.name, c.args)
+	fmt.Fprintf(os.Stderr, "%s%s.\n\n", strings.ToUpper(c.summary[:1]), c.summary[1:])
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	for _, name := range c.flags {
+		f := flag.Lookup(name)
+		if f == nil {
+			continue
+		}
+
+		kind, usage := flag.UnquoteUsage(f)
+		if kind != "" {
+			kind = " " + kind
+		}
+		fmt.Fprintf(os.Stderr, "  -%s%s\n    \t%s\n", f.Name, kind, usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	if c.scans {
+		fmt.Fprintf(os.Stderr, "The options of sha1files help scan apply to the DIRs.\n")
+	}
+	fmt.Fprintf(os.Stderr, "Options that no command lists apply too, see sha1files -h.\n")
+}
+
+// Print the list of commands for the general usage.
+func printCommands() {
+	fmt.Printf("\nCommands:\n")
+	for _, c := range commands {
+		fmt.Printf("  %-7s %s\n", c.name, c.summary)
+	}
+	fmt.Printf("\nRun sha1files help COMMAND for the options of a command.\n\n")
+}
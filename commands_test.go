@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	// The flags the commands below set, as strings so they can be reset
+	names := []string{"db", "quiet", "hash", "verify", "verify-fix", "dupes", "lookup", "stats", "dupes-format"}
+	saved := map[string]string{}
+	for _, name := range names {
+		saved[name] = flag.Lookup(name).Value.String()
+	}
+	reset := func() {
+		for name, value := range saved {
+			flag.Set(name, value)
+		}
+	}
+	defer reset()
+
+	tests := []struct {
+		args []string
+		want []string
+		set  map[string]string
+
+		// Part of the error, "" for none
+		err string
+	}{
+		{[]string{"scan", "d", "-db", "y.db", "-quiet"}, []string{"d"}, map[string]string{"db": "y.db", "quiet": "true"}, ""},
+		{[]string{"scan", "-quiet", "d1", "-db", "y.db", "d2"}, []string{"d1", "d2"}, map[string]string{"db": "y.db", "quiet": "true"}, ""},
+		{[]string{"scan", "d", "--", "-quiet"}, []string{"d", "-quiet"}, map[string]string{"quiet": "false"}, ""},
+		{[]string{"query", "0a1b", "-db", "other.db"}, []string{}, map[string]string{"lookup": "0a1b", "db": "other.db"}, ""},
+		{[]string{"verify", "d", "-verify-fix"}, []string{"d"}, map[string]string{"verify": "true", "verify-fix": "true"}, ""},
+		{[]string{"dupes", "d", "-hash", "sha256"}, []string{"d"}, map[string]string{"dupes": "true", "hash": "sha256"}, ""},
+		{[]string{"scan", "d", "-verify-fix"}, nil, nil, "-verify-fix"},
+		{[]string{"stats", "-dupes-format", "json", "-verify"}, nil, nil, "-dupes-format, -verify"},
+		{[]string{"diff", "a.db", "b.db", "-db", "c.db"}, nil, nil, "-db"},
+	}
+
+	for _, tt := range tests {
+		reset()
+
+		got, err := parseCommand(findCommand(tt.args[0]), tt.args[1:])
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: got error %v, want one naming %s", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", tt.args, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got arguments %q, want %q", tt.args, got, tt.want)
+		}
+		for name, value := range tt.set {
+			if got := flag.Lookup(name).Value.String(); got != value {
+				t.Errorf("%v: -%s = %q, want %q", tt.args, name, got, value)
+			}
+		}
+	}
+}
+
+func TestCommandFlagsExist(t *testing.T) {
+	for _, c := range commands {
+		for _, name := range append([]string{c.mode}, c.flags...) {
+			if name != "" && flag.Lookup(name) == nil {
+				t.Errorf("%s: no flag -%s", c.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// JSON file describing several scan jobs with options of their own.
+var configPath string
+
+func init() {
+	flag.StringVar(&configPath, "config", "", "run the scan jobs described in the JSON `FILE`, each with its own roots and options")
+}
+
+// Options that a job in a -config file may set for its own roots. Other
+// options apply to the whole run and can only be given on the command line.
+var jobOptions = []string{
+	"allow-overlap", "archives", "block-size", "btime", "bundle-ext", "canonical-path",
+	"dedup-scan", "exclude", "exclude-mime", "follow-symlinks", "fuzzy", "home-relative",
+	"ignore-file", "include", "include-ext", "include-mime", "include-streams", "max-read-size",
+	"max-size", "min-size", "no-abs", "one-filesystem", "prune-dir", "record-timing",
+	"rehash-links", "skip-empty", "skip-system-dirs", "sparse", "types", "warn-on-slow", "xattrs",
+}
+
+// Label of the job being scanned, stored with each record.
+var jobLabel string
+
+// A set of roots scanned with the same options. Jobs come from -config, plus
+// one for the DIRs given on the command line.
+type scanJob struct {
+	Label   string                 `json:"label"`
+	Roots   []string               `json:"roots"`
+	Options map[string]interface{} `json:"options"`
+
+	// Roots made absolute and deduplicated under the job's options
+	roots []string
+}
+
+// The job options as given on the command line, restored before each job.
+var commandLine map[string]interface{}
+
+// Save the command line values of the job options.
+func saveJobOptions() {
+	commandLine = map[string]interface{}{}
+	for _, name := range jobOptions {
+		value := flag.Lookup(name).Value
+		if list, ok := value.(*stringList); ok {
+			commandLine[name] = append(stringList{}, *list...)
+		} else {
+			commandLine[name] = value.String()
+		}
+	}
+}
+
+// Reset the job options to their command line values.
+func restoreJobOptions() {
+	for _, name := range jobOptions {
+		value := flag.Lookup(name).Value
+		if list, ok := value.(*stringList); ok {
+			*list = append(stringList{}, commandLine[name].(stringList)...)
+		} else {
+			value.Set(commandLine[name].(string))
+		}
+	}
+	jobLabel = ""
+}
+
+// Check whether an option may be set per job.
+func isJobOption(name string) bool {
+	for _, option := range jobOptions {
+		if name == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the options for scanning the job's roots: the command line values
+// overridden by the job's own. Repeatable options take a list of values.
+func (j *scanJob) apply() error {
+	restoreJobOptions()
+	jobLabel = j.Label
+
+	for name, value := range j.Options {
+		if !isJobOption(name) {
+			return fmt.Errorf("job %q: option %q cannot be set per job", j.Label, name)
+		}
+
+		f := flag.Lookup(name)
+		if list, ok := f.Value.(*stringList); ok {
+			*list = stringList{}
+			values, ok := value.([]interface{})
+			if !ok {
+				values = []interface{}{value}
+			}
+			for _, v := range values {
+				list.Set(fmt.Sprint(v))
+			}
+			continue
+		}
+
+		if err := f.Value.Set(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("job %q: invalid %s %v: %s", j.Label, name, value, err)
+		}
+	}
+
+	if err := checkPatterns(); err != nil {
+		return fmt.Errorf("job %q: %s", j.Label, err)
+	}
+	if err := checkTypes(); err != nil {
+		return fmt.Errorf("job %q: %s", j.Label, err)
+	}
+	return checkSparseMode()
+}
+
+// Read the jobs from a -config file, which looks like
+//
+//	{"jobs": [{"label": "photos", "roots": ["/data/photos"], "options": {"include-ext": [".jpg"]}}]}
+//
+// Each job's options are checked and its roots resolved up front so that a
+// mistake is reported before anything is scanned.
+func loadConfig(path string) ([]*scanJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config struct {
+		Jobs []*scanJob `json:"jobs"`
+	}
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	defer restoreJobOptions()
+	for _, job := range config.Jobs {
+		if len(job.Roots) == 0 {
+			return nil, fmt.Errorf("%s: job %q has no roots", path, job.Label)
+		}
+		if strings.TrimSpace(job.Label) == "" {
+			return nil, fmt.Errorf("%s: every job needs a label", path)
+		}
+
+		if err := job.apply(); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		job.roots = resolveRoots(job.Roots)
+	}
+
+	return config.Jobs, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestConfigJobs(t *testing.T) {
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	dir := t.TempDir()
+	docs, photos := filepath.Join(dir, "docs"), filepath.Join(dir, "photos")
+	for _, root := range []string{docs, photos} {
+		writeTree(t, root, map[string]string{"a.txt": "hi", "b.md": "longer text", "c.txt": "longer"})
+	}
+
+	config := filepath.Join(dir, "jobs.json")
+	err := ioutil.WriteFile(config, []byte(fmt.Sprintf(`{"jobs": [
+		{"label": "docs", "roots": [%q], "options": {"include-ext": [".txt"]}},
+		{"label": "photos", "roots": [%q], "options": {"min-size": 5}}
+	]}`, docs, photos)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveJobOptions()
+	defer restoreJobOptions()
+	jobs, err := loadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each job's options apply to its own roots only
+	want := map[string][]string{
+		"docs":   {filepath.Join(docs, "a.txt"), filepath.Join(docs, "c.txt")},
+		"photos": {filepath.Join(photos, "b.md"), filepath.Join(photos, "c.txt")},
+	}
+	got := map[string][]string{}
+
+	out := make(chan *record)
+	go func() {
+		for _, job := range jobs {
+			if err := job.apply(); err != nil {
+				t.Error(err)
+			}
+			scan(job.roots, out)
+		}
+		restoreJobOptions()
+		close(out)
+	}()
+	for r := range out {
+		got[r.job] = append(got[r.job], r.path)
+	}
+	for _, paths := range got {
+		sort.Strings(paths)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+	if len(includeExts) != 0 || minSize != 0 || jobLabel != "" {
+		t.Errorf("left -include-ext %v, -min-size %d and job %q after the jobs", includeExts, minSize, jobLabel)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+)
+
+// Optional function computing an extra identifier for each file's contents,
+// stored in the content_id column next to the SHA1. It is given the path of
+// the file and a reader over the contents already read for hashing, so the
+// file is not read twice. It is the ContentID of the scans' Hasher (see the
+// sha1files package). The default is none. To plug in another scheme, add a
+// file setting it from an init function, e.g.
+//
+//	func init() {
+//		contentID = func(path string, r io.Reader) (string, error) { ... }
+//	}
+var contentID func(path string, r io.Reader) (string, error)
+
+// The contentID as the ContentID of a Hasher, logging its errors instead of
+// failing the file. nil if there is no contentID.
+func contentIDFunc() func(path string, r io.Reader) (string, error) {
+	if contentID == nil {
+		return nil
+	}
+
+	return func(path string, r io.Reader) (string, error) {
+		id, err := contentID(path, r)
+		if err != nil {
+			fileError(storedPath(path), "Error computing content ID: %s: %s\n", path, err)
+		}
+		return id, nil
+	}
+}
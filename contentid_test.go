@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A content ID of the length and first byte of the contents, or an error for
+// files named bad.
+func stubContentID(path string, r io.Reader) (string, error) {
+	if strings.HasPrefix(filepath.Base(path), "bad") {
+		return "", errors.New("unsupported")
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%c", len(data), data[0]), nil
+}
+
+func TestContentID(t *testing.T) {
+	defer func(saved func(string, io.Reader) (string, error)) { contentID = saved }(contentID)
+	defer func(saved int64) { maxReadSize = saved }(maxReadSize)
+	defer func(saved bool) { quiet = saved }(quiet)
+	contentID, quiet = stubContentID, true
+
+	root := t.TempDir()
+	files := map[string]string{
+		"small.txt": "hello",
+		"large.txt": strings.Repeat("large", 1000),
+		"bad.txt":   "bad",
+	}
+	writeTree(t, root, files)
+
+	// large.txt is hashed as it is read
+	maxReadSize = 1000
+	all := []*record{}
+	for _, r := range scanRecords(t, root) {
+		all = append(all, r)
+	}
+	db := testDB(t, all...)
+
+	want := map[string]string{
+		"small.txt": "5:h",
+		"large.txt": "5000:l",
+		"bad.txt":   "",
+	}
+	for name, id := range want {
+		var got sql.NullString
+		var sum string
+		err := db.QueryRow("SELECT content_id, sha1 FROM files WHERE path = ?", filepath.Join(root, name)).Scan(&got, &sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String != id || got.Valid != (id != "") {
+			t.Errorf("%s: stored content ID %v, want %q", name, got, id)
+		}
+		// A failed content ID doesn't fail the file
+		if want := hashBytes([]byte(files[name])); sum != want {
+			t.Errorf("%s: stored SHA1 %q, want %q", name, sum, want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !darwin && !freebsd && !netbsd
+
+package main
+
+import (
+	"os"
+)
+
+// Change times are not available on this platform, so -incremental only
+// compares size and mtime.
+func changeTime(info os.FileInfo) int64 {
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build linux || openbsd || dragonfly || solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Change time of a file's inode in Unix nanoseconds, or 0 if it is unknown.
+func changeTime(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ctim.Nano()
+	}
+	return 0
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"log"
+	"strings"
+	"time"
+)
+
+// Number of times a commit is attempted while the database is busy.
+const commitAttempts = 5
+
+var (
+	// How long SQLite waits on a locked database before giving up with
+	// SQLITE_BUSY.
+	busyTimeout time.Duration
+
+	// Store each distinct hash once in a hashes table referenced by files.
+	normalized bool
+)
+
+func init() {
+	flag.DurationVar(&busyTimeout, "busy-timeout", 5*time.Second, "how long to wait for a locked database before retrying")
+	flag.BoolVar(&normalized, "normalized", false, "use a two-table schema where files reference a shared hashes row")
+}
+
+// A column of the files table, besides the hash which the flat and
+// normalized schemas store differently.
+type column struct {
+	name string
+	decl string
+
+	// Value of the column for a record being inserted.
+	value func(r *record) interface{}
+
+	// Expression the column is set to when a path is re-scanned, defaults to
+	// the newly inserted value. {hash} stands for the hash column.
+	update string
+}
+
+// Columns of the files table, ending with those of the -hash algorithms.
+// Columns missing from databases created by older versions are added when
+// the database is opened.
+var fileColumns = append([]column{
+	{name: "extless", decl: "TEXT", value: func(r *record) interface{} { return r.extless }},
+	{name: "ext", decl: "CHAR(3)", value: func(r *record) interface{} { return r.ext }},
+	{name: "path", decl: "TEXT", value: func(r *record) interface{} { return r.path }},
+	{name: "size", decl: "INTEGER", value: func(r *record) interface{} { return r.size }},
+	{name: "xattrs", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.xattrs) }},
+	{name: "mtime", decl: "INTEGER", value: func(r *record) interface{} { return r.mtime }},
+	{name: "is_sparse", decl: "INTEGER", value: func(r *record) interface{} { return r.sparse }},
+	// Rows from before first_seen existed get the time they are re-scanned
+	{name: "first_seen", decl: "INTEGER", value: func(r *record) interface{} { return r.seen },
+		update: "COALESCE(files.first_seen, excluded.first_seen)"},
+	{name: "last_seen", decl: "INTEGER", value: func(r *record) interface{} { return r.seen }},
+	{name: "blocks", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.blocks) }},
+	{name: "block_size", decl: "INTEGER", value: func(r *record) interface{} { return r.blockSize }},
+	{name: "fingerprint", decl: "CHAR(40)", value: func(r *record) interface{} { return nullString(r.fingerprint) }},
+	{name: "is_slow", decl: "INTEGER", value: func(r *record) interface{} { return r.slow }},
+	{name: "content_id", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.contentID) }},
+	{name: "is_encrypted", decl: "INTEGER", value: func(r *record) interface{} { return r.encrypted }},
+	{name: "btime", decl: "INTEGER", value: func(r *record) interface{} { return nullInt(r.btime) }},
+	{name: "fuzzy", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.fuzzy) }},
+	{name: "nlink", decl: "INTEGER", value: func(r *record) interface{} { return nullInt(r.nlink) }},
+	{name: "dev", decl: "INTEGER", value: func(r *record) interface{} { return nullInt(r.dev) }},
+	{name: "inode", decl: "INTEGER", value: func(r *record) interface{} { return nullInt(r.inode) }},
+	{name: "job", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.job) }},
+	{name: "mime", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.mime) }},
+	{name: "hash_ms", decl: "INTEGER", value: func(r *record) interface{} {
+		if !recordTiming {
+			return nil
+		}
+		return r.hashMS
+	}},
+	{name: "ctime", decl: "INTEGER", value: func(r *record) interface{} { return nullInt(r.ctime) }},
+	{name: "hash_prefix", decl: "CHAR(8)", value: func(r *record) interface{} { return nullString(hashPrefix(r.sha1)) },
+		update: keepWithHash("hash_prefix")},
+	{name: "mode", decl: "INTEGER", value: func(r *record) interface{} { return r.mode }},
+	{name: "uid", decl: "INTEGER", value: func(r *record) interface{} { return sql.NullInt64{Int64: r.uid, Valid: r.hasOwner} }},
+	{name: "gid", decl: "INTEGER", value: func(r *record) interface{} { return sql.NullInt64{Int64: r.gid, Valid: r.hasOwner} }},
+	{name: "run_id", decl: "INTEGER", value: func(r *record) interface{} { return nullInt(currentRun) }},
+	{name: "via_link", decl: "INTEGER", value: func(r *record) interface{} { return r.viaLink }},
+	{name: "link_of", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.linkOf) }},
+	{name: "archive", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.archive) }},
+	{name: "known", decl: "TEXT", value: func(r *record) interface{} { return nullString(r.known) }},
+	{name: "extents_sha1", decl: "CHAR(40)", value: func(r *record) interface{} { return nullString(r.extentsSha1) }},
+}, hashColumns()...)
+
+// Column holding the hash in each schema.
+func hashColumn() column {
+	if normalized {
+		return column{name: "hash_id", decl: "INTEGER REFERENCES hashes(id)", update: keepHash}
+	}
+	return column{name: "sha1", decl: "CHAR(40)", value: func(r *record) interface{} { return nullString(r.sha1) }, update: keepHash}
+}
+
+// Update of the hash column: a row written again without a hash, as by
+// -no-hash, keeps the hash it has while the file's size and mtime match.
+const keepHash = "COALESCE(excluded.{hash}, CASE WHEN excluded.size IS files.size AND excluded.mtime IS files.mtime THEN files.{hash} END)"
+
+// Update of a column derived from the contents, kept along with the hash.
+func keepWithHash(name string) string {
+	return fmt.Sprintf("COALESCE(excluded.%s, CASE WHEN files.{hash} IS %s THEN files.%s END)", name, keepHash, name)
+}
+
+// The hashes table of the -normalized schema. Contents are keyed on both
+// their hash and size so that a SHA1 collision between contents of
+// different sizes still gets two rows.
+const hashesTable = "hashes (id INTEGER PRIMARY KEY, sha1 CHAR(40) NOT NULL, size INTEGER, UNIQUE (sha1, size))"
+
+// Statements creating the tables. By default there is one row per file in
+// files. In the -normalized schema each distinct content is stored once in
+// hashes and files with that content reference it, so duplicates are simply
+// the hashes rows referenced more than once.
+func schema() []string {
+	decls := []string{}
+	for _, c := range append(fileColumns, hashColumn()) {
+		decls = append(decls, c.name+" "+c.decl)
+	}
+	files := fmt.Sprintf("CREATE TABLE IF NOT EXISTS files (%s)", strings.Join(decls, ", "))
+
+	// Facts about the database as a whole, such as the hash algorithm
+	metadata := "CREATE TABLE IF NOT EXISTS metadata (key TEXT PRIMARY KEY, value TEXT)"
+
+	// Aggregate hashes of directories, see -tree-hash
+	dirs := "CREATE TABLE IF NOT EXISTS dirs (path TEXT PRIMARY KEY, hash CHAR(40), files INTEGER, dirs INTEGER)"
+
+	// Files that could not be scanned, by run
+	errors := "CREATE TABLE IF NOT EXISTS errors (path TEXT, error_message TEXT, timestamp INTEGER, run_id INTEGER)"
+
+	if !normalized {
+		return []string{files, metadata, dirs, errors, historyTable, runsTable, schemaVersionTable, knownHashesTable}
+	}
+
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + hashesTable,
+		files,
+		"CREATE INDEX IF NOT EXISTS files_hash_id ON files (hash_id)",
+		metadata,
+		dirs,
+		errors,
+		historyTable,
+		runsTable,
+		schemaVersionTable,
+		knownHashesTable,
+	}
+}
+
+// The files table as seen by queries, with the hash in a sha1 column for
+// either schema.
+func filesView() string {
+	if normalized {
+		return "(SELECT files.*, hashes.sha1 AS sha1 FROM files JOIN hashes ON files.hash_id = hashes.id)"
+	}
+	return "files"
+}
+
+// Open the SQLite database at path and create the tables if they do not exist
+// yet. The busy timeout is set through the DSN and the pragmas by the driver
+// (see -page-size) so that they apply to every connection in the pool.
+func openDB(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s?_busy_timeout=%d", path, busyTimeout/time.Millisecond)
+
+	db, err := sql.Open(tunedDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if isMemoryDB(path) {
+		// Every connection to :memory: opens a database of its own
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxLifetime(0)
+	}
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	existing, err := tableColumns(db, "files")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	existed := len(existing) > 0
+	if err := checkMigrate(path, version, existed); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, stmt := range schema() {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%q: %s", err, stmt)
+		}
+	}
+
+	if !existed {
+		if existing, err = tableColumns(db, "files"); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// The files table may predate this run with the other schema
+	if isNormalized := existing["hash_id"]; isNormalized != normalized {
+		db.Close()
+		if isNormalized {
+			return nil, fmt.Errorf("%s uses the normalized schema, run with -normalized", path)
+		}
+		return nil, fmt.Errorf("%s uses the flat schema, run without -normalized", path)
+	}
+
+	if err := migrate(db, path, version, existed); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	warnPageSize(db, path)
+
+	return db, nil
+}
+
+// Check whether a database path is SQLite's in-memory database, which only
+// lives as long as its connection.
+func isMemoryDB(path string) bool {
+	return path == ":memory:"
+}
+
+// Make paths unique so that re-scanning a file updates its row in place.
+// Databases from before the index may hold several rows per path, only the
+// most recently inserted one is kept.
+func ensurePathIndex(db *sql.DB) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'files_path'").Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM files WHERE rowid NOT IN (SELECT MAX(rowid) FROM files GROUP BY path)")
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Removed %d duplicate rows for re-scanned paths\n", n)
+	}
+
+	_, err = db.Exec("CREATE UNIQUE INDEX files_path ON files (path)")
+	return err
+}
+
+// Rebuild a hashes table from before it was keyed on (sha1, size), when the
+// hash alone was unique. SQLite can't change the constraints of a table, so
+// the rows are copied, keeping their ids, into a new table that replaces the
+// old one.
+func migrateHashesKey(db *sql.DB) error {
+	var decl string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'hashes'").Scan(&decl); err != nil {
+		return err
+	}
+	if !strings.Contains(decl, "NOT NULL UNIQUE") {
+		return nil
+	}
+
+	log.Printf("Rebuilding the hashes table to key it on sha1 and size\n")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		"CREATE TABLE hashes_new " + strings.TrimPrefix(hashesTable, "hashes "),
+		"INSERT INTO hashes_new (id, sha1, size) SELECT id, sha1, size FROM hashes",
+		"DROP TABLE hashes",
+		"ALTER TABLE hashes_new RENAME TO hashes",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%q: %s", err, stmt)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Convert an empty string to NULL for optional columns.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Convert 0 to NULL for optional integer columns.
+func nullInt(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
+
+// Return the set of column names of a table.
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	return schemaColumns(db, "main", table)
+}
+
+// Return the set of column names of a table in an attached database.
+func schemaColumns(db *sql.DB, schema, table string) (map[string]bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA %s.table_info(%s)", schema, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, kind string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &kind, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
+
+// Check whether an error means another connection holds a conflicting lock.
+func isBusy(err error) bool {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// Insert a batch of records into files table in SQLite. If the database stays
+// busy past the busy timeout (e.g. a reader holds it open), the whole batch is
+// retried with an increasing delay. Returns any errors that occurred or nil if
+// there were none.
+func commitRecords(db *sql.DB, records []*record) error {
+	delay := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := insertRecords(db, records)
+		if err == nil || !isBusy(err) || attempt == commitAttempts {
+			return err
+		}
+
+		warnf("Database busy, retrying commit in %s\n", delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Insert the records in a single transaction, rolling it back on failure.
+func insertRecords(db *sql.DB, records []*record) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if appendHistory {
+		err = saveHistory(tx, records)
+	}
+	if err == nil && archives {
+		err = forgetMembers(tx, records)
+	}
+	if err == nil && normalized {
+		err = insertNormalized(tx, records)
+	} else if err == nil {
+		err = insertFlat(tx, records)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Build the statement inserting a row into files. The values are those of
+// fileColumns followed by the hash column, or for the normalized schema the
+// sha1 and size that hash_id is looked up by, which leave it NULL for a
+// record without a hash. A path that is already recorded has its row
+// updated instead.
+func insertStatement() string {
+	names := []string{}
+	params := []string{}
+	for _, c := range append(fileColumns, hashColumn()) {
+		names = append(names, c.name)
+		params = append(params, "?")
+	}
+
+	if normalized {
+		params[len(params)-1] = "(SELECT id FROM hashes WHERE sha1 = ? AND size = ?)"
+	}
+
+	return fmt.Sprintf("INSERT INTO files (%s) VALUES (%s) %s", strings.Join(names, ", "), strings.Join(params, ", "), upsertClause())
+}
+
+// Clause updating the existing row when a path is inserted again.
+func upsertClause() string {
+	updates := []string{}
+	for _, c := range append(fileColumns, hashColumn()) {
+		if c.name == "path" {
+			continue
+		}
+		update := strings.Replace(c.update, "{hash}", hashColumn().name, -1)
+		if update == "" {
+			update = "excluded." + c.name
+		}
+		updates = append(updates, c.name+" = "+update)
+	}
+
+	return "ON CONFLICT (path) DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+// Values for insertStatement.
+func insertValues(r *record) []interface{} {
+	values := []interface{}{}
+	for _, c := range fileColumns {
+		values = append(values, c.value(r))
+	}
+	if normalized {
+		return append(values, nullString(r.sha1), r.size)
+	}
+	return append(values, hashColumn().value(r))
+}
+
+// Insert records into the flat files table.
+func insertFlat(tx *sql.Tx, records []*record) error {
+	stmt, err := tx.Prepare(insertStatement())
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, record := range records {
+		if _, err := stmt.Exec(insertValues(record)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Insert records into the normalized schema, adding a hashes row only for
+// content that has not been seen before.
+func insertNormalized(tx *sql.Tx, records []*record) error {
+	hashStmt, err := tx.Prepare("INSERT OR IGNORE INTO hashes (sha1, size) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer hashStmt.Close()
+
+	fileStmt, err := tx.Prepare(insertStatement())
+	if err != nil {
+		return err
+	}
+	defer fileStmt.Close()
+
+	for _, record := range records {
+		if record.sha1 != "" {
+			if _, err := hashStmt.Exec(record.sha1, record.size); err != nil {
+				return err
+			}
+		}
+		if _, err := fileStmt.Exec(insertValues(record)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
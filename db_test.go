@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommitWhileBusy(t *testing.T) {
+	defer func(saved time.Duration) { busyTimeout = saved }(busyTimeout)
+	busyTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name string
+
+		// What the other connection does in its transaction
+		stmt string
+	}{
+		{"reading", "SELECT COUNT(*) FROM files"},
+		{"writing", "INSERT INTO files (path) VALUES ('/other')"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "files.db")
+		db, err := openDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := insertRecords(db, []*record{{path: "/a", sha1: emptySha1}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Another process, such as -serve, in the middle of a transaction
+		// held for longer than the busy timeout
+		other, err := openDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := other.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec(tt.stmt); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			tx.Rollback()
+		}()
+
+		if err := commitRecords(db, []*record{{path: "/b", sha1: emptySha1}}); err != nil {
+			t.Errorf("%s: commit failed: %s", tt.name, err)
+		}
+
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("%s: files has %d rows after the commit, want 2", tt.name, count)
+		}
+		other.Close()
+		db.Close()
+	}
+}
+
+func TestNormalizedSharesHashes(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+	normalized = true
+
+	const (
+		sum   = "3f786850e387550fdab836ed7e6dc881de23001b"
+		other = "89e6c98d92887913cadf06b2adb97f26cde4849b"
+	)
+	records := []*record{
+		{path: "/a", sha1: sum, size: 2},
+		{path: "/b", sha1: sum, size: 2},
+		{path: "/c", sha1: other, size: 2},
+	}
+	db := testDB(t, records...)
+
+	// Scanned again, the files keep their rows
+	if err := insertRecords(db, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var hashes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM hashes").Scan(&hashes); err != nil {
+		t.Fatal(err)
+	}
+	if hashes != 2 {
+		t.Errorf("hashes has %d rows, want 2", hashes)
+	}
+
+	var a, b int64
+	if err := db.QueryRow("SELECT (SELECT hash_id FROM files WHERE path = '/a'), (SELECT hash_id FROM files WHERE path = '/b')").Scan(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("/a and /b have hash_id %d and %d, want the same", a, b)
+	}
+
+	if got, want := dupePaths(t, db), map[string][]string{sum: {"/a", "/b"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("found duplicates %v, want %v", got, want)
+	}
+}
+
+func TestNormalizedKeysOnSize(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(ioutil.Discard)
+	normalized = true
+
+	// As a colliding hasher would report: one digest for contents of two
+	// sizes
+	const sum = "3f786850e387550fdab836ed7e6dc881de23001b"
+	records := []*record{
+		{path: "/a", sha1: sum, size: 2},
+		{path: "/b", sha1: sum, size: 3},
+		{path: "/c", sha1: sum, size: 2},
+	}
+
+	// In a new database, and in one from before hashes was keyed on size,
+	// which also predates the schema_version table
+	path := filepath.Join(t.TempDir(), "old.db")
+	old, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"DROP TABLE schema_version",
+		"DROP TABLE hashes",
+		"CREATE TABLE hashes (id INTEGER PRIMARY KEY, sha1 CHAR(40) NOT NULL UNIQUE, size INTEGER)",
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	migrated, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	if err := insertRecords(migrated, records); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, db := range map[string]*sql.DB{"new": testDB(t, records...), "migrated": migrated} {
+		rows, err := db.Query("SELECT sha1, size FROM hashes ORDER BY size")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for rows.Next() {
+			var sha1 string
+			var size int64
+			if err := rows.Scan(&sha1, &size); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%s %d", sha1, size))
+		}
+		rows.Close()
+		if want := []string{sum + " 2", sum + " 3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: hashes has rows %v, want %v", name, got, want)
+		}
+
+		var a, b, c int64
+		if err := db.QueryRow("SELECT (SELECT hash_id FROM files WHERE path = '/a'), (SELECT hash_id FROM files WHERE path = '/b'), (SELECT hash_id FROM files WHERE path = '/c')").Scan(&a, &b, &c); err != nil {
+			t.Fatal(err)
+		}
+		if a != c || a == b {
+			t.Errorf("%s: /a, /b and /c have hash_id %d, %d and %d, want /a and /c alone to share one", name, a, b, c)
+		}
+	}
+}
+
+func TestFirstSeen(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+
+	for _, normalized = range []bool{false, true} {
+		db := testDB(t, &record{path: "/a", sha1: emptySha1, seen: 100})
+		if err := insertRecords(db, []*record{{path: "/a", sha1: emptySha1, seen: 200}}); err != nil {
+			t.Fatal(err)
+		}
+
+		var first, last int64
+		if err := db.QueryRow("SELECT first_seen, last_seen FROM files WHERE path = '/a'").Scan(&first, &last); err != nil {
+			t.Fatal(err)
+		}
+		if first != 100 || last != 200 {
+			t.Errorf("normalized=%t: first_seen %d and last_seen %d after a re-scan, want 100 and 200", normalized, first, last)
+		}
+	}
+}
+
+func TestMemoryDB(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "files")
+	writeTree(t, root, map[string]string{"a.txt": "same", "b/c.txt": "same", "d.txt": "other"})
+
+	cwd, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The scan and the dupes query share the database of the run
+	out, err := runMain(t, "-quiet", "-db", ":memory:", "-dupes", root)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	want := hashBytes([]byte("same")) + " (4 B, 2 copies)\n" +
+		"  " + filepath.Join(root, "a.txt") + "\n" +
+		"  " + filepath.Join(root, "b", "c.txt") + "\n"
+	if !strings.Contains(out, want) || strings.Contains(out, filepath.Join(root, "d.txt")) {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+
+	// Nothing is left behind
+	after, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(cwd) {
+		t.Errorf("the working directory went from %d to %d entries", len(cwd), len(after))
+	}
+
+	// Nor does a later run see the files
+	if out, err := runMain(t, "-quiet", "-db", ":memory:", "-dupes"); err != nil || strings.Contains(out, root) {
+		t.Errorf("a later run printed %q, %v", out, err)
+	}
+}
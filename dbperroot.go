@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Scan each root into a database of its own, named from this template.
+var dbPerRoot string
+
+func init() {
+	flag.StringVar(&dbPerRoot, "db-per-root", "", "scan each DIR into its own database named by `TEMPLATE`, where {name} is the DIR's base name and {index} its position, e.g. {name}.db")
+}
+
+// Check that -db-per-root only has local roots to split and gives each its
+// own database.
+func checkDBPerRoot() error {
+	if dbPerRoot == "" {
+		return nil
+	}
+	if configPath != "" || len(sftpSources) > 0 || len(s3Sources) > 0 {
+		return errors.New("-db-per-root only splits DIRs, it cannot be combined with -config, -sftp or -s3")
+	}
+	if flag.NArg() == 0 {
+		return errors.New("-db-per-root needs at least one DIR")
+	}
+
+	seen := map[string]string{}
+	for i, root := range flag.Args() {
+		path, err := rootDBPath(root, i)
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[path]; ok {
+			return fmt.Errorf("-db-per-root gives %s and %s the same database %s, add {name} or {index} to the template", other, root, path)
+		}
+		seen[path] = root
+	}
+	return nil
+}
+
+// Name the database of the i-th root from the -db-per-root template.
+func rootDBPath(root string, i int) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	r := strings.NewReplacer("{name}", filepath.Base(abs), "{index}", strconv.Itoa(i+1))
+	return r.Replace(dbPerRoot), nil
+}
+
+// The command line options, without the DIRs and the ones -db-per-root sets
+// for each root itself.
+func perRootOptions() []string {
+	args := os.Args[1 : len(os.Args)-flag.NArg()]
+	if len(args) > 0 && args[len(args)-1] == "--" {
+		args = args[:len(args)-1]
+	}
+
+	options := []string{}
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "db" || name == "db-per-root" {
+			// The value is the next argument
+			i++
+			continue
+		}
+		if strings.HasPrefix(name, "db=") || strings.HasPrefix(name, "db-per-root=") {
+			continue
+		}
+		options = append(options, args[i])
+	}
+	return options
+}
+
+// Scan each root with a run of its own, one after the other, with the same
+// options but its own -db. Every root is scanned even if an earlier one
+// fails. Returns the exit status: that of the first run to fail, or
+// exitFileErrors if runs only had file errors, 0 if none did either.
+func scanPerRoot(roots []string) int {
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := perRootOptions()
+	status := 0
+	for i, root := range roots {
+		path, err := rootDBPath(root, i)
+		if err != nil {
+			log.Fatal(err)
+		}
+		infof("Scanning %s into %s\n", root, path)
+
+		args := append(append([]string{}, options...), "-db", path, "--", root)
+		cmd := exec.Command(self, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == exitFileErrors {
+			warnf("Scan of %s could not read every file\n", root)
+			if status == 0 {
+				status = exitFileErrors
+			}
+		} else if ok {
+			errorf("Scan of %s failed with status %d\n", root, exitErr.ExitCode())
+			if status == 0 || status == exitFileErrors {
+				status = exitErr.ExitCode()
+			}
+		} else if err != nil {
+			errorf("Error scanning %s: %s\n", root, err)
+			if status == 0 || status == exitFileErrors {
+				status = 1
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDBPerRoot(t *testing.T) {
+	dir := t.TempDir()
+	photos, music := filepath.Join(dir, "photos"), filepath.Join(dir, "music")
+	writeTree(t, photos, map[string]string{"a.jpg": "a", "b/c.jpg": "c"})
+	writeTree(t, music, map[string]string{"d.mp3": "d"})
+
+	template := filepath.Join(dir, "{index}-{name}.db")
+	if out, err := runMain(t, "-quiet", "-db-per-root", template, photos, music); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	// Each database has the rows of its own root only
+	tests := []struct {
+		db, root string
+		want     []string
+	}{
+		{filepath.Join(dir, "1-photos.db"), photos, []string{"a.jpg", "b/c.jpg"}},
+		{filepath.Join(dir, "2-music.db"), music, []string{"d.mp3"}},
+	}
+	for _, tt := range tests {
+		if got := storedPaths(t, tt.db, tt.root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s has %v, want %v", tt.db, got, tt.want)
+		}
+	}
+
+	// Two roots of the same name need {index} to be told apart
+	other := filepath.Join(dir, "other", "photos")
+	writeTree(t, other, map[string]string{"e.jpg": "e"})
+	if out, err := runMain(t, "-quiet", "-db-per-root", filepath.Join(dir, "{name}.db"), photos, other); err == nil {
+		t.Errorf("scanned two roots into one database\n%s", out)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// Command decrypting files on stdin to stdout.
+	decryptCmd string
+
+	// Extensions of the files to decrypt before hashing.
+	decryptExts stringList
+)
+
+func init() {
+	flag.StringVar(&decryptCmd, "decrypt", "", "pipe files matching -decrypt-ext through `CMD` and hash its output, e.g. \"age -d -i key.txt\"")
+	flag.Var(&decryptExts, "decrypt-ext", "with -decrypt, decrypt files with this extension, e.g. .age (repeatable)")
+}
+
+// Function returning the plaintext of an encrypted file given its path and
+// contents. -decrypt sets it to run a command, builds with another scheme can
+// set it from an init function as for contentID.
+var decryptor func(path string, r io.Reader) (io.Reader, error)
+
+// Check the -decrypt options, setting up the decryptor for the command.
+func checkDecrypt() error {
+	if decryptCmd != "" {
+		args := strings.Fields(decryptCmd)
+		decryptor = func(path string, r io.Reader) (io.Reader, error) {
+			return runDecrypt(args, r)
+		}
+	}
+
+	if decryptor == nil {
+		return nil
+	}
+
+	if len(decryptExts) == 0 {
+		return errors.New("-decrypt needs at least one -decrypt-ext")
+	}
+
+	// The decryptor needs the whole file
+	if fingerprintBytes > 0 {
+		return errors.New("-decrypt cannot be used with -fingerprint")
+	}
+	if sparseMode == "extents" {
+		return errors.New("-decrypt cannot be used with -sparse extents")
+	}
+	return nil
+}
+
+// Run a decryption command with the ciphertext on stdin and return its
+// output. The command is run directly, not through a shell.
+func runDecrypt(args []string, r io.Reader) (io.Reader, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = r
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout, nil
+}
+
+// Check whether a file is to be decrypted before hashing.
+func isEncrypted(path string) bool {
+	return decryptor != nil && hasExt(filepath.Base(path), decryptExts)
+}
+
+// The decryptor as the Decrypt of a Hasher, which leaves the files that
+// aren't encrypted as they are. nil if there is no decryptor.
+func decryptFunc() func(path string, r io.Reader) (io.Reader, error) {
+	if decryptor == nil {
+		return nil
+	}
+
+	return func(path string, r io.Reader) (io.Reader, error) {
+		if !isEncrypted(path) {
+			return r, nil
+		}
+		return decryptor(path, r)
+	}
+}
+
+// Return the plaintext of an encrypted file's contents.
+func decrypt(path string, data []byte) ([]byte, error) {
+	r, err := decryptor(path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
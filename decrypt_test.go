@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// XOR every byte with a key, which is its own inverse.
+func xorBytes(data []byte, key byte) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ key
+	}
+	return out
+}
+
+// A decryptor for contents XORed with 0x5a, as a stand-in for real
+// decryption.
+func xorDecryptor(path string, r io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(xorBytes(data, 0x5a)), nil
+}
+
+func TestDecrypt(t *testing.T) {
+	defer func(saved func(string, io.Reader) (io.Reader, error)) { decryptor = saved }(decryptor)
+	defer func(saved stringList) { decryptExts = saved }(decryptExts)
+	defer func(saved bool) { quiet = saved }(quiet)
+	decryptor, decryptExts, quiet = xorDecryptor, stringList{".x"}, true
+
+	plaintext := []byte("secret contents")
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"secret.txt.x": string(xorBytes(plaintext, 0x5a)),
+		"plain.txt":    string(plaintext),
+	})
+
+	records := scanRecords(t, root)
+	db := testDB(t, records["secret.txt.x"], records["plain.txt"])
+
+	want := hashBytes(plaintext)
+	for _, tt := range []struct {
+		name      string
+		encrypted bool
+	}{
+		{"secret.txt.x", true},
+		{"plain.txt", false},
+	} {
+		path := filepath.Join(root, tt.name)
+
+		var sum string
+		var encrypted bool
+		if err := db.QueryRow("SELECT sha1, is_encrypted FROM files WHERE path = ?", path).Scan(&sum, &encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if sum != want || encrypted != tt.encrypted {
+			t.Errorf("%s: stored %s, is_encrypted=%t, want %s, %t", tt.name, sum, encrypted, want, tt.encrypted)
+		}
+
+		// -verify and remote scans hash the plaintext too
+		if got, err := calcSha1(path); err != nil || got != want {
+			t.Errorf("%s: calcSha1 = %s, %v, want %s", tt.name, got, err, want)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := streamHash(path, bytes.NewReader(data)); err != nil || got.SHA1 != want {
+			t.Errorf("%s: streamHash = %+v, %v, want %s", tt.name, got, err, want)
+		}
+	}
+}
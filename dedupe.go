@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// What -dedupe does with the copies of each group that aren't kept:
+	// delete, hardlink or reflink. Empty if not deduplicating.
+	dedupeAction string
+
+	// Act on the duplicates instead of printing what -dedupe would do.
+	dedupeApply bool
+)
+
+func init() {
+	flag.StringVar(&dedupeAction, "dedupe", "", "act on the -dupes groups, keeping the copy chosen by -keep-rule (oldest by default): `ACTION` delete removes the others, hardlink or reflink replaces them with links to it. Only prints what it would do without -dedupe-apply")
+	flag.BoolVar(&dedupeApply, "dedupe-apply", false, "with -dedupe, change the files instead of printing what would be done")
+}
+
+// Check the -dedupe action.
+func checkDedupe() error {
+	switch dedupeAction {
+	case "", "delete", "hardlink", "reflink":
+		return nil
+	}
+	return fmt.Errorf("invalid -dedupe %q, want delete, hardlink or reflink", dedupeAction)
+}
+
+// What deduplicating did, or would do.
+type dedupeTotals struct {
+	copies, skipped int
+	bytes           int64
+}
+
+// Apply -dedupe to every duplicate group, printing each copy acted on with
+// the copy kept. Before a copy is touched both files are checked against
+// the database and read again, so that files changed since the scan are
+// skipped rather than lost. Archive members, symlinks, remote files and
+// copies that are already links to the kept file are left alone.
+func dedupe(w io.Writer, db *sql.DB) (dedupeTotals, error) {
+	done := dedupeTotals{}
+	if hashed, err := namesHashed(db); err != nil || hashed {
+		if hashed {
+			err = errors.New("cannot dedupe a database of hashed paths (see -hash-names)")
+		}
+		return done, err
+	}
+
+	if keepRule == "" {
+		keepRule = "oldest"
+	}
+	groups, err := findDupes(db)
+	if err != nil {
+		return done, err
+	}
+
+	linkedStmt, err := db.Prepare("SELECT archive IS NOT NULL OR COALESCE(via_link, 0) FROM files WHERE path = ?")
+	if err != nil {
+		return done, err
+	}
+	defer linkedStmt.Close()
+
+	for _, group := range groups {
+		if err := group.dropUntouchable(linkedStmt); err != nil {
+			return done, err
+		}
+		if len(group.paths) < 2 {
+			continue
+		}
+		group.chooseKeeper()
+
+		keeper := group.paths[group.keep]
+		for i, path := range group.paths {
+			if i == group.keep {
+				continue
+			}
+			if reason := checkCopy(keeper, path, group.size); reason != "" {
+				warnf("Not deduping %s: %s\n", path, reason)
+				done.skipped++
+				continue
+			}
+
+			if dedupeApply {
+				if err := dedupeCopy(db, keeper, path); err != nil {
+					errorf("Error deduping %s: %s\n", path, err)
+					done.skipped++
+					continue
+				}
+				fmt.Fprintf(w, "%s %s, keeping %s\n", dedupeVerb(), path, keeper)
+			} else {
+				fmt.Fprintf(w, "would %s %s, keeping %s\n", dedupeAction, path, keeper)
+			}
+			done.copies++
+			done.bytes += group.size
+		}
+	}
+	return done, nil
+}
+
+// Leave out of a group the paths dedupe can't act on, along with their
+// mtimes: the members of archives, files found through a symlink (see
+// -follow-symlinks) and remote files.
+func (g *dupeGroup) dropUntouchable(linkedStmt *sql.Stmt) error {
+	paths, mtimes := []string{}, []int64{}
+	for i, path := range g.paths {
+		if isRemote(path) {
+			continue
+		}
+		var linked bool
+		if err := linkedStmt.QueryRow(path).Scan(&linked); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if linked {
+			continue
+		}
+		paths = append(paths, path)
+		mtimes = append(mtimes, g.mtimes[i])
+	}
+	g.paths, g.mtimes = paths, mtimes
+	return nil
+}
+
+// Check that a copy is still a duplicate of the kept file, returning why
+// not if it isn't.
+func checkCopy(keeper, path string, size int64) string {
+	keeperInfo, err := os.Lstat(localPath(keeper))
+	if err != nil {
+		return fmt.Sprintf("cannot stat %s: %s", keeper, err)
+	}
+	info, err := os.Lstat(localPath(path))
+	if err != nil {
+		return err.Error()
+	}
+
+	switch {
+	case !keeperInfo.Mode().IsRegular() || !info.Mode().IsRegular():
+		return "not a regular file"
+	case os.SameFile(keeperInfo, info):
+		return "already a link to " + keeper
+	case keeperInfo.Size() != size || info.Size() != size:
+		return "changed since it was scanned"
+	}
+
+	keeperSum, err := hashFile(localPath(keeper))
+	if err != nil {
+		return fmt.Sprintf("cannot read %s: %s", keeper, err)
+	}
+	sum, err := hashFile(localPath(path))
+	if err != nil {
+		return err.Error()
+	}
+	if sum != keeperSum {
+		return "contents differ from " + keeper
+	}
+	return ""
+}
+
+// Past tense of the -dedupe action for the report.
+func dedupeVerb() string {
+	switch dedupeAction {
+	case "delete":
+		return "deleted"
+	case "hardlink":
+		return "hardlinked"
+	}
+	return "reflinked"
+}
+
+// Delete a copy or replace it with a link to the kept file, and update its
+// row. Links are made under a temporary name next to the copy then renamed
+// over it, so the copy is never lost if linking fails.
+func dedupeCopy(db *sql.DB, keeper, path string) error {
+	local := localPath(path)
+
+	if dedupeAction == "delete" {
+		if err := os.Remove(local); err != nil {
+			return err
+		}
+		return forgetPath(db, path)
+	}
+
+	tmp := filepath.Join(filepath.Dir(local), ".sha1files-dedupe-"+filepath.Base(local))
+	os.Remove(tmp)
+
+	var err error
+	if dedupeAction == "hardlink" {
+		err = os.Link(localPath(keeper), tmp)
+	} else {
+		err = reflink(localPath(keeper), local, tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, local); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if dedupeAction == "hardlink" {
+		// The copy has the kept file's inode now, and so its mtime
+		_, err = db.Exec("UPDATE files SET link_of = ?1, mtime = (SELECT mtime FROM files WHERE path = ?1) WHERE path = ?2", keeper, path)
+	}
+	return err
+}
+
+// Log the totals of -dedupe.
+func reportDeduped(done dedupeTotals) {
+	if dedupeApply {
+		log.Printf("Reclaimed %s from %d copies, skipped %d\n", formatBytes(done.bytes), done.copies, done.skipped)
+	} else {
+		log.Printf("Would reclaim %s from %d copies, skipped %d (see -dedupe-apply)\n", formatBytes(done.bytes), done.copies, done.skipped)
+	}
+}
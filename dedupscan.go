@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// Only hash files whose size is shared with another file.
+var dedupScan bool
+
+func init() {
+	flag.BoolVar(&dedupScan, "dedup-scan", false, "stat every file first and only hash the ones whose size is shared by another file, since a file of unique size has no duplicates")
+}
+
+// Check that -dedup-scan can be used with the other options.
+func checkDedupScan() error {
+	if dedupScan && normalized {
+		return errors.New("-dedup-scan cannot be used with -normalized, which keys rows on the full hash")
+	}
+	return nil
+}
+
+// Split the jobs gathered by the walk into those to hash, whose size is the
+// same as at least one other job's, and those of a unique size.
+func splitBySize(jobs []*job) (shared, unique []*job) {
+	counts := map[int64]int{}
+	for _, j := range jobs {
+		counts[j.contentSize()]++
+	}
+
+	for _, j := range jobs {
+		if counts[j.contentSize()] > 1 {
+			shared = append(shared, j)
+		} else {
+			unique = append(unique, j)
+		}
+	}
+
+	infof("Hashing %d of %d files, the rest have a unique size\n", len(shared), len(jobs))
+	return shared, unique
+}
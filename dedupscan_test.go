@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestDedupScan(t *testing.T) {
+	defer func(saved bool) { dedupScan = saved }(dedupScan)
+	defer func(saved bool) { quiet = saved }(quiet)
+	dedupScan, quiet = true, true
+
+	files := map[string]string{
+		"a.txt":      "same",
+		"b/copy.txt": "same",
+		"c.txt":      "size",
+		"unique.txt": "one of a kind",
+	}
+	root := t.TempDir()
+	writeTree(t, root, files)
+	records := scanRecords(t, root)
+
+	for name, contents := range files {
+		r, ok := records[name]
+		if !ok {
+			t.Errorf("%s wasn't recorded", name)
+			continue
+		}
+
+		// Only the stat of a file of unique size is recorded
+		want := hashBytes([]byte(contents))
+		if name == "unique.txt" {
+			want = ""
+		}
+		if r.sha1 != want || r.size != int64(len(contents)) {
+			t.Errorf("%s: recorded %q and size %d, want %q and %d", name, r.sha1, r.size, want, len(contents))
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// Devices are not compared on this platform, so -one-filesystem has no
+// effect.
+func sameDevice(a, b os.FileInfo) bool {
+	return true
+}
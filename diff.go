@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// Compare the two databases given as arguments instead of scanning.
+var diffDBs bool
+
+func init() {
+	flag.BoolVar(&diffDBs, "diff-dbs", false, "print the files added, removed, modified or moved between the databases OLD and NEW instead of scanning: -diff-dbs OLD NEW")
+}
+
+// What a database knows about a file for the diff.
+type diffEntry struct {
+	path string
+
+	// Full hash, empty for files recorded with -fingerprint only
+	sha1 string
+
+	size, mtime int64
+}
+
+// Check whether two entries of the same path are of the same content. Files
+// without a full hash in either database are compared by size and mtime.
+func (e *diffEntry) same(other *diffEntry) bool {
+	if e.sha1 != "" && other.sha1 != "" {
+		return e.sha1 == other.sha1
+	}
+	return e.size == other.size && e.mtime == other.mtime
+}
+
+// A difference between the databases, one line of the diff.
+type change struct {
+	// A, D, M or R, as in git diff --name-status
+	kind string
+
+	path string
+
+	// Path in the new database of a moved file
+	to string
+}
+
+// Read the files of a database of either schema, without changing it.
+func readDiffEntries(path string) (map[string]*diffEntry, string, error) {
+	// Opening a missing file would create it
+	if _, err := os.Stat(path); err != nil {
+		return nil, "", err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	columns, err := tableColumns(db, "files")
+	if err != nil {
+		return nil, "", err
+	}
+	if len(columns) == 0 {
+		return nil, "", fmt.Errorf("%s: no files table", path)
+	}
+
+	algorithm, err := diffAlgorithm(db)
+	if err != nil {
+		return nil, "", err
+	}
+
+	from := "files"
+	if columns["hash_id"] {
+		from = "files LEFT JOIN hashes ON files.hash_id = hashes.id"
+	}
+	rows, err := db.Query("SELECT path, COALESCE(sha1, ''), COALESCE(files.size, 0), COALESCE(mtime, 0) FROM " + from)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	entries := map[string]*diffEntry{}
+	for rows.Next() {
+		e := &diffEntry{}
+		if err := rows.Scan(&e.path, &e.sha1, &e.size, &e.mtime); err != nil {
+			return nil, "", err
+		}
+		entries[e.path] = e
+	}
+	return entries, algorithm, rows.Err()
+}
+
+// Algorithm a database was built with. Databases from before the metadata
+// table were always built with sha1.
+func diffAlgorithm(db *sql.DB) (string, error) {
+	columns, err := tableColumns(db, "metadata")
+	if err != nil || len(columns) == 0 {
+		return "sha1", err
+	}
+
+	algorithm, ok, err := getMeta(db, "algorithm")
+	if !ok {
+		return "sha1", err
+	}
+	return algorithm, nil
+}
+
+// Compare the files of two databases, e.g. snapshots of the same directories
+// before and after a sync. Files only in the old database are removed, only
+// in the new one added, and those whose content changed are modified. A
+// removed file with the same hash as an added one was moved; when several
+// paths share the hash they are paired in path order. The changes are
+// sorted by path.
+func diffEntries(before, after map[string]*diffEntry) []*change {
+	changes := []*change{}
+	added, removed := []*diffEntry{}, []*diffEntry{}
+
+	for path, e := range after {
+		o, ok := before[path]
+		switch {
+		case !ok:
+			added = append(added, e)
+		case !o.same(e):
+			changes = append(changes, &change{kind: "M", path: path})
+		}
+	}
+	for path, o := range before {
+		if _, ok := after[path]; !ok {
+			removed = append(removed, o)
+		}
+	}
+
+	byPath := func(entries []*diffEntry) {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	}
+	byPath(added)
+	byPath(removed)
+
+	// Added files by hash, to be taken in path order by the removed ones
+	unmatched := map[string][]*diffEntry{}
+	for _, e := range added {
+		if e.sha1 != "" {
+			unmatched[e.sha1] = append(unmatched[e.sha1], e)
+		}
+	}
+
+	moved := map[string]bool{}
+	for _, o := range removed {
+		if to := unmatched[o.sha1]; o.sha1 != "" && len(to) > 0 {
+			changes = append(changes, &change{kind: "R", path: o.path, to: to[0].path})
+			moved[to[0].path] = true
+			unmatched[o.sha1] = to[1:]
+			continue
+		}
+		changes = append(changes, &change{kind: "D", path: o.path})
+	}
+	for _, e := range added {
+		if !moved[e.path] {
+			changes = append(changes, &change{kind: "A", path: e.path})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].path < changes[j].path })
+	return changes
+}
+
+// Print the changes between the databases at oldPath and newPath, one per
+// line: the kind and the path, or both paths of moved files. A summary of the
+// counts is logged. Returns whether the databases differ.
+func diffDatabases(w io.Writer, oldPath, newPath string) (bool, error) {
+	before, oldAlgorithm, err := readDiffEntries(oldPath)
+	if err != nil {
+		return false, err
+	}
+	after, newAlgorithm, err := readDiffEntries(newPath)
+	if err != nil {
+		return false, err
+	}
+	if oldAlgorithm != newAlgorithm && !overrideAlgorithm {
+		return false, fmt.Errorf("%s was built with %s but %s with %s (use -override to compare anyway)", oldPath, oldAlgorithm, newPath, newAlgorithm)
+	}
+
+	changes := diffEntries(before, after)
+
+	counts := map[string]int{}
+	for _, c := range changes {
+		counts[c.kind]++
+		if c.kind == "R" {
+			fmt.Fprintf(w, "%s  %s -> %s\n", c.kind, c.path, c.to)
+		} else {
+			fmt.Fprintf(w, "%s  %s\n", c.kind, c.path)
+		}
+	}
+
+	log.Printf("%d added, %d removed, %d modified, %d moved\n", counts["A"], counts["D"], counts["M"], counts["R"])
+	return len(changes) > 0, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+)
+
+// Print a single hash of everything recorded under the roots.
+var treeDigest bool
+
+func init() {
+	flag.BoolVar(&treeDigest, "tree-digest", false, "print a single hash of the recorded paths and hashes under the DIRs (every row without DIRs) and store it in the metadata table")
+}
+
+// Compute the digest of the rows under the roots, or of every row with no
+// roots: the SHA1 of their "HASH  PATH" lines in path order, i.e. of the
+// sha1sum manifest of the tree. Sorting makes it independent of the order the
+// files were walked in, so two scans give the same digest exactly when no
+// path or hash changed. The digest is also stored as tree_digest in the
+// metadata table.
+func computeTreeDigest(db *sql.DB, roots []string) (string, error) {
+	stored := []string{}
+	for _, root := range roots {
+		stored = append(stored, storedPath(root))
+	}
+
+	rows, err := db.Query("SELECT path, COALESCE(sha1, fingerprint, '') FROM " + filesView() + " ORDER BY path")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	h := sha1.New()
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			return "", err
+		}
+
+		if len(stored) > 0 && rootOf(path, stored) == "" {
+			continue
+		}
+		fmt.Fprintf(h, "%s  %s\n", hash, path)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	return digest, setMeta(db, "tree_digest", digest)
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestTreeDigest(t *testing.T) {
+	tree := []*record{
+		{path: "/data/a.txt", sha1: hashBytes([]byte("a"))},
+		{path: "/data/b/c.txt", sha1: hashBytes([]byte("c"))},
+		{path: "/data/d.txt", sha1: hashBytes([]byte("d"))},
+	}
+	digest := func(records ...*record) string {
+		db := testDB(t, records...)
+		got, err := computeTreeDigest(db, []string{"/data"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored, _, err := getMeta(db, "tree_digest"); err != nil || stored != got {
+			t.Errorf("stored tree_digest %q, %v, want %q", stored, err, got)
+		}
+		return got
+	}
+	want := digest(tree...)
+
+	tests := []struct {
+		name    string
+		records []*record
+		same    bool
+	}{
+		{"walked in another order", []*record{tree[2], tree[0], tree[1]}, true},
+		// Only the rows under the roots count
+		{"outside the roots", append([]*record{{path: "/other/e.txt", sha1: emptySha1}}, tree...), true},
+		{"changed file", []*record{tree[0], tree[1], {path: "/data/d.txt", sha1: hashBytes([]byte("new d"))}}, false},
+		{"renamed file", []*record{tree[0], tree[1], {path: "/data/e.txt", sha1: tree[2].sha1}}, false},
+		{"added file", append([]*record{{path: "/data/e.txt", sha1: emptySha1}}, tree...), false},
+		{"removed file", tree[:2], false},
+	}
+
+	for _, tt := range tests {
+		if got := digest(tt.records...); (got == want) != tt.same {
+			t.Errorf("%s: digest %s, the tree's is %s", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// Exit status of a scan stopped because the database's disk filled up.
+const exitDiskFull = 3
+
+// Returned from the walk function to stop walking once the disk is full.
+var errDiskFull = errors.New("database disk is full")
+
+// Set once a commit fails for lack of space. The walk checks it to stop.
+var diskFull int32
+
+// Check whether an error means there is no space left for the database.
+func isDiskFull(err error) bool {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.Code == sqlite3.ErrFull || sqliteErr.SystemErrno == syscall.ENOSPC
+	}
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// Stop the scan: nothing more is queued and the records already on their way
+// are kept uncommitted.
+func setDiskFull() {
+	atomic.StoreInt32(&diskFull, 1)
+}
+
+func diskIsFull() bool {
+	return atomic.LoadInt32(&diskFull) == 1
+}
+
+// Find where a resumed scan should start so that no file of the uncommitted
+// records is missed: the one walked first, by order of the roots and then of
+// the walk. Returns false if no record was walked.
+func firstUncommitted(records []*record, roots []string) (checkpoint, bool) {
+	index := map[string]int{}
+	for i := len(roots) - 1; i >= 0; i-- {
+		index[roots[i]] = i
+	}
+
+	var first checkpoint
+	found := false
+	for _, r := range records {
+		w := r.walked
+		if w.path == "" {
+			continue
+		}
+		if !found || index[w.root] < index[first.root] || (w.root == first.root && scannedBefore(w.root, w.path, first.path)) {
+			first = w
+			found = true
+		}
+	}
+
+	first.next = true
+	return first, found
+}
+
+// End a scan whose database disk filled up. The failed transaction was
+// rolled back, so the database holds every batch committed before it. A
+// checkpoint at the first file that wasn't committed lets -resume carry on
+// from there once there is space. With -atomic the copy being built is
+// removed instead, leaving the original database as it was.
+func stopForDiskFull(db *sql.DB, path string, pending []*record, roots []string) {
+	errorf("The disk holding %s is full, %d records were not committed\n", path, len(pending))
+
+	if atomicSwap {
+		db.Close()
+		os.Remove(path)
+		warnf("%s is unchanged, free some space or use -db on another disk and run the scan again\n", dbPath)
+		exit(exitDiskFull)
+	}
+
+	first, ok := firstUncommitted(pending, roots)
+	if !ok {
+		warnf("Every file queued was committed, free some space or use -db on another disk and run the scan again\n")
+		exit(exitDiskFull)
+	}
+
+	if err := storeCheckpoint(db, first); err != nil {
+		errorf("Error saving the checkpoint, the scan will have to start over: %s\n", err)
+		exit(exitDiskFull)
+	}
+
+	warnf("Saved a checkpoint at %s, free some space or move %s to another disk (see -db) and run the same scan with -resume\n", first, path)
+	exit(exitDiskFull)
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDiskFull(t *testing.T) {
+	// The database goes on a small tmpfs of its own
+	dbDir := t.TempDir()
+	if err := syscall.Mount("tmpfs", dbDir, "tmpfs", 0, "size=4m"); err != nil {
+		t.Skipf("can't mount a tmpfs: %s", err)
+	}
+	defer syscall.Unmount(dbDir, 0)
+	dbFile := filepath.Join(dbDir, "files.db")
+
+	root := filepath.Join(t.TempDir(), "files")
+	files := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("dir%02d/%s-%04d.txt", i/100, strings.Repeat("long-name", 10), i)
+		files[name] = fmt.Sprint(i)
+	}
+	writeTree(t, root, files)
+
+	if out, err := runMain(t, "-quiet", "-db", dbFile, filepath.Join(root, "dir00")); err != nil {
+		t.Fatalf("first scan: %s\n%s", err, out)
+	}
+
+	// Fill the disk up to the last few pages
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dbDir, &fs); err != nil {
+		t.Fatal(err)
+	}
+	ballast := filepath.Join(dbDir, "ballast")
+	free := int64(fs.Bavail)*int64(fs.Bsize) - 64<<10
+	if err := ioutil.WriteFile(ballast, make([]byte, free), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runMain(t, "-quiet", "-batch", "50", "-db", dbFile, root)
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != exitDiskFull {
+		t.Fatalf("scan of a full disk exited with %v, want status %d\n%s", err, exitDiskFull, out)
+	}
+	if !strings.Contains(out, "run the same scan with -resume") {
+		t.Errorf("printed %q", out)
+	}
+
+	stored := countRows(t, dbFile)
+	if stored == len(files) {
+		t.Fatalf("stored all %d files on a full disk", stored)
+	}
+	db, err := openDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _, err := getMeta(db, "checkpoint_path")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		t.Fatalf("no checkpoint was saved after storing %d files", stored)
+	}
+
+	// With space again, the scan carries on from the checkpoint
+	if err := os.Remove(ballast); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runMain(t, "-quiet", "-resume", "-db", dbFile, root); err != nil {
+		t.Fatalf("resumed scan: %s\n%s", err, out)
+	}
+	if n := countRows(t, dbFile); n != len(files) {
+		t.Errorf("stored %d files after -resume, want %d", n, len(files))
+	}
+}
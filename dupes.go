@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SHA1 of empty content, shared by every empty file.
+const emptySha1 = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+var (
+	// Print groups of files with identical content.
+	dupesMode bool
+
+	// Treat empty files as duplicates of each other in reports.
+	includeEmpty bool
+
+	// Leave zero-byte files out of the scan.
+	skipEmpty bool
+
+	// Output format of -dupes: text, json or csv.
+	dupesFormat string
+
+	// Order of the -dupes groups: hash or wasted.
+	dupesSort string
+
+	// How -dupes picks the copy to keep in each group, empty to not pick one.
+	keepRule string
+
+	// Directory whose copies are kept by the prefer-prefix rule.
+	keepPrefix string
+)
+
+func init() {
+	flag.BoolVar(&dupesMode, "dupes", false, "print groups of files with identical content (after the scan if DIRs are given)")
+	flag.BoolVar(&includeEmpty, "include-empty", false, "report empty files as duplicates of each other")
+	flag.BoolVar(&skipEmpty, "skip-empty", false, "do not record zero-byte files")
+	flag.StringVar(&dupesFormat, "dupes-format", "text", "output format of -dupes: text, json or csv")
+	flag.StringVar(&dupesSort, "dupes-sort", "hash", "order of the -dupes groups: hash, or wasted for the most bytes wasted by extra copies first")
+	flag.StringVar(&keepRule, "keep-rule", "", "mark one copy per -dupes group to keep and the rest as removable: shortest-path, oldest, newest or prefer-prefix")
+	flag.StringVar(&keepPrefix, "keep-prefix", "", "with -keep-rule prefer-prefix, keep the copy under `DIR`")
+}
+
+// Files sharing the same content.
+type dupeGroup struct {
+	sha1   string
+	size   int64
+	paths  []string
+	mtimes []int64
+
+	// Number of separate files among the paths: hard links to the same
+	// inode count once
+	copies int
+
+	// Index of the path to keep, chosen by -keep-rule
+	keep int
+}
+
+// Check that -keep-rule names a known rule.
+func checkKeepRule() error {
+	switch keepRule {
+	case "", "shortest-path", "oldest", "newest":
+		return nil
+	case "prefer-prefix":
+		if keepPrefix == "" {
+			return fmt.Errorf("-keep-rule prefer-prefix needs -keep-prefix")
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid -keep-rule %q, want shortest-path, oldest, newest or prefer-prefix", keepRule)
+}
+
+// Index of the path with the shortest name, the first in sorted order on a
+// tie.
+func shortestPath(paths []string) int {
+	best := 0
+	for i, path := range paths {
+		if len(path) < len(paths[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// Choose the copy of the group to keep according to -keep-rule. Ties go to
+// the first path in sorted order. The prefer-prefix rule falls back to the
+// shortest path for groups with no copy under -keep-prefix.
+func (g *dupeGroup) chooseKeeper() {
+	g.keep = 0
+
+	switch keepRule {
+	case "shortest-path":
+		g.keep = shortestPath(g.paths)
+	case "oldest":
+		for i, mtime := range g.mtimes {
+			if mtime < g.mtimes[g.keep] {
+				g.keep = i
+			}
+		}
+	case "newest":
+		for i, mtime := range g.mtimes {
+			if mtime > g.mtimes[g.keep] {
+				g.keep = i
+			}
+		}
+	case "prefer-prefix":
+		g.keep = shortestPath(g.paths)
+		prefix := keepPrefix
+		if abs, err := filepath.Abs(prefix); err == nil {
+			prefix = storedPath(abs)
+		}
+		prefix = strings.TrimSuffix(prefix, string(filepath.Separator)) + string(filepath.Separator)
+		for i, path := range g.paths {
+			if strings.HasPrefix(path, prefix) {
+				g.keep = i
+				break
+			}
+		}
+	}
+}
+
+// Find every hash recorded for more than one path, with the paths sorted.
+// Empty files are left out unless -include-empty is given, and known files
+// with -hide-known. Paths that are hard links to a file already in the
+// group, found by the scan (see -rehash-links) or sharing its device and
+// inode, are listed but are not counted as copies, and groups left with a
+// single copy are dropped.
+func findDupes(db *sql.DB) ([]*dupeGroup, error) {
+	view := filesView()
+	query := "SELECT sha1, COALESCE(size, 0), path, COALESCE(mtime, 0), link_of IS NOT NULL, COALESCE(dev, 0), inode FROM " + view +
+		" WHERE sha1 IN (SELECT sha1 FROM " + view + " GROUP BY sha1 HAVING COUNT(*) > 1)"
+	args := []interface{}{}
+	if !includeEmpty {
+		query += " AND sha1 != ?"
+		args = append(args, emptySha1)
+	}
+	query += knownCondition()
+	query += " ORDER BY sha1, path"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*dupeGroup{}
+	var inodes map[[2]int64]bool
+	for rows.Next() {
+		var hash, path string
+		var size, mtime, dev int64
+		var linked bool
+		var inode sql.NullInt64
+		if err := rows.Scan(&hash, &size, &path, &mtime, &linked, &dev, &inode); err != nil {
+			return nil, err
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].sha1 != hash {
+			groups = append(groups, &dupeGroup{sha1: hash, size: size})
+			inodes = map[[2]int64]bool{}
+		}
+		group := groups[len(groups)-1]
+		group.paths = append(group.paths, path)
+		group.mtimes = append(group.mtimes, mtime)
+
+		if linked {
+			continue
+		}
+		if inode.Valid {
+			id := [2]int64{dev, inode.Int64}
+			if inodes[id] {
+				continue
+			}
+			inodes[id] = true
+		}
+		group.copies++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	copies := groups[:0]
+	for _, group := range groups {
+		if group.copies > 1 {
+			copies = append(copies, group)
+		}
+	}
+	groups = copies
+
+	if keepRule != "" {
+		for _, group := range groups {
+			group.chooseKeeper()
+		}
+	}
+
+	return groups, nil
+}
+
+// Bytes that would be freed by keeping a single copy of the group.
+func (g *dupeGroup) reclaimable() int64 {
+	if g.copies < 2 {
+		return 0
+	}
+	return g.size * int64(g.copies-1)
+}
+
+// Order the duplicate groups by -dupes-sort.
+func sortDupes(groups []*dupeGroup) error {
+	switch dupesSort {
+	case "hash":
+	case "wasted":
+		// Stable so that groups wasting the same space stay in hash order
+		sort.SliceStable(groups, func(i, j int) bool {
+			return groups[i].reclaimable() > groups[j].reclaimable()
+		})
+	default:
+		return fmt.Errorf("invalid -dupes-sort %q, want hash or wasted", dupesSort)
+	}
+	return nil
+}
+
+// Print the duplicate groups in the -dupes-format.
+func printDupes(w io.Writer, db *sql.DB) error {
+	groups, err := findDupes(db)
+	if err != nil {
+		return err
+	}
+	if err := sortDupes(groups); err != nil {
+		return err
+	}
+
+	switch dupesFormat {
+	case "text":
+		printDupesText(w, groups)
+		return nil
+	case "json":
+		return printDupesJSON(w, groups)
+	case "csv":
+		return printDupesCSV(w, groups)
+	}
+	return fmt.Errorf("invalid -dupes-format %q, want text, json or csv", dupesFormat)
+}
+
+// Print each group of duplicates as its hash and size followed by the
+// indented paths. With -keep-rule each path is marked KEEP or REMOVE. With
+// -print0 only the paths are printed, see printDupesPaths.
+func printDupesText(w io.Writer, groups []*dupeGroup) {
+	if print0 {
+		printDupesPaths(w, groups)
+		return
+	}
+
+	end := lineEnd()
+	for i, group := range groups {
+		if i > 0 {
+			fmt.Fprint(w, end)
+		}
+
+		fmt.Fprintf(w, "%s (%s, %d copies)%s", group.sha1, formatBytes(group.size), group.copies, end)
+		for i, path := range group.paths {
+			switch {
+			case keepRule == "":
+				fmt.Fprintf(w, "  %s%s", path, end)
+			case i == group.keep:
+				fmt.Fprintf(w, "  KEEP   %s%s", path, end)
+			default:
+				fmt.Fprintf(w, "  REMOVE %s%s", path, end)
+			}
+		}
+	}
+}
+
+// Print the paths of the duplicates as they are, each ending in NUL, for
+// xargs -0. With -keep-rule only the copies to remove are printed.
+func printDupesPaths(w io.Writer, groups []*dupeGroup) {
+	for _, group := range groups {
+		for i, path := range group.paths {
+			if keepRule == "" || i != group.keep {
+				fmt.Fprintf(w, "%s\x00", path)
+			}
+		}
+	}
+}
+
+// The JSON form of the -dupes report.
+type dupesReport struct {
+	Groups           []dupeGroupJSON `json:"groups"`
+	TotalGroups      int             `json:"total_groups"`
+	ReclaimableBytes int64           `json:"reclaimable_bytes"`
+}
+
+type dupeGroupJSON struct {
+	SHA1  string   `json:"sha1"`
+	Size  int64    `json:"size"`
+	Paths []string `json:"paths"`
+
+	// Set with -keep-rule
+	Keep   string   `json:"keep,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// Print the duplicate groups as a single JSON object, with the number of
+// groups and the bytes that removing all but one copy of each would free.
+func printDupesJSON(w io.Writer, groups []*dupeGroup) error {
+	report := &dupesReport{Groups: []dupeGroupJSON{}, TotalGroups: len(groups)}
+	for _, group := range groups {
+		g := dupeGroupJSON{SHA1: group.sha1, Size: group.size, Paths: group.paths}
+		if keepRule != "" {
+			g.Keep = group.paths[group.keep]
+			g.Remove = []string{}
+			for i, path := range group.paths {
+				if i != group.keep {
+					g.Remove = append(g.Remove, path)
+				}
+			}
+		}
+		report.Groups = append(report.Groups, g)
+		report.ReclaimableBytes += group.reclaimable()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// Print the duplicates as CSV with a header and one row per path, giving the
+// group's hash and size and, with -keep-rule, whether to keep the path.
+func printDupesCSV(w io.Writer, groups []*dupeGroup) error {
+	out := csv.NewWriter(w)
+
+	header := []string{"sha1", "size", "copies", "path"}
+	if keepRule != "" {
+		header = append(header, "action")
+	}
+	out.Write(header)
+
+	for _, group := range groups {
+		for i, path := range group.paths {
+			row := []string{group.sha1, strconv.FormatInt(group.size, 10), strconv.Itoa(group.copies), path}
+			switch {
+			case keepRule == "":
+			case i == group.keep:
+				row = append(row, "keep")
+			default:
+				row = append(row, "remove")
+			}
+			out.Write(row)
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Open a new database in a temporary directory and record rows in it.
+func testDB(t *testing.T, records ...*record) *sql.DB {
+	db, err := openDB(filepath.Join(t.TempDir(), "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := insertRecords(db, records); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func mustFindDupes(t *testing.T, db *sql.DB) []*dupeGroup {
+	groups, err := findDupes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return groups
+}
+
+// The hash and paths of each group of duplicates.
+func dupePaths(t *testing.T, db *sql.DB) map[string][]string {
+	found := map[string][]string{}
+	for _, group := range mustFindDupes(t, db) {
+		found[group.sha1] = group.paths
+	}
+	return found
+}
+
+func TestFindDupesEmpty(t *testing.T) {
+	defer func(saved bool) { includeEmpty = saved }(includeEmpty)
+
+	const sum = "3f786850e387550fdab836ed7e6dc881de23001b"
+	db := testDB(t,
+		&record{path: "/a", sha1: sum, size: 2},
+		&record{path: "/b", sha1: sum, size: 2},
+		&record{path: "/empty1", sha1: emptySha1},
+		&record{path: "/empty2", sha1: emptySha1},
+		&record{path: "/unique", sha1: "89e6c98d92887913cadf06b2adb97f26cde4849b", size: 2},
+	)
+
+	tests := []struct {
+		includeEmpty bool
+		want         map[string][]string
+	}{
+		{false, map[string][]string{sum: {"/a", "/b"}}},
+		{true, map[string][]string{sum: {"/a", "/b"}, emptySha1: {"/empty1", "/empty2"}}},
+	}
+
+	for _, tt := range tests {
+		includeEmpty = tt.includeEmpty
+		if got := dupePaths(t, db); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-include-empty=%t: found %v, want %v", tt.includeEmpty, got, tt.want)
+		}
+	}
+}
+
+func TestPrintDupesJSON(t *testing.T) {
+	const sum = "3f786850e387550fdab836ed7e6dc881de23001b"
+	db := testDB(t,
+		&record{path: "/photos/a.jpg", sha1: sum, size: 1000},
+		&record{path: "/backup/a.jpg", sha1: sum, size: 1000},
+		&record{path: "/photos/b.jpg", sha1: "89e6c98d92887913cadf06b2adb97f26cde4849b", size: 500},
+	)
+
+	out := &bytes.Buffer{}
+	if err := printDupesJSON(out, mustFindDupes(t, db)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got dupesReport
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	want := dupesReport{
+		Groups:           []dupeGroupJSON{{SHA1: sum, Size: 1000, Paths: []string{"/backup/a.jpg", "/photos/a.jpg"}}},
+		TotalGroups:      1,
+		ReclaimableBytes: 1000,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("-dupes-format json printed %+v, want %+v", got, want)
+	}
+}
+
+func TestFindDupesHardLinks(t *testing.T) {
+	const (
+		linked = "3f786850e387550fdab836ed7e6dc881de23001b"
+		copied = "89e6c98d92887913cadf06b2adb97f26cde4849b"
+		single = "e9d71f5ee7c92d6dc9e92ffdad17b8bd49418f98"
+	)
+	db := testDB(t,
+		// Three paths to one inode and a copy of it elsewhere
+		&record{path: "/a1", sha1: linked, size: 100, dev: 1, inode: 10},
+		&record{path: "/a2", sha1: linked, size: 100, dev: 1, inode: 10},
+		&record{path: "/a3", sha1: linked, size: 100, dev: 1, inode: 10},
+		&record{path: "/a4", sha1: linked, size: 100, dev: 1, inode: 11},
+		// The same inode number on another device is another file, and a
+		// link found by the scan is not a copy
+		&record{path: "/b1", sha1: copied, size: 10, dev: 1, inode: 20},
+		&record{path: "/b2", sha1: copied, size: 10, dev: 2, inode: 20},
+		&record{path: "/b3", sha1: copied, size: 10, dev: 1, inode: 21, linkOf: "/b1"},
+		&record{path: "/b4", sha1: copied, size: 10},
+		// Only links to one file
+		&record{path: "/c1", sha1: single, size: 1000, dev: 1, inode: 30},
+		&record{path: "/c2", sha1: single, size: 1000, dev: 1, inode: 30},
+	)
+
+	want := map[string]struct {
+		copies      int
+		reclaimable int64
+	}{
+		linked: {2, 100},
+		copied: {3, 20},
+	}
+
+	groups := mustFindDupes(t, db)
+	if len(groups) != len(want) {
+		t.Errorf("found %d groups, want %d", len(groups), len(want))
+	}
+	for _, group := range groups {
+		w, ok := want[group.sha1]
+		if !ok {
+			t.Errorf("unexpected group %s of %v", group.sha1, group.paths)
+			continue
+		}
+		if group.copies != w.copies || group.reclaimable() != w.reclaimable {
+			t.Errorf("group %s has %d copies reclaiming %d bytes, want %d and %d",
+				group.sha1, group.copies, group.reclaimable(), w.copies, w.reclaimable)
+		}
+	}
+}
+
+func TestPrintDupesPrint0(t *testing.T) {
+	defer func(saved bool) { print0 = saved }(print0)
+	defer func(saved string) { keepRule = saved }(keepRule)
+	defer func(saved string) { dupesFormat = saved }(dupesFormat)
+	print0, dupesFormat = true, "text"
+
+	const sum = "3f786850e387550fdab836ed7e6dc881de23001b"
+	db := testDB(t,
+		&record{path: "/photos/new\nline.jpg", sha1: sum, size: 1000, mtime: 2},
+		&record{path: "/backup/a.jpg", sha1: sum, size: 1000, mtime: 1},
+		&record{path: "/photos/b.jpg", sha1: "89e6c98d92887913cadf06b2adb97f26cde4849b", size: 500},
+	)
+
+	tests := []struct {
+		keepRule string
+		want     []string
+	}{
+		{"", []string{"/backup/a.jpg", "/photos/new\nline.jpg"}},
+		{"oldest", []string{"/photos/new\nline.jpg"}},
+	}
+
+	for _, tt := range tests {
+		keepRule = tt.keepRule
+
+		out := &bytes.Buffer{}
+		if err := printDupes(out, db); err != nil {
+			t.Fatal(err)
+		}
+
+		// As xargs -0 reads it
+		got := strings.Split(out.String(), "\x00")
+		if got[len(got)-1] != "" {
+			t.Errorf("-keep-rule %q: output %q doesn't end in NUL", tt.keepRule, out)
+		}
+		if got = got[:len(got)-1]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-keep-rule %q: printed %q, want %q", tt.keepRule, got, tt.want)
+		}
+	}
+}
+
+func TestKeepRule(t *testing.T) {
+	defer func(saved string) { keepRule = saved }(keepRule)
+	defer func(saved string) { keepPrefix = saved }(keepPrefix)
+
+	const sum = "3f786850e387550fdab836ed7e6dc881de23001b"
+	db := testDB(t,
+		&record{path: "/photos/2019/long name.jpg", sha1: sum, size: 1000, mtime: 200},
+		&record{path: "/backup/old.jpg", sha1: sum, size: 1000, mtime: 100},
+		&record{path: "/photos/a.jpg", sha1: sum, size: 1000, mtime: 300},
+		&record{path: "/tmp/b.jpg", sha1: sum, size: 1000, mtime: 300},
+	)
+
+	tests := []struct {
+		rule, prefix string
+		want         string
+	}{
+		{"shortest-path", "", "/tmp/b.jpg"},
+		{"oldest", "", "/backup/old.jpg"},
+		// The first in sorted order on a tie
+		{"newest", "", "/photos/a.jpg"},
+		{"prefer-prefix", "/photos/2019/", "/photos/2019/long name.jpg"},
+		// The shortest path if no copy is under the prefix
+		{"prefer-prefix", "/music", "/tmp/b.jpg"},
+	}
+
+	for _, tt := range tests {
+		keepRule, keepPrefix = tt.rule, tt.prefix
+
+		groups := mustFindDupes(t, db)
+		if len(groups) != 1 {
+			t.Fatalf("found %d groups, want 1", len(groups))
+		}
+		if got := groups[0].paths[groups[0].keep]; got != tt.want {
+			t.Errorf("-keep-rule %s %s kept %s, want %s", tt.rule, tt.prefix, got, tt.want)
+		}
+	}
+}
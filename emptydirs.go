@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	// List the directories without files found by the walk.
+	listEmptyDirs bool
+
+	// Count only the files directly in a directory, not in subdirectories.
+	emptyDirsDirect bool
+
+	// The directories walked so far, for -empty-dirs.
+	walkedDirs = map[string]*walkedDir{}
+)
+
+func init() {
+	flag.BoolVar(&listEmptyDirs, "empty-dirs", false, "after the scan, print the directories walked that contain no files, including in their subdirectories")
+	flag.BoolVar(&emptyDirsDirect, "empty-dirs-direct", false, "with -empty-dirs, also list directories with no files directly in them but some in subdirectories")
+}
+
+// A directory seen by the walk: the number of entries in it that aren't
+// directories walked themselves and its walked subdirectories.
+type walkedDir struct {
+	files   int
+	subdirs []string
+}
+
+// Wrap a walk function to keep track of the files in every directory for
+// -empty-dirs. Every entry walked counts, including hidden and filtered
+// files, so that only directories that really are empty are listed.
+// Directories whose contents aren't walked, e.g. pruned or unreadable ones,
+// count as files since they may not be empty.
+func trackEmptyDirs(fn filepath.WalkFunc) filepath.WalkFunc {
+	if !listEmptyDirs {
+		return fn
+	}
+
+	return func(path string, info os.FileInfo, err error) error {
+		walkErr := err
+		err = fn(path, info, err)
+		if info == nil {
+			return err
+		}
+
+		dir, seen := walkedDirs[path]
+		switch {
+		case seen && walkErr != nil:
+			// The directory couldn't be read after all
+			dir.files++
+		case info.IsDir() && walkErr == nil && err == nil && !seen:
+			walkedDirs[path] = &walkedDir{}
+			if parent, ok := walkedDirs[filepath.Dir(path)]; ok && filepath.Dir(path) != path {
+				parent.subdirs = append(parent.subdirs, path)
+			}
+		default:
+			if parent, ok := walkedDirs[filepath.Dir(path)]; ok {
+				parent.files++
+			}
+		}
+		return err
+	}
+}
+
+// Count the files in a directory and all its subdirectories.
+func filesBelow(path string) int {
+	dir := walkedDirs[path]
+	n := dir.files
+	for _, sub := range dir.subdirs {
+		n += filesBelow(sub)
+	}
+	return n
+}
+
+// Print the walked directories without files, sorted by path. By default a
+// directory is empty if there are no files anywhere below it, with
+// -empty-dirs-direct if there are none directly in it.
+func printEmptyDirs(w io.Writer) {
+	paths := []string{}
+	for path, dir := range walkedDirs {
+		if (emptyDirsDirect && dir.files == 0) || filesBelow(path) == 0 {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		fmt.Fprintln(w, path)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEmptyDirs(t *testing.T) {
+	defer func(saved bool) { listEmptyDirs = saved }(listEmptyDirs)
+	defer func(saved bool) { emptyDirsDirect = saved }(emptyDirsDirect)
+	defer func(saved map[string]*walkedDir) { walkedDirs = saved }(walkedDirs)
+	defer func(saved bool) { quiet = saved }(quiet)
+	listEmptyDirs, quiet = true, true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.txt":          "a",
+		"full/sub/b.txt": "b",
+		"mixed/c.txt":    "c",
+		// Not scanned, but a file all the same
+		"hidden/.keep": "",
+	})
+	for _, dir := range []string{"empty", "nested/deep/deeper", "mixed/empty"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		direct bool
+		want   []string
+	}{
+		{false, []string{"empty", "mixed/empty", "nested", "nested/deep", "nested/deep/deeper"}},
+		// full has no files of its own, only in sub
+		{true, []string{"empty", "full", "mixed/empty", "nested", "nested/deep", "nested/deep/deeper"}},
+	}
+
+	for _, tt := range tests {
+		emptyDirsDirect, walkedDirs = tt.direct, map[string]*walkedDir{}
+		scanPaths(t, root)
+
+		var out bytes.Buffer
+		printEmptyDirs(&out)
+		got := []string{}
+		for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+			rel, err := filepath.Rel(root, line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-empty-dirs-direct=%t listed %v, want %v", tt.direct, got, tt.want)
+		}
+	}
+}
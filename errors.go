@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Number of files or directories that could not be scanned in this run.
+	fileErrors int64
+
+	// Errors matching this are expected noise, not logged or counted as
+	// errors.
+	ignoreErrorsMatching string
+	ignoreErrors         *regexp.Regexp
+
+	// Number of errors that matched -ignore-errors-matching.
+	ignoredErrors int64
+
+	// The errors of this run, to be stored in the errors table.
+	scanErrors   []scanError
+	scanErrorsMu sync.Mutex
+
+	// Number of files deliberately left out of this run, by reason.
+	skipped   = map[string]int64{}
+	skippedMu sync.Mutex
+)
+
+func init() {
+	flag.StringVar(&ignoreErrorsMatching, "ignore-errors-matching", "", "don't log or count as errors the file errors matching `REGEX`, count them as ignored instead")
+}
+
+// Compile the -ignore-errors-matching expression.
+func checkIgnoreErrors() error {
+	if ignoreErrorsMatching == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(ignoreErrorsMatching)
+	if err != nil {
+		return fmt.Errorf("invalid -ignore-errors-matching: %s", err)
+	}
+	ignoreErrors = re
+	return nil
+}
+
+// An error about a single file, as stored in the errors table.
+type scanError struct {
+	path    string
+	message string
+	time    int64
+}
+
+// Log an error about the file or directory at path and count it for the run
+// summary and the errors table. Such errors do not stop the scan. Errors
+// matching -ignore-errors-matching are only counted as ignored.
+func fileError(path, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if ignoreErrors != nil && ignoreErrors.MatchString(msg) {
+		atomic.AddInt64(&ignoredErrors, 1)
+		return
+	}
+
+	atomic.AddInt64(&fileErrors, 1)
+	logEvent(levelError, logFields{"event": "error", "path": path}, "%s", msg)
+
+	scanErrorsMu.Lock()
+	scanErrors = append(scanErrors, scanError{path: path, message: strings.TrimSpace(msg), time: time.Now().Unix()})
+	scanErrorsMu.Unlock()
+}
+
+// Store the errors of the run in the errors table, so failed files can be
+// looked up after the logs are gone. They are filed under the run's number in
+// the runs table, see startRun. With -hash-names the errors are not stored
+// since their messages name the files.
+func storeErrors(db *sql.DB) (int64, error) {
+	runID := currentRun
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if !hashNames {
+		scanErrorsMu.Lock()
+		defer scanErrorsMu.Unlock()
+
+		for _, e := range scanErrors {
+			if _, err := tx.Exec("INSERT INTO errors (path, error_message, timestamp, run_id) VALUES (?, ?, ?, ?)", e.path, e.message, e.time, runID); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+
+	return runID, tx.Commit()
+}
+
+// Exit status of a scan that finished but could not read every file. Runs
+// that fail outright exit with 1.
+const exitFileErrors = 2
+
+// Log how many paths could not be scanned, by the kind of error: the part of
+// the message before the first ": ", such as "Error reading file". The
+// errors are in the errors table under runID, unless it is 0.
+func reportErrors(runID int64) {
+	scanErrorsMu.Lock()
+	defer scanErrorsMu.Unlock()
+
+	kinds := []string{}
+	counts := map[string]int{}
+	for _, e := range scanErrors {
+		kind := e.message
+		if i := strings.Index(kind, ": "); i >= 0 {
+			kind = kind[:i]
+		}
+		if counts[kind] == 0 {
+			kinds = append(kinds, kind)
+		}
+		counts[kind]++
+	}
+
+	if runID > 0 && !hashNames {
+		warnf("%d paths could not be scanned, see run %d in the errors table:\n", fileErrors, runID)
+	} else {
+		warnf("%d paths could not be scanned:\n", fileErrors)
+	}
+	for _, kind := range kinds {
+		warnf("  %6d  %s\n", counts[kind], kind)
+	}
+}
+
+// Log that a file is left out of the scan for a reason such as "sparse" or
+// "locked", counting it separately from errors.
+func fileSkipped(reason, path string) {
+	skippedMu.Lock()
+	skipped[reason]++
+	skippedMu.Unlock()
+
+	logEvent(levelInfo, logFields{"event": "skipped", "reason": reason, "path": path}, "Skipping %s file: %s\n", reason, path)
+}
+
+// Copy of the skipped counts.
+func skippedCounts() map[string]int64 {
+	skippedMu.Lock()
+	defer skippedMu.Unlock()
+
+	counts := map[string]int64{}
+	for reason, n := range skipped {
+		counts[reason] = n
+	}
+	return counts
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestIgnoreErrorsMatching(t *testing.T) {
+	defer func(saved string) { ignoreErrorsMatching = saved }(ignoreErrorsMatching)
+	defer func(saved *regexp.Regexp) { ignoreErrors = saved }(ignoreErrors)
+	defer func(errors, ignored int64) { fileErrors, ignoredErrors = errors, ignored }(fileErrors, ignoredErrors)
+	defer func(saved []scanError) { scanErrors = saved }(scanErrors)
+	defer log.SetOutput(os.Stderr)
+
+	ignoreErrorsMatching = `^Error reading file: /mnt/fuse/`
+	if err := checkIgnoreErrors(); err != nil {
+		t.Fatal(err)
+	}
+	fileErrors, ignoredErrors, scanErrors = 0, 0, nil
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+
+	fileError("/mnt/fuse/a", "Error reading file: %s: %s\n", "/mnt/fuse/a", "input/output error")
+	fileError("/data/b", "Error reading file: %s: %s\n", "/data/b", "input/output error")
+	fileError("/data/mnt/fuse/c", "Error reading file: %s: %s\n", "/data/mnt/fuse/c", "permission denied")
+
+	if fileErrors != 2 || ignoredErrors != 1 {
+		t.Errorf("counted %d errors and %d ignored, want 2 and 1", fileErrors, ignoredErrors)
+	}
+	if len(scanErrors) != 2 || scanErrors[0].path != "/data/b" || scanErrors[1].path != "/data/mnt/fuse/c" {
+		t.Errorf("kept errors %+v, want those of /data/b and /data/mnt/fuse/c", scanErrors)
+	}
+	if strings.Contains(logged.String(), "/mnt/fuse/a") || !strings.Contains(logged.String(), "/data/b") {
+		t.Errorf("logged %q", logged.String())
+	}
+
+	ignoreErrorsMatching = "("
+	if err := checkIgnoreErrors(); err == nil {
+		t.Error("accepted an invalid -ignore-errors-matching")
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	defer func(saved func(string, io.Reader) (io.Reader, error)) { decryptor = saved }(decryptor)
+	defer func(saved stringList) { decryptExts = saved }(decryptExts)
+	defer func(saved int64) { fileErrors = saved }(fileErrors)
+	defer func(saved []scanError) { scanErrors = saved }(scanErrors)
+	defer func(saved int64) { currentRun = saved }(currentRun)
+	defer func(saved bool) { quiet = saved }(quiet)
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(ioutil.Discard)
+
+	// Reading the plaintext of the file fails as a bad disk would
+	decryptor = func(path string, r io.Reader) (io.Reader, error) {
+		return iotest.ErrReader(errors.New("input/output error")), nil
+	}
+	decryptExts, quiet, scanErrors = stringList{".x"}, true, nil
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"bad.x": "unreadable", "good.txt": "readable"})
+	records := scanRecords(t, root)
+	if _, ok := records["bad.x"]; ok || records["good.txt"] == nil {
+		t.Fatalf("recorded %v", records)
+	}
+
+	db := testDB(t)
+	if err := startRun(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	runID, err := storeErrors(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runID == 0 || runID != currentRun {
+		t.Errorf("stored errors under run %d, want %d", runID, currentRun)
+	}
+
+	rows, err := db.Query("SELECT path, error_message, run_id FROM errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var path, message string
+		var run int64
+		if err := rows.Scan(&path, &message, &run); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if path != filepath.Join(root, "bad.x") || !strings.Contains(message, "input/output error") || run != runID {
+			t.Errorf("stored error %q for %s under run %d", message, path, run)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("stored %d errors, want 1", n)
+	}
+}
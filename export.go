@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Number of rows exported between checkpoints of the cursor.
+const exportCheckpoint = 10000
+
+var (
+	// Dump the database to this file instead of scanning.
+	exportPath string
+
+	// Format of the export: json, sha1sum or hashdeep.
+	exportFormat string
+)
+
+func init() {
+	flag.StringVar(&exportPath, "export", "", "write every row of the db to `FILE` in path order (see -export-format), resuming an interrupted export")
+	flag.StringVar(&exportFormat, "export-format", "json", "`FORMAT` of -export: json lines, sha1sum or hashdeep")
+}
+
+// Algorithms hashdeep knows that may be stored, in the order of its columns.
+var hashdeepHashes = []string{"md5", "sha1", "sha256"}
+
+// Check the -export-format value.
+func checkExportFormat() error {
+	switch exportFormat {
+	case "json", "sha1sum", "hashdeep":
+		return nil
+	}
+	return fmt.Errorf("invalid -export-format %q, want json, sha1sum or hashdeep", exportFormat)
+}
+
+// The digests of a hashdeep export: SHA1 and those of -hash that hashdeep
+// knows.
+func hashdeepColumns() []string {
+	columns := []string{}
+	for _, name := range hashdeepHashes {
+		for _, requested := range append([]string{"sha1"}, requestedHashes...) {
+			if name == requested {
+				columns = append(columns, name)
+				break
+			}
+		}
+	}
+	return columns
+}
+
+// The header hashdeep -k and -a expect at the start of a known hashes file.
+func hashdeepHeader() string {
+	wd, _ := os.Getwd()
+	return fmt.Sprintf("%%%%%%%% HASHDEEP-1.0\n%%%%%%%% size,%s,filename\n## Invoked from: %s\n## $ sha1files -export\n##\n",
+		strings.Join(hashdeepColumns(), ","), wd)
+}
+
+// Format a row as a line of the export, without its terminator. Rows lacking
+// a digest the format needs (see -fingerprint and -hash) are left out.
+func exportLine(r *record) (string, bool, error) {
+	if r.sha1 == "" && exportFormat != "json" {
+		return "", false, nil
+	}
+
+	switch exportFormat {
+	case "sha1sum":
+		return sha1sumLine(r.sha1, r.path), true, nil
+	case "hashdeep":
+		fields := []string{strconv.FormatInt(r.size, 10)}
+		for _, name := range hashdeepColumns() {
+			sum := r.sha1
+			if name != "sha1" {
+				sum = r.hashes[name]
+			}
+			if sum == "" {
+				return "", false, nil
+			}
+			fields = append(fields, sum)
+		}
+		return strings.Join(append(fields, r.path), ","), true, nil
+	}
+
+	b, err := json.Marshal(newJSONRecord(r))
+	return string(b), true, err
+}
+
+// Location of the cursor of an export, present only while it is unfinished.
+func cursorPath(path string) string {
+	return path + ".cursor"
+}
+
+// Read the cursor of an interrupted export: the size of the output at the
+// last checkpoint and the last path written before it.
+func readCursor(path string) (int64, string, error) {
+	b, err := ioutil.ReadFile(cursorPath(path))
+	if err != nil {
+		return 0, "", err
+	}
+
+	fields := strings.SplitN(string(b), "\t", 2)
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("malformed export cursor %s", cursorPath(path))
+	}
+
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	return offset, fields[1], err
+}
+
+// Record a checkpoint, replacing the previous one atomically.
+func writeCursor(path string, offset int64, last string) error {
+	tmp := cursorPath(path) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d\t%s", offset, last)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cursorPath(path))
+}
+
+// Write every row to path in path order: as JSON lines in the -also-json
+// format, or as the lines of a sha1sum manifest or hashdeep file. Every
+// exportCheckpoint rows the output is synced and a cursor recording its size
+// and the last path is saved next to it. If a cursor is found the export
+// resumes: the output is cut back to the checkpoint, which drops any rows
+// written after it, and continues with the following path, so no row is
+// missed or repeated. The cursor is removed once the export completes.
+// Returns the number of rows written by this run.
+func exportRows(db *sql.DB, path string) (int64, error) {
+	offset, last, err := readCursor(path)
+	resume := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	// Compressed output can't be cut back to a checkpoint
+	if strings.HasSuffix(path, ".gz") {
+		return 0, errors.New("-export cannot write compressed files, compress the finished export instead")
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if resume {
+		infof("Resuming export after %s\n", last)
+		if err := f.Truncate(offset); err != nil {
+			return 0, err
+		}
+		if _, err := f.Seek(offset, 0); err != nil {
+			return 0, err
+		}
+	}
+
+	// The digests of the -hash algorithms follow the other columns
+	columns, extra := hashColumns(), ""
+	for _, c := range columns {
+		extra += fmt.Sprintf(", COALESCE(%s, '')", c.name)
+	}
+
+	rows, err := db.Query("SELECT path, COALESCE(sha1, ''), COALESCE(size, 0), COALESCE(mtime, 0), "+
+		"COALESCE(extless, ''), COALESCE(ext, ''), COALESCE(xattrs, ''), COALESCE(is_sparse, 0), COALESCE(fingerprint, '')"+extra+
+		" FROM "+filesView()+" WHERE path > ? ORDER BY path", last)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriter(f)
+
+	// Write out the buffered rows, make sure they are on disk and move the
+	// cursor past them.
+	checkpoint := func() error {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		offset, err := f.Seek(0, 1)
+		if err != nil {
+			return err
+		}
+		return writeCursor(path, offset, last)
+	}
+
+	if !resume && exportFormat == "hashdeep" {
+		if _, err := w.WriteString(hashdeepHeader()); err != nil {
+			return 0, err
+		}
+	}
+
+	var n, skipped int64
+	for rows.Next() {
+		r := &record{}
+		sums := make([]string, len(columns))
+		dest := []interface{}{&r.path, &r.sha1, &r.size, &r.mtime, &r.extless, &r.ext, &r.xattrs, &r.sparse, &r.fingerprint}
+		for i := range sums {
+			dest = append(dest, &sums[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		for i, c := range columns {
+			if sums[i] != "" {
+				if r.hashes == nil {
+					r.hashes = map[string]string{}
+				}
+				r.hashes[c.name] = sums[i]
+			}
+		}
+
+		line, ok, err := exportLine(r)
+		if err != nil {
+			return n, err
+		}
+		last = r.path
+		if !ok {
+			skipped++
+			continue
+		}
+		if _, err := w.WriteString(line + lineEnd()); err != nil {
+			return n, err
+		}
+
+		n++
+		if n%exportCheckpoint == 0 {
+			if err := checkpoint(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+
+	if skipped > 0 {
+		warnf("Left out %d rows without the hashes -export-format %s needs\n", skipped, exportFormat)
+	}
+
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	err = os.Remove(cursorPath(path))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return n, err
+}
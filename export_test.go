@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportResume(t *testing.T) {
+	defer func(saved string) { exportFormat = saved }(exportFormat)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	records := []*record{}
+	for i := 0; i < 6; i++ {
+		records = append(records, &record{path: fmt.Sprintf("/data/%d.txt", i), sha1: hashBytes([]byte{byte(i)}), size: int64(i)})
+	}
+	db := testDB(t, records...)
+
+	for _, exportFormat = range []string{"json", "sha1sum"} {
+		dir := t.TempDir()
+		full := filepath.Join(dir, "full")
+		if n, err := exportRows(db, full); err != nil || n != 6 {
+			t.Fatalf("exported %d rows, %v", n, err)
+		}
+		want, err := ioutil.ReadFile(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.SplitAfter(string(want), "\n")
+
+		// Interrupted with cut rows checkpointed and the next row half
+		// written
+		for _, cut := range []int{0, 1, 4} {
+			path := filepath.Join(dir, fmt.Sprintf("cut%d", cut))
+			done := strings.Join(lines[:cut], "")
+			if err := ioutil.WriteFile(path, []byte(done+lines[cut][:10]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			last := ""
+			if cut > 0 {
+				last = records[cut-1].path
+			}
+			if err := writeCursor(path, int64(len(done)), last); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := exportRows(db, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(6-cut) || string(got) != string(want) {
+				t.Errorf("%s after %d rows: wrote %d rows\n%s\nwant\n%s", exportFormat, cut, n, got, want)
+			}
+			if _, err := os.Stat(cursorPath(path)); !os.IsNotExist(err) {
+				t.Errorf("%s after %d rows: cursor left behind: %v", exportFormat, cut, err)
+			}
+		}
+	}
+}
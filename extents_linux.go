@@ -0,0 +1,46 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+// Read only the data extents of a sparse file, skipping holes with
+// SEEK_DATA/SEEK_HOLE. The extents are returned concatenated in file order.
+func readExtents(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fd := int(f.Fd())
+	data := []byte{}
+
+	offset := int64(0)
+	for {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// No data after offset
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+
+		extent := make([]byte, end-start)
+		if _, err := f.ReadAt(extent, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		data = append(data, extent...)
+
+		offset = end
+	}
+
+	return data, nil
+}
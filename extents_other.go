@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"io/ioutil"
+)
+
+// SEEK_DATA/SEEK_HOLE are only used on Linux, elsewhere the whole file is
+// read.
+func readExtents(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Print a table of the files, bytes and time spent by extension at the end.
+var extStats bool
+
+func init() {
+	flag.BoolVar(&extStats, "ext-stats", false, "after the scan, print the files, bytes and time spent reading and hashing them by extension, slowest first")
+}
+
+// Totals for the files of one extension hashed in this run.
+type extTotals struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Time spent reading and hashing, summed over the workers
+	Seconds float64 `json:"seconds"`
+}
+
+// Count a hashed file towards its extension, ignoring case.
+func (p *progress) addExt(r *record) {
+	if p.exts == nil {
+		p.exts = map[string]*extTotals{}
+	}
+
+	ext := strings.ToLower(r.ext)
+	t, ok := p.exts[ext]
+	if !ok {
+		t = &extTotals{}
+		p.exts[ext] = t
+	}
+	t.Files++
+	t.Bytes += r.size
+	t.Seconds += r.elapsed.Seconds()
+}
+
+// Print the totals by extension, the ones that took longest first, with the
+// throughput of each.
+func printExtStats(w io.Writer, p *progress) {
+	exts := []string{}
+	for ext := range p.exts {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		a, b := p.exts[exts[i]], p.exts[exts[j]]
+		if a.Seconds != b.Seconds {
+			return a.Seconds > b.Seconds
+		}
+		return exts[i] < exts[j]
+	})
+
+	fmt.Fprintf(w, "%-10s %10s %12s %10s %12s\n", "EXT", "FILES", "BYTES", "TIME", "RATE")
+	for _, ext := range exts {
+		t := p.exts[ext]
+
+		rate := "-"
+		if t.Seconds > 0 {
+			rate = formatBytes(int64(float64(t.Bytes)/t.Seconds)) + "/s"
+		}
+
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		elapsed := time.Duration(t.Seconds * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(w, "%-10s %10d %12s %10s %12s\n", name, t.Files, formatBytes(t.Bytes), elapsed, rate)
+	}
+}
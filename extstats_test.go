@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtStats(t *testing.T) {
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.txt":      "alpha",
+		"b.TXT":      "beta",
+		"c/d.mp4":    "0123456789",
+		"c/README":   "readme",
+		"c/e/f.jpeg": "jpeg",
+	})
+
+	prog := &progress{start: time.Now(), last: time.Now()}
+	for _, r := range scanRecords(t, root) {
+		prog.add(r)
+	}
+
+	got := map[string]extTotals{}
+	for ext, totals := range prog.exts {
+		if totals.Seconds <= 0 {
+			t.Errorf("%q: took %f seconds", ext, totals.Seconds)
+		}
+		got[ext] = extTotals{Files: totals.Files, Bytes: totals.Bytes}
+	}
+	want := map[string]extTotals{
+		".txt":  {Files: 2, Bytes: 9},
+		".mp4":  {Files: 1, Bytes: 10},
+		"":      {Files: 1, Bytes: 6},
+		".jpeg": {Files: 1, Bytes: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got totals by extension %v, want %v", got, want)
+	}
+
+	// The slowest extensions first
+	prog = &progress{start: time.Now(), last: time.Now()}
+	for _, r := range []*record{
+		{ext: ".txt", size: 1024, elapsed: time.Second},
+		{ext: ".mp4", size: 3 << 20, elapsed: 2 * time.Second},
+		{ext: ".mp4", size: 1 << 20, elapsed: 2 * time.Second},
+		{size: 10},
+	} {
+		prog.add(r)
+	}
+
+	var out bytes.Buffer
+	printExtStats(&out, prog)
+	wantTable := "EXT             FILES        BYTES       TIME         RATE\n" +
+		".mp4                2      4.0 MiB         4s    1.0 MiB/s\n" +
+		".txt                1      1.0 KiB         1s    1.0 KiB/s\n" +
+		"(none)              1         10 B         0s            -\n"
+	if out.String() != wantTable {
+		t.Errorf("printed:\n%s\nwant:\n%s", out.String(), wantTable)
+	}
+}
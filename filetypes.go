@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Only scan files of at least and at most this many bytes, 0 for no
+	// bound.
+	minSize, maxSize byteSize
+
+	// Kinds of files to scan, such as image, or extensions and MIME types.
+	types stringList
+
+	// Extensions and MIME type patterns of the -types, and the extensions of
+	// the kinds not asked for.
+	typeExts, typeMimes, otherTypeExts []string
+)
+
+func init() {
+	flag.Var(&minSize, "min-size", "only scan files of at least `SIZE` bytes, or with a unit such as 10MB")
+	flag.Var(&maxSize, "max-size", "only scan files of at most `SIZE` bytes, or with a unit such as 4GB")
+	flag.Var(&types, "types", "only scan files of the comma-separated `TYPES`: "+strings.Join(fileTypeNames(), ", ")+", an extension such as .iso or a MIME type such as text/* (repeatable)")
+}
+
+// A number of bytes given as a flag, with an optional unit as in -filter.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	// Sizes come from JSON as floats in -config jobs
+	n, err := strconv.ParseFloat(expandSizes(strings.TrimSpace(value)), 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, want BYTES or a number with a unit such as 10MB", value)
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+// The extensions and sniffed content types of a kind of file for -types.
+type fileType struct {
+	exts  []string
+	mimes []string
+}
+
+var fileTypes = map[string]fileType{
+	"image": {
+		exts:  []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff", ".webp", ".heic", ".heif", ".svg", ".ico", ".raw", ".cr2", ".cr3", ".nef", ".arw", ".dng", ".orf", ".rw2"},
+		mimes: []string{"image/*"},
+	},
+	"video": {
+		exts:  []string{".mp4", ".m4v", ".mov", ".avi", ".mkv", ".webm", ".wmv", ".flv", ".mpg", ".mpeg", ".m2ts", ".mts", ".3gp"},
+		mimes: []string{"video/*", "application/ogg"},
+	},
+	"audio": {
+		exts:  []string{".mp3", ".flac", ".wav", ".ogg", ".oga", ".opus", ".m4a", ".aac", ".wma", ".aif", ".aiff", ".mid", ".midi"},
+		mimes: []string{"audio/*"},
+	},
+	"document": {
+		exts:  []string{".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".odt", ".ods", ".odp", ".rtf", ".epub", ".ps"},
+		mimes: []string{"application/pdf", "application/postscript", "text/rtf"},
+	},
+	"archive": {
+		exts:  []string{".zip", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar", ".iso", ".dmg"},
+		mimes: []string{"application/zip", "application/x-gzip", "application/x-rar-compressed", "application/x-7z-compressed"},
+	},
+}
+
+// Names of the kinds of file -types knows, sorted.
+func fileTypeNames() []string {
+	names := []string{}
+	for name := range fileTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve -types into the extensions and MIME types to scan.
+func checkTypes() error {
+	typeExts, typeMimes, otherTypeExts = nil, nil, nil
+	if len(types) == 0 {
+		return nil
+	}
+
+	wanted := map[string]bool{}
+	for _, list := range types {
+		for _, t := range strings.Split(list, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			switch ft, ok := fileTypes[t]; {
+			case ok:
+				wanted[t] = true
+				typeExts = append(typeExts, ft.exts...)
+				typeMimes = append(typeMimes, ft.mimes...)
+			case strings.HasPrefix(t, "."):
+				typeExts = append(typeExts, t)
+			case strings.Contains(t, "/"):
+				typeMimes = append(typeMimes, t)
+			case t != "":
+				return fmt.Errorf("invalid -types %q, want %s, an .extension or a MIME type", t, strings.Join(fileTypeNames(), ", "))
+			}
+		}
+	}
+
+	for name, ft := range fileTypes {
+		if !wanted[name] {
+			otherTypeExts = append(otherTypeExts, ft.exts...)
+		}
+	}
+	return nil
+}
+
+// Check a file against -min-size, -max-size and the extensions of -types.
+// A file whose extension is of a kind asked for is scanned, one whose
+// extension is of another kind is left out, and any other file is only
+// scanned if MIME types are asked for, to be sniffed once it is read.
+func wantSizeAndType(name string, size int64) bool {
+	if size < int64(minSize) || (maxSize > 0 && size > int64(maxSize)) {
+		return false
+	}
+
+	switch {
+	case len(types) == 0, hasExt(name, typeExts):
+		return true
+	case hasExt(name, otherTypeExts):
+		return false
+	}
+	return len(typeMimes) > 0
+}
+
+// Check the sniffed type of a file that wantSizeAndType let through against
+// -types, unless its extension matched already.
+func wantType(name, mime string) bool {
+	if len(types) == 0 || hasExt(name, typeExts) {
+		return true
+	}
+	return matchMime(mime, typeMimes)
+}
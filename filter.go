@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Expression files must match to be scanned.
+	filterExpr    string
+	filterProgram *vm.Program
+)
+
+func init() {
+	flag.StringVar(&filterExpr, "filter", "", "only scan files for which `EXPR` is true, e.g. 'size > 1MB && ext in [\".jpg\", \".png\"]'")
+}
+
+// The variables available to -filter expressions.
+type filterEnv struct {
+	Path  string    `expr:"path"`
+	Name  string    `expr:"name"`
+	Ext   string    `expr:"ext"`
+	Size  int64     `expr:"size"`
+	Mtime time.Time `expr:"mtime"`
+}
+
+// Sizes with a unit in -filter expressions, e.g. 1MB or 1.5 GiB.
+var sizeLiteral = regexp.MustCompile(`\b(\d+(?:\.\d+)?)\s*([KMGT])i?B\b`)
+
+// Replace the sizes with a unit in an expression by the number of bytes.
+// Units are powers of 1024 like the sizes in the logs. String literals are
+// left alone.
+func expandSizes(s string) string {
+	var b strings.Builder
+	start := 0
+	quote := rune(0)
+
+	for i, c := range s {
+		switch {
+		case quote == 0 && (c == '"' || c == '\'' || c == '`'):
+			b.WriteString(expandSizeRun(s[start:i]))
+			start, quote = i, c
+		case quote != 0 && c == quote && (i == 0 || s[i-1] != '\\' || quote == '`'):
+			b.WriteString(s[start : i+1])
+			start, quote = i+1, 0
+		}
+	}
+
+	if quote != 0 {
+		b.WriteString(s[start:])
+	} else {
+		b.WriteString(expandSizeRun(s[start:]))
+	}
+	return b.String()
+}
+
+func expandSizeRun(s string) string {
+	return sizeLiteral.ReplaceAllStringFunc(s, func(m string) string {
+		parts := sizeLiteral.FindStringSubmatch(m)
+		n, _ := strconv.ParseFloat(parts[1], 64)
+		shift := uint(10 * (strings.Index("KMGT", parts[2]) + 1))
+		return strconv.FormatInt(int64(n*float64(int64(1)<<shift)), 10)
+	})
+}
+
+// Compile the -filter expression.
+func checkFilter() error {
+	if filterExpr == "" {
+		return nil
+	}
+
+	program, err := expr.Compile(expandSizes(filterExpr), expr.Env(filterEnv{}), expr.AsBool())
+	if err != nil {
+		return fmt.Errorf("invalid -filter: %s", err)
+	}
+	filterProgram = program
+	return nil
+}
+
+// Check whether a file matches the -filter expression. Files the expression
+// fails on are logged as errors and left out.
+func filterMatches(path string, info os.FileInfo) bool {
+	if filterProgram == nil {
+		return true
+	}
+
+	env := filterEnv{
+		Path:  path,
+		Name:  info.Name(),
+		Ext:   filepath.Ext(info.Name()),
+		Size:  info.Size(),
+		Mtime: info.ModTime(),
+	}
+
+	out, err := vm.Run(filterProgram, env)
+	if err != nil {
+		fileError(storedPath(path), "Error evaluating -filter: %s: %s\n", path, err)
+		return false
+	}
+	return out.(bool)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	defer func(saved string) { filterExpr = saved }(filterExpr)
+	defer func(saved bool) { quiet = saved }(quiet)
+	defer func() { filterProgram = nil }()
+	quiet = true
+
+	big := strings.Repeat("x", 2048)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"big.jpg":           big,
+		"big.png":           big,
+		"small.jpg":         "small",
+		"notes.txt":         big,
+		"1KB":               "named like a size",
+		"thumbnail/big.jpg": big,
+	})
+	old := time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "notes.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{`size > 1KB && ext in [".jpg", ".png"] && !(path contains "thumbnail")`, []string{"big.jpg", "big.png"}},
+		{`ext == ".txt" || size < 1KB`, []string{"1KB", "notes.txt", "small.jpg"}},
+		{`name startsWith "big" and not (ext == ".png")`, []string{"big.jpg", "thumbnail/big.jpg"}},
+		{`mtime.Year() < 2000`, []string{"notes.txt"}},
+		{`size >= 2 KiB and ext != ".jpg"`, []string{"big.png", "notes.txt"}},
+		// Sizes in strings are left as they are
+		{`name == "1KB"`, []string{"1KB"}},
+	}
+
+	for _, tt := range tests {
+		filterExpr = tt.expr
+		if err := checkFilter(); err != nil {
+			t.Fatalf("%s: %s", tt.expr, err)
+		}
+		if got := scanPaths(t, root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-filter %s scanned %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{`size >`, `size`, `owner == "me"`} {
+		filterExpr = bad
+		if err := checkFilter(); err == nil {
+			t.Errorf("-filter %s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"io"
+	"os"
+)
+
+// Bytes read from each end of a file for -fingerprint, 0 to hash whole files.
+var fingerprintBytes int64
+
+func init() {
+	flag.Int64Var(&fingerprintBytes, "fingerprint", 0, "instead of hashing whole files, store a fingerprint of the size and first and last `BYTES` of each")
+}
+
+// Read the parts of a file that make up its fingerprint: the first and last
+// n bytes, or the whole file if it is no larger than 2n.
+func readFingerprintData(path string, size, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if size <= 2*n {
+		return io.ReadAll(f)
+	}
+
+	data := make([]byte, 2*n)
+	if _, err := f.ReadAt(data[:n], 0); err != nil {
+		return nil, err
+	}
+	if _, err := f.ReadAt(data[n:], size-n); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Compute the fingerprint of a file from its size and the data read by
+// readFingerprintData. This is a heuristic for finding duplicate candidates,
+// not a content hash: files that differ only in the middle share a
+// fingerprint.
+func fingerprint(size int64, data []byte) string {
+	hasher := sha1.New()
+	binary.Write(hasher, binary.BigEndian, size)
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
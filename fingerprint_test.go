@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	defer func(saved int64) { fingerprintBytes = saved }(fingerprintBytes)
+	defer func(saved bool) { quiet = saved }(quiet)
+	fingerprintBytes, quiet = 8, true
+
+	original := "head of file" + strings.Repeat("m", 100) + "tail of file"
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"original": original,
+		"copy":     original,
+		// Only the size and ends are read, so this is taken for a copy
+		"middle": "head of file" + strings.Repeat("x", 100) + "tail of file",
+		"tail":   "head of file" + strings.Repeat("m", 100) + "tail of FILE",
+		"grown":  "head of file" + strings.Repeat("m", 101) + "tail of file",
+		"small":  "tiny",
+	})
+	records := scanRecords(t, root)
+
+	want := records["original"].fingerprint
+	if want == "" {
+		t.Fatal("original has no fingerprint")
+	}
+	for _, tt := range []struct {
+		name string
+		same bool
+	}{
+		{"copy", true},
+		{"middle", true},
+		{"tail", false},
+		{"grown", false},
+		{"small", false},
+	} {
+		got := records[tt.name].fingerprint
+		if got == "" || (got == want) != tt.same {
+			t.Errorf("%s: fingerprint %q, original's %q", tt.name, got, want)
+		}
+	}
+
+	// Files no larger than both ends are fingerprinted whole
+	if got, want := records["small"].fingerprint, fingerprint(4, []byte("tiny")); got != want {
+		t.Errorf("small: fingerprint %q, want %q", got, want)
+	}
+}
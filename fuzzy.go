@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Compute a fuzzy hash of every file for similarity searches.
+var fuzzyHashes bool
+
+func init() {
+	flag.BoolVar(&fuzzyHashes, "fuzzy", false, "also store an ssdeep-style fuzzy hash of each file in the fuzzy column, for finding similar files")
+}
+
+const (
+	// Bytes covered by the rolling hash.
+	rollingWindow = 7
+
+	// Smallest block size and longest first signature of a fuzzy hash.
+	minBlockSize  = 3
+	spamsumLength = 64
+
+	hashPrime = 0x01000193
+	hashInit  = 0x28021967
+
+	b64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+// The rolling hash of the last rollingWindow bytes used to find the block
+// boundaries.
+type rollingHash struct {
+	window     [rollingWindow]byte
+	h1, h2, h3 uint32
+	n          uint32
+}
+
+func (r *rollingHash) update(c byte) uint32 {
+	r.h2 -= r.h1
+	r.h2 += rollingWindow * uint32(c)
+
+	r.h1 += uint32(c)
+	r.h1 -= uint32(r.window[r.n%rollingWindow])
+
+	r.window[r.n%rollingWindow] = c
+	r.n++
+
+	r.h3 <<= 5
+	r.h3 ^= uint32(c)
+
+	return r.h1 + r.h2 + r.h3
+}
+
+// Step the FNV-style hash of the current block.
+func sumHash(c byte, h uint32) uint32 {
+	return (h * hashPrime) ^ uint32(c)
+}
+
+// Compute the context-triggered piecewise hash of data, as done by spamsum
+// and ssdeep: "BLOCKSIZE:SIG1:SIG2". A boundary is placed wherever the
+// rolling hash of the last few bytes hits a value depending on the block
+// size, and each signature character is a hash of one block, so a local
+// change to the data only changes a few characters. SIG2 is the same with
+// twice the block size so that hashes of files whose sizes differ up to
+// twofold can still be compared.
+func fuzzyHash(data []byte) string {
+	bs := uint32(minBlockSize)
+	for bs*spamsumLength < uint32(len(data)) {
+		bs *= 2
+	}
+
+	for {
+		var roll rollingHash
+		h2, h3 := uint32(hashInit), uint32(hashInit)
+		sig1 := make([]byte, 0, spamsumLength)
+		sig2 := make([]byte, 0, spamsumLength/2)
+
+		var h uint32
+		for _, c := range data {
+			h = roll.update(c)
+			h2 = sumHash(c, h2)
+			h3 = sumHash(c, h3)
+
+			if h%bs == bs-1 && len(sig1) < spamsumLength-1 {
+				sig1 = append(sig1, b64[h2%64])
+				h2 = hashInit
+			}
+			if h%(bs*2) == bs*2-1 && len(sig2) < spamsumLength/2-1 {
+				sig2 = append(sig2, b64[h3%64])
+				h3 = hashInit
+			}
+		}
+
+		// The rest of the data after the last boundary
+		if h != 0 {
+			sig1 = append(sig1, b64[h2%64])
+			sig2 = append(sig2, b64[h3%64])
+		}
+
+		// Too few blocks to be useful, try again with smaller ones
+		if bs > minBlockSize && len(sig1) < spamsumLength/2 {
+			bs /= 2
+			continue
+		}
+
+		return fmt.Sprintf("%d:%s:%s", bs, sig1, sig2)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Printable pseudo-random bytes, the same for a seed.
+func randomText(seed int64, n int) []byte {
+	rng := rand.New(rand.NewSource(seed))
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + rng.Intn(26))
+	}
+	return b
+}
+
+func TestFuzzyHash(t *testing.T) {
+	defer func(saved bool) { fuzzyHashes = saved }(fuzzyHashes)
+	defer func(saved bool) { quiet = saved }(quiet)
+	fuzzyHashes, quiet = true, true
+
+	original := randomText(1, 50000)
+	edited := append([]byte{}, original...)
+	copy(edited[25000:], "a small edit in the middle")
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"original.txt": string(original),
+		"edited.txt":   string(edited),
+		"other.txt":    string(randomText(2, 50000)),
+	})
+	records := scanRecords(t, root)
+
+	sigs := map[string]*fuzzySig{}
+	for name, r := range records {
+		sig, ok := parseFuzzy(r.path, r.fuzzy)
+		if !ok {
+			t.Fatalf("%s: invalid fuzzy hash %q", name, r.fuzzy)
+		}
+		sigs[name] = sig
+	}
+
+	if records["original.txt"].sha1 == records["edited.txt"].sha1 {
+		t.Error("the edited file has the original's SHA1")
+	}
+	if score := compareFuzzy(sigs["original.txt"], sigs["edited.txt"]); score < 80 {
+		t.Errorf("the edited file scores %d against the original, want at least 80", score)
+	}
+	if score := compareFuzzy(sigs["original.txt"], sigs["other.txt"]); score != 0 {
+		t.Errorf("an unrelated file scores %d against the original, want 0", score)
+	}
+	if score := compareFuzzy(sigs["original.txt"], sigs["original.txt"]); score != 100 {
+		t.Errorf("the original scores %d against itself, want 100", score)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Read every hard link to a file instead of reusing the hash of the first.
+var rehashLinks bool
+
+func init() {
+	flag.BoolVar(&rehashLinks, "rehash-links", false, "read and hash every hard link to a file rather than hashing its inode once and recording the hash for each of its paths")
+}
+
+// The device and inode that hard links share.
+type inodeKey struct {
+	dev, inode int64
+}
+
+// The hard links of an inode found by the walk so far.
+type linkedInode struct {
+	key inodeKey
+
+	// Record of the first link once it is hashed, nil before
+	result *record
+
+	// Links found before the first was hashed, recorded after it
+	waiting []*job
+
+	// Links not seen yet, the inode is forgotten once they all are
+	left int64
+}
+
+// Hashes each inode with several hard links once during a scan. The first
+// link found is hashed as usual and every other one gets a copy of its
+// record, so rsnapshot-style trees where most files are links cost one read
+// per distinct file. Rows of the copies name the link hashed in link_of.
+type hardlinks struct {
+	mu     sync.Mutex
+	inodes map[inodeKey]*linkedInode
+}
+
+func newHardlinks() *hardlinks {
+	return &hardlinks{inodes: map[inodeKey]*linkedInode{}}
+}
+
+// Check whether a file found by the walk must be hashed. Links of an inode
+// that is already queued are recorded from the first one's record, sent to
+// out now if it's hashed already and otherwise once it is.
+func (h *hardlinks) claim(j *job, out chan<- *record) bool {
+	if rehashLinks {
+		return true
+	}
+	nlink, dev, inode := fileLinks(j.path, j.info)
+	if nlink <= 1 || inode == 0 {
+		return true
+	}
+	key := inodeKey{dev, inode}
+
+	h.mu.Lock()
+	linked, ok := h.inodes[key]
+	if !ok {
+		j.links = &linkedInode{key: key, left: nlink - 1}
+		h.inodes[key] = j.links
+		h.mu.Unlock()
+		return true
+	}
+
+	linked.left--
+	result := linked.result
+	if result == nil {
+		linked.waiting = append(linked.waiting, j)
+	} else if linked.left <= 0 {
+		delete(h.inodes, key)
+	}
+	h.mu.Unlock()
+
+	if result != nil {
+		out <- linkRecord(result, j)
+	}
+	return false
+}
+
+// Record the links waiting on a job that was hashed.
+func (h *hardlinks) hashed(j *job, result *record, out chan<- *record) {
+	if j.links == nil {
+		return
+	}
+
+	h.mu.Lock()
+	waiting := j.links.waiting
+	j.links.waiting = nil
+	j.links.result = result
+	if j.links.left <= 0 {
+		delete(h.inodes, j.links.key)
+	}
+	h.mu.Unlock()
+
+	for _, link := range waiting {
+		out <- linkRecord(result, link)
+	}
+}
+
+// Give up on the links of a job that could not be hashed, passing each one
+// waiting to report. Permissions belong to the inode, so they would most
+// likely fail the same way. Links found later are hashed themselves.
+func (h *hardlinks) failed(j *job, report func(path string)) {
+	if j.links == nil {
+		return
+	}
+
+	h.mu.Lock()
+	waiting := j.links.waiting
+	j.links.waiting = nil
+	delete(h.inodes, j.links.key)
+	h.mu.Unlock()
+
+	for _, link := range waiting {
+		report(link.path)
+	}
+}
+
+// Copy the record of the link that was hashed for another link to it.
+func linkRecord(first *record, j *job) *record {
+	ext := filepath.Ext(j.info.Name())
+
+	r := *first
+	r.extless = strings.Replace(j.info.Name(), ext, "", -1)
+	r.ext = ext
+	r.path = storedPath(j.path)
+	r.walked = j.walked
+	r.viaLink = viaLink(j.info)
+	r.linkOf = first.path
+	r.elapsed, r.hashMS, r.slow = 0, 0, false
+	return &r
+}
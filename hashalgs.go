@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jcrussell/sha1files/sha1files"
+	"io"
+	"sort"
+	"strings"
+)
+
+var (
+	// Comma-separated algorithms to hash files with.
+	hashList string
+
+	// The algorithms of -hash in order, and those besides SHA1, which is
+	// always computed.
+	requestedHashes, extraHashes []string
+)
+
+func init() {
+	flag.StringVar(&hashList, "hash", "sha1", "comma-separated `ALGORITHMS` to hash files with in the same read: sha1, sha256, sha512, md5, blake2b or xxh64 (sha1 is always stored)")
+}
+
+// Parse -hash, leaving out repeats.
+func checkHashes() error {
+	requestedHashes, extraHashes = nil, nil
+
+	seen := map[string]bool{}
+	for _, name := range strings.Split(hashList, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := sha1files.Algorithms[name]; !ok {
+			return fmt.Errorf("invalid -hash algorithm %q, want %s", name, strings.Join(sha1files.AlgorithmNames(), ", "))
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		requestedHashes = append(requestedHashes, name)
+		if name != "sha1" {
+			extraHashes = append(extraHashes, name)
+		}
+	}
+
+	if len(extraHashes) > 0 && fingerprintBytes > 0 {
+		return errors.New("-hash cannot be used with -fingerprint, which doesn't read whole files")
+	}
+	return nil
+}
+
+// The hasher of scans: SHA1 and the -hash algorithms, -bufsize bytes at a
+// time, with the content ID and decryptor if there are any.
+func scanHasher() *sha1files.Hasher {
+	return &sha1files.Hasher{
+		Algorithms: extraHashes,
+		BufSize:    bufSize,
+		ContentID:  contentIDFunc(),
+		Decrypt:    decryptFunc(),
+	}
+}
+
+// Columns storing the digests of the algorithms besides SHA1. A row keeps a
+// digest computed by an earlier scan for as long as its SHA1 doesn't change,
+// including when the SHA1 is kept by a -no-hash scan.
+func hashColumns() []column {
+	columns := []column{}
+	for _, name := range sha1files.AlgorithmNames() {
+		if name == "sha1" {
+			continue
+		}
+
+		name := name
+		columns = append(columns, column{
+			name:   name,
+			decl:   fmt.Sprintf("CHAR(%d)", sha1files.Algorithms[name].Size),
+			value:  func(r *record) interface{} { return nullString(r.hashes[name]) },
+			update: keepWithHash(name),
+		})
+	}
+	return columns
+}
+
+// Hash contents with SHA1 and the extra algorithms as they are read.
+func hashReaderAll(r io.Reader) (string, map[string]string, error) {
+	d, err := (&sha1files.Hasher{Algorithms: extraHashes, BufSize: bufSize}).Sum("", r, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return d.SHA1, d.Hashes, nil
+}
+
+// Compute every -hash digest of a file, by algorithm, as it is read.
+// Bundles and encrypted files are hashed over the same contents as their
+// SHA1.
+func calcHashes(path string) (map[string]string, error) {
+	hasher := &sha1files.Hasher{Algorithms: extraHashes, BufSize: bufSize, Decrypt: decryptFunc()}
+
+	var d *sha1files.Digests
+	var err error
+	if isBundle(path) {
+		var manifest []byte
+		if manifest, _, err = bundleManifest(path); err == nil {
+			d, err = hasher.Sum(path, bytes.NewReader(manifest), nil)
+		}
+	} else {
+		d, err = hasher.HashFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sums := map[string]string{"sha1": d.SHA1}
+	for name, sum := range d.Hashes {
+		sums[name] = sum
+	}
+	return sums, nil
+}
+
+// Record the algorithms scans have stored digests for, so readers of the
+// database know which columns to expect filled in.
+func recordHashes(store Store) error {
+	recorded, _, err := store.Meta("hashes")
+	if err != nil {
+		return err
+	}
+
+	names := map[string]bool{"sha1": true}
+	for _, name := range strings.Split(recorded, ",") {
+		if name != "" {
+			names[name] = true
+		}
+	}
+	for _, name := range extraHashes {
+		names[name] = true
+	}
+
+	all := []string{}
+	for name := range names {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+
+	if joined := strings.Join(all, ","); joined != recorded {
+		return store.SetMeta("hashes", joined)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"log"
+)
+
+var (
+	// Store a keyed hash of each path instead of the path itself.
+	hashNames bool
+
+	// Key for -hash-names, generated and recorded in the database if empty.
+	nameSalt string
+)
+
+func init() {
+	flag.BoolVar(&hashNames, "hash-names", false, "store an HMAC of each path instead of the path, and no file name, so the db can be shared without the names")
+	flag.StringVar(&nameSalt, "name-salt", "", "with -hash-names, the `SALT` used as the HMAC key (default: the one recorded in the db, or a new random one)")
+}
+
+// Settle the salt for -hash-names: the one given, else the one recorded by
+// an earlier run so the same path always hashes the same, else a new random
+// one. The salt is recorded in the metadata table so that the owner can
+// still look up paths. A salt that differs from the recorded one is refused
+// since rows would no longer match, as is a scan without -hash-names into a
+// database of hashed paths.
+func checkNameSalt(store Store) error {
+	recorded, ok, err := store.Meta("name_salt")
+	if err != nil {
+		return err
+	}
+
+	if !hashNames {
+		if ok {
+			return errors.New("database stores hashed paths, run with -hash-names")
+		}
+		return nil
+	}
+
+	switch {
+	case ok && nameSalt != "" && nameSalt != recorded:
+		return errors.New("-name-salt differs from the salt recorded in the database")
+	case ok:
+		nameSalt = recorded
+		return nil
+	case nameSalt == "":
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		nameSalt = hex.EncodeToString(b)
+		log.Printf("Hashing names with new salt %s\n", nameSalt)
+	}
+
+	return store.SetMeta("name_salt", nameSalt)
+}
+
+// Check whether the database stores hashed paths, which can't be opened to
+// verify or prune them.
+func namesHashed(db *sql.DB) (bool, error) {
+	_, ok, err := getMeta(db, "name_salt")
+	return ok, err
+}
+
+// Hex HMAC-SHA256 of a path keyed with the salt.
+func hashName(path string) string {
+	mac := hmac.New(sha256.New, []byte(nameSalt))
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Replace the path of a record by its hash and drop the name, keeping only
+// the extension.
+func (r *record) hideName() {
+	r.path = hashName(r.path)
+	r.extless = ""
+}
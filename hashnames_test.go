@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashNames(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "private")
+	writeTree(t, root, map[string]string{"secret plans.txt": "plans"})
+	dbFile := filepath.Join(dir, "files.db")
+
+	if out, err := runMain(t, "-quiet", "-db", dbFile, "-hash-names", "-name-salt", "pepper", root); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	mac := hmac.New(sha256.New, []byte("pepper"))
+	mac.Write([]byte(filepath.Join(root, "secret plans.txt")))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	db, err := openDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var path, extless, ext, sum string
+	if err := db.QueryRow("SELECT path, extless, ext, sha1 FROM files").Scan(&path, &extless, &ext, &sum); err != nil {
+		t.Fatal(err)
+	}
+	if path != want || extless != "" || ext != ".txt" || sum != hashBytes([]byte("plans")) {
+		t.Errorf("stored path %q, extless %q, ext %q and sha1 %s, want path %q", path, extless, ext, sum, want)
+	}
+	if salt, _, err := getMeta(db, "name_salt"); err != nil || salt != "pepper" {
+		t.Errorf("recorded salt %q, %v", salt, err)
+	}
+	db.Close()
+
+	// Cleartext paths don't mix with hashed ones
+	if out, err := runMain(t, "-quiet", "-db", dbFile, root); err == nil {
+		t.Errorf("scanned without -hash-names into a db of hashed paths\n%s", out)
+	}
+	if out, err := runMain(t, "-quiet", "-db", dbFile, "-hash-names", "-name-salt", "salt", root); err == nil {
+		t.Errorf("scanned with another -name-salt\n%s", out)
+	}
+}
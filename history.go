@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"time"
+)
+
+// Keep the rows of re-scanned files whose hash changed in the history table.
+var appendHistory bool
+
+func init() {
+	flag.BoolVar(&appendHistory, "append", false, "keep the old hash of re-scanned files that changed as a row in the history table instead of only replacing it")
+}
+
+// Previous hashes of files, see -append. Each row is a files row as it was
+// until replaced, the time it was replaced at.
+const historyTable = "CREATE TABLE IF NOT EXISTS history (path TEXT, sha1 CHAR(40), size INTEGER, mtime INTEGER, first_seen INTEGER, last_seen INTEGER, replaced INTEGER)"
+
+// Copy the rows the records are about to replace into the history table,
+// unless the file still has the same hash. Rows without a full hash (see
+// -fingerprint) have nothing worth keeping.
+func saveHistory(tx *sql.Tx, records []*record) error {
+	stmt, err := tx.Prepare("INSERT INTO history (path, sha1, size, mtime, first_seen, last_seen, replaced) " +
+		"SELECT path, sha1, size, mtime, first_seen, last_seen, ? FROM " + filesView() +
+		" WHERE path = ? AND sha1 IS NOT NULL AND sha1 IS NOT ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, record := range records {
+		if _, err := stmt.Exec(now, record.path, nullString(record.sha1)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
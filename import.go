@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jcrussell/sha1files/sha1files"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Import the manifests given as arguments instead of scanning.
+	importMode bool
+
+	// Algorithm of the hashes in sha1sum-style manifests, guessed from their
+	// length if empty.
+	importHash string
+)
+
+func init() {
+	flag.BoolVar(&importMode, "import", false, "add the files listed in the sha1sum-style, hashdeep or JSON lines manifests FILE... to the db without hashing them")
+	flag.StringVar(&importHash, "import-hash", "", "`ALGORITHM` of the hashes in sha1sum-style manifests for -import, by default sha1, md5, sha256 or sha512 by their length")
+}
+
+// Algorithms of the sha1sum-style manifests by the length of their hashes.
+// b2sum writes hashes as long as sha512sum's, see -import-hash.
+var hashLengths = map[int]string{32: "md5", 40: "sha1", 64: "sha256", 128: "sha512"}
+
+// A line of a manifest in the BSD format of sha1sum --tag and shasum,
+// e.g. "SHA256 (path) = hash".
+var taggedLine = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.*)\) = ([0-9a-fA-F]+)$`)
+
+// Check the -import-hash value.
+func checkImportHash() error {
+	if _, ok := sha1files.Algorithms[importHash]; importHash != "" && !ok {
+		return fmt.Errorf("invalid -import-hash %q, want %s", importHash, strings.Join(sha1files.AlgorithmNames(), ", "))
+	}
+	return nil
+}
+
+// Reads the records of one manifest, whatever its format.
+type manifestReader struct {
+	// Directory of the manifest, which relative paths are under
+	dir string
+
+	// Columns of a hashdeep file, from its header, nil for other formats
+	hashdeep []string
+}
+
+// Create the record of a file listed with the hash of an algorithm.
+func (m *manifestReader) listed(path, algorithm, sum string) *record {
+	if !filepath.IsAbs(path) {
+		// Manifests are usually written from the directory they sit in
+		path = filepath.Join(m.dir, path)
+	}
+	return newImportedRecord(storedPath(path), algorithm, sum)
+}
+
+// Create the record of a file by its stored path.
+func newImportedRecord(stored, algorithm, sum string) *record {
+	name := filepath.Base(stored)
+	ext := filepath.Ext(name)
+	r := &record{
+		extless: strings.Replace(name, ext, "", -1),
+		ext:     ext,
+		path:    stored,
+		seen:    time.Now().Unix(),
+		hashes:  map[string]string{},
+	}
+	r.setHash(algorithm, sum)
+	return r
+}
+
+// Set the digest of an algorithm.
+func (r *record) setHash(algorithm, sum string) {
+	sum = strings.ToLower(sum)
+	if algorithm == "sha1" {
+		r.sha1 = sum
+	} else {
+		r.hashes[algorithm] = sum
+	}
+}
+
+// Parse a line of the manifest into a record, nil for lines with none such
+// as comments and headers.
+func (m *manifestReader) parse(line string) (*record, error) {
+	switch {
+	case strings.HasPrefix(line, "%%%% HASHDEEP"):
+		return nil, nil
+	case strings.HasPrefix(line, "%%%% "):
+		m.hashdeep = strings.Split(strings.TrimPrefix(line, "%%%% "), ",")
+		return nil, nil
+	case strings.HasPrefix(line, "#"):
+		return nil, nil
+	case strings.HasPrefix(line, "{"):
+		return m.parseJSON(line)
+	case m.hashdeep != nil:
+		return m.parseHashdeep(line)
+	}
+
+	if parts := taggedLine.FindStringSubmatch(line); parts != nil {
+		algorithm := strings.ToLower(strings.Replace(parts[1], "-", "", -1))
+		if algorithm == "blake2b512" {
+			algorithm = "blake2b"
+		}
+		if _, ok := sha1files.Algorithms[algorithm]; !ok {
+			return nil, fmt.Errorf("unknown algorithm %s", parts[1])
+		}
+		return m.listed(parts[2], algorithm, parts[3]), nil
+	}
+
+	sum, path, err := parseManifestLine(line)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := importHash
+	if algorithm == "" {
+		algorithm = hashLengths[len(sum)]
+	}
+	if algorithm == "" || len(sum) != sha1files.Algorithms[algorithm].Size {
+		return nil, fmt.Errorf("hash of %d digits for %s, see -import-hash", len(sum), path)
+	}
+	return m.listed(path, algorithm, sum), nil
+}
+
+// Parse a line of a JSON lines export, see -export.
+func (m *manifestReader) parseJSON(line string) (*record, error) {
+	var j jsonRecord
+	if err := json.Unmarshal([]byte(line), &j); err != nil {
+		return nil, err
+	}
+	if j.Path == "" {
+		return nil, fmt.Errorf("no path in %s", line)
+	}
+
+	// Exported paths are already as stored
+	r := newImportedRecord(j.Path, "sha1", j.SHA1)
+	r.size, r.mtime, r.xattrs, r.sparse, r.fingerprint = j.Size, j.Mtime, j.Xattrs, j.Sparse, j.Fingerprint
+	for algorithm, sum := range j.Hashes {
+		if _, ok := sha1files.Algorithms[algorithm]; ok {
+			r.setHash(algorithm, sum)
+		}
+	}
+	return r, nil
+}
+
+// Parse a line of a hashdeep file. The file name comes last and may contain
+// commas.
+func (m *manifestReader) parseHashdeep(line string) (*record, error) {
+	fields := strings.SplitN(line, ",", len(m.hashdeep))
+	if len(fields) != len(m.hashdeep) || m.hashdeep[len(m.hashdeep)-1] != "filename" {
+		return nil, fmt.Errorf("malformed hashdeep line: %q", line)
+	}
+
+	r := m.listed(fields[len(fields)-1], "sha1", "")
+	for i, column := range m.hashdeep[:len(m.hashdeep)-1] {
+		if column == "size" {
+			size, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			r.size = size
+		} else if _, ok := sha1files.Algorithms[column]; ok {
+			r.setHash(column, fields[i])
+		}
+	}
+	return r, nil
+}
+
+// Add the files listed in the manifests to the database, trusting their
+// hashes. A file listed by several manifests, e.g. SHA1SUMS and SHA256SUMS,
+// gets the hashes of all of them. Paths that already have a row are left
+// alone since a scan knows more about the file than a manifest. The sizes
+// missing from sha1sum-style manifests come from a stat of the files that
+// still exist; the files are never read. Returns the number of rows added.
+func importManifests(db *sql.DB, paths []string) (int, error) {
+	listed := map[string]*record{}
+	order := []*record{}
+	for _, path := range paths {
+		if err := readManifest(path, func(r *record) {
+			if seen, ok := listed[r.path]; ok {
+				seen.merge(r)
+				return
+			}
+			listed[r.path] = r
+			order = append(order, r)
+		}); err != nil {
+			return 0, err
+		}
+	}
+
+	exists, err := db.Prepare("SELECT COUNT(*) FROM files WHERE path = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer exists.Close()
+
+	store := newBatcher(db)
+	added, known := 0, 0
+	for _, r := range order {
+		if r.sha1 == "" && normalized {
+			warnf("Skipping %s: the normalized schema needs a SHA1\n", r.path)
+			continue
+		}
+
+		var count int
+		if err := exists.QueryRow(r.path).Scan(&count); err != nil {
+			return added, err
+		}
+		if count > 0 {
+			known++
+			continue
+		}
+
+		if r.size == 0 {
+			if info, err := os.Stat(localPath(r.path)); err == nil {
+				r.size = info.Size()
+			}
+		}
+
+		if err := store.add(r); err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	if err := store.Close(); err != nil {
+		return added, err
+	}
+	if known > 0 {
+		log.Printf("Left alone %d files that already had a row\n", known)
+	}
+	return added, nil
+}
+
+// Read the records of a manifest, passing each to add.
+func readManifest(path string, add func(*record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	m := &manifestReader{dir: filepath.Dir(abs)}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		r, err := m.parse(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		if r != nil {
+			add(r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// Fill in what another manifest's record of the same file knows that this
+// one doesn't.
+func (r *record) merge(other *record) {
+	if r.sha1 == "" {
+		r.sha1 = other.sha1
+	}
+	if r.size == 0 {
+		r.size = other.size
+	}
+	if r.mtime == 0 {
+		r.mtime = other.mtime
+	}
+	for algorithm, sum := range other.hashes {
+		if r.hashes[algorithm] == "" {
+			r.hashes[algorithm] = sum
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	// Skip hashing files whose size, mtime and ctime match their row.
+	incremental bool
+
+	// Size, mtime and ctime of the files already hashed, by stored path.
+	knownStats map[string]fileStat
+
+	// Files found unchanged, whose rows only need last_seen updating.
+	unchangedPaths []string
+)
+
+func init() {
+	flag.BoolVar(&incremental, "incremental", false, "skip hashing files whose size, mtime and (where available) ctime are the same as when they were last hashed")
+}
+
+// What is compared to decide whether a file changed since it was hashed.
+type fileStat struct {
+	size, mtime, ctime int64
+}
+
+// Load the stats of the hashed rows, with a ctime of 0 for rows without one.
+func loadKnownStats(db *sql.DB) error {
+	query := fmt.Sprintf("SELECT path, size, mtime, COALESCE(ctime, 0) FROM %s WHERE sha1 IS NOT NULL OR fingerprint IS NOT NULL", filesView())
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	knownStats = map[string]fileStat{}
+	for rows.Next() {
+		var path string
+		var stat fileStat
+		if err := rows.Scan(&path, &stat.size, &stat.mtime, &stat.ctime); err != nil {
+			return err
+		}
+		knownStats[path] = stat
+	}
+
+	infof("Loaded %d rows to skip if unchanged\n", len(knownStats))
+	return rows.Err()
+}
+
+// Check whether a file is the same as when it was last hashed, remembering it
+// to update its row if so. The ctime changes with any write and with metadata
+// edits such as chmod, rename or touch, and unlike mtime it cannot be set by
+// the file's owner. Where the platform has no ctime, size and mtime have to
+// do. A row without a ctime on a platform that has one, from before the
+// column existed, is hashed again once to record it.
+func isUnchanged(path string, info os.FileInfo) bool {
+	if !incremental {
+		return false
+	}
+
+	stored := storedPath(path)
+	if hashNames {
+		stored = hashName(stored)
+	}
+
+	known, ok := knownStats[stored]
+	if !ok {
+		return false
+	}
+
+	if known != (fileStat{size: info.Size(), mtime: info.ModTime().Unix(), ctime: changeTime(info)}) {
+		return false
+	}
+
+	unchangedPaths = append(unchangedPaths, stored)
+	return true
+}
+
+// Set last_seen on the rows of the unchanged files, so that -prune-missing
+// keeps them.
+func touchUnchanged(db *sql.DB, seen int64) error {
+	if len(unchangedPaths) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("UPDATE files SET last_seen = ? WHERE path = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, path := range unchangedPaths {
+		if _, err := stmt.Exec(seen, path); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	infof("Skipped %d unchanged files\n", len(unchangedPaths))
+	return tx.Commit()
+}
@@ -0,0 +1,61 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIncremental(t *testing.T) {
+	defer func(saved bool) { incremental = saved }(incremental)
+	defer func(saved map[string]fileStat) { knownStats = saved }(knownStats)
+	defer func(saved []string) { unchangedPaths = saved }(unchangedPaths)
+	defer func(saved bool) { quiet = saved }(quiet)
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(ioutil.Discard)
+	quiet = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha", "b.txt": "beta", "c.txt": "gamma"})
+
+	records := []*record{}
+	for _, r := range scanRecords(t, root) {
+		records = append(records, r)
+	}
+	db := testDB(t, records...)
+
+	incremental, unchangedPaths = true, nil
+	if err := loadKnownStats(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the ctimes time to move on filesystems with coarse timestamps
+	time.Sleep(20 * time.Millisecond)
+
+	// A chmod changes only the ctime, as does setting the mtime back to
+	// what it was
+	b, c := filepath.Join(root, "b.txt"), filepath.Join(root, "c.txt")
+	if err := os.Chmod(b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(c, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := scanPaths(t, root), []string{"b.txt", "c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rescanned %v, want %v", got, want)
+	}
+	if want := []string{filepath.Join(root, "a.txt")}; !reflect.DeepEqual(unchangedPaths, want) {
+		t.Errorf("skipped %v as unchanged, want %v", unchangedPaths, want)
+	}
+}
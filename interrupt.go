@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Exit status of a scan stopped by SIGINT or SIGTERM, as for a shell.
+const exitInterrupted = 130
+
+// Returned from the walk function to stop walking once interrupted.
+var errInterrupted = errors.New("interrupted")
+
+// Set by the first SIGINT or SIGTERM. The walk checks it to stop.
+var interrupted int32
+
+// Stop the scan cleanly on SIGINT or SIGTERM: nothing more is queued, the
+// files already queued are hashed and committed and a checkpoint is saved
+// for -resume. A second signal exits at once, losing the uncommitted
+// records.
+func catchInterrupts() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		atomic.StoreInt32(&interrupted, 1)
+		warnf("Interrupted, committing the files already queued (interrupt again to quit now)\n")
+
+		<-signals
+		warnf("Interrupted again, quitting without committing\n")
+		exit(exitInterrupted)
+	}()
+}
+
+func isInterrupted() bool {
+	return atomic.LoadInt32(&interrupted) == 1
+}
+
+// End a scan that was interrupted, once everything queued was committed and
+// the checkpoint saved. With -atomic the copy being built is removed
+// instead, leaving the original database as it was.
+func stopInterrupted(db *sql.DB, path string) {
+	if path != dbPath {
+		db.Close()
+		os.Remove(path)
+		warnf("%s is unchanged, run the scan again\n", dbPath)
+		exit(exitInterrupted)
+	}
+
+	db.Close()
+	if lastQueued.path == "" {
+		warnf("Interrupted before any file was queued, run the scan again\n")
+	} else {
+		warnf("Stopped at %s, run the same scan with -resume to continue\n", lastQueued)
+	}
+	exit(exitInterrupted)
+}
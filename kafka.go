@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/segmentio/kafka-go"
+	"strings"
+)
+
+// Number of records sent to Kafka in one request.
+const kafkaBatch = 1000
+
+var (
+	// Comma-separated Kafka brokers to publish records to.
+	kafkaBrokers string
+
+	// Kafka topic records are published to.
+	kafkaTopic string
+)
+
+func init() {
+	flag.StringVar(&kafkaBrokers, "kafka", "", "also publish every record as JSON to the Kafka `BROKERS` (host:port, comma-separated)")
+	flag.StringVar(&kafkaTopic, "kafka-topic", "sha1files", "Kafka `TOPIC` for -kafka")
+}
+
+// Publishes records to a Kafka topic as JSON messages keyed by path, so the
+// updates for a file land on one partition in order. Messages are sent in
+// batches, each waiting for the brokers to acknowledge it, which slows the
+// scan down rather than buffering without bound when Kafka can't keep up.
+// Failed sends are retried by the writer.
+type kafkaSink struct {
+	writer  *kafka.Writer
+	pending []kafka.Message
+}
+
+func newKafkaSink(brokers, topic string) (*kafkaSink, error) {
+	if topic == "" {
+		return nil, errors.New("-kafka needs a -kafka-topic")
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    kafkaBatch,
+		RequiredAcks: kafka.RequireOne,
+	}
+	return &kafkaSink{writer: w}, nil
+}
+
+func (s *kafkaSink) write(r *record) error {
+	b, err := json.Marshal(newJSONRecord(r))
+	if err != nil {
+		return err
+	}
+
+	s.pending = append(s.pending, kafka.Message{Key: []byte(r.path), Value: b})
+	if len(s.pending) >= kafkaBatch {
+		return s.flush()
+	}
+	return nil
+}
+
+// Send the pending messages.
+func (s *kafkaSink) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	err := s.writer.WriteMessages(context.Background(), s.pending...)
+	s.pending = nil
+	return err
+}
+
+// Send the final messages and close the connections.
+func (s *kafkaSink) Close() error {
+	err := s.flush()
+	if cerr := s.writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
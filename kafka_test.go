@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// A broker with a two-partition topic that keeps the messages produced to
+// it.
+type mockBroker struct {
+	topic string
+
+	mu       sync.Mutex
+	messages map[string][]byte
+	requests int
+}
+
+func (b *mockBroker) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	switch req := req.(type) {
+	case *metadata.Request:
+		return &metadata.Response{Topics: []metadata.ResponseTopic{{
+			Name:       b.topic,
+			Partitions: []metadata.ResponsePartition{{PartitionIndex: 0}, {PartitionIndex: 1}},
+		}}}, nil
+
+	case *produce.Request:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.requests++
+
+		res := &produce.Response{}
+		for _, topic := range req.Topics {
+			partitions := []produce.ResponsePartition{}
+			for _, partition := range topic.Partitions {
+				records := partition.RecordSet.Records
+				for {
+					r, err := records.ReadRecord()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						return nil, err
+					}
+					key, err := protocol.ReadAll(r.Key)
+					if err != nil {
+						return nil, err
+					}
+					value, err := protocol.ReadAll(r.Value)
+					if err != nil {
+						return nil, err
+					}
+					b.messages[string(key)] = value
+				}
+				partitions = append(partitions, produce.ResponsePartition{Partition: partition.Partition})
+			}
+			res.Topics = append(res.Topics, produce.ResponseTopic{Topic: topic.Topic, Partitions: partitions})
+		}
+		return res, nil
+	}
+	return nil, protocol.ErrNoRecord
+}
+
+func TestKafkaSink(t *testing.T) {
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "b/c.txt": "gamma", "d.txt": "delta"}
+	writeTree(t, root, files)
+	records := scanRecords(t, root)
+
+	broker := &mockBroker{topic: "files", messages: map[string][]byte{}}
+	sink, err := newKafkaSink("localhost:9092", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.writer.Transport = broker
+
+	for _, r := range records {
+		if err := sink.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Batched until closed
+	if broker.requests != 0 {
+		t.Errorf("sent %d requests before closing", broker.requests)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(broker.messages) != len(files) {
+		t.Errorf("published %d messages, want %d", len(broker.messages), len(files))
+	}
+	for name, r := range records {
+		var got jsonRecord
+		if err := json.Unmarshal(broker.messages[r.path], &got); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if got.Path != r.path || got.SHA1 != hashBytes([]byte(files[name])) || got.Size != int64(len(files[name])) {
+			t.Errorf("%s: published %+v", name, got)
+		}
+	}
+}
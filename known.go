@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// Load the known-hash lists given as arguments instead of scanning.
+	loadKnown bool
+
+	// Name of the set the lists are loaded into, by default the name of
+	// each list.
+	knownSet string
+
+	// What a scan does with the files whose hash is known: mark or
+	// exclude, nothing if empty.
+	knownAction string
+
+	// Leave the files whose hash is known out of the duplicate and
+	// similarity reports.
+	hideKnown bool
+
+	// Looks up the set of a known hash during the scan.
+	knownStmt *sql.Stmt
+)
+
+func init() {
+	flag.BoolVar(&loadKnown, "load-known", false, "load the NSRL RDS or plain lists of SHA1s FILE... into the known_hashes table instead of scanning")
+	flag.StringVar(&knownSet, "known-set", "", "with -load-known, the `NAME` of the set the lists are loaded into (by default each list's file name)")
+	flag.StringVar(&knownAction, "known", "", "what a scan does with files whose hash is in known_hashes: mark, to store the set's name in the known column, or exclude, to not record them")
+	flag.BoolVar(&hideKnown, "hide-known", false, "leave files whose hash is in known_hashes out of -dupes and -similar")
+}
+
+// Hashes of known files, such as the operating system's from the NSRL, so
+// that triage can leave them out. A hash may be in several sets.
+const knownHashesTable = "CREATE TABLE IF NOT EXISTS known_hashes (sha1 CHAR(40) NOT NULL, name TEXT, known_set TEXT, UNIQUE (sha1, known_set))"
+
+// Check the -known value.
+func checkKnown() error {
+	if knownAction != "" && knownAction != "mark" && knownAction != "exclude" {
+		return fmt.Errorf("invalid -known %q, want mark or exclude", knownAction)
+	}
+	if knownAction != "" && fingerprintBytes > 0 {
+		return errors.New("-known needs full hashes, it cannot be used with -fingerprint")
+	}
+	return nil
+}
+
+// Load known-hash lists into their sets, skipping the hashes a set already
+// has. A list is either NSRLFile.txt of an NSRL RDS release, a CSV file
+// with a "SHA-1" column, or has a SHA1 at the start of each line, optionally
+// followed by a name as sha1sum writes it. Returns the number of hashes
+// added.
+func loadKnownLists(db *sql.DB, paths []string) (int64, error) {
+	var added int64
+	for _, path := range paths {
+		set := knownSet
+		if set == "" {
+			set = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+
+		n, err := loadKnownList(db, path, set)
+		added += n
+		if err != nil {
+			return added, fmt.Errorf("%s: %s", path, err)
+		}
+		log.Printf("Loaded %d known hashes from %s into set %s\n", n, path, set)
+	}
+	return added, nil
+}
+
+func loadKnownList(db *sql.DB, path, set string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO known_hashes (sha1, name, known_set) VALUES (?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var added, skipped int64
+	add := func(sum, name string) error {
+		sum = strings.ToLower(sum)
+		if !isSha1(sum) {
+			skipped++
+			return nil
+		}
+		res, err := stmt.Exec(sum, nullString(name), set)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		added += n
+		return nil
+	}
+
+	// NSRL files start with a header naming their columns
+	r := bufio.NewReader(f)
+	head, _ := r.Peek(4096)
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	if !bytes.HasPrefix(head, []byte("#")) && bytes.Contains(head, []byte(`"SHA-1"`)) {
+		err = readNSRL(r, add)
+	} else {
+		err = readHashList(r, add)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if skipped > 0 {
+		warnf("Skipped %d lines of %s without a SHA1\n", skipped, path)
+	}
+	return added, tx.Commit()
+}
+
+// Read the SHA-1 and FileName columns of an NSRL RDS file.
+func readNSRL(r io.Reader, add func(sum, name string) error) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	hashCol, nameCol := -1, -1
+	for i, name := range header {
+		switch name {
+		case "SHA-1":
+			hashCol = i
+		case "FileName":
+			nameCol = i
+		}
+	}
+
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hashCol >= len(row) {
+			continue
+		}
+
+		name := ""
+		if nameCol >= 0 && nameCol < len(row) {
+			name = row[nameCol]
+		}
+		if err := add(row[hashCol], name); err != nil {
+			return err
+		}
+	}
+}
+
+// Read a list of SHA1s, one per line and each maybe followed by a name.
+// Blank lines and those starting with # are skipped.
+func readHashList(r io.Reader, add func(sum, name string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sum, name := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			sum = line[:i]
+			// sha1sum marks files hashed in binary mode with a *
+			name = strings.TrimPrefix(strings.TrimSpace(line[i:]), "*")
+		}
+		if err := add(sum, name); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Check whether a string is a lowercase hex SHA1.
+func isSha1(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Prepare the lookups of -known for the scan.
+func openKnown(db *sql.DB) error {
+	if knownAction == "" {
+		return nil
+	}
+
+	var count int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM known_hashes").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		warnf("No known hashes loaded, see -load-known\n")
+	}
+
+	var err error
+	knownStmt, err = db.Prepare("SELECT known_set FROM known_hashes WHERE sha1 = ? ORDER BY known_set LIMIT 1")
+	return err
+}
+
+// Apply -known to a scanned file, returning false if it is not to be
+// recorded. Lookups that fail are logged and the file is recorded as if it
+// was unknown.
+func filterKnown(r *record) bool {
+	if knownStmt == nil || r.sha1 == "" {
+		return true
+	}
+
+	var set string
+	err := knownStmt.QueryRow(r.sha1).Scan(&set)
+	if err == sql.ErrNoRows {
+		return true
+	} else if err != nil {
+		errorf("Error looking up known hash: %s\n", err)
+		return true
+	}
+
+	if knownAction == "exclude" {
+		fileSkipped("known", r.path)
+		return false
+	}
+	r.known = set
+	return true
+}
+
+// Condition on the sha1 column leaving out the known files with -hide-known,
+// empty otherwise.
+func knownCondition() string {
+	if !hideKnown {
+		return ""
+	}
+	return " AND (sha1 IS NULL OR sha1 NOT IN (SELECT sha1 FROM known_hashes))"
+}
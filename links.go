@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Print the total size of the index with hard links counted once.
+var diskUsage bool
+
+func init() {
+	flag.BoolVar(&diskUsage, "disk-usage", false, "print the total size of the indexed files, counting hard links to the same inode once (after the scan if DIRs are given)")
+}
+
+// Print the number and total size of the files in the index. Files with
+// several hard links share one inode, recorded in the dev and inode columns,
+// so the disk usage counts each such inode once while the apparent size
+// counts every path.
+func printDiskUsage(w io.Writer, db *sql.DB) error {
+	var files, apparent int64
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM files").Scan(&files, &apparent); err != nil {
+		return err
+	}
+
+	var inodes, usage int64
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM (
+		SELECT MAX(size) AS size FROM files WHERE nlink > 1 AND inode IS NOT NULL GROUP BY dev, inode)`).Scan(&inodes, &usage)
+	if err != nil {
+		return err
+	}
+
+	var single int64
+	if err := db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM files WHERE nlink IS NULL OR nlink <= 1 OR inode IS NULL").Scan(&single); err != nil {
+		return err
+	}
+	usage += single
+
+	fmt.Fprintf(w, "Files: %d\n", files)
+	fmt.Fprintf(w, "Apparent size: %s (%d bytes)\n", formatBytes(apparent), apparent)
+	fmt.Fprintf(w, "Disk usage: %s (%d bytes)\n", formatBytes(usage), usage)
+	fmt.Fprintf(w, "Hard-linked inodes: %d\n", inodes)
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"os"
+)
+
+// Hard links are not counted on this platform.
+func fileLinks(path string, info os.FileInfo) (nlink, dev, inode int64) {
+	return 0, 0, 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Number of hard links to a file and the device and inode they share, all 0
+// if unknown.
+func fileLinks(path string, info os.FileInfo) (nlink, dev, inode int64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Nlink), int64(st.Dev), int64(st.Ino)
+	}
+	return 0, 0, 0
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.bin": strings.Repeat("a", 1000), "c.txt": "0123456789"})
+	if err := os.Link(filepath.Join(root, "a.bin"), filepath.Join(root, "b.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	records := scanRecords(t, root)
+	db := testDB(t, records["a.bin"], records["b.bin"], records["c.txt"])
+
+	for name, want := range map[string]int64{"a.bin": 2, "b.bin": 2, "c.txt": 1} {
+		var nlink int64
+		if err := db.QueryRow("SELECT nlink FROM files WHERE path = ?", filepath.Join(root, name)).Scan(&nlink); err != nil {
+			t.Fatal(err)
+		}
+		if nlink != want {
+			t.Errorf("%s: nlink = %d, want %d", name, nlink, want)
+		}
+	}
+
+	// Both links are listed but their inode is counted once
+	var out bytes.Buffer
+	if err := printDiskUsage(&out, db); err != nil {
+		t.Fatal(err)
+	}
+	want := "Files: 3\n" +
+		"Apparent size: 2.0 KiB (2010 bytes)\n" +
+		"Disk usage: 1010 B (1010 bytes)\n" +
+		"Hard-linked inodes: 1\n"
+	if out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Number of hard links to a file and the volume and file index they share,
+// all 0 if unknown. Unlike on Unix these aren't part of the stat done by
+// Walk, so the file is opened, without read access, to query them.
+func fileLinks(path string, info os.FileInfo) (nlink, dev, inode int64) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, 0
+	}
+
+	share := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	h, err := syscall.CreateFile(name, 0, share, nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, 0, 0
+	}
+	defer syscall.CloseHandle(h)
+
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return 0, 0, 0
+	}
+
+	return int64(d.NumberOfLinks), int64(d.VolumeSerialNumber), int64(d.FileIndexHigh)<<32 | int64(d.FileIndexLow)
+}
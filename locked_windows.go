@@ -0,0 +1,12 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+)
+
+// Check whether opening or reading a file failed because another process
+// holds it open exclusively (antivirus, Office, ...).
+func isLocked(err error) bool {
+	return errors.Is(err, windows.ERROR_SHARING_VIOLATION) || errors.Is(err, windows.ERROR_LOCK_VIOLATION)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Also log an event for every file scanned.
+	verbose bool
+
+	// Only log warnings, errors and results, not the progress of the scan.
+	quiet bool
+
+	// How log lines are written: text, or json for one object per line.
+	logFormat string
+
+	// Where -log-format json lines go, nil for text.
+	jsonOut *jsonLog
+)
+
+func init() {
+	flag.BoolVar(&verbose, "v", false, "also log a debug event for every file hashed")
+	flag.BoolVar(&quiet, "quiet", false, "don't log the progress of the scan (directories, skipped files, commits and throughput), only warnings, errors and results")
+	flag.StringVar(&logFormat, "log-format", "text", "`FORMAT` of the log lines on stderr: text, or json for an object per line with time, level, msg and the event's fields")
+}
+
+// Importance of a log line, in increasing order.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+// Fields of a log event besides its message, for -log-format json.
+type logFields map[string]interface{}
+
+// Check the logging options.
+func checkLogging() error {
+	switch {
+	case logFormat != "text" && logFormat != "json":
+		return fmt.Errorf("invalid -log-format %q, want text or json", logFormat)
+	case verbose && quiet:
+		return errors.New("-v and -quiet cannot be used together")
+	case tuiMode && logFormat == "json":
+		return errors.New("-tui cannot be used with -log-format json")
+	}
+	return nil
+}
+
+// Send the log output through -log-format json if it is given. Lines logged
+// with log.Printf become info events with only a message.
+func setupLogging() {
+	if logFormat != "json" {
+		return
+	}
+	jsonOut = &jsonLog{out: os.Stderr}
+	log.SetFlags(0)
+	log.SetOutput(jsonOut)
+}
+
+// Writes log events as JSON objects, one per line.
+type jsonLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (j *jsonLog) Write(p []byte) (int, error) {
+	j.emit(levelInfo, string(p), nil)
+	return len(p), nil
+}
+
+func (j *jsonLog) emit(level logLevel, msg string, fields logFields) {
+	event := map[string]interface{}{}
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["time"] = time.Now().Format(time.RFC3339Nano)
+	event["level"] = levelNames[level]
+	event["msg"] = strings.TrimSpace(msg)
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": err.Error()})
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.out.Write(append(b, '\n'))
+}
+
+// The lowest level logged, by -v and -quiet.
+func logThreshold() logLevel {
+	switch {
+	case verbose:
+		return levelDebug
+	case quiet:
+		return levelWarn
+	}
+	return levelInfo
+}
+
+// Log an event at a level, with fields that only -log-format json shows:
+// the text form is the message alone, so it must carry what matters.
+func logEvent(level logLevel, fields logFields, format string, args ...interface{}) {
+	if level < logThreshold() {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if jsonOut != nil {
+		jsonOut.emit(level, msg, fields)
+		return
+	}
+	log.Output(3, msg)
+}
+
+// Log the progress of the scan, left out with -quiet.
+func infof(format string, args ...interface{}) {
+	logEvent(levelInfo, nil, format, args...)
+}
+
+// Log a problem that doesn't stop the run.
+func warnf(format string, args ...interface{}) {
+	logEvent(levelWarn, nil, format, args...)
+}
+
+// Log a failure, of a file or of part of the run.
+func errorf(format string, args ...interface{}) {
+	logEvent(levelError, nil, format, args...)
+}
+
+// Log a debug event for a file hashed with -v.
+func logHashed(r *record) {
+	if !verbose {
+		return
+	}
+	logEvent(levelDebug, logFields{"event": "hashed", "path": r.path, "size": r.size, "sha1": r.sha1, "ms": r.elapsed.Milliseconds()},
+		"Hashed %s (%s in %s)\n", r.path, formatBytes(r.size), r.elapsed.Round(time.Millisecond))
+}
+
+// Log the summary of a finished scan as a JSON event, the same as the
+// -summary-json file. Text logs have the totals in the last progress line.
+func logSummary(db string, roots []string, prog *progress) {
+	if jsonOut == nil {
+		return
+	}
+
+	b, err := json.Marshal(newSummary(db, roots, prog))
+	if err != nil {
+		errorf("Error encoding the summary: %s\n", err)
+		return
+	}
+	fields := logFields{}
+	json.Unmarshal(b, &fields)
+	fields["event"] = "summary"
+	jsonOut.emit(levelInfo, "Finished the scan", fields)
+}
@@ -2,152 +2,1030 @@ package main
 
 import (
 	"crypto/sha1"
-	"database/sql"
 	"encoding/hex"
 	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	"io/ioutil"
+	"github.com/jcrussell/sha1files/sha1files"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
+// A flag.Value that collects every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var (
+	// Names of directories to skip wherever they appear in the tree.
+	pruneDirs stringList
+
+	// Only scan files with these extensions.
+	includeExts stringList
+
+	// Count the files in a first pass so progress can show percent complete.
+	estimate bool
+
+	// Walk roots that lie inside other roots instead of dropping them.
+	allowOverlap bool
+
+	// Print the hashes of the given files like sha1sum instead of scanning.
+	printOnly bool
+
+	// Walk and store the directories as given instead of making them
+	// absolute.
+	noAbs bool
+
+	// Location of the database, or :memory: for one that only lasts the run.
+	// Defaults to $SHA1FILES_DB if set.
+	dbPath string
+)
+
+func init() {
+	flag.Var(&pruneDirs, "prune-dir", "skip directories with this name anywhere in the tree (repeatable)")
+	flag.Var(&includeExts, "include-ext", "only scan files with this extension, e.g. .jpg (repeatable)")
+	flag.BoolVar(&estimate, "estimate", false, "count files in a first pass to report percent complete and ETA")
+	flag.BoolVar(&printOnly, "print", false, "print the hash of each FILE argument like sha1sum and exit without touching the db")
+	flag.BoolVar(&allowOverlap, "allow-overlap", false, "scan overlapping directories separately, indexing shared files twice")
+	flag.BoolVar(&noAbs, "no-abs", false, "store paths as given on the command line, relative if the DIR is relative")
+
+	// The environment can point every run at another database
+	defaultDB := "./files.db"
+	if env := os.Getenv("SHA1FILES_DB"); env != "" {
+		defaultDB = env
+	}
+	flag.StringVar(&dbPath, "db", defaultDB, "`PATH` of the database (defaults to $SHA1FILES_DB if set), :memory: to keep it in memory for this run only, or a postgres:// or mysql:// URL to scan into a server")
+}
+
 // Information about the file that will be stored in the sqlite database.
 type record struct {
 	extless string
 	ext     string
 	sha1    string
 	path    string
+	size    int64
+	xattrs  string
+	mtime   int64
+	sparse  bool
+	seen    int64
+	slow    bool
+
+	// Time taken to read and hash the file, and the same in milliseconds to
+	// store with -record-timing
+	elapsed time.Duration
+	hashMS  int64
+
+	// The hash is of the decrypted contents, see -decrypt
+	encrypted bool
+
+	// Content type sniffed from the start of the contents
+	mime string
+
+	// Concatenated hex digests of each block, see -block-size
+	blocks    string
+	blockSize int64
+
+	// Hash of the size, head and tail, see -fingerprint
+	fingerprint string
+
+	// SHA1 of the allocated data alone, see -sparse extents
+	extentsSha1 string
+
+	// Identifier from the contentID function, if one is set
+	contentID string
+
+	// Label of the -config job that scanned the file
+	job string
+
+	// Digests of the -hash algorithms besides SHA1, by algorithm
+	hashes map[string]string
+
+	// Where the walk found the file, for the checkpoint when the disk fills
+	walked checkpoint
+
+	// Creation time of the file, 0 if unknown, see -btime
+	btime int64
+
+	// Change time of the file's inode in nanoseconds, 0 if unknown
+	ctime int64
+
+	// Fuzzy hash for finding similar files, see -fuzzy
+	fuzzy string
+
+	// Number of hard links to the file and the device and inode they share,
+	// 0 if unknown
+	nlink, dev, inode int64
+
+	// Permission bits of the file and, if hasOwner, the uid and gid owning it
+	mode, uid, gid int64
+	hasOwner       bool
+
+	// The file is a symlink or under a linked directory, see -follow-symlinks
+	viaLink bool
+
+	// Path of the hard link to the same inode whose hash was reused, empty
+	// if the file itself was hashed
+	linkOf string
+
+	// Stored path of the archive holding the file, see -archives
+	archive string
+
+	// Set of known hashes the file's hash is in, see -known
+	known string
+
+	// The file is an archive whose members were hashed, replacing the rows
+	// of those recorded before
+	membersRead bool
 }
 
-// Compute the SHA1 hash of a file specified by its path. It will return the SHA1 or
-// an empty string and the error that occured.
+// Compute the SHA1 hash of a file specified by its path, -bufsize bytes at a
+// time. It will return the SHA1 or an empty string and the error that
+// occured. Encrypted files (see -decrypt) are decrypted first, and
+// bundles (see -bundle-ext) hashed over their files.
 func calcSha1(path string) (string, error) {
-	bytes, err := ioutil.ReadFile(path)
+	if isBundle(path) {
+		return bundleSha1(path)
+	}
+
+	d, err := (&sha1files.Hasher{BufSize: bufSize, Decrypt: decryptFunc()}).HashFile(path)
 	if err != nil {
 		return "", err
 	}
+	return d.SHA1, nil
+}
 
+// Compute the hex encoded SHA1 hash of a file's contents.
+func hashBytes(bytes []byte) string {
 	hasher := sha1.New()
 	hasher.Write(bytes)
-	hash := hex.EncodeToString(hasher.Sum(nil))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
 
-	return hash, nil
+// Print the hash of each file in sha1sum format. Returns false if any file
+// could not be hashed.
+func printHashes(paths []string) bool {
+	ok := true
+
+	for _, path := range paths {
+		sums, err := calcHashes(path)
+		if err != nil {
+			errorf("%s: %s\n", path, err)
+			ok = false
+			continue
+		}
+
+		// Several algorithms are tagged like shasum --tag does
+		for _, name := range requestedHashes {
+			if len(requestedHashes) == 1 {
+				fmt.Printf("%s  %s%s", sums[name], path, lineEnd())
+			} else {
+				fmt.Printf("%s (%s) = %s%s", strings.ToUpper(name), path, sums[name], lineEnd())
+			}
+		}
+	}
+
+	return ok
 }
 
-// Visit a file in the directory tree, return a new record for the file or
-// the error that occured. If the file starts with a ".", an error will be
-// returned indicating that the file/directory should be skipped.
-func doVisit(path string, info os.FileInfo, err error) (*record, error) {
-	if strings.HasPrefix(info.Name(), ".") {
-		// Skip hidden files and directories
-		return nil, filepath.SkipDir
+// Remove roots that are repeated or nested inside another root so that no
+// file is visited twice in one run. The roots must be absolute and clean.
+func dedupeRoots(roots []string) []string {
+	sorted := append([]string{}, roots...)
+	sort.Strings(sorted)
+
+	result := []string{}
+	for _, root := range sorted {
+		covered := false
+		for _, kept := range result {
+			if root == kept || strings.HasPrefix(root, strings.TrimSuffix(kept, string(filepath.Separator))+string(filepath.Separator)) {
+				infof("Skipping dir: %s, already covered by %s\n", root, kept)
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			result = append(result, root)
+		}
 	}
 
-	if info.IsDir() {
-		log.Printf("Descending into dir: %s\n", info.Name())
-		return nil, nil
-	} else {
-		ext := filepath.Ext(info.Name())
-		extless := strings.Replace(info.Name(), ext, "", -1)
+	return result
+}
 
-		sha1, err := calcSha1(path)
+// Make the directories to scan absolute, unless -no-abs is given, and drop
+// any that overlap unless -allow-overlap is given.
+func resolveRoots(dirs []string) []string {
+	roots := []string{}
+	for _, dir := range dirs {
+		if noAbs {
+			roots = append(roots, dir)
+			continue
+		}
+
+		abs, err := filepath.Abs(dir)
 		if err != nil {
-			return nil, err
+			fileError(dir, "Error processing dir: %s\n", dir)
+			continue
 		}
 
-		return &record{
-			extless: extless,
-			ext:     ext,
-			sha1:    sha1,
-			path:    path,
-		}, nil
+		roots = append(roots, abs)
+	}
+
+	if !allowOverlap {
+		roots = dedupeRoots(roots)
 	}
+	return roots
 }
 
-// Insert a batch of records into files table in SQLite. Returns any errors
-// that occurred or nil if there were none.
-func commitRecords(db *sql.DB, records []*record) error {
-	log.Printf("Commmitting batch of %d records\n", len(records))
+func main() {
+	parseCommandLine()
+	if err := checkLogging(); err != nil {
+		log.Fatal(err)
+	}
+	setupLogging()
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+	if err := takeRemoteArgs(); err != nil {
+		log.Fatal(err)
 	}
 
-	stmt, err := db.Prepare("INSERT INTO files (extless, ext, sha1, path) VALUES (?, ?, ?, ?)")
-	if err != nil {
-		return err
+	if listSystemDirs {
+		printSystemDirs()
+		return
 	}
-	defer stmt.Close()
 
-	for _, record := range records {
-		stmt.Exec(record.extless, record.ext, record.sha1, record.path)
+	scanning := (len(flag.Args()) > 0 && !importMode && !loadKnown) || len(sftpSources) > 0 || len(s3Sources) > 0 || configPath != ""
+
+	if !scanning && !importMode && !loadKnown && !verifyMode && !pruneMissing && !reportTree && !dupesMode && !similarMode && !checkCaseCollisions && !sameName && !treeDigest && !diskUsage && !statsMode && !querying() && serveAddr == "" && !listRuns && !rescanMissing && !promoteMode && dedupeAction == "" && manifestPath == "" && validateDB == "" && exportPath == "" {
+		fmt.Printf("USAGE: sha1files [OPTIONS] DIR [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] -sftp [USER@]HOST:/PATH [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] sftp://[USER@]HOST/PATH [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] -s3 s3://BUCKET/PREFIX [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] s3://BUCKET/PREFIX [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] -config FILE [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] -db-per-root TEMPLATE DIR [DIR]...\n")
+		fmt.Printf("       sha1files [OPTIONS] -watch [-watch-delay DURATION] DIR [DIR]...\n")
+		fmt.Printf("       sha1files -print FILE [FILE]...\n")
+		fmt.Printf("       sha1files -verify [-check-only-new SINCE] [-verify-fix [-prune-missing]] [DIR]...\n")
+		fmt.Printf("       sha1files -verify-manifest FILE\n")
+		fmt.Printf("       sha1files -rescan-only-missing-hashes\n")
+		fmt.Printf("       sha1files -promote\n")
+		fmt.Printf("       sha1files -prune-missing [-dry-run] [-prune-under DIR]... [DIR]...\n")
+		fmt.Printf("       sha1files -report-tree [DIR]...\n")
+		fmt.Printf("       sha1files -dupes [DIR]...\n")
+		fmt.Printf("       sha1files -dedupe ACTION [-keep-rule RULE] [-dedupe-apply]\n")
+		fmt.Printf("       sha1files -similar [-similarity SCORE] [DIR]...\n")
+		fmt.Printf("       sha1files -check-case-collisions [DIR]...\n")
+		fmt.Printf("       sha1files -same-name [DIR]...\n")
+		fmt.Printf("       sha1files -stats [-stats-format json] [-stats-top N] [DIR]...\n")
+		fmt.Printf("       sha1files -lookup PREFIX | -lookup-path PATH | -lookup-name GLOB [-query-format json]\n")
+		fmt.Printf("       sha1files -serve ADDR\n")
+		fmt.Printf("       sha1files -merge-dbs [-merge-host | -merge-prefix] OUT IN [IN]...\n")
+		fmt.Printf("       sha1files -diff-dbs OLD NEW\n")
+		fmt.Printf("       sha1files -list-runs\n")
+		fmt.Printf("       sha1files -validate-db FILE\n")
+		fmt.Printf("       sha1files -export FILE [-export-format json|sha1sum|hashdeep]\n")
+		fmt.Printf("       sha1files -import FILE [FILE]...\n")
+		fmt.Printf("       sha1files -load-known [-known-set NAME] FILE [FILE]...\n")
+		fmt.Printf("       sha1files COMMAND [OPTIONS] [ARGS]...\n")
+		printCommands()
+		flag.PrintDefaults()
+		return
 	}
 
-	tx.Commit()
-	return nil
-}
+	if err := applyQuick(); err != nil {
+		log.Fatal(err)
+	}
 
-func main() {
-	flag.Parse()
+	if err := checkSparseMode(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkIgnoreErrors(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkDecrypt(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkKeepRule(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkDedupe(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkBackup(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkSimilar(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkArchives(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkKnown(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkStats(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkBundles(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkSFTP(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkS3(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkDedupScan(); err != nil {
+		log.Fatal(err)
+	}
 
-	if len(flag.Args()) == 0 {
-		fmt.Printf("USAGE: sha1files DIR [DIR]...\n")
+	if err := checkPageSize(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkJournal(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkBatch(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkRewrites(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkMaxBytes(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkFilter(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkTypes(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkPatterns(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkQuery(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkServe(scanning); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkWatch(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkExportFormat(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkImportHash(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkDBPerRoot(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkBufSize(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkHashes(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkTrustETag(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := checkNoHash(); err != nil {
+		log.Fatal(err)
+	}
+
+	applyWorkers()
+
+	if rescanMissing && scanning {
+		log.Fatal("-rescan-only-missing-hashes reads the paths from the db and cannot be given DIRs or other sources")
+	}
+
+	if promoteMode && scanning {
+		log.Fatal("-promote reads the paths from the db and cannot be given DIRs or other sources")
+	}
+
+	if dedupeAction != "" && scanning {
+		log.Fatal("-dedupe acts on the duplicates in the db and cannot be given DIRs or other sources, scan them first")
+	}
+
+	if atomicSwap && isMemoryDB(dbPath) {
+		log.Fatal("-atomic cannot be used with an in-memory -db")
+	}
+
+	if fingerprintBytes > 0 && normalized {
+		log.Fatal("-fingerprint cannot be used with -normalized, which keys rows on the full hash")
+	}
+
+	if dbPerRoot != "" {
+		os.Exit(scanPerRoot(flag.Args()))
+	}
+
+	if printOnly {
+		if !printHashes(flag.Args()) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if validateDB != "" {
+		ok, err := validate(validateDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if mergeDBs {
+		if len(flag.Args()) < 2 {
+			log.Fatal("-merge-dbs needs an output and at least one input database")
+		}
+		if err := mergeDatabases(flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if diffDBs {
+		if len(flag.Args()) != 2 {
+			log.Fatal("-diff-dbs needs an old and a new database")
+		}
+		differ, err := diffDatabases(os.Stdout, flag.Arg(0), flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if differ {
+			os.Exit(1)
+		}
 		return
 	}
 
-	db, err := sql.Open("sqlite3", "./files.db")
+	if manifestPath != "" {
+		ok, err := verifyManifest(manifestPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	stopProfiling = startProfiling()
+	defer stopProfiling()
+
+	if d := serverDialect(dbPath); d != nil {
+		if err := checkServerOptions(d, scanning); err != nil {
+			log.Fatal(err)
+		}
+		if err := scanServer(dbPath, d); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	path := dbPath
+	if atomicSwap && scanning && !verifyMode {
+		tmp, err := prepareAtomic(dbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		path = tmp
+	}
+
+	db, err := openDB(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	sql := "CREATE TABLE IF NOT EXISTS files (extless TEXT, ext CHAR(3), sha1 CHAR(40), path TEXT)"
-	_, err = db.Exec(sql)
-	if err != nil {
-		log.Printf("%q: %s\n", err, sql)
+	if verifyMode {
+		ok, err := verify(db, resolveRoots(flag.Args()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			db.Close()
+			exit(1)
+		}
+		return
+	}
+
+	if importMode {
+		n, err := importManifests(db, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Imported %d files\n", n)
+		return
+	}
+
+	if loadKnown {
+		n, err := loadKnownLists(db, flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d known hashes\n", n)
+		return
+	}
+
+	if promoteMode {
+		n, err := promoteCollisions(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Promoted %d files to a full hash, %d files could not be read\n", n, fileErrors)
 		return
 	}
 
-	records := []*record{}
+	if dedupeAction != "" {
+		done, err := dedupe(os.Stdout, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reportDeduped(done)
+		return
+	}
 
-	visit := func(path string, info os.FileInfo, err error) error {
-		result, suberr := doVisit(path, info, err)
-		if suberr != nil {
-			return suberr
-		} else if result != nil {
-			records = append(records, result)
+	if rescanMissing {
+		n, err := rescanMissingHashes(db)
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Printf("Updated %d rows, %d files could not be read\n", n, fileErrors)
+		return
+	}
 
-		// Commit in batches of 100000
-		if len(records) == 100000 {
-			err := commitRecords(db, records)
+	if querying() {
+		ok, err := runQuery(os.Stdout, db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			db.Close()
+			exit(1)
+		}
+		return
+	}
+
+	if serveAddr != "" {
+		if err := serve(db, serveAddr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if !scanning {
+		if pruneMissing {
+			removed, err := pruneRows(db, pruneRoots(), 0)
 			if err != nil {
 				log.Fatal(err)
 			}
-			records = []*record{}
+			reportPruned(removed)
+		}
+
+		if reportTree {
+			if err := printTree(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if dupesMode {
+			if err := printDupes(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
 		}
 
-		return nil
+		if similarMode {
+			if err := printSimilar(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if checkCaseCollisions {
+			if err := printCaseCollisions(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if sameName {
+			if err := printSameName(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if diskUsage {
+			if err := printDiskUsage(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if statsMode {
+			if err := printStats(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if treeDigest {
+			digest, err := computeTreeDigest(db, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(digest)
+		}
+
+		if listRuns {
+			if err := printRuns(os.Stdout, db); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if exportPath != "" {
+			n, err := exportRows(db, exportPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Exported %d rows to %s\n", n, exportPath)
+		}
+		return
 	}
 
-	for _, dir := range flag.Args() {
-		abs, err := filepath.Abs(dir)
+	if err := prepareStore(sqliteStore{db}); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startRun(db, time.Now()); err != nil {
+		log.Fatal(err)
+	}
+
+	saveJobOptions()
+
+	jobs, err := loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Checkpoints may be in the remote sources too, scanned last
+	roots := []string{}
+	for _, job := range jobs {
+		roots = append(roots, job.roots...)
+	}
+	roots = append(roots, remoteRoots()...)
+
+	if resumeScan {
+		if err := loadCheckpoint(db, roots); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if incremental {
+		if err := loadKnownStats(db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := openKnown(db); err != nil {
+		log.Fatal(err)
+	}
+
+	prog := startProgress(jobs)
+
+	// The database is always written, other outputs are optional
+	sinks := &fanout{}
+	store := newBatcher(db)
+	sinks.add("database", store)
+
+	addOutputs(sinks)
+
+	runScan(jobs, prog, sinks)
+
+	// Commit any remaining records and close the other outputs
+	if err := sinks.Close(); store.full {
+		stopForDiskFull(db, path, store.records, roots)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	prog.stopStatus()
+	prog.report()
+
+	if err := touchUnchanged(db, time.Now().Unix()); err != nil {
+		log.Fatal(err)
+	}
+
+	if budgetSpent {
+		warnf("Stopped after -max-bytes %d at %s, run again with -resume to continue\n", maxBytes, lastQueued)
+	}
+	if err := saveCheckpoint(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := storeErrors(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := finishRun(db, prog.done); err != nil {
+		log.Fatal(err)
+	}
+
+	if isInterrupted() {
+		stopInterrupted(db, path)
+	}
+
+	if summaryJSON != "" {
+		if err := writeSummary(summaryJSON, dbPath, roots, prog); err != nil {
+			log.Fatal(err)
+		}
+	}
+	logSummary(dbPath, roots, prog)
+
+	if pruneMissing {
+		removed, err := pruneRows(db, roots, prog.start.Unix())
+		if err != nil {
+			log.Fatal(err)
+		}
+		reportPruned(removed)
+	}
+
+	if treeHash {
+		n, err := storeTreeHashes(db, roots)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Stored hashes for %d directories\n", n)
+	}
+
+	if reportTree {
+		if err := printTree(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if dupesMode {
+		if err := printDupes(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if similarMode {
+		if err := printSimilar(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if checkCaseCollisions {
+		if err := printCaseCollisions(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if sameName {
+		if err := printSameName(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if extStats {
+		printExtStats(os.Stdout, prog)
+	}
+
+	if traceSlowDirs > 0 {
+		printSlowDirs(os.Stdout, prog, traceSlowDirs)
+	}
+
+	if listEmptyDirs {
+		printEmptyDirs(os.Stdout)
+	}
+
+	if diskUsage {
+		if err := printDiskUsage(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if statsMode {
+		if err := printStats(os.Stdout, db); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if treeDigest {
+		digest, err := computeTreeDigest(db, roots)
 		if err != nil {
-			log.Printf("Error processing dir: %s\n", dir)
+			log.Fatal(err)
+		}
+		fmt.Println(digest)
+	}
+
+	if watchMode {
+		if err := watch(db, roots, prog); err != nil {
+			log.Fatal(err)
 		}
+	}
+
+	if path != dbPath {
+		// Only now that the run succeeded do readers see the new database
+		db.Close()
+		if err := os.Rename(path, dbPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if fileErrors > 0 {
+		reportErrors(currentRun)
+		db.Close()
+		exit(exitFileErrors)
+	}
+}
+
+// The scan jobs of the run: those of -config, then the DIRs.
+func loadJobs() ([]*scanJob, error) {
+	jobs := []*scanJob{}
+	if configPath != "" {
+		var err error
+		if jobs, err = loadConfig(configPath); err != nil {
+			return nil, err
+		}
+	}
+	if len(flag.Args()) > 0 {
+		jobs = append(jobs, &scanJob{roots: resolveRoots(flag.Args())})
+	}
+	return jobs, nil
+}
+
+// Start tracking the progress of the scan, first counting what the jobs will
+// hash with -estimate.
+func startProgress(jobs []*scanJob) *progress {
+	prog := &progress{}
+	if estimate {
+		for _, job := range jobs {
+			job.apply()
+			total := countFiles(job.roots)
+			prog.total.files += total.files
+			prog.total.bytes += total.bytes
+		}
+		restoreJobOptions()
+		infof("Found %d files (%s) to hash\n", prog.total.files, formatBytes(prog.total.bytes))
+	}
+	if showProgress && !estimate {
+		prog.counted = make(chan totals, len(jobs))
+	}
+	prog.start = time.Now()
+	prog.last = prog.start
+	return prog
+}
+
+// Add the optional outputs to the sinks besides the database. A resumed
+// scan appends to the files written by the runs before it.
+func addOutputs(sinks *fanout) {
+	resuming := resumeFrom != nil
+	if outPath != "" {
+		out, err := createManifest(outPath, resuming)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks.add(outPath, out)
+	}
 
-		filepath.Walk(abs, visit)
+	if alsoJSON != "" {
+		out, err := createJSONSink(alsoJSON, resuming)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks.add(alsoJSON, out)
 	}
 
-	// Commit any remaining records
-	if len(records) > 0 {
-		err := commitRecords(db, records)
+	if kafkaBrokers != "" {
+		out, err := newKafkaSink(kafkaBrokers, kafkaTopic)
 		if err != nil {
 			log.Fatal(err)
 		}
+		sinks.add("kafka", out)
+	}
+
+	if topN > 0 {
+		sinks.add("top", newTopSink(topN))
+	}
+}
+
+// Scan the jobs and then the remote sources, writing every record to the
+// sinks, until done, interrupted or out of budget or disk space.
+func runScan(jobs []*scanJob, prog *progress, sinks *fanout) {
+	var dash *dashboard
+	if tuiMode && isTerminal(os.Stderr) {
+		dash = newDashboard(os.Stderr)
+		dash.run()
+		defer dash.restore()
+	} else if tuiMode {
+		warnf("Not a terminal, logging progress instead of -tui\n")
+	}
+
+	if showProgress && dash == nil {
+		prog.startStatus()
+	}
+
+	catchInterrupts()
+
+	results := make(chan *record, resultsBuffer)
+	go func() {
+		// The options were checked by loadConfig
+		for _, job := range jobs {
+			if budgetSpent || diskIsFull() || isInterrupted() {
+				break
+			}
+			job.apply()
+			wait := func() {}
+			if prog.counted != nil {
+				wait = prog.countAlong(job.roots)
+			}
+			scan(job.roots, results)
+			wait()
+		}
+		restoreJobOptions()
+
+		if !budgetSpent && !diskIsFull() && !isInterrupted() {
+			scanRemotes(results)
+		}
+		close(results)
+	}()
+
+	// Ticks on the same goroutine as the writes, so a timed commit never
+	// runs at the same time as one triggered by a full batch
+	var ticks <-chan time.Time
+	if commitEvery > 0 {
+		ticker := time.NewTicker(commitTickInterval())
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+loop:
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				break loop
+			}
+
+			if !filterKnown(result) {
+				continue
+			}
+			prog.add(result)
+			if hashNames {
+				result.hideName()
+			}
+			logHashed(result)
+			sinks.write(result)
+			if dash != nil {
+				dash.add(result)
+			}
+		case now := <-ticks:
+			sinks.tick(now)
+		}
+	}
+
+	if dash != nil {
+		dash.Close()
 	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Run as sha1files rather than the tests when re-executed by runMain. The
+// runs sha1files starts itself, see -db-per-root, get their arguments on the
+// command line instead.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("SHA1FILES_ARGS"); ok {
+		if len(os.Args) == 1 {
+			os.Args = append(os.Args, strings.Split(args, "\n")...)
+		}
+		os.Args[0] = "sha1files"
+		main()
+		exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Run sha1files with args in a process of its own, returning its output and
+// an error if it exited with a non-zero status.
+func runMain(t *testing.T, args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "SHA1FILES_ARGS="+strings.Join(args, "\n"))
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestOverlappingRoots(t *testing.T) {
+	defer func(saved bool) { allowOverlap = saved }(allowOverlap)
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.txt":      "a",
+		"sub/b.txt":  "b",
+		"sub2/c.txt": "c",
+	})
+	dirs := []string{filepath.Join(root, "sub"), root, filepath.Join(root, "sub2"), root}
+
+	tests := []struct {
+		allowOverlap bool
+		want         map[string]int
+	}{
+		{false, map[string]int{"a.txt": 1, "sub/b.txt": 1, "sub2/c.txt": 1}},
+		{true, map[string]int{"a.txt": 2, "sub/b.txt": 3, "sub2/c.txt": 3}},
+	}
+
+	for _, tt := range tests {
+		allowOverlap = tt.allowOverlap
+
+		out := make(chan *record)
+		go func() {
+			scan(resolveRoots(dirs), out)
+			close(out)
+		}()
+
+		got := map[string]int{}
+		for r := range out {
+			rel, err := filepath.Rel(root, r.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[filepath.ToSlash(rel)]++
+		}
+		for path, n := range tt.want {
+			if got[path] != n {
+				t.Errorf("-allow-overlap=%t: %s indexed %d times, want %d", tt.allowOverlap, path, got[path], n)
+			}
+		}
+	}
+}
+
+func TestDedupeRoots(t *testing.T) {
+	roots := []string{}
+	for _, root := range []string{"/data/sub", "/data10", "/data", "/data/sub/deep", "/other", "/data"} {
+		roots = append(roots, filepath.FromSlash(root))
+	}
+	got := dedupeRoots(roots)
+	sort.Strings(got)
+
+	want := []string{}
+	for _, root := range []string{"/data", "/data10", "/other"} {
+		want = append(want, filepath.FromSlash(root))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestPrintHashes(t *testing.T) {
+	defer func(requested, extra []string) { requestedHashes, extraHashes = requested, extra }(requestedHashes, extraHashes)
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"abc.txt": "abc"})
+	path := filepath.Join(dir, "abc.txt")
+	missing := filepath.Join(dir, "missing.txt")
+
+	const (
+		sha1Sum   = "a9993e364706816aba3e25717850c26c9cd0d89d"
+		sha256Sum = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	)
+	tests := []struct {
+		requested []string
+		paths     []string
+		ok        bool
+		want      string
+	}{
+		{[]string{"sha1"}, []string{path}, true, sha1Sum + "  " + path + "\n"},
+		{[]string{"sha1", "sha256"}, []string{path}, true, "SHA1 (" + path + ") = " + sha1Sum + "\nSHA256 (" + path + ") = " + sha256Sum + "\n"},
+		{[]string{"sha1"}, []string{missing, path}, false, sha1Sum + "  " + path + "\n"},
+	}
+
+	for _, tt := range tests {
+		requestedHashes, extraHashes = tt.requested, tt.requested[1:]
+
+		var ok bool
+		printed := captureStdout(t, func() { ok = printHashes(tt.paths) })
+		if ok != tt.ok || printed != tt.want {
+			t.Errorf("-hash %v: printed %q and returned %t, want %q and %t", tt.requested, printed, ok, tt.want, tt.ok)
+		}
+	}
+}
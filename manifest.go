@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	// File to write a sha1sum-format manifest to, gzip-compressed if it ends
+	// in .gz.
+	outPath string
+
+	// End text output lines with NUL instead of newline.
+	print0 bool
+)
+
+func init() {
+	flag.StringVar(&outPath, "out", "", "also write a sha1sum-format manifest to `FILE` (gzip-compressed if FILE ends in .gz)")
+	flag.BoolVar(&print0, "print0", false, "end each record of -print, -out, -also-json, -lookup, -dupes and -verify output with NUL instead of newline, for xargs -0")
+}
+
+// The terminator of each record in text output.
+func lineEnd() string {
+	if print0 {
+		return "\x00"
+	}
+	return "\n"
+}
+
+// A buffered output file, gzip-compressed if its name ends in .gz.
+type outputFile struct {
+	*bufio.Writer
+	file *os.File
+	gz   *gzip.Writer
+}
+
+// Create the output file at path, truncating any existing file unless
+// appending to it, as a resumed scan does. Appending to a .gz file adds a
+// gzip member, which gzip readers take as the rest of the same stream.
+func createOutput(path string, appending bool) (*outputFile, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &outputFile{file: f}
+
+	var w io.Writer = f
+	if strings.HasSuffix(path, ".gz") {
+		out.gz = gzip.NewWriter(f)
+		w = out.gz
+	}
+	out.Writer = bufio.NewWriter(w)
+
+	return out, nil
+}
+
+// Flush buffered data, finish the gzip stream and close the file. The output
+// is truncated or unreadable unless Close is called.
+func (out *outputFile) Close() error {
+	err := out.Flush()
+
+	if out.gz != nil {
+		if gzErr := out.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+
+	if closeErr := out.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// A manifest file listing the hash and path of every file scanned.
+type manifest struct {
+	*outputFile
+}
+
+// Create the manifest at path, or append to it.
+func createManifest(path string, appending bool) (*manifest, error) {
+	out, err := createOutput(path, appending)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest{out}, nil
+}
+
+// Append a record to the manifest. Records without a full hash (see
+// -fingerprint) are left out.
+func (m *manifest) write(r *record) error {
+	if r.sha1 == "" {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(m, "%s%s", sha1sumLine(r.sha1, r.path), lineEnd())
+	return err
+}
+
+// Format a line of a sha1sum manifest, without its terminator. As sha1sum
+// does, a path containing a backslash or newline is escaped and the line
+// starts with a backslash, unless lines end in NUL (see -print0).
+func sha1sumLine(hash, path string) string {
+	if print0 || !strings.ContainsAny(path, "\\\n") {
+		return hash + "  " + path
+	}
+	return "\\" + hash + "  " + strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(path)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write one record to the manifest at path.
+func writeManifest(t *testing.T, path string, appending bool, r *record) {
+	m, err := createManifest(path, appending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.write(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The contents of an output file, uncompressed.
+func readOutput(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestManifestResume(t *testing.T) {
+	first := &record{path: "/a", sha1: hashBytes([]byte("a"))}
+	second := &record{path: "/b", sha1: hashBytes([]byte("b"))}
+	firstLine := first.sha1 + "  /a\n"
+	secondLine := second.sha1 + "  /b\n"
+
+	for _, name := range []string{"files.sha1", "files.sha1.gz"} {
+		path := filepath.Join(t.TempDir(), name)
+
+		writeManifest(t, path, false, first)
+		writeManifest(t, path, true, second)
+		if got, want := readOutput(t, path), firstLine+secondLine; got != want {
+			t.Errorf("%s: resumed manifest is %q, want %q", name, got, want)
+		}
+
+		// A run that isn't resumed starts over
+		writeManifest(t, path, false, second)
+		if got := readOutput(t, path); got != secondLine {
+			t.Errorf("%s: new manifest is %q, want %q", name, got, secondLine)
+		}
+	}
+}
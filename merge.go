@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// Merge the databases given as arguments instead of scanning.
+	mergeDBs bool
+
+	// Prefix the paths of merged rows with the name of their database.
+	mergePrefix bool
+
+	// Prefix the paths of merged rows with the host that scanned them.
+	mergeHost bool
+)
+
+func init() {
+	flag.BoolVar(&mergeDBs, "merge-dbs", false, "merge the rows of the databases IN... into OUT instead of scanning: -merge-dbs OUT IN...")
+	flag.BoolVar(&mergePrefix, "merge-prefix", false, "with -merge-dbs, prefix merged paths with the name of their database, e.g. laptop:/home/...")
+	flag.BoolVar(&mergeHost, "merge-host", false, "with -merge-dbs, prefix merged paths with the host that last scanned into their database, as recorded in its runs table")
+}
+
+// Merge the rows of each input database into the output database, creating it
+// if needed. Inputs may use either schema and the output uses the one chosen
+// by -normalized. When a path is in several databases the row seen by the
+// most recent scan wins, that of the last database on a tie.
+func mergeDatabases(out string, inputs []string) error {
+	db, err := openDB(out)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Attached databases are per connection
+	db.SetMaxOpenConns(1)
+
+	for _, in := range inputs {
+		n, err := mergeDB(db, in)
+		if err != nil {
+			return fmt.Errorf("%s: %s", in, err)
+		}
+		log.Printf("Merged %d rows from %s\n", n, in)
+	}
+
+	return nil
+}
+
+// Name used to prefix the paths from a database with -merge-prefix: its file
+// name without the extension.
+func mergeName(path string) string {
+	name := filepath.Base(path)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// Name used to prefix the paths from the attached database with
+// -merge-host: the host of its latest run with one recorded, by default its
+// file name as with -merge-prefix.
+func mergeHostName(db *sql.DB, in string) (string, error) {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM src.sqlite_master WHERE type = 'table' AND name = 'runs'").Scan(&tables); err != nil {
+		return "", err
+	}
+
+	var host string
+	if tables > 0 {
+		err := db.QueryRow("SELECT host FROM src.runs WHERE host IS NOT NULL AND host != '' ORDER BY id DESC LIMIT 1").Scan(&host)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+	if host == "" {
+		host = mergeName(in)
+		warnf("No host recorded in %s, prefixing its paths with %s\n", in, host)
+	}
+	return host, nil
+}
+
+// Merge the rows of a single database into db and return how many were
+// inserted or updated.
+func mergeDB(db *sql.DB, in string) (int64, error) {
+	// ATTACH would create a missing database
+	if _, err := os.Stat(in); err != nil {
+		return 0, err
+	}
+
+	if _, err := db.Exec("ATTACH DATABASE ? AS src", in); err != nil {
+		return 0, err
+	}
+	defer db.Exec("DETACH DATABASE src")
+
+	if err := checkMergeAlgorithm(db); err != nil {
+		return 0, err
+	}
+
+	columns, err := schemaColumns(db, "src", "files")
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("no files table")
+	}
+
+	from, hash := "src.files", "src.files.sha1"
+	if columns["hash_id"] {
+		from = "src.files LEFT JOIN src.hashes ON src.files.hash_id = src.hashes.id"
+		hash = "src.hashes.sha1"
+	}
+
+	prefix := ""
+	if mergeHost {
+		host, err := mergeHostName(db, in)
+		if err != nil {
+			return 0, err
+		}
+		prefix = host + ":"
+	} else if mergePrefix {
+		prefix = mergeName(in) + ":"
+	}
+
+	// Columns the input predates are left NULL
+	names, exprs := []string{}, []string{}
+	for _, c := range fileColumns {
+		names = append(names, c.name)
+		switch {
+		case c.name == "path":
+			exprs = append(exprs, "? || src.files.path")
+		case c.name == "run_id":
+			// Runs are numbered per database
+			exprs = append(exprs, "NULL")
+		case c.name == "hash_prefix":
+			exprs = append(exprs, fmt.Sprintf("substr(%s, 1, %d)", hash, hashPrefixLen))
+		case columns[c.name]:
+			exprs = append(exprs, "src.files."+c.name)
+		default:
+			exprs = append(exprs, "NULL")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	names = append(names, hashColumn().name)
+	if normalized {
+		stmt := fmt.Sprintf("INSERT OR IGNORE INTO main.hashes (sha1, size) SELECT %s, src.files.size FROM %s WHERE %s IS NOT NULL", hash, from, hash)
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		hash = fmt.Sprintf("(SELECT id FROM main.hashes WHERE main.hashes.sha1 = %s AND main.hashes.size = src.files.size)", hash)
+	}
+	exprs = append(exprs, hash)
+
+	// The first WHERE keeps SQLite from parsing ON CONFLICT as part of a
+	// join, the second keeps the row of the newer scan. Rows of databases
+	// from before last_seen count as the oldest.
+	stmt := fmt.Sprintf("INSERT INTO main.files (%s) SELECT %s FROM %s WHERE true %s WHERE COALESCE(excluded.last_seen, 0) >= COALESCE(files.last_seen, 0)",
+		strings.Join(names, ", "), strings.Join(exprs, ", "), from, upsertClause())
+	res, err := tx.Exec(stmt, prefix)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	n, _ := res.RowsAffected()
+	return n, tx.Commit()
+}
+
+// Make sure an attached input was built with the same algorithm as the output
+// database, unless -override is given. An output without a recorded algorithm
+// takes that of its first input.
+func checkMergeAlgorithm(db *sql.DB) error {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM src.sqlite_master WHERE type = 'table' AND name = 'metadata'").Scan(&tables); err != nil {
+		return err
+	}
+
+	// Databases from before the metadata table were always built with sha1
+	theirs := "sha1"
+	if tables > 0 {
+		err := db.QueryRow("SELECT value FROM src.metadata WHERE key = 'algorithm'").Scan(&theirs)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	ours, ok, err := getMeta(db, "algorithm")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return setMeta(db, "algorithm", theirs)
+	}
+
+	if ours != theirs && !overrideAlgorithm {
+		return fmt.Errorf("built with %s but the output uses %s (use -override to merge anyway)", theirs, ours)
+	}
+	return nil
+}
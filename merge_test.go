@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeDatabases(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+	defer func(saved bool) { mergePrefix = saved }(mergePrefix)
+
+	const (
+		older = "0000000000000000000000000000000000000001"
+		newer = "0000000000000000000000000000000000000002"
+		sum   = "0000000000000000000000000000000000000003"
+	)
+
+	dir := t.TempDir()
+	write := func(name string, records ...*record) string {
+		path := filepath.Join(dir, name)
+		db, err := openDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := insertRecords(db, records); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	normalized = false
+	laptop := write("laptop.db",
+		&record{path: "/shared", sha1: older, size: 1, seen: 100},
+		&record{path: "/only-laptop", sha1: sum, size: 1, seen: 100},
+	)
+	desktop := write("desktop.db",
+		&record{path: "/shared", sha1: newer, size: 1, seen: 200},
+		&record{path: "/only-desktop", sha1: sum, size: 1, seen: 50},
+	)
+
+	tests := []struct {
+		normalized, prefix bool
+		inputs             []string
+		want               map[string]string
+	}{
+		// The newer scan of /shared wins whichever database comes last
+		{false, false, []string{laptop, desktop}, map[string]string{"/shared": newer, "/only-laptop": sum, "/only-desktop": sum}},
+		{false, false, []string{desktop, laptop}, map[string]string{"/shared": newer, "/only-laptop": sum, "/only-desktop": sum}},
+		{true, false, []string{desktop, laptop}, map[string]string{"/shared": newer, "/only-laptop": sum, "/only-desktop": sum}},
+		{false, true, []string{laptop, desktop}, map[string]string{
+			"laptop:/shared": older, "laptop:/only-laptop": sum, "desktop:/shared": newer, "desktop:/only-desktop": sum}},
+	}
+
+	for i, tt := range tests {
+		normalized, mergePrefix = tt.normalized, tt.prefix
+		out := filepath.Join(dir, fmt.Sprintf("merged%d.db", i))
+		if err := mergeDatabases(out, tt.inputs); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("sqlite3", out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		rows, err := db.Query("SELECT path FROM files")
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := []string{}
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+		rows.Close()
+		for _, path := range paths {
+			got[path] = storedSha1(t, db, path)
+		}
+		db.Close()
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("merging %v with -normalized=%t -merge-prefix=%t gave %v, want %v",
+				tt.inputs, tt.normalized, tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+)
+
+// Scan into a database recorded with a different algorithm anyway.
+var overrideAlgorithm bool
+
+func init() {
+	flag.BoolVar(&overrideAlgorithm, "override", false, "scan even if the db was built with a different hash algorithm")
+}
+
+// Read a value from the metadata table. The boolean is false if the key is
+// not set.
+func getMeta(db *sql.DB, key string) (string, bool, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM metadata WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+// Store a value in the metadata table.
+func setMeta(db *sql.DB, key, value string) error {
+	_, err := db.Exec("INSERT INTO metadata (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
+
+// Name of the algorithm the scan hashes files with.
+func scanAlgorithm() string {
+	if fingerprintBytes > 0 {
+		return "fingerprint"
+	}
+	return "sha1"
+}
+
+// Make sure the scan uses the algorithm the database was built with, since
+// comparing hashes from different algorithms is meaningless. A new database
+// records the algorithm of its first scan. With -override the scan goes ahead
+// and the database is marked with the new algorithm.
+func checkAlgorithm(store Store) error {
+	want := scanAlgorithm()
+
+	recorded, ok, err := store.Meta("algorithm")
+	if err != nil {
+		return err
+	}
+
+	if ok && recorded != want {
+		if !overrideAlgorithm {
+			return fmt.Errorf("database was built with %s, refusing to scan with %s (use -override to force)", recorded, want)
+		}
+		warnf("Database was built with %s, scanning with %s anyway\n", recorded, want)
+	}
+
+	if !ok || recorded != want {
+		return store.SetMeta("algorithm", want)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestCheckAlgorithm(t *testing.T) {
+	defer func(saved int64) { fingerprintBytes = saved }(fingerprintBytes)
+	defer func(saved bool) { overrideAlgorithm = saved }(overrideAlgorithm)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	tests := []struct {
+		name     string
+		first    int64
+		second   int64
+		override bool
+
+		fails    bool
+		recorded string
+	}{
+		{"same", 0, 0, false, false, "sha1"},
+		{"mismatch", 0, 8, false, true, "sha1"},
+		{"override", 0, 8, true, false, "fingerprint"},
+		{"back to sha1", 8, 0, false, true, "fingerprint"},
+	}
+
+	for _, tt := range tests {
+		store := sqliteStore{testDB(t)}
+
+		fingerprintBytes, overrideAlgorithm = tt.first, false
+		if err := checkAlgorithm(store); err != nil {
+			t.Fatal(err)
+		}
+
+		fingerprintBytes, overrideAlgorithm = tt.second, tt.override
+		if err := checkAlgorithm(store); (err != nil) != tt.fails {
+			t.Errorf("%s: second scan got %v, want error %t", tt.name, err, tt.fails)
+		}
+
+		recorded, _, err := store.Meta("algorithm")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recorded != tt.recorded {
+			t.Errorf("%s: recorded %q, want %q", tt.name, recorded, tt.recorded)
+		}
+	}
+}
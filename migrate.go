@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// Refuse to open databases that would need upgrading.
+var noMigrate bool
+
+func init() {
+	flag.BoolVar(&noMigrate, "no-migrate", false, "refuse to upgrade a db created by an older version instead of migrating it in place, e.g. for a db shared with other hosts")
+}
+
+// Version of the schema the migrations below bring a database up to, stored
+// in the schema_version table. Databases from before the table are version 0.
+const schemaVersion = 6
+
+// It takes one row, the version of the schema a database is at.
+const schemaVersionTable = "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"
+
+// A step upgrading databases to the next schema version. Steps must be safe
+// to run on a database that already has some of their changes, since
+// databases from before versioning are at version 0 whatever they contain.
+type migration struct {
+	version int
+	summary string
+	apply   func(db *sql.DB) error
+}
+
+// Every migration in version order. Changing the schema (e.g. adding a file
+// column) means adding a migration at the next version. New databases run
+// them all too, once their tables are created.
+var migrations = []migration{
+	{1, "add the missing files columns, index hash prefixes and paths", func(db *sql.DB) error {
+		existing, err := tableColumns(db, "files")
+		if err != nil {
+			return err
+		}
+		if err := addMissingColumns(db); err != nil {
+			return err
+		}
+		if err := ensureHashPrefix(db, !existing["hash_prefix"]); err != nil {
+			return err
+		}
+		if err := ensurePathIndex(db); err != nil {
+			return err
+		}
+		if normalized {
+			return migrateHashesKey(db)
+		}
+		return nil
+	}},
+	{2, "add the run_id column for the runs table", addMissingColumns},
+	{3, "add the via_link column for -follow-symlinks", addMissingColumns},
+	{4, "add the link_of column for hard links hashed once", addMissingColumns},
+	{5, "add the archive column for -archives and index it", func(db *sql.DB) error {
+		if err := addMissingColumns(db); err != nil {
+			return err
+		}
+		_, err := db.Exec("CREATE INDEX IF NOT EXISTS files_archive ON files (archive)")
+		return err
+	}},
+	{6, "add the known column for -known", addMissingColumns},
+}
+
+// Add the columns of fileColumns that the files table lacks.
+func addMissingColumns(db *sql.DB) error {
+	existing, err := tableColumns(db, "files")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range fileColumns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE files ADD COLUMN %s %s", c.name, c.decl)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the schema version of a database, 0 if it predates the
+// schema_version table.
+func readSchemaVersion(db *sql.DB) (int, error) {
+	columns, err := tableColumns(db, "schema_version")
+	if err != nil || len(columns) == 0 {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// Store the schema version of a database.
+func storeSchemaVersion(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Check, before anything is created, that a database at version may be
+// upgraded: with -no-migrate only new databases and those already at the
+// current version are opened.
+func checkMigrate(path string, version int, existed bool) error {
+	if !noMigrate || !existed || version >= schemaVersion {
+		return nil
+	}
+	return fmt.Errorf("%s is at schema version %d, this sha1files needs version %d: run without -no-migrate to upgrade it", path, version, schemaVersion)
+}
+
+// Run the migrations a database at version is missing, recording the new
+// version after each one so an interrupted upgrade resumes where it stopped.
+// Upgrades of databases that already had files are logged.
+func migrate(db *sql.DB, path string, version int, existed bool) error {
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if existed {
+			log.Printf("Upgrading %s to schema version %d: %s\n", path, m.version, m.summary)
+		}
+		if err := m.apply(db); err != nil {
+			return fmt.Errorf("upgrading %s to schema version %d: %s", path, m.version, err)
+		}
+		if err := storeSchemaVersion(db, m.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	// Only record files whose sniffed content type matches one of these.
+	includeMimes stringList
+
+	// Skip files whose sniffed content type matches one of these.
+	excludeMimes stringList
+)
+
+func init() {
+	flag.Var(&includeMimes, "include-mime", "only record files whose content sniffs as this type, e.g. image/* (repeatable)")
+	flag.Var(&excludeMimes, "exclude-mime", "skip files whose content sniffs as this type, e.g. video/* (repeatable)")
+}
+
+// Sniff the content type of a file from the start of its contents, as
+// net/http does with the first 512 bytes.
+func sniffMime(data []byte) string {
+	return http.DetectContentType(data)
+}
+
+// Check whether a content type matches one of the patterns, which may use
+// path.Match wildcards. Parameters such as the charset are ignored.
+func matchMime(mime string, patterns []string) bool {
+	mime = strings.TrimSpace(strings.SplitN(mime, ";", 2)[0])
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mime); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a sniffed content type against -include-mime and -exclude-mime.
+func wantMime(mime string) bool {
+	if len(includeMimes) > 0 && !matchMime(mime, includeMimes) {
+		return false
+	}
+	return !matchMime(mime, excludeMimes)
+}
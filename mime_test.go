@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMimeFilters(t *testing.T) {
+	defer func(include, exclude stringList) { includeMimes, excludeMimes = include, exclude }(includeMimes, excludeMimes)
+	defer func(saved bool) { fuzzyHashes = saved }(fuzzyHashes)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		// An MP4 whatever its name says
+		"holiday.txt": "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom" + strings.Repeat("\x00", 100),
+		"movie.mp4":   "not really a movie",
+		"notes.txt":   "plain text",
+	})
+
+	tests := []struct {
+		include, exclude stringList
+		want             []string
+	}{
+		{nil, stringList{"video/*"}, []string{"movie.mp4", "notes.txt"}},
+		{stringList{"video/mp4"}, nil, []string{"holiday.txt"}},
+		{stringList{"text/*"}, stringList{"video/*"}, []string{"movie.mp4", "notes.txt"}},
+	}
+
+	// Both files hashed as they are read and read whole
+	for _, fuzzyHashes = range []bool{false, true} {
+		for _, tt := range tests {
+			includeMimes, excludeMimes = tt.include, tt.exclude
+
+			if got := scanPaths(t, root); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("-fuzzy=%t -include-mime %v -exclude-mime %v: scanned %v, want %v", fuzzyHashes, tt.include, tt.exclude, got, tt.want)
+			}
+		}
+	}
+}
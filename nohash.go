@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// Record files from their stat alone, without reading them.
+var noHash bool
+
+func init() {
+	flag.BoolVar(&noHash, "no-hash", false, "record each file's metadata without reading it, leaving its hash NULL for -rescan-only-missing-hashes to fill in")
+}
+
+// Check that -no-hash isn't given with options that need the contents of
+// the files.
+func checkNoHash() error {
+	if !noHash {
+		return nil
+	}
+
+	needContents := []struct {
+		name  string
+		given bool
+	}{
+		{"-archives", archives},
+		{"-backup-to", backupTo != ""},
+		{"-bundle-ext", len(bundleExts) > 0},
+		{"-decrypt", decryptCmd != ""},
+		{"-dedup-scan", dedupScan},
+		{"-exclude-mime", len(excludeMimes) > 0},
+		{"-fingerprint", fingerprintBytes > 0},
+		{"-fuzzy", fuzzyHashes},
+		{"-hash", len(extraHashes) > 0},
+		{"-include-mime", len(includeMimes) > 0},
+		{"-known", knownAction != ""},
+	}
+	for _, option := range needContents {
+		if option.given {
+			return fmt.Errorf("-no-hash cannot be used with %s, which reads the files", option.name)
+		}
+	}
+	return nil
+}
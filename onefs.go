@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// Don't descend into directories on another filesystem than their root.
+var oneFilesystem bool
+
+func init() {
+	flag.BoolVar(&oneFilesystem, "one-filesystem", false, "don't descend into directories on a different filesystem than the DIR they were found under, like find -xdev")
+}
+
+// Check whether a directory found under root is on another filesystem and
+// should be skipped with -one-filesystem. The root itself is never skipped.
+func otherFilesystem(path string, root, info os.FileInfo) bool {
+	if !oneFilesystem || root == nil || !info.IsDir() || sameDevice(root, info) {
+		return false
+	}
+
+	infof("Not crossing into other filesystem: %s\n", path)
+	return true
+}
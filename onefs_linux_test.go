@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestOneFilesystem(t *testing.T) {
+	defer func(saved bool) { oneFilesystem = saved }(oneFilesystem)
+	defer func(saved bool) { quiet = saved }(quiet)
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(ioutil.Discard)
+	quiet = true
+
+	// A tmpfs mounted under the root is on another device, as a network
+	// share mounted under / would be
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"})
+	mnt := filepath.Join(root, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount a tmpfs: %s", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	writeTree(t, mnt, map[string]string{"c.txt": "gamma", "d/e.txt": "epsilon"})
+
+	tests := []struct {
+		oneFilesystem bool
+		root          string
+		want          []string
+	}{
+		{false, root, []string{"a.txt", "mnt/c.txt", "mnt/d/e.txt", "sub/b.txt"}},
+		{true, root, []string{"a.txt", "sub/b.txt"}},
+		// The mount point is scanned when given as a root
+		{true, mnt, []string{"c.txt", "d/e.txt"}},
+	}
+
+	for _, tt := range tests {
+		oneFilesystem = tt.oneFilesystem
+		if got := scanPaths(t, tt.root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-one-filesystem=%t under %s scanned %v, want %v", tt.oneFilesystem, tt.root, got, tt.want)
+		}
+		if got := countFiles([]string{tt.root}); got.files != int64(len(tt.want)) {
+			t.Errorf("-one-filesystem=%t under %s counted %d files, want %d", tt.oneFilesystem, tt.root, got.files, len(tt.want))
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Permission bits of a file as in chmod, including setuid, setgid and
+// sticky, and the user and group owning it. ok is false if the owner is
+// unknown.
+func fileOwner(info os.FileInfo) (mode, uid, gid int64, ok bool) {
+	if st, isStat := info.Sys().(*syscall.Stat_t); isStat {
+		return int64(st.Mode & 07777), int64(st.Uid), int64(st.Gid), true
+	}
+	return int64(info.Mode().Perm()), 0, 0, false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	// Store paths under the home directory as ~/... so an index can be shared
+	// between users.
+	homeRelative bool
+
+	// Clean stored paths and fold their case where filesystems ignore it.
+	canonicalPath bool
+
+	// Prefixes of scanned paths replaced in stored paths, as FROM=TO.
+	rewriteFlags stringList
+	rewrites     []pathRewrite
+)
+
+func init() {
+	flag.BoolVar(&homeRelative, "home-relative", false, "store paths under the home directory relative to ~")
+	flag.BoolVar(&canonicalPath, "canonical-path", false, "clean stored paths, and lowercase them on Windows and macOS")
+	flag.Var(&rewriteFlags, "rewrite", "store paths under the `FROM=TO` prefix FROM as under TO instead, e.g. /mnt/snapshot=/ (repeatable)")
+}
+
+// A prefix replaced in stored paths, see -rewrite.
+type pathRewrite struct {
+	from, to string
+}
+
+// Parse the -rewrite flags.
+func checkRewrites() error {
+	for _, arg := range rewriteFlags {
+		i := strings.Index(arg, "=")
+		if i <= 0 || i == len(arg)-1 {
+			return fmt.Errorf("invalid -rewrite %q, want FROM=TO", arg)
+		}
+		rewrites = append(rewrites, pathRewrite{from: filepath.Clean(arg[:i]), to: filepath.Clean(arg[i+1:])})
+	}
+	return nil
+}
+
+// Replace the prefix from of path by to. Prefixes only match whole path
+// elements, so /mnt/snap doesn't match /mnt/snapshot.
+func replacePrefix(path, from, to string) (string, bool) {
+	if path == from {
+		return to, true
+	}
+
+	prefix := strings.TrimSuffix(from, string(filepath.Separator)) + string(filepath.Separator)
+	if !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+	return filepath.Join(to, path[len(prefix):]), true
+}
+
+// Whether the platform's usual filesystems ignore case: NTFS on Windows and
+// APFS/HFS+ on macOS unless formatted case-sensitive.
+func caseInsensitiveFS() bool {
+	return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+}
+
+// Convert the path of a scanned file to the form stored in the database.
+func storedPath(path string) string {
+	// The first -rewrite that matches applies
+	for _, r := range rewrites {
+		if rewritten, ok := replacePrefix(path, r.from, r.to); ok {
+			path = rewritten
+			break
+		}
+	}
+
+	if homeRelative {
+		if home, err := os.UserHomeDir(); err == nil {
+			if rel, err := filepath.Rel(home, path); err == nil && rel == "." {
+				path = "~"
+			} else if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				path = "~" + string(filepath.Separator) + rel
+			}
+		}
+	}
+
+	if canonicalPath {
+		path = filepath.Clean(path)
+		if caseInsensitiveFS() {
+			path = strings.ToLower(path)
+		}
+	}
+
+	return path
+}
+
+// Convert a path stored in the database back to one that can be opened,
+// expanding a leading ~ to the current user's home directory and undoing
+// -rewrite.
+func localPath(stored string) string {
+	if stored == "~" || strings.HasPrefix(stored, "~"+string(filepath.Separator)) {
+		if home, err := os.UserHomeDir(); err == nil {
+			stored = filepath.Join(home, stored[1:])
+		}
+	}
+
+	for _, r := range rewrites {
+		if local, ok := replacePrefix(stored, r.to, r.from); ok {
+			return local
+		}
+	}
+
+	return stored
+}
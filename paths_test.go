@@ -0,0 +1,171 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHomeRelative(t *testing.T) {
+	defer func(saved bool) { homeRelative = saved }(homeRelative)
+	homeRelative = true
+
+	home := filepath.Join(t.TempDir(), "me")
+	t.Setenv("HOME", home)
+	writeTree(t, home, map[string]string{"docs/a.txt": "a"})
+	writeTree(t, home+"2", map[string]string{"b.txt": "b"})
+
+	tests := []struct {
+		path, stored string
+	}{
+		{filepath.Join(home, "docs", "a.txt"), filepath.Join("~", "docs", "a.txt")},
+		{home, "~"},
+		// Beside the home directory, not under it
+		{filepath.Join(home+"2", "b.txt"), filepath.Join(home+"2", "b.txt")},
+	}
+
+	for _, tt := range tests {
+		stored := storedPath(tt.path)
+		if stored != tt.stored {
+			t.Errorf("storedPath(%q) = %q, want %q", tt.path, stored, tt.stored)
+		}
+		if local := localPath(stored); local != tt.path {
+			t.Errorf("localPath(%q) = %q, want %q", stored, local, tt.path)
+		}
+	}
+
+	// Another user's home expands to theirs when verifying
+	out := make(chan *record)
+	go func() {
+		scan([]string{home}, out)
+		close(out)
+	}()
+	records := []*record{}
+	for r := range out {
+		records = append(records, r)
+	}
+	if len(records) != 1 || records[0].path != filepath.Join("~", "docs", "a.txt") {
+		t.Fatalf("scanned %d files, want docs/a.txt stored under ~", len(records))
+	}
+	db := testDB(t, records...)
+
+	other := filepath.Join(t.TempDir(), "you")
+	t.Setenv("HOME", other)
+	writeTree(t, other, map[string]string{"docs/a.txt": "a"})
+
+	var ok bool
+	var err error
+	printed := captureStdout(t, func() { ok, err = verify(db, nil) })
+	if err != nil || !ok || !strings.Contains(printed, ": OK") {
+		t.Errorf("verifying under another home printed %q, %t, %v", printed, ok, err)
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	defer func(saved bool) { canonicalPath = saved }(canonicalPath)
+	canonicalPath = true
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"Photos/A.jpg": "a", "Photos/2019/B.jpg": "b"})
+	sep := string(filepath.Separator)
+
+	want := []string{filepath.Join(dir, "Photos", "2019", "B.jpg"), filepath.Join(dir, "Photos", "A.jpg")}
+	if caseInsensitiveFS() {
+		for i := range want {
+			want[i] = strings.ToLower(want[i])
+		}
+	}
+
+	for _, tt := range []struct {
+		root string
+		want []string
+	}{
+		{dir + sep + "." + sep + "Photos" + sep, want},
+		{dir + sep + sep + "Photos" + sep + "2019" + sep + ".." + sep + "." + sep, want},
+		// A file isn't joined to anything by the walk
+		{dir + sep + "Photos" + sep + "2019" + sep + ".." + sep + "." + sep + "A.jpg", want[1:]},
+	} {
+		root := tt.root
+		out := make(chan *record)
+		go func() {
+			scan([]string{root}, out)
+			close(out)
+		}()
+		got := []string{}
+		for r := range out {
+			got = append(got, r.path)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scanning %s stored %v, want %v", root, got, tt.want)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	defer func(saved stringList) { rewriteFlags = saved }(rewriteFlags)
+	defer func(saved []pathRewrite) { rewrites = saved }(rewrites)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	for _, arg := range []string{"/mnt/snapshot", "=/production", "/mnt/snapshot="} {
+		rewriteFlags, rewrites = stringList{arg}, nil
+		if err := checkRewrites(); err == nil {
+			t.Errorf("-rewrite %q accepted", arg)
+		}
+	}
+
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "mnt", "snapshot")
+	production := filepath.Join(dir, "production")
+	writeTree(t, dir, map[string]string{"mnt/snapshot/etc/hosts": "127.0.0.1 localhost", "mnt/snapshots/old.txt": "old"})
+
+	rewriteFlags, rewrites = stringList{snapshot + "=" + production}, nil
+	if err := checkRewrites(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, stored string
+	}{
+		{filepath.Join(snapshot, "etc", "hosts"), filepath.Join(production, "etc", "hosts")},
+		{snapshot, production},
+		// Only whole path elements match
+		{filepath.Join(dir, "mnt", "snapshots", "old.txt"), filepath.Join(dir, "mnt", "snapshots", "old.txt")},
+	}
+	for _, tt := range tests {
+		stored := storedPath(tt.path)
+		if stored != tt.stored {
+			t.Errorf("storedPath(%q) = %q, want %q", tt.path, stored, tt.stored)
+		}
+		if local := localPath(stored); local != tt.path {
+			t.Errorf("localPath(%q) = %q, want %q", stored, local, tt.path)
+		}
+	}
+
+	// The snapshot is stored under the production paths, and -verify reads
+	// them back from the snapshot
+	out := make(chan *record)
+	go func() {
+		scan([]string{snapshot}, out)
+		close(out)
+	}()
+	records := []*record{}
+	for r := range out {
+		records = append(records, r)
+	}
+	if len(records) != 1 || records[0].path != filepath.Join(production, "etc", "hosts") {
+		t.Fatalf("scanned %d files, want etc/hosts stored under %s", len(records), production)
+	}
+	db := testDB(t, records...)
+
+	var ok bool
+	var err error
+	printed := captureStdout(t, func() { ok, err = verify(db, nil) })
+	if err != nil || !ok || !strings.Contains(printed, ": OK") {
+		t.Errorf("verifying the snapshot printed %q, %t, %v", printed, ok, err)
+	}
+}
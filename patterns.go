@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	// Patterns of the paths to leave out and of the files to scan.
+	excludePatterns stringList
+	includePatterns stringList
+
+	// Name of the files listing patterns to leave out of their directory.
+	ignoreFile string
+
+	// Compiled patterns by their text, and the rules of each directory's
+	// ignore file (nil if it has none)
+	compiledPatterns = map[string]*pathPattern{}
+	ignoreRules      = map[string][]*pathPattern{}
+	patternsMu       sync.Mutex
+)
+
+func init() {
+	flag.Var(&excludePatterns, "exclude", "skip files and directories whose path matches this glob, or regex with a re: prefix (repeatable)")
+	flag.Var(&includePatterns, "include", "only scan files whose path matches this glob, or regex with a re: prefix (repeatable)")
+	flag.StringVar(&ignoreFile, "ignore-file", ".sha1ignore", "skip the paths matching the patterns in files with this `NAME`, like .gitignore, empty to disable")
+}
+
+// A glob or regex that paths are matched against.
+type pathPattern struct {
+	re *regexp.Regexp
+
+	// Only directories match, for globs ending in "/"
+	dirOnly bool
+
+	// Matching files are scanned after all, for ignore file lines starting
+	// with "!"
+	negate bool
+}
+
+// Check whether a path, with "/" separators, matches.
+func (p *pathPattern) match(path string, isDir bool) bool {
+	return (isDir || !p.dirOnly) && p.re.MatchString(path)
+}
+
+// Compile a pattern. Regexes, prefixed by "re:", are matched anywhere in the
+// path. Globs are matched against the whole path, gitignore style: "*" and
+// "?" don't match "/", "**" matches any number of directories and a glob
+// without a "/" (other than a trailing one) matches names at any depth. In an
+// ignore file (anchored), globs with a "/" are relative to the file's
+// directory, on the command line those starting with "/" are absolute and
+// others match the end of the path.
+func compilePattern(s string, anchored bool) (*pathPattern, error) {
+	p := &pathPattern{}
+
+	if strings.HasPrefix(s, "re:") {
+		re, err := regexp.Compile(s[len("re:"):])
+		if err != nil {
+			return nil, err
+		}
+		p.re = re
+		return p, nil
+	}
+
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+
+	prefix := "(.*/)?"
+	if strings.HasPrefix(s, "/") || (anchored && strings.Contains(s, "/")) {
+		prefix = ""
+		if anchored {
+			s = strings.TrimPrefix(s, "/")
+		}
+	}
+
+	re, err := regexp.Compile("^" + prefix + globRegexp(s) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q", s)
+	}
+	p.re = re
+	return p, nil
+}
+
+// Translate a glob to a regular expression.
+func globRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// Compile a -exclude or -include pattern, once.
+func commandLinePattern(s string) (*pathPattern, error) {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+
+	if p, ok := compiledPatterns[s]; ok {
+		return p, nil
+	}
+
+	p, err := compilePattern(s, false)
+	if err != nil {
+		return nil, err
+	}
+	compiledPatterns[s] = p
+	return p, nil
+}
+
+// Compile the -exclude and -include patterns.
+func checkPatterns() error {
+	for _, list := range []struct {
+		name     string
+		patterns stringList
+	}{{"exclude", excludePatterns}, {"include", includePatterns}} {
+		for _, s := range list.patterns {
+			if _, err := commandLinePattern(s); err != nil {
+				return fmt.Errorf("invalid -%s %q: %s", list.name, s, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Check whether a path matches any of the patterns.
+func matchesAny(patterns stringList, path string, isDir bool) bool {
+	for _, s := range patterns {
+		if p, err := commandLinePattern(s); err == nil && p.match(filepath.ToSlash(path), isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a file or directory is left out by -exclude.
+func isExcluded(path string, info os.FileInfo) bool {
+	return matchesAny(excludePatterns, path, info.IsDir())
+}
+
+// Check whether a file is wanted by -include, which every file is if no
+// pattern was given.
+func isIncluded(path string, info os.FileInfo) bool {
+	return len(includePatterns) == 0 || matchesAny(includePatterns, path, false)
+}
+
+// Check whether a path is left out by the ignore files of the directories
+// above it. As in git the last pattern that matches decides, and those of
+// deeper directories come last.
+func isIgnored(path string, info os.FileInfo) bool {
+	if ignoreFile == "" {
+		return false
+	}
+
+	dirs := []string{}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if parent := filepath.Dir(dir); parent == dir {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], path)
+		if err != nil {
+			continue
+		}
+		for _, p := range loadIgnoreFile(dirs[i]) {
+			if p.match(filepath.ToSlash(rel), info.IsDir()) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// Read the patterns of a directory's ignore file, once. Blank lines and
+// those starting with "#" are skipped, lines starting with "!" scan the
+// paths they match after all. Unreadable files and invalid lines are logged
+// as errors.
+func loadIgnoreFile(dir string) []*pathPattern {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+
+	if rules, ok := ignoreRules[dir]; ok {
+		return rules
+	}
+
+	var rules []*pathPattern
+	defer func() { ignoreRules[dir] = rules }()
+
+	path := filepath.Join(dir, ignoreFile)
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fileError(storedPath(path), "Error reading ignore file: %s\n", err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		negate := strings.HasPrefix(line, "!")
+		p, err := compilePattern(strings.TrimPrefix(line, "!"), true)
+		if err != nil {
+			fileError(storedPath(path), "Error in ignore file: %s: %s\n", path, err)
+			continue
+		}
+		p.negate = negate
+		rules = append(rules, p)
+	}
+	if err := scanner.Err(); err != nil {
+		fileError(storedPath(path), "Error reading ignore file: %s\n", err)
+	}
+
+	return rules
+}
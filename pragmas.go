@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Name of the SQLite driver that applies -page-size and -mmap-size to every
+// connection it opens.
+const tunedDriver = "sqlite3_tuned"
+
+var (
+	// Page size of a new database, 0 for SQLite's default.
+	pageSize int
+
+	// Bytes of the database file to memory-map, 0 to not use mmap.
+	mmapSize int64
+
+	// Journal mode of the database and how often SQLite syncs it to disk,
+	// empty to leave them alone.
+	journalMode, synchronous string
+)
+
+func init() {
+	flag.IntVar(&pageSize, "page-size", 0, "page size in `BYTES` of a newly created db, a power of two from 512 to 65536 (0 for the SQLite default)")
+	flag.Int64Var(&mmapSize, "mmap-size", 0, "memory-map up to `BYTES` of the db for faster reads of large databases (0 to disable)")
+	flag.StringVar(&journalMode, "journal-mode", "wal", "SQLite journal `MODE` of the db: wal, delete, truncate, persist, memory or off (empty to keep the db's)")
+	flag.StringVar(&synchronous, "synchronous", "normal", "how often SQLite syncs the db to disk: off, normal, full or extra (empty for the SQLite default)")
+
+	// The pragmas are per connection, so they are set as each one is opened
+	// rather than once on the pool
+	sql.Register(tunedDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if pageSize > 0 {
+				if _, err := conn.Exec(fmt.Sprintf("PRAGMA page_size = %d", pageSize), nil); err != nil {
+					return err
+				}
+			}
+			if mmapSize > 0 {
+				if _, err := conn.Exec(fmt.Sprintf("PRAGMA mmap_size = %d", mmapSize), nil); err != nil {
+					return err
+				}
+			}
+			if journalMode != "" {
+				if _, err := conn.Exec("PRAGMA journal_mode = "+journalMode, nil); err != nil {
+					return err
+				}
+			}
+			if synchronous != "" {
+				if _, err := conn.Exec("PRAGMA synchronous = "+synchronous, nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// Check that -page-size is one SQLite accepts, since it silently ignores
+// others.
+func checkPageSize() error {
+	if pageSize == 0 {
+		return nil
+	}
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("invalid -page-size %d, want a power of two from 512 to 65536", pageSize)
+	}
+	return nil
+}
+
+// Check -journal-mode and -synchronous, which are pasted into the pragmas
+// and which SQLite would otherwise ignore if misspelled.
+func checkJournal() error {
+	switch journalMode {
+	case "", "wal", "delete", "truncate", "persist", "memory", "off":
+	default:
+		return fmt.Errorf("invalid -journal-mode %q, want wal, delete, truncate, persist, memory or off", journalMode)
+	}
+	switch synchronous {
+	case "", "off", "normal", "full", "extra":
+	default:
+		return fmt.Errorf("invalid -synchronous %q, want off, normal, full or extra", synchronous)
+	}
+	return nil
+}
+
+// Warn if the database doesn't have the -page-size asked for. The page size
+// can only be set before the first table is created, so it has no effect on
+// an existing database.
+func warnPageSize(db *sql.DB, path string) {
+	if pageSize == 0 {
+		return
+	}
+
+	var actual int
+	if err := db.QueryRow("PRAGMA page_size").Scan(&actual); err != nil {
+		errorf("Error reading page size: %s\n", err)
+		return
+	}
+	if actual != pageSize {
+		warnf("%s already exists with a page size of %d, -page-size %d only applies to new databases\n", path, actual, pageSize)
+	}
+}
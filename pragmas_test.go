@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPageSize(t *testing.T) {
+	defer func(saved int) { pageSize = saved }(pageSize)
+	defer func(saved int64) { mmapSize = saved }(mmapSize)
+	pageSize, mmapSize = 8192, 1<<20
+
+	path := filepath.Join(t.TempDir(), "files.db")
+	pragmas := func() (int, int64) {
+		db, err := openDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		var page int
+		var mmap int64
+		if err := db.QueryRow("PRAGMA page_size").Scan(&page); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow("PRAGMA mmap_size").Scan(&mmap); err != nil {
+			t.Fatal(err)
+		}
+		return page, mmap
+	}
+
+	if page, mmap := pragmas(); page != 8192 || mmap != 1<<20 {
+		t.Errorf("new db has page_size %d and mmap_size %d, want 8192 and %d", page, mmap, 1<<20)
+	}
+
+	// The page size of an existing database stays
+	pageSize = 16384
+	if page, _ := pragmas(); page != 8192 {
+		t.Errorf("reopened db has page_size %d, want 8192", page)
+	}
+
+	for _, size := range []int{256, 1000, 131072} {
+		pageSize = size
+		if err := checkPageSize(); err == nil {
+			t.Errorf("accepted -page-size %d", size)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+var (
+	// File to write a CPU profile to, see go tool pprof.
+	cpuProfile string
+
+	// File to write a heap profile to when the run finishes.
+	memProfile string
+)
+
+func init() {
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile to `FILE`")
+	flag.StringVar(&memProfile, "memprofile", "", "write a memory profile to `FILE` on exit")
+}
+
+// Stops the profiling started by startProfiling, nothing until then.
+var stopProfiling = func() {}
+
+// Exit with the status code, first stopping profiling as main's deferred
+// call would have.
+func exit(code int) {
+	stopProfiling()
+	os.Exit(code)
+}
+
+// Start any profiling requested on the command line. The returned function
+// stops CPU profiling and writes the memory profile, it must be called before
+// the program exits for the profiles to be usable. Calls after the first do
+// nothing, in case an exit races main's own.
+func startProfiling() func() {
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	once := &sync.Once{}
+	return func() { once.Do(stopAll) }
+}
+
+// Stop CPU profiling and write the memory profile.
+func stopAll() {
+	if cpuProfile != "" {
+		pprof.StopCPUProfile()
+	}
+
+	if memProfile != "" {
+		f, err := os.Create(memProfile)
+		if err != nil {
+			errorf("Error writing memory profile: %s\n", err)
+			return
+		}
+		defer f.Close()
+
+		// Get up-to-date statistics
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			errorf("Error writing memory profile: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProfiling(t *testing.T) {
+	defer func(cpu, mem string) { cpuProfile, memProfile = cpu, mem }(cpuProfile, memProfile)
+
+	dir := t.TempDir()
+	cpuProfile, memProfile = filepath.Join(dir, "cpu.prof"), filepath.Join(dir, "mem.prof")
+
+	stop := startProfiling()
+	hashBytes(make([]byte, 1<<20))
+	stop()
+	// As when an exit races main's own call
+	stop()
+
+	for _, path := range []string{cpuProfile, memProfile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			t.Errorf("%s is empty", filepath.Base(path))
+		}
+	}
+}
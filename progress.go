@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// How often progress is logged while hashing.
+	progressInterval = 5 * time.Second
+
+	// How often the -progress line is redrawn on a terminal.
+	statusInterval = time.Second
+)
+
+// Show the progress on a line of its own, counting the files as they are
+// hashed.
+var showProgress bool
+
+func init() {
+	flag.BoolVar(&showProgress, "progress", false, "keep a progress line with throughput and ETA at the bottom of stderr when it is a terminal, counting the files to hash while scanning")
+}
+
+// Number of files and bytes in the directory trees being scanned.
+type totals struct {
+	files int64
+	bytes int64
+}
+
+// Tracks how much has been hashed so far. If total is known (see -estimate),
+// progress lines include the percent complete and an ETA.
+type progress struct {
+	start time.Time
+	last  time.Time
+	done  totals
+	total totals
+
+	// Totals by extension, see -ext-stats
+	exts map[string]*extTotals
+
+	// Time spent by directory, see -trace-slow-dirs
+	dirs map[string]*dirTiming
+
+	// Totals of the roots counted while scanning, see -progress
+	counted chan totals
+
+	// Line redrawn at the bottom of the terminal, nil to log progress
+	status *statusLine
+}
+
+// Walk the roots without hashing anything, counting the files and bytes that
+// the real scan will visit. Only the information from the stat done by Walk
+// is used so this pass is cheap compared to hashing.
+func countFiles(roots []string) totals {
+	count := totals{}
+
+	for _, root := range roots {
+		var rootInfo os.FileInfo
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if skipPath(path, info) || isIgnored(path, info) {
+				return skipEntry(info)
+			}
+			if otherFilesystem(path, rootInfo, info) {
+				return filepath.SkipDir
+			}
+			if rootInfo == nil {
+				rootInfo = info
+			}
+			if !info.IsDir() && wantFile(path, info) {
+				count.files++
+				count.bytes += info.Size()
+			}
+			return nil
+		})
+	}
+
+	return count
+}
+
+// Record that a file has been hashed, reporting progress if enough time has
+// passed since the last report.
+func (p *progress) add(r *record) {
+	p.done.files++
+	p.done.bytes += r.size
+	p.addExt(r)
+	p.addDir(r)
+
+	interval := progressInterval
+	if p.status != nil {
+		interval = statusInterval
+	}
+	if time.Since(p.last) >= interval {
+		p.report()
+	}
+}
+
+// Count the files under the roots while they are scanned so that progress
+// gets an ETA once the count is done. The returned function waits for the
+// count, which reads the options of the job being scanned.
+func (p *progress) countAlong(roots []string) func() {
+	done := make(chan struct{})
+	go func() {
+		p.counted <- countFiles(roots)
+		close(done)
+	}()
+	return func() { <-done }
+}
+
+// Report the current progress, on the status line if there is one and to
+// the log otherwise.
+func (p *progress) report() {
+	p.last = time.Now()
+	elapsed := p.last.Sub(p.start)
+
+	for counting := true; counting; {
+		select {
+		case t := <-p.counted:
+			p.total.files += t.files
+			p.total.bytes += t.bytes
+		default:
+			counting = false
+		}
+	}
+
+	rate := int64(0)
+	if elapsed > 0 {
+		rate = int64(float64(p.done.bytes) / elapsed.Seconds())
+	}
+
+	line := fmt.Sprintf("Hashed %d files (%s) in %s, %s/s", p.done.files, formatBytes(p.done.bytes), elapsed.Truncate(time.Second), formatBytes(rate))
+	if p.total.files > 0 {
+		// Bytes are a better measure of the remaining work than file counts,
+		// fall back to counts for trees full of empty files. Files created
+		// since the count can take the scan past it.
+		fraction := float64(p.done.files) / float64(p.total.files)
+		if p.total.bytes > 0 {
+			fraction = float64(p.done.bytes) / float64(p.total.bytes)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+
+		eta := "unknown"
+		if fraction > 0 {
+			remaining := time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+			eta = remaining.Truncate(time.Second).String()
+		}
+
+		line = fmt.Sprintf("Hashed %d/%d files (%s of %s), %s/s, %.1f%% complete, ETA %s",
+			p.done.files, p.total.files, formatBytes(p.done.bytes), formatBytes(p.total.bytes), formatBytes(rate), 100*fraction, eta)
+	}
+
+	if p.status != nil {
+		p.status.set(line)
+	} else {
+		logEvent(levelInfo, logFields{"event": "progress", "files": p.done.files, "bytes": p.done.bytes}, "%s\n", line)
+	}
+}
+
+// Draw the -progress line at the bottom of stderr if it is a terminal,
+// taking over the log output so log lines are printed above it. JSON logs
+// are left alone for whatever reads them.
+func (p *progress) startStatus() {
+	if !isTerminal(os.Stderr) || jsonOut != nil {
+		return
+	}
+	p.status = &statusLine{out: os.Stderr}
+	log.SetOutput(p.status)
+}
+
+// Remove the -progress line and give the log output back.
+func (p *progress) stopStatus() {
+	if p.status == nil {
+		return
+	}
+	p.status.set("")
+	p.status = nil
+	log.SetOutput(os.Stderr)
+}
+
+// A line kept at the bottom of a terminal, below the log output.
+type statusLine struct {
+	mu   sync.Mutex
+	out  io.Writer
+	line string
+}
+
+// Replace the line.
+func (s *statusLine) set(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A line that wraps could not be redrawn in place
+	if r := []rune(line); len(r) > tuiWidth {
+		line = string(r[:tuiWidth])
+	}
+	s.line = line
+	fmt.Fprintf(s.out, "\r\x1b[K%s", s.line)
+}
+
+// Write log output over the line and draw it again below.
+func (s *statusLine) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.out, "\r\x1b[K%s%s", p, s.line)
+	return len(p), err
+}
+
+// Format a byte count for humans, e.g. 1.5 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestCountFiles(t *testing.T) {
+	defer func(saved stringList) { includeExts = saved }(includeExts)
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.txt":         "a",
+		"b.jpg":         "bb",
+		"sub/c.txt":     "ccc",
+		"sub/deep/d.md": "dddd",
+		".hidden/e.txt": "eeeee",
+		".f.txt":        "ffffff",
+	})
+
+	tests := []struct {
+		exts  stringList
+		files int
+	}{
+		{nil, 4},
+		{stringList{".txt"}, 2},
+	}
+
+	for _, tt := range tests {
+		includeExts = tt.exts
+
+		scanned := scanRecords(t, root)
+		if len(scanned) != tt.files {
+			t.Errorf("-include-ext %v: scanned %d files, want %d", tt.exts, len(scanned), tt.files)
+		}
+		var bytes int64
+		for _, r := range scanned {
+			bytes += r.size
+		}
+
+		got := countFiles([]string{root})
+		if want := (totals{files: int64(len(scanned)), bytes: bytes}); got != want {
+			t.Errorf("-include-ext %v: counted %+v, scanned %+v", tt.exts, got, want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// Delete rows for files that no longer exist on disk.
+	pruneMissing bool
+
+	// List the rows that would be pruned without deleting them.
+	pruneDryRun bool
+
+	// Only prune the rows under these directories, without scanning them.
+	pruneUnder stringList
+)
+
+func init() {
+	flag.BoolVar(&pruneMissing, "prune-missing", false, "delete rows for files that no longer exist (after the scan if DIRs are given)")
+	flag.BoolVar(&pruneDryRun, "dry-run", false, "with -prune-missing, print the paths of the missing files instead of deleting their rows")
+	flag.Var(&pruneUnder, "prune-under", "with -prune-missing and no DIRs, only check the rows under this directory (repeatable)")
+}
+
+// Log how many rows of missing files were pruned, or would have been.
+func reportPruned(n int) {
+	if pruneDryRun {
+		log.Printf("Would prune %d rows for missing files\n", n)
+	} else {
+		log.Printf("Pruned %d rows for missing files\n", n)
+	}
+}
+
+// The -prune-under directories in stored form. Unlike the DIRs of a scan
+// they may no longer exist.
+func pruneRoots() []string {
+	roots := []string{}
+	for _, dir := range pruneUnder {
+		if !noAbs {
+			if abs, err := filepath.Abs(dir); err == nil {
+				dir = abs
+			}
+		}
+		roots = append(roots, filepath.Clean(dir))
+	}
+	return roots
+}
+
+// Check whether a stored path lies under one of the roots, which must be in
+// stored form as well. Walking "." (see -no-abs) gives paths without a
+// leading "./", so every relative path is under it.
+func underRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if filepath.Clean(root) == "." && !filepath.IsAbs(path) && !strings.HasPrefix(path, "~") && !isRemote(path) {
+			return true
+		}
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete the rows of files that no longer exist and return how many were
+// removed, or with -dry-run print their paths instead. With no roots every
+// row is checked, except those of files scanned over SFTP, otherwise only
+// the rows under the roots. If since is set this is the sweep after a scan
+// of the roots: only rows with last_seen at or before since, the start of
+// the scan, are checked, so files that were just indexed are mostly not
+// stat'ed a second time.
+func pruneRows(db *sql.DB, roots []string, since int64) (int, error) {
+	// Hashed paths can't be checked and would all look missing
+	if hashed, err := namesHashed(db); err != nil || hashed {
+		if hashed {
+			err = errors.New("cannot prune a database of hashed paths (see -hash-names)")
+		}
+		return 0, err
+	}
+
+	query := "SELECT path, COALESCE(archive, '') FROM files"
+	args := []interface{}{}
+	if since > 0 {
+		query += " WHERE last_seen IS NULL OR last_seen <= ?"
+		args = append(args, since)
+	}
+
+	stored := []string{}
+	for _, root := range roots {
+		stored = append(stored, storedPath(root))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	missing := []string{}
+	for rows.Next() {
+		var path, archive string
+		if err := rows.Scan(&path, &archive); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		if len(stored) > 0 && !underRoots(path, stored) {
+			continue
+		}
+
+		if isRemote(path) {
+			// Can't tell from here whether a remote file still exists
+			continue
+		}
+
+		// Members of an archive exist for as long as the archive does
+		file := path
+		if archive != "" {
+			file = archive
+		}
+		if _, err := os.Lstat(localPath(file)); os.IsNotExist(err) {
+			missing = append(missing, path)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if pruneDryRun {
+		for _, path := range missing {
+			fmt.Println(path)
+		}
+		return len(missing), nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, path := range missing {
+		infof("Pruning missing file: %s\n", path)
+		if _, err := tx.Exec("DELETE FROM files WHERE path = ?", path); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if normalized {
+		// Drop content no file refers to anymore
+		if _, err := tx.Exec("DELETE FROM hashes WHERE id NOT IN (SELECT hash_id FROM files)"); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return len(missing), tx.Commit()
+}
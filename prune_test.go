@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPruneRows(t *testing.T) {
+	defer func(saved bool) { pruneDryRun = saved }(pruneDryRun)
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"photos/kept.jpg": "kept", "photos/gone.jpg": "gone", "music/gone.mp3": "gone"})
+	kept := filepath.Join(dir, "photos", "kept.jpg")
+	gone := filepath.Join(dir, "photos", "gone.jpg")
+	otherGone := filepath.Join(dir, "music", "gone.mp3")
+
+	tests := []struct {
+		name   string
+		roots  []string
+		since  int64
+		dryRun bool
+
+		removed int
+		left    []string
+	}{
+		{"all", nil, 0, false, 2, []string{kept}},
+		{"under a root", []string{filepath.Join(dir, "photos")}, 0, false, 1, []string{otherGone, kept}},
+		{"dry run", nil, 0, true, 2, []string{otherGone, gone, kept}},
+		// Rows seen by the scan that just ran aren't checked
+		{"sweep", nil, 150, false, 1, []string{gone, kept}},
+	}
+
+	for _, tt := range tests {
+		pruneDryRun = tt.dryRun
+		db := testDB(t,
+			&record{path: kept, sha1: emptySha1, seen: 100},
+			&record{path: gone, sha1: emptySha1, seen: 200},
+			&record{path: otherGone, sha1: emptySha1, seen: 100},
+		)
+		os.Remove(gone)
+		os.Remove(otherGone)
+
+		var removed int
+		var err error
+		captureStdout(t, func() { removed, err = pruneRows(db, tt.roots, tt.since) })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		left := []string{}
+		rows, err := db.Query("SELECT path FROM files")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var path string
+			rows.Scan(&path)
+			left = append(left, path)
+		}
+		rows.Close()
+		sort.Strings(left)
+
+		if removed != tt.removed || !reflect.DeepEqual(left, tt.left) {
+			t.Errorf("%s: pruned %d rows leaving %v, want %d leaving %v", tt.name, removed, left, tt.removed, tt.left)
+		}
+	}
+}
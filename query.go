@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+)
+
+var (
+	// Print the row of this path, or the rows of the files with a matching
+	// name, instead of scanning.
+	lookupPath string
+	lookupName string
+
+	// Format of the files printed by the lookups: text or json.
+	queryFormat string
+)
+
+func init() {
+	flag.StringVar(&lookupPath, "lookup-path", "", "print the hash of the file at `PATH` as recorded in the db instead of scanning")
+	flag.StringVar(&lookupName, "lookup-name", "", "print the files whose name matches the `GLOB`, e.g. '*.iso', instead of scanning")
+	flag.StringVar(&queryFormat, "query-format", "text", "`FORMAT` of -lookup, -lookup-path and -lookup-name: text (like sha1sum) or json lines")
+}
+
+// Check whether any of the lookups was asked for.
+func querying() bool {
+	return lookupHash != "" || lookupPath != "" || lookupName != ""
+}
+
+// Check the lookup options.
+func checkQuery() error {
+	if queryFormat != "text" && queryFormat != "json" {
+		return fmt.Errorf("invalid -query-format %q, want text or json", queryFormat)
+	}
+	if lookupName != "" {
+		if _, err := filepath.Match(lookupName, ""); err != nil {
+			return fmt.Errorf("invalid -lookup-name %q: %s", lookupName, err)
+		}
+	}
+	return checkLookup()
+}
+
+// Columns selected for the files printed by the lookups.
+const matchColumns = "path, COALESCE(sha1, ''), COALESCE(size, 0), COALESCE(mtime, 0), COALESCE(extless, ''), COALESCE(ext, '')"
+
+// Read the files of rows, selected with matchColumns, leaving out those for
+// which keep returns false.
+func scanMatches(rows *sql.Rows, keep func(path string) bool) ([]*record, error) {
+	defer rows.Close()
+
+	matches := []*record{}
+	for rows.Next() {
+		r := &record{}
+		if err := rows.Scan(&r.path, &r.sha1, &r.size, &r.mtime, &r.extless, &r.ext); err != nil {
+			return nil, err
+		}
+		if keep(r.path) {
+			matches = append(matches, r)
+		}
+	}
+	return matches, rows.Err()
+}
+
+// Print the files of rows, selected with matchColumns, in -query-format:
+// sha1sum lines ("-" for files without a full hash) or JSON lines in the
+// format of -also-json. Files for which keep returns false are left out.
+// Returns the distinct hashes printed.
+func printMatches(w io.Writer, rows *sql.Rows, keep func(path string) bool) (map[string]bool, error) {
+	matches, err := scanMatches(rows, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]bool{}
+	for _, r := range matches {
+		hashes[r.sha1] = true
+
+		if queryFormat == "json" {
+			b, err := json.Marshal(newJSONRecord(r))
+			if err != nil {
+				return hashes, err
+			}
+			fmt.Fprintf(w, "%s\n", b)
+			continue
+		}
+
+		hash := r.sha1
+		if hash == "" {
+			hash = "-"
+		}
+		fmt.Fprint(w, sha1sumLine(hash, r.path)+lineEnd())
+	}
+	return hashes, nil
+}
+
+// Keep every file.
+func anyPath(string) bool {
+	return true
+}
+
+// Run the lookups that were asked for, printing what they find. Returns
+// whether each found something.
+func runQuery(w io.Writer, db *sql.DB) (bool, error) {
+	found := true
+
+	if lookupHash != "" {
+		ok, err := lookupShortHash(w, db, lookupHash)
+		if err != nil {
+			return false, err
+		}
+		found = found && ok
+	}
+
+	if lookupPath != "" {
+		ok, err := lookupStoredPath(w, db, lookupPath)
+		if err != nil {
+			return false, err
+		}
+		found = found && ok
+	}
+
+	if lookupName != "" {
+		ok, err := lookupFileName(w, db, lookupName)
+		if err != nil {
+			return false, err
+		}
+		found = found && ok
+	}
+
+	return found, nil
+}
+
+// Print the row of the file at path, given as on the command line. Returns
+// whether it has one.
+func lookupStoredPath(w io.Writer, db *sql.DB, path string) (bool, error) {
+	if !noAbs && !isRemote(path) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	stored := storedPath(path)
+
+	rows, err := queryStoredPath(db, stored)
+	if err != nil {
+		return false, err
+	}
+	hashes, err := printMatches(w, rows, anyPath)
+	if err != nil {
+		return false, err
+	}
+
+	if len(hashes) == 0 {
+		log.Printf("No row for %s\n", stored)
+	}
+	return len(hashes) > 0, nil
+}
+
+// Select matchColumns of the row of a stored path.
+func queryStoredPath(db *sql.DB, stored string) (*sql.Rows, error) {
+	return db.Query("SELECT "+matchColumns+" FROM "+filesView()+" WHERE path = ?", stored)
+}
+
+// Select matchColumns of the files whose name might match the glob, in path
+// order. SQLite's GLOB narrows the rows down but lets "*" match "/", so they
+// must still be kept by nameMatches.
+func queryFileName(db *sql.DB, glob string) (*sql.Rows, error) {
+	return db.Query("SELECT "+matchColumns+" FROM "+filesView()+" WHERE path GLOB ? ORDER BY path", "*"+glob)
+}
+
+// Check whether the name of a file, without its directory, matches the glob.
+func nameMatches(glob string) func(path string) bool {
+	return func(path string) bool {
+		ok, _ := filepath.Match(glob, filepath.Base(path))
+		return ok
+	}
+}
+
+// Print the files whose name matches the glob, in path order. Returns whether
+// any did.
+func lookupFileName(w io.Writer, db *sql.DB, glob string) (bool, error) {
+	rows, err := queryFileName(db, glob)
+	if err != nil {
+		return false, err
+	}
+
+	hashes, err := printMatches(w, rows, nameMatches(glob))
+	if err != nil {
+		return false, err
+	}
+
+	if len(hashes) == 0 {
+		log.Printf("No file is named like %s\n", glob)
+	}
+	return len(hashes) > 0, nil
+}
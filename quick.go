@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// Mebibytes read from each end of a file by a quick scan, 0 to hash
+	// whole files.
+	quickMB int64
+
+	// Hash in full the files whose fingerprint another file shares.
+	promoteMode bool
+)
+
+func init() {
+	flag.Int64Var(&quickMB, "quick", 0, "quick-hash huge files: the same as -fingerprint with the first and last `MB` mebibytes of each")
+	flag.BoolVar(&promoteMode, "promote", false, "compute the full hash of the files whose fingerprint from -quick or -fingerprint is shared with another file, instead of scanning")
+}
+
+// Turn -quick into the -fingerprint it stands for.
+func applyQuick() error {
+	switch {
+	case quickMB < 0:
+		return errors.New("-quick must be positive")
+	case quickMB == 0:
+		return nil
+	case fingerprintBytes > 0 && fingerprintBytes != quickMB<<20:
+		return errors.New("-quick and -fingerprint set different sizes, give only one")
+	}
+	fingerprintBytes = quickMB << 20
+	return nil
+}
+
+// A row with a fingerprint to hash in full.
+type promotion struct {
+	path        string
+	size, mtime int64
+}
+
+// Load the rows without a full hash whose fingerprint isn't unique, leaving
+// out remote files which can't be read from here.
+func fingerprintCollisions(db *sql.DB) ([]promotion, error) {
+	rows, err := db.Query("SELECT path, COALESCE(size, 0), COALESCE(mtime, 0) FROM files WHERE sha1 IS NULL AND fingerprint IN " +
+		"(SELECT fingerprint FROM files WHERE fingerprint IS NOT NULL GROUP BY fingerprint HAVING COUNT(*) > 1)" +
+		" AND path NOT LIKE '" + remotePrefix + "%' AND path NOT LIKE '" + s3Prefix + "%' ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := []promotion{}
+	for rows.Next() {
+		var p promotion
+		if err := rows.Scan(&p.path, &p.size, &p.mtime); err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+// Hash in full the files that share a fingerprint with -hash-workers
+// goroutines and store their SHA1 next to the fingerprint, so -dupes lists
+// the real duplicates among the candidates of a quick scan. Files changed
+// since they were fingerprinted are left for the next scan. Returns the
+// number of rows updated.
+func promoteCollisions(db *sql.DB) (int, error) {
+	if hashed, err := namesHashed(db); err != nil || hashed {
+		if hashed {
+			err = errors.New("cannot promote a database of hashed paths (see -hash-names)")
+		}
+		return 0, err
+	}
+
+	promotions, err := fingerprintCollisions(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := startRun(db, time.Now()); err != nil {
+		return 0, err
+	}
+	infof("Hashing %d files sharing a fingerprint\n", len(promotions))
+
+	workers := hashWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan promotion)
+	results := make(chan *record, workers)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				if result := promoteRow(p); result != nil {
+					results <- result
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, p := range promotions {
+			work <- p
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+
+	stmt, err := db.Prepare("UPDATE files SET sha1 = ?, hash_prefix = ?, run_id = ? WHERE path = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	updated := 0
+	done := totals{}
+	for result := range results {
+		if _, err := stmt.Exec(result.sha1, hashPrefix(result.sha1), currentRun, result.path); err != nil {
+			return updated, err
+		}
+		updated++
+		done.files++
+		done.bytes += result.size
+	}
+
+	if _, err := storeErrors(db); err != nil {
+		return updated, err
+	}
+	return updated, finishRun(db, done)
+}
+
+// Hash the file of a row in full, returning a record of its path, size and
+// SHA1 or nil if it could not be read or changed since it was fingerprinted.
+func promoteRow(p promotion) *record {
+	path := localPath(p.path)
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		fileError(p.path, "Missing file: %s\n", path)
+		return nil
+	} else if err != nil {
+		fileError(p.path, "Error reading file: %s\n", err)
+		return nil
+	}
+	if info.Size() != p.size || info.ModTime().Unix() != p.mtime {
+		warnf("Not promoting %s, it changed since it was fingerprinted: scan it again\n", path)
+		return nil
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		fileError(p.path, "Error reading file: %s\n", err)
+		return nil
+	}
+	return &record{path: p.path, size: p.size, sha1: sum}
+}
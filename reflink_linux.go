@@ -0,0 +1,35 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Make a file at tmp sharing the extents of src with FICLONE, as cp
+// --reflink does, with the mode and mtime of the file it is to replace.
+// Only some filesystems, such as btrfs and XFS, support it.
+func reflink(src, replaced, tmp string) error {
+	info, err := os.Stat(replaced)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(tmp, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// Reflinks are only made with Linux's FICLONE.
+func reflink(src, replaced, tmp string) error {
+	return errors.New("reflinks are only supported on Linux")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Print a per-directory summary of the index.
+var reportTree bool
+
+func init() {
+	flag.BoolVar(&reportTree, "report-tree", false, "print file count, size and duplicates per directory (after the scan if DIRs are given)")
+}
+
+// Totals for a directory and everything below it.
+type dirStats struct {
+	files    int64
+	bytes    int64
+	dupes    int64
+	children map[string]*dirStats
+}
+
+func newDirStats() *dirStats {
+	return &dirStats{children: map[string]*dirStats{}}
+}
+
+// Aggregate the indexed files by directory. A file counts as a duplicate if
+// its content appears more than once anywhere in the index, empty files only
+// with -include-empty.
+func buildTree(db *sql.DB) (map[string]*dirStats, error) {
+	dupes := map[string]bool{}
+
+	rows, err := db.Query("SELECT sha1 FROM " + filesView() + " WHERE sha1 IS NOT NULL GROUP BY sha1 HAVING COUNT(*) > 1")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if hash != emptySha1 || includeEmpty {
+			dupes[hash] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dirs := map[string]*dirStats{}
+
+	rows, err = db.Query("SELECT path, COALESCE(sha1, ''), COALESCE(size, 0) FROM " + filesView())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, hash string
+		var size int64
+		if err := rows.Scan(&path, &hash, &size); err != nil {
+			return nil, err
+		}
+
+		// Add the file to every directory above it, up to the root
+		child := ""
+		for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+			stats, ok := dirs[dir]
+			if !ok {
+				stats = newDirStats()
+				dirs[dir] = stats
+			}
+
+			stats.files++
+			stats.bytes += size
+			if dupes[hash] {
+				stats.dupes++
+			}
+			if child != "" {
+				stats.children[child] = dirs[child]
+			}
+
+			if filepath.Dir(dir) == dir {
+				break
+			}
+			child = dir
+		}
+	}
+
+	return dirs, rows.Err()
+}
+
+// Print the tree of directories with their totals, starting at the deepest
+// directory that contains everything indexed.
+func printTree(w io.Writer, db *sql.DB) error {
+	dirs, err := buildTree(db)
+	if err != nil {
+		return err
+	}
+
+	// Find the filesystem root(s), then descend while there is a single
+	// directory holding all files.
+	tops := []string{}
+	for dir := range dirs {
+		if filepath.Dir(dir) == dir {
+			tops = append(tops, dir)
+		}
+	}
+	sort.Strings(tops)
+
+	for _, top := range tops {
+		for {
+			stats := dirs[top]
+			if len(stats.children) != 1 {
+				break
+			}
+
+			var only string
+			for child := range stats.children {
+				only = child
+			}
+			if dirs[only].files != stats.files {
+				break
+			}
+			top = only
+		}
+
+		printDir(w, dirs, top, top, 0)
+	}
+
+	return nil
+}
+
+// Print a directory and, indented below it, its subdirectories by name.
+func printDir(w io.Writer, dirs map[string]*dirStats, dir, name string, depth int) {
+	stats := dirs[dir]
+	fmt.Fprintf(w, "%s%s  %d files, %s, %d dupes\n", strings.Repeat("  ", depth), name, stats.files, formatBytes(stats.bytes), stats.dupes)
+
+	children := []string{}
+	for child := range stats.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+
+	for _, child := range children {
+		printDir(w, dirs, child, filepath.Base(child), depth+1)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintTree(t *testing.T) {
+	db := testDB(t,
+		&record{path: "/data/photos/a.jpg", sha1: hashBytes([]byte("a")), size: 1000},
+		&record{path: "/data/photos/2019/b.jpg", sha1: hashBytes([]byte("b")), size: 2000},
+		&record{path: "/data/photos/2019/copy.jpg", sha1: hashBytes([]byte("a")), size: 1000},
+		&record{path: "/data/music/c.mp3", sha1: hashBytes([]byte("c")), size: 100},
+		&record{path: "/data/music/empty", sha1: emptySha1, size: 0},
+		&record{path: "/data/music/empty2", sha1: emptySha1, size: 0},
+	)
+
+	// Starts at /data, which holds everything, and doesn't count the empty
+	// files as duplicates
+	want := `/data  6 files, 4.0 KiB, 2 dupes
+  music  3 files, 100 B, 0 dupes
+  photos  3 files, 3.9 KiB, 2 dupes
+    2019  2 files, 2.9 KiB, 1 dupes
+`
+
+	var buf bytes.Buffer
+	if err := printTree(&buf, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Hash the files of the rows without a hash instead of scanning.
+var rescanMissing bool
+
+func init() {
+	flag.BoolVar(&rescanMissing, "rescan-only-missing-hashes", false, "hash the files of the rows that have no hash yet (e.g. from -no-hash or -dedup-scan) and update them, without walking any directory")
+}
+
+// Load the paths of the rows with no hash, fingerprint or extents hash,
+// leaving out remote files which can't be read from here. Normalized databases
+// written before -no-hash may reference an empty hash instead of NULL.
+func missingHashPaths(db *sql.DB) ([]string, error) {
+	missing := "sha1 IS NULL"
+	if normalized {
+		missing = "(hash_id IS NULL OR hash_id IN (SELECT id FROM hashes WHERE sha1 = ''))"
+	}
+	query := "SELECT path FROM files WHERE " + missing + " AND fingerprint IS NULL AND extents_sha1 IS NULL" +
+		" AND path NOT LIKE '" + remotePrefix + "%' AND path NOT LIKE '" + s3Prefix + "%' ORDER BY path"
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// Hash the files of the rows without a hash with -hash-workers goroutines and
+// update their rows, other rows are left alone. The paths come from the
+// database so nothing is walked. Files deleted since their row was written
+// are recorded in the errors table as missing and their rows kept, run
+// -prune-missing to remove them. Returns the number of rows updated.
+func rescanMissingHashes(db *sql.DB) (int, error) {
+	if hashed, err := namesHashed(db); err != nil || hashed {
+		if hashed {
+			err = errors.New("cannot rescan a database of hashed paths (see -hash-names)")
+		}
+		return 0, err
+	}
+
+	paths, err := missingHashPaths(db)
+	if err != nil {
+		return 0, err
+	}
+	if err := startRun(db, time.Now()); err != nil {
+		return 0, err
+	}
+	infof("Hashing %d files without a hash\n", len(paths))
+
+	workers := hashWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	work := make(chan string)
+	results := make(chan *record, workers)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				if result := rehashRow(path); result != nil {
+					results <- result
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, path := range paths {
+			work <- path
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	}()
+
+	store := newBatcher(db)
+	updated := 0
+	done := totals{}
+	for result := range results {
+		if err := store.add(result); err != nil {
+			return updated, err
+		}
+		updated++
+		done.files++
+		done.bytes += result.size
+	}
+	if err := store.Close(); err != nil {
+		return updated, err
+	}
+
+	if _, err := storeErrors(db); err != nil {
+		return updated, err
+	}
+	return updated, finishRun(db, done)
+}
+
+// Hash the file of a stored path, returning its record or nil if it could
+// not be read.
+func rehashRow(stored string) *record {
+	path := localPath(stored)
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		fileError(stored, "Missing file: %s\n", path)
+		return nil
+	} else if err != nil {
+		fileError(stored, "Error reading file: %s\n", err)
+		return nil
+	}
+
+	j := &job{path: path, info: info, bundle: isBundleDir(info)}
+	if j.bundle {
+		// Recorded by -no-hash, hashed over its manifest as by a scan
+		data, err := j.read()
+		if err != nil {
+			fileError(stored, "Error reading file: %s\n", err)
+			return nil
+		}
+		result := newRecord(path, info, data)
+		result.path, result.size = stored, j.size
+		return result
+	}
+
+	j.streamed = !j.needsWhole()
+	if maxReadSize > 0 && info.Size() > maxReadSize {
+		if isEncrypted(path) {
+			fileSkipped("too large", path)
+			return nil
+		}
+		j.streamed = true
+	}
+
+	if j.streamed {
+		f, err := os.Open(path)
+		if err != nil {
+			fileError(stored, "Error reading file: %s\n", err)
+			return nil
+		}
+		defer f.Close()
+
+		result, err := streamRecord(j, f)
+		if err != nil {
+			fileError(stored, "Error reading file: %s\n", err)
+			return nil
+		}
+		if result != nil {
+			result.path = stored
+		}
+		return result
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fileError(stored, "Error reading file: %s\n", err)
+		return nil
+	}
+
+	encrypted := isEncrypted(path)
+	if encrypted {
+		if data, err = decrypt(path, data); err != nil {
+			fileError(stored, "Error decrypting file: %s: %s\n", path, err)
+			return nil
+		}
+	}
+
+	result := newRecord(path, info, data)
+	result.path = stored
+	result.encrypted = encrypted
+	return result
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRescanMissingHashes(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+
+	for _, normalized = range []bool{false, true} {
+		dir := t.TempDir()
+		hashed := filepath.Join(dir, "hashed")
+		unhashed := filepath.Join(dir, "unhashed")
+		deleted := filepath.Join(dir, "deleted")
+		for _, path := range []string{hashed, unhashed, deleted} {
+			if err := ioutil.WriteFile(path, []byte(filepath.Base(path)), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		db, err := openDB(filepath.Join(dir, "files.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The stored hash of hashed is wrong, so it shows if it is rehashed
+		const stale = "0123456789abcdef0123456789abcdef01234567"
+		records := []*record{}
+		for _, path := range []string{hashed, unhashed, deleted} {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := statRecord(path, info)
+			if path == hashed {
+				r.sha1 = stale
+			}
+			records = append(records, r)
+		}
+		if err := insertRecords(db, records); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(deleted)
+
+		updated, err := rescanMissingHashes(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated != 1 {
+			t.Errorf("normalized=%t: updated %d rows, want 1", normalized, updated)
+		}
+
+		want := map[string]string{hashed: stale, unhashed: hashBytes([]byte("unhashed")), deleted: ""}
+		for path, sum := range want {
+			if got := storedSha1(t, db, path); got != sum {
+				t.Errorf("normalized=%t: sha1 of %s = %q, want %q", normalized, filepath.Base(path), got, sum)
+			}
+		}
+		db.Close()
+	}
+}
+
+// The SHA1 stored for a path in either schema, "" for none.
+func storedSha1(t *testing.T, db *sql.DB, path string) string {
+	query := "SELECT COALESCE(sha1, '') FROM files WHERE path = ?"
+	if normalized {
+		query = "SELECT COALESCE(hashes.sha1, '') FROM files LEFT JOIN hashes ON files.hash_id = hashes.id WHERE path = ?"
+	}
+
+	var sum string
+	if err := db.QueryRow(query, path).Scan(&sum); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Returned from the walk function to stop walking once -max-bytes is used up.
+var errBudgetSpent = errors.New("byte budget spent")
+
+var (
+	// Stop queueing files once their sizes add up to this, 0 for no limit.
+	maxBytes int64
+
+	// Carry on from the checkpoint left by a run stopped by -max-bytes.
+	resumeScan bool
+
+	// Bytes of the files queued so far and whether the budget ran out.
+	bytesQueued int64
+	budgetSpent bool
+
+	// The last file queued, saved as the checkpoint when the budget runs out.
+	lastQueued checkpoint
+
+	// The checkpoint being resumed from, nil once it has been passed.
+	resumeFrom *checkpoint
+)
+
+func init() {
+	flag.Int64Var(&maxBytes, "max-bytes", 0, "stop the scan once about `BYTES` of files have been hashed and save a checkpoint for -resume (0 for no limit)")
+	flag.BoolVar(&resumeScan, "resume", false, "skip the files hashed before the checkpoint saved by a run stopped by -max-bytes, an interrupt or a full disk")
+}
+
+// A position in the walk: a root and the last path walked under it. If next
+// is set, the path itself is still to be hashed.
+type checkpoint struct {
+	root, path string
+	next       bool
+}
+
+// Check that -max-bytes can be used with the other options.
+func checkMaxBytes() error {
+	if maxBytes > 0 && hashNames {
+		return errors.New("-max-bytes cannot be used with -hash-names since the checkpoint records a path")
+	}
+	return nil
+}
+
+// Check whether the budget allows queueing a file of the given size under
+// root, counting it and keeping it as the last file queued if so. The
+// first file is always let through, however large, so that every run makes
+// progress.
+func withinBudget(root, path string, size int64) bool {
+	if maxBytes <= 0 {
+		// The checkpoint is saved for interrupted scans too
+		lastQueued = checkpoint{root: root, path: path}
+		return true
+	}
+	if budgetSpent || (bytesQueued > 0 && bytesQueued+size > maxBytes) {
+		budgetSpent = true
+		return false
+	}
+
+	bytesQueued += size
+	lastQueued = checkpoint{root: root, path: path}
+	return true
+}
+
+// Load the checkpoint to resume from. The roots must include the one it was
+// saved under, otherwise nothing would be skipped correctly and the scan
+// starts over.
+func loadCheckpoint(db *sql.DB, roots []string) error {
+	root, ok, err := getMeta(db, "checkpoint_root")
+	if err != nil || !ok {
+		if err == nil {
+			warnf("No checkpoint to resume from, scanning everything\n")
+		}
+		return err
+	}
+	path, _, err := getMeta(db, "checkpoint_path")
+	if err != nil {
+		return err
+	}
+	next, _, err := getMeta(db, "checkpoint_next")
+	if err != nil {
+		return err
+	}
+
+	for _, r := range roots {
+		if r == root {
+			resumeFrom = &checkpoint{root: root, path: path, next: next == "1"}
+			if resumeFrom.next {
+				infof("Resuming at %s\n", path)
+			} else {
+				infof("Resuming after %s\n", path)
+			}
+			return nil
+		}
+	}
+
+	warnf("Checkpoint is under %s which is not being scanned, scanning everything\n", root)
+	return nil
+}
+
+// Save the checkpoint of a run stopped by -max-bytes or an interrupt, or
+// clear the one of an earlier run once a scan with -max-bytes or -resume got
+// to the end.
+func saveCheckpoint(db *sql.DB) error {
+	if isInterrupted() && lastQueued.path == "" {
+		// Nothing was queued, an earlier checkpoint still holds
+		return nil
+	}
+	if !budgetSpent && !isInterrupted() {
+		if maxBytes <= 0 && !resumeScan {
+			return nil
+		}
+		_, err := db.Exec("DELETE FROM metadata WHERE key IN ('checkpoint_root', 'checkpoint_path', 'checkpoint_next')")
+		return err
+	}
+
+	return storeCheckpoint(db, lastQueued)
+}
+
+// Record a checkpoint in the metadata table, replacing any earlier one.
+func storeCheckpoint(db *sql.DB, c checkpoint) error {
+	next := ""
+	if c.next {
+		next = "1"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range [][2]string{{"checkpoint_root", c.root}, {"checkpoint_path", c.path}, {"checkpoint_next", next}} {
+		_, err := tx.Exec("INSERT INTO metadata (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", kv[0], kv[1])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Check whether a path walked under root was already hashed by the run
+// being resumed, i.e. comes before the checkpoint in walk order, or is the
+// checkpoint itself unless it is of the next path to hash. Roots scanned
+// before the checkpoint's are skipped whole. Once the walk passes the
+// checkpoint nothing more is skipped.
+func resumeSkip(root, path string) bool {
+	if resumeFrom == nil {
+		return false
+	}
+
+	switch {
+	case root != resumeFrom.root:
+		return true
+	case isAncestor(path, resumeFrom.path):
+		return false
+	case path == resumeFrom.path:
+		skip := !resumeFrom.next
+		resumeFrom = nil
+		return skip
+	case walksBefore(path, resumeFrom.path):
+		return true
+	}
+
+	resumeFrom = nil
+	return false
+}
+
+// Check whether an object of an -s3 source was already hashed by the run
+// being resumed, as resumeSkip does for walked paths. Objects are listed in
+// byte order of their keys.
+func resumeSkipKey(root, key string) bool {
+	if resumeFrom == nil {
+		return false
+	}
+
+	switch {
+	case root != resumeFrom.root:
+		return true
+	case key < resumeFrom.path:
+		return true
+	case key == resumeFrom.path:
+		skip := !resumeFrom.next
+		resumeFrom = nil
+		return skip
+	}
+
+	resumeFrom = nil
+	return false
+}
+
+// Check whether a is scanned before b under root: walk order, or key order
+// for an -s3 source.
+func scannedBefore(root, a, b string) bool {
+	if strings.HasPrefix(root, s3Prefix) {
+		return a < b
+	}
+	return walksBefore(a, b)
+}
+
+// Check whether dir is a directory above path.
+func isAncestor(dir, path string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// Check whether filepath.Walk visits a before b. Walk goes through each
+// directory in lexical order of the names, so paths are compared an element
+// at a time rather than as strings ("a/b" is walked before "a.txt").
+func walksBefore(a, b string) bool {
+	as := strings.Split(a, string(filepath.Separator))
+	bs := strings.Split(b, string(filepath.Separator))
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// Describe where a resumed scan stopped, for the log.
+func (c checkpoint) String() string {
+	return fmt.Sprintf("%s (under %s)", c.path, c.root)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResumeSkipKey(t *testing.T) {
+	defer func(saved *checkpoint) { resumeFrom = saved }(resumeFrom)
+
+	const root = "s3://bucket/photos"
+	keys := []string{"photos/a.jpg", "photos/a.txt", "photos/a/b.jpg", "photos/c.jpg"}
+
+	// Keys are listed in byte order, so "a.txt" comes before "a/b.jpg"
+	tests := []struct {
+		from checkpoint
+		want []string
+	}{
+		{checkpoint{root: root, path: "photos/a.txt"}, []string{"photos/a/b.jpg", "photos/c.jpg"}},
+		{checkpoint{root: root, path: "photos/a.txt", next: true}, []string{"photos/a.txt", "photos/a/b.jpg", "photos/c.jpg"}},
+		{checkpoint{root: root, path: "photos/b.jpg"}, []string{"photos/c.jpg"}},
+		{checkpoint{root: "s3://bucket/videos", path: "videos/a.mp4"}, []string{}},
+	}
+
+	for _, tt := range tests {
+		from := tt.from
+		resumeFrom = &from
+
+		got := []string{}
+		for _, key := range keys {
+			if !resumeSkipKey(root, key) {
+				got = append(got, key)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resuming from %s scanned %v, want %v", tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestFirstUncommittedRemote(t *testing.T) {
+	roots := []string{"/home", "me@host:/data", "s3://bucket/"}
+	records := []*record{
+		{walked: checkpoint{root: "s3://bucket/", path: "a/b.txt"}},
+		{walked: checkpoint{root: "s3://bucket/", path: "a.txt"}},
+		{walked: checkpoint{root: "me@host:/data", path: "/data/z.txt"}},
+	}
+
+	got, ok := firstUncommitted(records, roots)
+	if want := (checkpoint{root: "me@host:/data", path: "/data/z.txt", next: true}); !ok || got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	got, ok = firstUncommitted(records[:2], roots)
+	if want := (checkpoint{root: "s3://bucket/", path: "a.txt", next: true}); !ok || got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// Paths in the files table of the database at path, relative to root and
+// sorted.
+func storedPaths(t *testing.T, path, root string) []string {
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT path FROM files ORDER BY path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	paths := []string{}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "files")
+	writeTree(t, root, map[string]string{
+		"a.txt":   "0123456789",
+		"b.txt":   "0123456789",
+		"c/d.txt": "0123456789",
+		"c/e.txt": "0123456789",
+		"f.txt":   "0123456789",
+	})
+	dbFile := filepath.Join(dir, "files.db")
+
+	// Each run hashes the files that fit in the budget and leaves a
+	// checkpoint at the last of them
+	tests := []struct {
+		args       []string
+		want       []string
+		checkpoint string
+	}{
+		{[]string{"-max-bytes", "25"}, []string{"a.txt", "b.txt"}, filepath.Join(root, "b.txt")},
+		{[]string{"-max-bytes", "25", "-resume"}, []string{"a.txt", "b.txt", "c/d.txt", "c/e.txt"}, filepath.Join(root, "c", "e.txt")},
+		// The last run gets to the end and clears the checkpoint
+		{[]string{"-max-bytes", "25", "-resume"}, []string{"a.txt", "b.txt", "c/d.txt", "c/e.txt", "f.txt"}, ""},
+	}
+
+	for i, tt := range tests {
+		args := append(append([]string{"-quiet", "-db", dbFile}, tt.args...), root)
+		if out, err := runMain(t, args...); err != nil {
+			t.Fatalf("run %d: %s\n%s", i+1, err, out)
+		}
+
+		if got := storedPaths(t, dbFile, root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("run %d stored %v, want %v", i+1, got, tt.want)
+		}
+
+		db, err := openDB(dbFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, _, err := getMeta(db, "checkpoint_path")
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != tt.checkpoint {
+			t.Errorf("run %d left the checkpoint at %q, want %q", i+1, path, tt.checkpoint)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Label stored with the run, e.g. "before-sync".
+	runTag string
+
+	// Print the recorded runs instead of scanning.
+	listRuns bool
+
+	// Number of this run in the runs table, 0 until the scan starts.
+	currentRun int64
+)
+
+func init() {
+	flag.StringVar(&runTag, "tag", "", "store `TAG` with this scan's row in the runs table, e.g. before-sync")
+	flag.BoolVar(&listRuns, "list-runs", false, "print the scans recorded in the runs table instead of scanning")
+}
+
+// Every scan of the database, see -list-runs. The files, bytes and errors
+// are those of the run, and finished is NULL for runs that did not get to
+// the end. Rows of files record the run that last hashed them in run_id.
+const runsTable = "CREATE TABLE IF NOT EXISTS runs (id INTEGER PRIMARY KEY, started INTEGER, finished INTEGER, args TEXT, host TEXT, tag TEXT, files INTEGER, bytes INTEGER, errors INTEGER)"
+
+// Number the run and add its row to the runs table. Runs are numbered after
+// the last one in the table or, for databases from before it, the last_run_id
+// of the errors table, which is kept up to date. With -hash-names the
+// arguments are not stored since they may name files.
+func startRun(db *sql.DB, started time.Time) error {
+	last, _, err := getMeta(db, "last_run_id")
+	if err != nil {
+		return err
+	}
+	runID, _ := strconv.ParseInt(last, 10, 64)
+
+	var latest int64
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM runs").Scan(&latest); err != nil {
+		return err
+	}
+	if latest > runID {
+		runID = latest
+	}
+	runID++
+
+	args := sql.NullString{String: strings.Join(os.Args[1:], " "), Valid: !hashNames}
+	host, _ := os.Hostname()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("INSERT INTO runs (id, started, args, host, tag) VALUES (?, ?, ?, ?, ?)", runID, started.Unix(), args, nullString(host), nullString(runTag)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO metadata (key, value) VALUES ('last_run_id', ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", strconv.FormatInt(runID, 10)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	currentRun = runID
+	return nil
+}
+
+// Record the end of the run with the totals of the files it hashed.
+func finishRun(db *sql.DB, done totals) error {
+	_, err := db.Exec("UPDATE runs SET finished = ?, files = ?, bytes = ?, errors = ? WHERE id = ?",
+		time.Now().Unix(), done.files, done.bytes, atomic.LoadInt64(&fileErrors), currentRun)
+	return err
+}
+
+// Print the recorded runs, oldest first, one per line: the number, start
+// and finish times, the files and bytes hashed, the errors, the host and the
+// tag, then the arguments.
+func printRuns(w io.Writer, db *sql.DB) error {
+	rows, err := db.Query("SELECT id, started, COALESCE(finished, 0), COALESCE(files, 0), COALESCE(bytes, 0), COALESCE(errors, 0), COALESCE(host, ''), COALESCE(tag, ''), COALESCE(args, '') FROM runs ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	const layout = "2006-01-02 15:04:05"
+	for rows.Next() {
+		var id, started, finished, files, bytes, errors int64
+		var host, tag, args string
+		if err := rows.Scan(&id, &started, &finished, &files, &bytes, &errors, &host, &tag, &args); err != nil {
+			return err
+		}
+
+		end := "unfinished"
+		if finished != 0 {
+			end = time.Unix(finished, 0).Format(layout)
+		}
+		if tag == "" {
+			tag = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d files\t%s\t%d errors\t%s\t%s\t%s\n",
+			id, time.Unix(started, 0).Format(layout), end, files, formatBytes(bytes), errors, host, tag, args)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jcrussell/sha1files/sha1files"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Prefix of the stored paths of objects scanned from S3.
+const s3Prefix = "s3://"
+
+var (
+	// Buckets, or prefixes in them, to scan as s3://bucket/prefix.
+	s3Sources stringList
+
+	// Endpoint of an S3-compatible service such as MinIO, instead of AWS.
+	s3Endpoint string
+
+	// Take the ETag of objects uploaded in one part as their MD5 instead of
+	// downloading them.
+	s3TrustETag bool
+)
+
+func init() {
+	flag.Var(&s3Sources, "s3", "also scan the objects under `s3://bucket/prefix` (repeatable)")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "`URL` of an S3-compatible service to use for -s3 instead of AWS, e.g. http://localhost:9000 for MinIO")
+	flag.BoolVar(&s3TrustETag, "s3-trust-etag", false, "with -s3, store the ETag of objects uploaded in one part and not encrypted with KMS or a customer key as their md5 instead of downloading them (needs -hash md5)")
+}
+
+// A bucket and key prefix given to -s3.
+type s3Source struct {
+	bucket string
+	prefix string
+}
+
+// Parse a -s3 source. The prefix may be empty to scan the whole bucket.
+func parseS3Source(source string) (*s3Source, error) {
+	rest := strings.TrimPrefix(source, s3Prefix)
+	if rest == source || rest == "" || strings.HasPrefix(rest, "/") {
+		return nil, fmt.Errorf("invalid -s3 %q, want s3://bucket/prefix", source)
+	}
+
+	s := &s3Source{bucket: rest}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		s.bucket, s.prefix = rest[:i], rest[i+1:]
+	}
+	return s, nil
+}
+
+// Path an object is stored under.
+func (s *s3Source) storedPath(key string) string {
+	return s3Prefix + s.bucket + "/" + key
+}
+
+// Check that -s3 sources are valid and can be used with the other options.
+func checkS3() error {
+	if len(s3Sources) == 0 {
+		return nil
+	}
+
+	// Objects are streamed through the hasher, not read into memory
+	if fingerprintBytes > 0 {
+		return errors.New("-s3 cannot be used with -fingerprint")
+	}
+	if backupTo != "" {
+		return errors.New("-s3 cannot be used with -backup-to")
+	}
+
+	for _, source := range s3Sources {
+		if _, err := parseS3Source(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that the ETags of -s3-trust-etag have a column to go in. Needs the
+// algorithms of -hash, see checkHashes.
+func checkTrustETag() error {
+	if !s3TrustETag {
+		return nil
+	}
+	for _, name := range extraHashes {
+		if name == "md5" {
+			return nil
+		}
+	}
+	return errors.New("-s3-trust-etag stores ETags as the md5 of objects, add md5 to -hash")
+}
+
+// Create an S3 client with credentials and region from the standard AWS
+// chain: the environment, the shared config and credentials files, then the
+// instance or container role.
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// The whole object is hashed anyway, and not every service sends
+		// checksums
+		o.DisableLogOutputChecksumValidationSkipped = true
+
+		if s3Endpoint != "" {
+			// S3-compatible services rarely support virtual-hosted buckets
+			o.BaseEndpoint = aws.String(s3Endpoint)
+			o.UsePathStyle = true
+		}
+	}), nil
+}
+
+// The parts of an object used by the filters, as a file.
+type s3ObjectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (o *s3ObjectInfo) Name() string       { return o.name }
+func (o *s3ObjectInfo) Size() int64        { return o.size }
+func (o *s3ObjectInfo) Mode() os.FileMode  { return 0444 }
+func (o *s3ObjectInfo) ModTime() time.Time { return o.modTime }
+func (o *s3ObjectInfo) IsDir() bool        { return false }
+func (o *s3ObjectInfo) Sys() interface{}   { return nil }
+
+// Check whether an object would be skipped if its key were a local path:
+// some element is hidden or a directory named by -prune-dir.
+func skipKey(key string) bool {
+	elems := strings.Split(key, "/")
+	for i, elem := range elems {
+		if strings.HasPrefix(elem, ".") || (i < len(elems)-1 && isPruned(elem)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash every object under each -s3 source and send a record for each one to
+// out. Objects are streamed through the hasher rather than trusting their
+// ETag, which is not a hash of the contents for multipart uploads or
+// encrypted buckets, unless -s3-trust-etag is given.
+func scanS3Sources(out chan<- *record) {
+	if len(s3Sources) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	client, err := newS3Client(ctx)
+	if err != nil {
+		fileError(s3Prefix, "Error configuring S3: %s\n", err)
+		return
+	}
+
+	for _, arg := range s3Sources {
+		if budgetSpent || diskIsFull() || isInterrupted() {
+			return
+		}
+
+		// Already checked by checkS3
+		source, _ := parseS3Source(arg)
+
+		if err := scanS3(ctx, client, arg, source, out); err != nil {
+			fileError(arg, "Error scanning %s: %s\n", arg, err)
+		}
+	}
+}
+
+// Hash the objects under a single -s3 source, given as root. The scan stops
+// once interrupted, the disk is full or -max-bytes is spent, as for the -sftp
+// sources.
+func scanS3(ctx context.Context, client *s3.Client, root string, source *s3Source, out chan<- *record) error {
+	pages := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(source.bucket),
+		Prefix: aws.String(source.prefix),
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range page.Contents {
+			if diskIsFull() || isInterrupted() {
+				return nil
+			}
+
+			key := aws.ToString(obj.Key)
+			if strings.HasSuffix(key, "/") || skipKey(key) || resumeSkipKey(root, key) {
+				continue
+			}
+
+			info := &s3ObjectInfo{name: path.Base(key), size: aws.ToInt64(obj.Size), modTime: aws.ToTime(obj.LastModified)}
+			if !wantFile(source.storedPath(key), info) {
+				continue
+			}
+
+			if !withinBudget(root, key, info.size) {
+				return nil
+			}
+			walked := checkpoint{root: root, path: key}
+
+			start := time.Now()
+			if sum, ok := etagMD5(aws.ToString(obj.ETag)); ok && s3TrustETag {
+				plain, err := isPlainObject(ctx, client, source.bucket, key)
+				if err != nil {
+					fileError(source.storedPath(key), "Error reading object: %s: %s\n", source.storedPath(key), err)
+					continue
+				}
+				if plain {
+					// Only the md5 is known, the sha1 stays NULL
+					result := remoteRecord(source.storedPath(key), info, nil)
+					result.hashes = map[string]string{"md5": sum}
+					result.walked = walked
+					result.setTiming(time.Since(start))
+					out <- result
+					continue
+				}
+			}
+
+			d, err := s3Hash(ctx, client, source.bucket, key)
+			if err != nil {
+				fileError(source.storedPath(key), "Error reading object: %s: %s\n", source.storedPath(key), err)
+				continue
+			}
+
+			result := remoteRecord(source.storedPath(key), info, d)
+			result.walked = walked
+			result.setTiming(time.Since(start))
+			out <- result
+		}
+	}
+
+	return nil
+}
+
+// The MD5 an ETag stands for, if it is one: ETags of multipart uploads end
+// in -PARTS.
+func etagMD5(etag string) (string, bool) {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if len(etag) != 32 {
+		return "", false
+	}
+	for _, c := range etag {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", false
+		}
+	}
+	return etag, true
+}
+
+// Check whether the ETag of an object is the MD5 of its contents, which it
+// isn't if it is encrypted with KMS or a key of the customer's.
+func isPlainObject(ctx context.Context, client *s3.Client, bucket, key string) (bool, error) {
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return false, err
+	}
+	sse := string(head.ServerSideEncryption)
+	return (sse == "" || sse == "AES256") && head.SSECustomerAlgorithm == nil, nil
+}
+
+// Hash an object with every -hash algorithm by streaming it.
+func s3Hash(ctx context.Context, client *s3.Client, bucket, key string) (*sha1files.Digests, error) {
+	obj, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	return streamHash(key, obj.Body)
+}
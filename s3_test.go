@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Objects listed by the mock S3 service, in the shape of ListObjectsV2.
+type listBucketResult struct {
+	XMLName     xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string     `xml:"Name"`
+	Prefix      string     `xml:"Prefix"`
+	KeyCount    int        `xml:"KeyCount"`
+	MaxKeys     int        `xml:"MaxKeys"`
+	IsTruncated bool       `xml:"IsTruncated"`
+	Contents    []s3Object `xml:"Contents"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+// An S3 service on a local port serving the objects of one bucket with path
+// style URLs, as MinIO does: ListObjectsV2 on the bucket and GetObject and
+// HeadObject on its keys. Objects are downloaded by GetObject alone, counted
+// in gets.
+func mockS3(t *testing.T, bucket string, objects map[string]string, gets *int32) string {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	etag := func(contents string) string {
+		sum := md5.Sum([]byte(contents))
+		return `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if parts[0] != bucket {
+			http.Error(w, "NoSuchBucket", http.StatusNotFound)
+			return
+		}
+
+		if len(parts) == 1 || parts[1] == "" {
+			prefix := r.URL.Query().Get("prefix")
+			result := listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+			for key, contents := range objects {
+				if strings.HasPrefix(key, prefix) {
+					result.Contents = append(result.Contents, s3Object{Key: key, LastModified: modified.Format(time.RFC3339), ETag: etag(contents), Size: len(contents)})
+				}
+			}
+			sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+			result.KeyCount = len(result.Contents)
+
+			w.Header().Set("Content-Type", "application/xml")
+			xml.NewEncoder(w).Encode(result)
+			return
+		}
+
+		contents, ok := objects[parts[1]]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.Header().Set("ETag", etag(contents))
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(gets, 1)
+			w.Write([]byte(contents))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestScanS3(t *testing.T) {
+	defer func(saved stringList) { s3Sources = saved }(s3Sources)
+	defer func(saved string) { s3Endpoint = saved }(s3Endpoint)
+	defer func(saved bool) { s3TrustETag = saved }(s3TrustETag)
+	defer func(saved []string) { extraHashes = saved }(extraHashes)
+	defer func(saved bool) { quiet = saved }(quiet)
+	defer func() { lastQueued = checkpoint{} }()
+	quiet = true
+
+	// Credentials from the environment, with no config files or instance
+	// role to fall back on
+	dir := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CONFIG_FILE", dir+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", dir+"/credentials")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	objects := map[string]string{
+		"photos/a.jpg":   "alpha",
+		"photos/b/c.txt": "gamma",
+		"photos/.hidden": "hidden",
+		"photos/d/":      "",
+		"videos/e.mp4":   "epsilon",
+	}
+	var gets int32
+	s3Endpoint = mockS3(t, "bucket", objects, &gets)
+	s3Sources, extraHashes = stringList{"s3://bucket/photos/"}, []string{"md5"}
+
+	tests := []struct {
+		trustETag bool
+		gets      int32
+	}{
+		{false, 2},
+		// Both objects were uploaded in one part, so their ETags are their
+		// MD5s and nothing is downloaded
+		{true, 0},
+	}
+
+	for _, tt := range tests {
+		s3TrustETag = tt.trustETag
+		atomic.StoreInt32(&gets, 0)
+
+		out := make(chan *record)
+		go func() {
+			scanS3Sources(out)
+			close(out)
+		}()
+		records := []*record{}
+		for r := range out {
+			records = append(records, r)
+		}
+
+		got := []string{}
+		for _, r := range records {
+			key := strings.TrimPrefix(r.path, "s3://bucket/")
+			got = append(got, key)
+
+			sum := md5.Sum([]byte(objects[key]))
+			if r.hashes["md5"] != hex.EncodeToString(sum[:]) {
+				t.Errorf("-s3-trust-etag=%t: %s has md5 %q", tt.trustETag, r.path, r.hashes["md5"])
+			}
+			wantSha1 := hashBytes([]byte(objects[key]))
+			if tt.trustETag {
+				wantSha1 = ""
+			}
+			if r.sha1 != wantSha1 || r.size != int64(len(objects[key])) {
+				t.Errorf("-s3-trust-etag=%t: %s has sha1 %q and size %d", tt.trustETag, r.path, r.sha1, r.size)
+			}
+		}
+		sort.Strings(got)
+		if want := []string{"photos/a.jpg", "photos/b/c.txt"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("-s3-trust-etag=%t: scanned %v, want %v", tt.trustETag, got, want)
+		}
+		if n := atomic.LoadInt32(&gets); n != tt.gets {
+			t.Errorf("-s3-trust-etag=%t: downloaded %d objects, want %d", tt.trustETag, n, tt.gets)
+		}
+
+		// Stored under their s3:// paths
+		if !tt.trustETag {
+			db := testDB(t, records...)
+			if sum := storedSha1(t, db, "s3://bucket/photos/a.jpg"); sum != hashBytes([]byte("alpha")) {
+				t.Errorf("s3://bucket/photos/a.jpg stored with %q", sum)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Report file names that occur with different contents.
+var sameName bool
+
+func init() {
+	flag.BoolVar(&sameName, "same-name", false, "print groups of files with the same name but different content (after the scan if DIRs are given)")
+}
+
+// Files sharing a name, with differing contents.
+type nameGroup struct {
+	name   string
+	hashes []string
+	paths  []string
+}
+
+// Find every file name recorded with more than one distinct hash, such as a
+// movie.mp4 that was re-encoded in one copy of a library. Each group's paths
+// are sorted by hash then path, so copies with the same content are together.
+func findSameName(db *sql.DB) ([]*nameGroup, error) {
+	view := filesView()
+	query := "SELECT extless, ext, sha1, path FROM " + view + " WHERE sha1 IS NOT NULL AND (extless, ext) IN " +
+		"(SELECT extless, ext FROM " + view + " WHERE sha1 IS NOT NULL GROUP BY extless, ext HAVING COUNT(DISTINCT sha1) > 1) " +
+		"ORDER BY extless, ext, sha1, path"
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*nameGroup{}
+	for rows.Next() {
+		var extless, ext, hash, path string
+		if err := rows.Scan(&extless, &ext, &hash, &path); err != nil {
+			return nil, err
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].name != extless+ext {
+			groups = append(groups, &nameGroup{name: extless + ext})
+		}
+		group := groups[len(groups)-1]
+		group.hashes = append(group.hashes, hash)
+		group.paths = append(group.paths, path)
+	}
+
+	return groups, rows.Err()
+}
+
+// Print each file name with differing contents followed by the indented hash
+// and path of every copy.
+func printSameName(w io.Writer, db *sql.DB) error {
+	groups, err := findSameName(db)
+	if err != nil {
+		return err
+	}
+
+	for i, group := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		fmt.Fprintf(w, "%s (%d copies)\n", group.name, len(group.paths))
+		for j, path := range group.paths {
+			fmt.Fprintf(w, "  %s  %s\n", group.hashes[j], path)
+		}
+	}
+
+	return nil
+}
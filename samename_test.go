@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrintSameName(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"2019/movie.mp4": "original",
+		"2020/movie.mp4": "re-encoded",
+		"copy/movie.mp4": "original",
+		// The same name throughout with the same content isn't reported
+		"2019/notes.txt": "notes",
+		"2020/notes.txt": "notes",
+		"2020/movie.mkv": "other",
+	})
+	original, encoded := hashBytes([]byte("original")), hashBytes([]byte("re-encoded"))
+
+	// Copies with the same content are together
+	copies := []string{
+		original + "  " + filepath.Join(root, "2019", "movie.mp4"),
+		original + "  " + filepath.Join(root, "copy", "movie.mp4"),
+		encoded + "  " + filepath.Join(root, "2020", "movie.mp4"),
+	}
+	if encoded < original {
+		copies = append(copies[2:], copies[:2]...)
+	}
+	want := "movie.mp4 (3 copies)\n"
+	for _, line := range copies {
+		want += "  " + line + "\n"
+	}
+
+	for _, normalized = range []bool{false, true} {
+		all := []*record{}
+		for _, r := range scanRecords(t, root) {
+			all = append(all, r)
+		}
+		db := testDB(t, all...)
+
+		var buf bytes.Buffer
+		if err := printSameName(&buf, db); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("normalized=%t: printed\n%s\nwant\n%s", normalized, got, want)
+		}
+	}
+}
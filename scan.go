@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of records that may wait for the committer before hashing blocks.
+const resultsBuffer = 1024
+
+var (
+	// Number of goroutines reading file contents from disk.
+	ioWorkers int
+
+	// Number of goroutines computing hashes of the contents read.
+	hashWorkers int
+
+	// Sets both -io-workers and -hash-workers when given.
+	workers int
+
+	// Upper bound on the bytes of file contents held in memory between the
+	// read and hash stages.
+	bufferMem int64
+
+	// Files larger than this are hashed as they are read even when an option
+	// needs their whole contents, 0 for no limit.
+	maxReadSize int64
+)
+
+func init() {
+	flag.IntVar(&ioWorkers, "io-workers", 4, "number of files to read from disk concurrently")
+	flag.IntVar(&hashWorkers, "hash-workers", runtime.NumCPU(), "number of files to hash concurrently")
+	flag.IntVar(&workers, "workers", 0, "set both -io-workers and -hash-workers to `N`, e.g. to match GOMAXPROCS")
+	flag.Int64Var(&bufferMem, "buffer-mem", 256<<20, "maximum `BYTES` of file contents buffered between reading and hashing")
+	flag.Int64Var(&maxReadSize, "max-read-size", 4<<30, "read files larger than `BYTES` as they are hashed even for the options that need whole files, such as -fuzzy (0 for no limit)")
+}
+
+// Apply -workers to both worker pools.
+func applyWorkers() {
+	if workers > 0 {
+		ioWorkers, hashWorkers = workers, workers
+	}
+}
+
+// A file making its way through the scan pipeline.
+type job struct {
+	path   string
+	info   os.FileInfo
+	sparse bool
+	data   []byte
+
+	// Time spent reading the contents
+	readTime time.Duration
+
+	// Where the walk found the file
+	walked checkpoint
+
+	// The file is hashed as it is read, its contents passed through pipe
+	// rather than data
+	streamed bool
+	pipe     *chunkPipe
+
+	// The job is a -bundle-ext directory, data is its manifest and size the
+	// total size of its files
+	bundle bool
+	size   int64
+
+	// The inode's hard links, if this is the link to hash for all of them
+	links *linkedInode
+}
+
+// Check whether the job's contents have to be read into memory whole rather
+// than hashed as they are read: for a bundle's manifest, a fingerprint, the
+// extents of a sparse file, a fuzzy hash or an archive's members.
+func (j *job) needsWhole() bool {
+	return j.bundle || fingerprintBytes > 0 || (j.sparse && sparseMode == "extents") ||
+		fuzzyHashes || isArchive(j.info.Name())
+}
+
+// Bytes of memory the job's contents will take once read.
+func (j *job) bufferSize() int64 {
+	if j.streamed {
+		n := readAhead * chunkSize(j.info.Size())
+		if blockSize > 0 {
+			n += blockSize
+		}
+		return n
+	}
+	return j.wholeSize()
+}
+
+// Bytes of memory the job's contents would take read whole.
+func (j *job) wholeSize() int64 {
+	if fingerprintBytes > 0 && j.info.Size() > 2*fingerprintBytes {
+		return 2 * fingerprintBytes
+	}
+	if j.sparse && sparseMode == "extents" {
+		return allocatedSize(j.info)
+	}
+	return j.info.Size()
+}
+
+// Size of the job's contents, the total size of its files for a bundle.
+func (j *job) contentSize() int64 {
+	if j.bundle {
+		return j.size
+	}
+	return j.info.Size()
+}
+
+// The record of the job's file from its stat alone, without a hash.
+func (j *job) statRecord() *record {
+	result := statRecord(j.path, j.info)
+	if j.bundle {
+		result.size = j.size
+	}
+	result.walked = j.walked
+	return result
+}
+
+// Read the contents of the job's file.
+func (j *job) read() ([]byte, error) {
+	if j.bundle {
+		data, size, err := bundleManifest(j.path)
+		j.size = size
+		return data, err
+	}
+	if fingerprintBytes > 0 {
+		return readFingerprintData(j.path, j.info.Size(), fingerprintBytes)
+	}
+	if j.sparse && sparseMode == "extents" {
+		return readExtents(j.path)
+	}
+	return ioutil.ReadFile(j.path)
+}
+
+// Limits the total size of the file contents in flight. A file larger than
+// the limit is still let through when nothing else is in flight so it cannot
+// block forever.
+type memLimiter struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	max   int64
+	inUse int64
+}
+
+func newMemLimiter(max int64) *memLimiter {
+	l := &memLimiter{max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Block until n bytes can be buffered.
+func (l *memLimiter) acquire(n int64) {
+	l.mu.Lock()
+	for l.inUse > 0 && l.inUse+n > l.max {
+		l.cond.Wait()
+	}
+	l.inUse += n
+	l.mu.Unlock()
+}
+
+// Return n bytes acquired earlier.
+func (l *memLimiter) release(n int64) {
+	l.mu.Lock()
+	l.inUse -= n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// Check whether a directory name was given to -prune-dir.
+func isPruned(name string) bool {
+	for _, pruned := range pruneDirs {
+		if name == pruned {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide whether a path should be left out of the scan: if the file starts
+// with a ".", matches -exclude or is a directory named by -prune-dir or
+// -skip-system-dirs.
+func skipPath(path string, info os.FileInfo) bool {
+	name := info.Name()
+	if strings.HasPrefix(name, ".") && name != "." && name != ".." {
+		// Skip hidden files and directories, but not a root of "." or ".."
+		// as given with -no-abs
+		return true
+	}
+
+	if info.IsDir() && (isPruned(info.Name()) || (skipSystemDirs && isSystemDir(path, info.Name()))) {
+		infof("Pruning dir: %s\n", path)
+		return true
+	}
+
+	if isExcluded(path, info) {
+		return true
+	}
+
+	if info.IsDir() && backupTo != "" {
+		// Don't back up the backups. Paths are relative with -no-abs.
+		if abs, err := filepath.Abs(path); err == nil && abs == backupTo {
+			return true
+		}
+	}
+
+	return false
+}
+
+// What a Walk function returns to leave out a path: filepath.SkipDir for a
+// directory, nil for a file since SkipDir would skip the rest of its
+// directory too.
+func skipEntry(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// Check a file against the filters that only need its path and the stat done
+// by Walk. These run first so that excluded files cost as little as possible.
+func wantFile(path string, info os.FileInfo) bool {
+	if len(includeExts) > 0 && !hasExt(info.Name(), includeExts) {
+		return false
+	}
+
+	if skipEmpty && info.Size() == 0 {
+		return false
+	}
+
+	if !wantSizeAndType(info.Name(), info.Size()) {
+		return false
+	}
+
+	if !isIncluded(path, info) {
+		return false
+	}
+
+	return filterMatches(path, info)
+}
+
+// Check whether a file name ends in one of the extensions, ignoring case. The
+// extensions may be given with or without the leading ".".
+func hasExt(name string, exts []string) bool {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return false
+	}
+
+	for _, want := range exts {
+		if strings.EqualFold(ext[1:], strings.TrimPrefix(want, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash every file under the roots and send a record for each one to out.
+// Files flow through three stages: the walk, a pool of -io-workers reading
+// contents and a pool of -hash-workers hashing them, so that disk and CPU
+// parallelism can be tuned separately. Most files are passed between the two
+// a -bufsize chunk at a time, those an option needs whole are read into
+// memory first.
+func scan(roots []string, out chan<- *record) {
+	if ioWorkers < 1 {
+		ioWorkers = 1
+	}
+	if hashWorkers < 1 {
+		hashWorkers = 1
+	}
+
+	paths := make(chan *job, ioWorkers)
+	loaded := make(chan *job, hashWorkers)
+	limiter := newMemLimiter(bufferMem)
+	links := newHardlinks()
+
+	go func() {
+		// With -dedup-scan, files are only gathered during the walk and
+		// sent once all their sizes are known. With -no-hash, they are
+		// recorded from their stat without going through the readers.
+		var gathered []*job
+		queue := func(j *job) {
+			if noHash {
+				result := j.statRecord()
+				out <- result
+				links.hashed(j, result, out)
+				return
+			}
+			if dedupScan {
+				gathered = append(gathered, j)
+			} else {
+				paths <- j
+			}
+		}
+
+		for _, root := range roots {
+			if budgetSpent || diskIsFull() || isInterrupted() {
+				break
+			}
+
+			// The first file walked is the root, for -one-filesystem
+			var rootInfo os.FileInfo
+
+			filepath.Walk(root, trackEmptyDirs(walkLinks(root, func(path string, info os.FileInfo, err error) error {
+				if diskIsFull() {
+					return errDiskFull
+				}
+				if isInterrupted() {
+					return errInterrupted
+				}
+
+				if err != nil {
+					fileError(storedPath(path), "Error walking: %s\n", err)
+					return nil
+				}
+
+				if skipPath(path, info) || isIgnored(path, info) {
+					return skipEntry(info)
+				}
+
+				if otherFilesystem(path, rootInfo, info) {
+					return filepath.SkipDir
+				}
+				if rootInfo == nil {
+					rootInfo = info
+				}
+
+				if resumeSkip(root, path) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				if isBundleDir(info) {
+					j := &job{path: path, info: info, bundle: true, size: bundleSize(path), walked: checkpoint{root: root, path: path}}
+					if !withinBudget(root, path, j.size) {
+						return errBudgetSpent
+					}
+					queue(j)
+					return filepath.SkipDir
+				}
+
+				if info.IsDir() {
+					infof("Descending into dir: %s\n", info.Name())
+					return nil
+				}
+
+				if !wantFile(path, info) {
+					return nil
+				}
+
+				if isUnchanged(path, info) {
+					return nil
+				}
+
+				sparse := isSparse(info)
+				if sparse && sparseMode == "skip" {
+					fileSkipped("sparse", path)
+					return nil
+				}
+
+				j := &job{path: path, info: info, sparse: sparse, walked: checkpoint{root: root, path: path}}
+				j.streamed = !j.needsWhole()
+				if maxReadSize > 0 && j.wholeSize() > maxReadSize {
+					// Extents need the whole file, as does the plaintext
+					// -decrypt buffers
+					if isEncrypted(path) || (sparse && sparseMode == "extents") {
+						fileSkipped("too large", path)
+						return nil
+					}
+					j.streamed = true
+				}
+
+				if !links.claim(j, out) {
+					// Another link to the file is hashed instead
+					return nil
+				}
+
+				if !withinBudget(root, path, info.Size()) {
+					return errBudgetSpent
+				}
+
+				queue(j)
+
+				if includeStreams {
+					queueStreams(path, func(stream *job) {
+						stream.walked = j.walked
+						queue(stream)
+					})
+				}
+				return nil
+			})))
+		}
+
+		if dedupScan {
+			shared, unique := splitBySize(gathered)
+			for _, j := range unique {
+				result := j.statRecord()
+				out <- result
+				links.hashed(j, result, out)
+			}
+			for _, j := range shared {
+				paths <- j
+			}
+		}
+		close(paths)
+	}()
+
+	readers := &sync.WaitGroup{}
+	for i := 0; i < ioWorkers; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+
+			for j := range paths {
+				limiter.acquire(j.bufferSize())
+
+				var data []byte
+				var err error
+				var f *os.File
+				start := time.Now()
+				if j.streamed {
+					// The file is read as a hasher hashes it
+					f, err = os.Open(j.path)
+				} else {
+					data, err = j.read()
+				}
+				j.readTime = time.Since(start)
+				if err != nil && isLocked(err) {
+					fileSkipped("locked", j.path)
+					links.failed(j, func(link string) { fileSkipped("locked", link) })
+					limiter.release(j.bufferSize())
+					continue
+				} else if err != nil {
+					fileError(storedPath(j.path), "Error reading file: %s\n", err)
+					links.failed(j, func(link string) {
+						fileError(storedPath(link), "Error reading file: %s: hard link of %s\n", err, j.path)
+					})
+					limiter.release(j.bufferSize())
+					continue
+				}
+
+				if j.streamed {
+					j.pipe = newChunkPipe(j.info.Size())
+					loaded <- j
+					j.pipe.fill(f)
+					f.Close()
+					continue
+				}
+
+				j.data = data
+				loaded <- j
+			}
+		}()
+	}
+
+	go func() {
+		readers.Wait()
+		close(loaded)
+	}()
+
+	hashers := &sync.WaitGroup{}
+	for i := 0; i < hashWorkers; i++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+
+			for j := range loaded {
+				start := time.Now()
+
+				if j.streamed {
+					result, err := streamRecord(j, j.pipe)
+					j.pipe.Close()
+					limiter.release(j.bufferSize())
+					switch {
+					case err != nil:
+						fileError(storedPath(j.path), "Error reading file: %s\n", err)
+						links.failed(j, func(link string) {
+							fileError(storedPath(link), "Error reading file: %s: hard link of %s\n", err, j.path)
+						})
+					case result == nil:
+						links.failed(j, func(link string) { fileSkipped("mime-excluded", link) })
+					case isArchive(j.info.Name()):
+						// The members are read from the file again
+						sendArchive(result, j.path, nil, out)
+						links.hashed(j, result, out)
+					default:
+						out <- result
+						links.hashed(j, result, out)
+					}
+					continue
+				}
+
+				if j.bundle {
+					result := newRecord(j.path, j.info, j.data)
+					result.size = j.size
+					result.walked = j.walked
+					result.setTiming(j.readTime + time.Since(start))
+					limiter.release(j.bufferSize())
+					out <- result
+					continue
+				}
+
+				data := j.data
+				encrypted := isEncrypted(j.path)
+				if encrypted {
+					var err error
+					data, err = decrypt(j.path, j.data)
+					if err != nil {
+						fileError(storedPath(j.path), "Error decrypting file: %s: %s\n", j.path, err)
+						links.failed(j, func(link string) {
+							fileError(storedPath(link), "Error decrypting file: %s: %s, hard link of %s\n", link, err, j.path)
+						})
+						limiter.release(j.bufferSize())
+						continue
+					}
+				}
+
+				// The sniff reuses the contents read for hashing
+				mime := sniffMime(data)
+				if !wantMime(mime) || !wantType(j.info.Name(), mime) {
+					fileSkipped("mime-excluded", j.path)
+					links.failed(j, func(link string) { fileSkipped("mime-excluded", link) })
+					limiter.release(j.bufferSize())
+					continue
+				}
+
+				result := newRecord(j.path, j.info, data)
+				result.sparse = j.sparse
+				if j.sparse && sparseMode == "extents" {
+					// Not the file's SHA1, which -verify and -dupes compare
+					result.extentsSha1, result.sha1 = result.sha1, ""
+					result.hashes = nil
+				}
+				result.walked = j.walked
+				result.encrypted = encrypted
+				result.mime = mime
+				result.setTiming(j.readTime + time.Since(start))
+				if backupTo != "" {
+					if err := backupFile(j.path, j.info, j.data, result.sha1); err != nil {
+						fileError(storedPath(j.path), "Error backing up file: %s: %s\n", j.path, err)
+					}
+				}
+				if isArchive(j.info.Name()) {
+					// The members are read from the contents in memory
+					sendArchive(result, j.path, data, out)
+					limiter.release(j.bufferSize())
+				} else {
+					limiter.release(j.bufferSize())
+					out <- result
+				}
+				links.hashed(j, result, out)
+			}
+		}()
+	}
+
+	hashers.Wait()
+}
+
+// Queue the named streams of a file (see -include-streams) to be hashed as
+// files of their own. Errors are logged and otherwise ignored since streams
+// are best effort.
+func queueStreams(path string, queue func(*job)) {
+	streams, err := listStreams(path)
+	if err != nil {
+		fileError(storedPath(path), "Error listing streams: %s: %s\n", path, err)
+		return
+	}
+
+	for _, stream := range streams {
+		info, err := os.Stat(stream)
+		if err != nil {
+			fileError(storedPath(stream), "Error reading stream: %s\n", err)
+			continue
+		}
+
+		queue(&job{path: stream, info: info})
+	}
+}
+
+// Create the record for a file from its stat alone, without a hash.
+func statRecord(path string, info os.FileInfo) *record {
+	ext := filepath.Ext(info.Name())
+	extless := strings.Replace(info.Name(), ext, "", -1)
+
+	result := &record{
+		extless: extless,
+		ext:     ext,
+		path:    storedPath(path),
+		size:    info.Size(),
+		mtime:   info.ModTime().Unix(),
+		seen:    time.Now().Unix(),
+		ctime:   changeTime(info),
+		job:     jobLabel,
+	}
+	result.mode, result.uid, result.gid, result.hasOwner = fileOwner(info)
+	result.viaLink = viaLink(info)
+
+	if readBtime {
+		result.btime = birthTime(path, info)
+	}
+
+	if !info.IsDir() {
+		result.nlink, result.dev, result.inode = fileLinks(path, info)
+	}
+
+	if readXattrs {
+		var err error
+		if result.xattrs, err = xattrsJSON(path); err != nil {
+			fileError(storedPath(path), "Error reading xattrs: %s: %s\n", path, err)
+		}
+	}
+
+	return result
+}
+
+// Create the record for a file given its contents.
+func newRecord(path string, info os.FileInfo, data []byte) *record {
+	result := statRecord(path, info)
+
+	if fingerprintBytes > 0 {
+		// Only part of the file was read, there is no full hash
+		result.fingerprint = fingerprint(info.Size(), data)
+		return result
+	}
+
+	// The contents are already decrypted
+	d, err := scanHasher().Sum(path, bytes.NewReader(data), nil)
+	if err != nil {
+		fileError(storedPath(path), "Error hashing file: %s: %s\n", path, err)
+		return result
+	}
+	result.sha1, result.hashes, result.contentID = d.SHA1, d.Hashes, d.ContentID
+
+	// -verify can't rehash the plaintext of encrypted files or bundles a
+	// block at a time
+	if blockSize > 0 && int64(len(data)) > blockSize && !isEncrypted(path) && !isBundleDir(info) {
+		result.blocks = hashBlocks(data, blockSize)
+		result.blockSize = blockSize
+	}
+
+	if fuzzyHashes {
+		result.fuzzy = fuzzyHash(data)
+	}
+
+	return result
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Create the files under dir, named by their slash-separated paths.
+func writeTree(t testing.TB, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Scan root and return the records sent, by path relative to it.
+func scanRecords(t testing.TB, root string) map[string]*record {
+	out := make(chan *record)
+	go func() {
+		scan([]string{root}, out)
+		close(out)
+	}()
+
+	records := map[string]*record{}
+	for r := range out {
+		rel, err := filepath.Rel(root, r.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[filepath.ToSlash(rel)] = r
+	}
+	return records
+}
+
+// Scan root and return the paths recorded, relative to it and sorted.
+func scanPaths(t testing.TB, root string) []string {
+	out := make(chan *record)
+	go func() {
+		scan([]string{root}, out)
+		close(out)
+	}()
+
+	paths := []string{}
+	for r := range out {
+		rel, err := filepath.Rel(root, r.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestPruneDir(t *testing.T) {
+	defer func(saved stringList) { pruneDirs = saved }(pruneDirs)
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.txt":               "a",
+		"cache/b.txt":         "b",
+		"src/cache/c.txt":     "c",
+		"src/cache/sub/d.txt": "d",
+		"src/e.txt":           "e",
+		"src/tmp/f.txt":       "f",
+		"src/cached/g.txt":    "g",
+		"cache.txt":           "h",
+	})
+
+	tests := []struct {
+		prune stringList
+		want  []string
+	}{
+		{nil, []string{"a.txt", "cache.txt", "cache/b.txt", "src/cache/c.txt", "src/cache/sub/d.txt", "src/cached/g.txt", "src/e.txt", "src/tmp/f.txt"}},
+		{stringList{"cache"}, []string{"a.txt", "cache.txt", "src/cached/g.txt", "src/e.txt", "src/tmp/f.txt"}},
+		{stringList{"cache", "tmp"}, []string{"a.txt", "cache.txt", "src/cached/g.txt", "src/e.txt"}},
+		{stringList{"src"}, []string{"a.txt", "cache.txt", "cache/b.txt"}},
+	}
+
+	for _, tt := range tests {
+		pruneDirs = tt.prune
+		if got := scanPaths(t, root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-prune-dir %v scanned %v, want %v", tt.prune, got, tt.want)
+		}
+	}
+}
+
+func TestNoAbs(t *testing.T) {
+	defer func(saved bool) { noAbs = saved }(noAbs)
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"work/a.txt": "a", "work/sub/b.txt": "b", "other/c.txt": "c"})
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(filepath.Join(dir, "work")); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary directory may be behind a symlink, as on macOS
+	work, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		noAbs bool
+		want  []string
+	}{
+		{true, []string{"../other/c.txt", "a.txt", "sub/b.txt"}},
+		{false, []string{filepath.Join(filepath.Dir(work), "other/c.txt"), filepath.Join(work, "a.txt"), filepath.Join(work, "sub/b.txt")}},
+	}
+
+	for _, tt := range tests {
+		noAbs = tt.noAbs
+		out := make(chan *record)
+		go func() {
+			scan(resolveRoots([]string{".", "../other"}), out)
+			close(out)
+		}()
+
+		got := []string{}
+		for r := range out {
+			got = append(got, filepath.ToSlash(r.path))
+		}
+		sort.Strings(got)
+		for i := range tt.want {
+			tt.want[i] = filepath.ToSlash(tt.want[i])
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-no-abs=%t stored %v, want %v", tt.noAbs, got, tt.want)
+		}
+	}
+}
+
+// A mixed tree: many small files and a few large ones.
+func benchmarkTree(b *testing.B) string {
+	root := b.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 500; i++ {
+		files[fmt.Sprintf("small/%03d.txt", i)] = strings.Repeat("x", 4<<10+i)
+	}
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("large/%d.bin", i)] = strings.Repeat(string(rune('a'+i)), 8<<20)
+	}
+	writeTree(b, root, files)
+	return root
+}
+
+// Each worker both reads and hashes whole files, as scans did before
+// -io-workers and -hash-workers.
+func combinedScan(root string, workers int, out chan<- *record) {
+	paths := make(chan string)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					continue
+				}
+				out <- newRecord(path, info, data)
+			}
+		}()
+	}
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths <- path
+		}
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+}
+
+func BenchmarkScanPools(b *testing.B) {
+	defer func(io, hash int) { ioWorkers, hashWorkers = io, hash }(ioWorkers, hashWorkers)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := benchmarkTree(b)
+	cpus := runtime.NumCPU()
+
+	drain := func(scan func(out chan<- *record)) {
+		out := make(chan *record, 64)
+		go func() {
+			scan(out)
+			close(out)
+		}()
+		for range out {
+		}
+	}
+
+	b.Run("combined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			drain(func(out chan<- *record) { combinedScan(root, cpus, out) })
+		}
+	})
+
+	b.Run("split", func(b *testing.B) {
+		ioWorkers, hashWorkers = 4*cpus, cpus
+		for i := 0; i < b.N; i++ {
+			drain(func(out chan<- *record) { scan([]string{root}, out) })
+		}
+	})
+}
+
+func BenchmarkIncludeExt(b *testing.B) {
+	defer func(saved stringList) { includeExts = saved }(includeExts)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	// One file in a hundred is kept
+	root := b.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("%02d/%04d.txt", i%20, i)
+		if i%100 == 0 {
+			name = fmt.Sprintf("%02d/%04d.jpg", i%20, i)
+		}
+		files[name] = strings.Repeat("x", 16<<10)
+	}
+	writeTree(b, root, files)
+
+	for _, exts := range []stringList{nil, {".jpg"}} {
+		name := "all"
+		if exts != nil {
+			name = "include-ext"
+		}
+		b.Run(name, func(b *testing.B) {
+			includeExts = exts
+			for i := 0; i < b.N; i++ {
+				scanPaths(b, root)
+			}
+		})
+	}
+}
+
+func TestMaxReadSize(t *testing.T) {
+	defer func(saved int64) { maxReadSize = saved }(maxReadSize)
+	defer func(saved bool) { fuzzyHashes = saved }(fuzzyHashes)
+	defer func(saved func(string, io.Reader) (io.Reader, error)) { decryptor = saved }(decryptor)
+	defer func(saved stringList) { decryptExts = saved }(decryptExts)
+	defer log.SetOutput(os.Stderr)
+	maxReadSize, fuzzyHashes = 10000, true
+	decryptor, decryptExts = xorDecryptor, stringList{".x"}
+
+	small := strings.Repeat("small contents ", 500)
+	large := strings.Repeat("large contents ", 1000)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"small.txt":   small,
+		"large.txt":   large,
+		"large.txt.x": string(xorBytes([]byte(large), 0x5a)),
+	})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	skipped := skippedCounts()["too large"]
+	records := scanRecords(t, root)
+
+	// Files over the limit are hashed as they are read, without the fuzzy
+	// hash that needs them whole
+	if r := records["small.txt"]; r == nil || r.sha1 != hashBytes([]byte(small)) || r.fuzzy == "" {
+		t.Errorf("small.txt recorded as %+v", r)
+	}
+	if r := records["large.txt"]; r == nil || r.sha1 != hashBytes([]byte(large)) || r.fuzzy != "" {
+		t.Errorf("large.txt recorded as %+v", r)
+	}
+
+	// Decrypting holds the plaintext in memory, so those are skipped
+	if r, ok := records["large.txt.x"]; ok {
+		t.Errorf("large.txt.x recorded as %+v", r)
+	}
+	if n := skippedCounts()["too large"] - skipped; n != 1 {
+		t.Errorf("skipped %d files as too large, want 1", n)
+	}
+	if want := "Skipping too large file: " + filepath.Join(root, "large.txt.x"); !strings.Contains(logged.String(), want) {
+		t.Errorf("logged %q, want %q", logged.String(), want)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIncludeExtNoRead(t *testing.T) {
+	defer func(saved stringList) { includeExts = saved }(includeExts)
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.jpg": "a", "b.JPG": "b", "sub/c.jpg": "c"})
+
+	// Reading a FIFO blocks until something writes to it, so the scan only
+	// finishes if the filter leaves these out before opening them
+	for _, name := range []string{"d.txt", "e", "f.jpeg", "sub/g.png"} {
+		if err := syscall.Mkfifo(filepath.Join(root, filepath.FromSlash(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	includeExts = stringList{".jpg"}
+	done := make(chan []string)
+	go func() { done <- scanPaths(t, root) }()
+
+	select {
+	case got := <-done:
+		if want := []string{"a.jpg", "b.JPG", "sub/c.jpg"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("-include-ext .jpg scanned %v, want %v", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the scan is stuck reading a file that -include-ext leaves out")
+	}
+}
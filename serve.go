@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// Address to serve the database's HTTP API on instead of scanning.
+var serveAddr string
+
+func init() {
+	flag.StringVar(&serveAddr, "serve", "", "serve the db as an HTTP JSON API on `ADDR`, e.g. localhost:8080, instead of scanning")
+}
+
+// Check that -serve is not given DIRs to scan, the database is served as it
+// is.
+func checkServe(scanning bool) error {
+	if serveAddr != "" && scanning {
+		return fmt.Errorf("-serve cannot be combined with a scan, scan the DIRs first")
+	}
+	return nil
+}
+
+// Answer the HTTP API until killed:
+//
+//	GET /files?hash=PREFIX  the files whose hash starts with PREFIX
+//	GET /files?path=PATH    the file recorded at PATH
+//	GET /files?name=GLOB    the files whose name matches GLOB
+//	GET /dupes              the duplicate groups, as -dupes-format json
+//	GET /stats              totals of the database
+//
+// Files are listed as JSON arrays of the objects written by -also-json.
+func serve(db *sql.DB, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
+		serveFiles(w, r, db)
+	})
+	mux.HandleFunc("/dupes", func(w http.ResponseWriter, r *http.Request) {
+		serveDupes(w, r, db)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		serveStats(w, r, db)
+	})
+
+	log.Printf("Serving %s on http://%s/\n", dbPath, addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// Write v as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Answer with an error. Errors of the database are logged and not shown to
+// the client.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status == http.StatusInternalServerError {
+		errorf("Error serving %s: %s\n", r.URL, err)
+		err = fmt.Errorf("internal error")
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Check that a request only reads. Returns false once it has answered.
+func isGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// List the files looked up by hash prefix, stored path or name.
+func serveFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !isGet(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	hash, path, name := query.Get("hash"), query.Get("path"), query.Get("name")
+
+	var rows *sql.Rows
+	var err error
+	keep := anyPath
+	switch {
+	case hash != "":
+		if !isShortHash(hash) {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("invalid hash %q, want at least 4 hex digits", hash))
+			return
+		}
+		rows, err = queryShortHash(db, hash)
+	case path != "":
+		// Paths are looked up as stored, there is no directory to resolve
+		// relative ones against
+		rows, err = queryStoredPath(db, path)
+	case name != "":
+		if _, err := filepath.Match(name, ""); err != nil {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("invalid name %q: %s", name, err))
+			return
+		}
+		rows, err = queryFileName(db, name)
+		keep = nameMatches(name)
+	default:
+		writeError(w, r, http.StatusBadRequest, fmt.Errorf("want a hash, path or name parameter"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	matches, err := scanMatches(rows, keep)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	files := []*jsonRecord{}
+	for _, m := range matches {
+		files = append(files, newJSONRecord(m))
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// List the duplicate groups in the order of -dupes-sort.
+func serveDupes(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !isGet(w, r) {
+		return
+	}
+
+	groups, err := findDupes(db)
+	if err == nil {
+		err = sortDupes(groups)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := printDupesJSON(w, groups); err != nil {
+		errorf("Error serving %s: %s\n", r.URL, err)
+	}
+}
+
+// Totals of the database served by /stats.
+type dbStats struct {
+	Files     int64  `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	Hashes    int64  `json:"distinct_hashes"`
+	LastSeen  int64  `json:"last_seen"`
+	Algorithm string `json:"algorithm"`
+}
+
+// Count the files, their bytes and distinct contents.
+func serveStats(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !isGet(w, r) {
+		return
+	}
+
+	stats := &dbStats{}
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0), COUNT(DISTINCT sha1), COALESCE(MAX(last_seen), 0) FROM "+filesView()).
+		Scan(&stats.Files, &stats.Bytes, &stats.Hashes, &stats.LastSeen)
+	if err == nil {
+		stats.Algorithm, _, err = getMeta(db, "algorithm")
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A SQL server that scans can write to instead of SQLite, chosen by the
+// scheme of the -db DSN. Only the SQL that differs from SQLite's is here.
+type dialect struct {
+	name    string
+	schemes []string
+	driver  string
+
+	// Placeholder of the n-th parameter of a statement, from 1
+	placeholder func(n int) string
+
+	// Declarations of the path column, which is the key of the files
+	// table, and of the other text columns
+	pathDecl string
+	textDecl string
+
+	// Statements of the metadata table
+	metadataTable string
+	getMeta       string
+	setMeta       string
+
+	// Names of the columns of the files table
+	columnsQuery string
+
+	// Start of the clause updating the row of a path inserted again
+	upsert string
+
+	// Rewrite SQLite's expressions of the column updates, see column.update
+	rewrite func(expr string) string
+}
+
+var (
+	postgreSQL = &dialect{
+		name:          "PostgreSQL",
+		schemes:       []string{"postgres", "postgresql"},
+		driver:        "pgx",
+		placeholder:   func(n int) string { return fmt.Sprintf("$%d", n) },
+		pathDecl:      "TEXT PRIMARY KEY",
+		textDecl:      "TEXT",
+		metadataTable: "CREATE TABLE IF NOT EXISTS metadata (key TEXT PRIMARY KEY, value TEXT)",
+		getMeta:       "SELECT value FROM metadata WHERE key = $1",
+		setMeta:       "INSERT INTO metadata (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = excluded.value",
+		columnsQuery:  "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'files'",
+		upsert:        "ON CONFLICT (path) DO UPDATE SET ",
+		rewrite: func(expr string) string {
+			return sqliteIs.ReplaceAllString(expr, " IS NOT DISTINCT FROM ")
+		},
+	}
+
+	// Paths are compared byte for byte, the default collation would treat
+	// paths differing in case as the same. InnoDB can't index a longer
+	// key.
+	mySQL = &dialect{
+		name:          "MySQL",
+		schemes:       []string{"mysql"},
+		driver:        "mysql",
+		placeholder:   func(int) string { return "?" },
+		pathDecl:      "VARCHAR(768) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL PRIMARY KEY",
+		textDecl:      "MEDIUMTEXT",
+		metadataTable: "CREATE TABLE IF NOT EXISTS metadata (`key` VARCHAR(255) PRIMARY KEY, value TEXT)",
+		getMeta:       "SELECT value FROM metadata WHERE `key` = ?",
+		setMeta:       "INSERT INTO metadata (`key`, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+		columnsQuery:  "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'files'",
+		upsert:        "ON DUPLICATE KEY UPDATE ",
+		rewrite: func(expr string) string {
+			expr = sqliteIs.ReplaceAllString(expr, " <=> ")
+			return excludedColumn.ReplaceAllString(expr, "VALUES($1)")
+		},
+	}
+
+	dialects = []*dialect{postgreSQL, mySQL}
+
+	// SQLite's null-safe comparison and its name for the inserted row
+	sqliteIs       = regexp.MustCompile(` IS `)
+	excludedColumn = regexp.MustCompile(`excluded\.(\w+)`)
+)
+
+// Find the dialect of a -db value, nil for the path of a SQLite database.
+func serverDialect(path string) *dialect {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil
+	}
+	for _, d := range dialects {
+		for _, scheme := range d.schemes {
+			if u.Scheme == scheme {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// Translate a -db URL to what the dialect's driver takes. The PostgreSQL
+// driver takes URLs as they are, the MySQL one its own format.
+func (d *dialect) dsn(path string) (string, error) {
+	if d != mySQL {
+		return path, nil
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	config := mysql.NewConfig()
+	config.User = u.User.Username()
+	config.Passwd, _ = u.User.Password()
+	config.Net = "tcp"
+	config.Addr = u.Host
+	config.DBName = strings.TrimPrefix(u.Path, "/")
+	config.Params = map[string]string{}
+	for key, values := range u.Query() {
+		config.Params[key] = values[0]
+	}
+	return config.FormatDSN(), nil
+}
+
+// Declaration of a files column for the dialect. SQLite ignores the lengths
+// of its CHAR columns but servers do not, and a file's extension can be
+// longer than three characters.
+func (d *dialect) decl(c column) string {
+	switch {
+	case c.name == "path":
+		return d.pathDecl
+	case c.decl == "INTEGER":
+		return "BIGINT"
+	}
+	return d.textDecl
+}
+
+// A PostgreSQL or MySQL database. It has the files table of the flat schema
+// and the metadata table; the runs, errors and other tables only SQLite
+// databases have.
+type serverStore struct {
+	db      *sql.DB
+	dialect *dialect
+
+	// Statement inserting a record
+	insert string
+}
+
+// Connect to the server database named by a -db URL and create its tables,
+// or add the files columns a table created by an older version lacks.
+func openServerStore(path string, d *dialect) (*serverStore, error) {
+	dsn, err := d.dsn(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &serverStore{db: db, dialect: d}
+	if err := s.createTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.insert = s.insertStatement()
+	return s, nil
+}
+
+// Create the tables if they do not exist yet, adding missing files columns.
+func (s *serverStore) createTables() error {
+	columns := append(fileColumns, hashColumn())
+
+	decls := []string{}
+	for _, c := range columns {
+		decls = append(decls, c.name+" "+s.dialect.decl(c))
+	}
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS files (%s)", strings.Join(decls, ", ")),
+		s.dialect.metadataTable,
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("%q: %s", err, stmt)
+		}
+	}
+
+	rows, err := s.db.Query(s.dialect.columnsQuery)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range columns {
+		if existing[c.name] {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE files ADD COLUMN %s %s", c.name, s.dialect.decl(c))
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("%q: %s", err, stmt)
+		}
+	}
+	return nil
+}
+
+// Order the column updates of an upsert for MySQL, which assigns them left to
+// right so that later ones read the new values: the columns kept with the
+// hash go first, while the row has its old hash, then the hash, while it has
+// its old size and mtime.
+func updateOrder(columns []column) []column {
+	rank := func(c column) int {
+		switch {
+		case c.update == keepHash:
+			return 1
+		case strings.Contains(c.update, "files.{hash}"):
+			return 0
+		}
+		return 2
+	}
+
+	ordered := append([]column{}, columns...)
+	sort.SliceStable(ordered, func(i, j int) bool { return rank(ordered[i]) < rank(ordered[j]) })
+	return ordered
+}
+
+// Build the statement inserting a row into files, updating the row of a path
+// that is already recorded, like insertStatement does for SQLite.
+func (s *serverStore) insertStatement() string {
+	columns := append(fileColumns, hashColumn())
+
+	names, params, updates := []string{}, []string{}, []string{}
+	for i, c := range columns {
+		names = append(names, c.name)
+		params = append(params, s.dialect.placeholder(i+1))
+	}
+
+	for _, c := range updateOrder(columns) {
+		if c.name == "path" {
+			continue
+		}
+		update := strings.Replace(c.update, "{hash}", hashColumn().name, -1)
+		if update == "" {
+			update = "excluded." + c.name
+		}
+		updates = append(updates, c.name+" = "+s.dialect.rewrite(update))
+	}
+
+	return fmt.Sprintf("INSERT INTO files (%s) VALUES (%s) %s%s",
+		strings.Join(names, ", "), strings.Join(params, ", "), s.dialect.upsert, strings.Join(updates, ", "))
+}
+
+func (s *serverStore) Commit(records []*record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		values := insertValues(r)
+		for i, v := range values {
+			// SQLite stores booleans as integers, which servers don't do
+			// for us
+			if b, ok := v.(bool); ok {
+				values[i] = 0
+				if b {
+					values[i] = 1
+				}
+			}
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *serverStore) Meta(key string) (string, bool, error) {
+	var value string
+	err := s.db.QueryRow(s.dialect.getMeta, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+func (s *serverStore) SetMeta(key, value string) error {
+	_, err := s.db.Exec(s.dialect.setMeta, key, value)
+	return err
+}
+
+func (s *serverStore) Close() error {
+	return s.db.Close()
+}
+
+// Check that a run with a server -db only scans. The other modes and the
+// options that read the database back or need its other tables, such as
+// -incremental, only work with SQLite for now.
+func checkServerOptions(d *dialect, scanning bool) error {
+	if !scanning {
+		return fmt.Errorf("a %s -db can only be scanned into, the other modes need a SQLite database", d.name)
+	}
+
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{verifyMode, "-verify"},
+		{importMode, "-import"},
+		{loadKnown, "-load-known"},
+		{knownAction != "", "-known"},
+		{hideKnown, "-hide-known"},
+		{rescanMissing, "-rescan-only-missing-hashes"},
+		{querying(), "-lookup"},
+		{listRuns, "-list-runs"},
+		{exportPath != "", "-export"},
+		{normalized, "-normalized"},
+		{incremental, "-incremental"},
+		{resumeScan, "-resume"},
+		{maxBytes > 0, "-max-bytes"},
+		{atomicSwap, "-atomic"},
+		{dbPerRoot != "", "-db-per-root"},
+		{appendHistory, "-append"},
+		{watchMode, "-watch"},
+		{archives, "-archives"},
+		{pruneMissing, "-prune-missing"},
+		{treeHash, "-tree-hash"},
+		{reportTree, "-report-tree"},
+		{dupesMode, "-dupes"},
+		{dedupeAction != "", "-dedupe"},
+		{similarMode, "-similar"},
+		{checkCaseCollisions, "-check-case-collisions"},
+		{sameName, "-same-name"},
+		{diskUsage, "-disk-usage"},
+		{statsMode, "-stats"},
+		{treeDigest, "-tree-digest"},
+	} {
+		if o.set {
+			return fmt.Errorf("%s needs a SQLite -db, not %s", o.name, d.name)
+		}
+	}
+	return nil
+}
+
+// Scan the jobs into a server database. Unlike a scan into SQLite, no run
+// or errors are recorded and an interrupted scan can't be resumed, the files
+// already queued are committed and the scan must be run again.
+func scanServer(path string, d *dialect) error {
+	store, err := openServerStore(path, d)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := prepareStore(store); err != nil {
+		return err
+	}
+
+	saveJobOptions()
+	jobs, err := loadJobs()
+	if err != nil {
+		return err
+	}
+	roots := []string{}
+	for _, job := range jobs {
+		roots = append(roots, job.roots...)
+	}
+
+	prog := startProgress(jobs)
+	sinks := &fanout{}
+	sinks.add("database", newStoreBatcher(store))
+	addOutputs(sinks)
+
+	runScan(jobs, prog, sinks)
+	err = sinks.Close()
+	prog.stopStatus()
+	prog.report()
+	if err != nil {
+		return err
+	}
+
+	if isInterrupted() {
+		store.Close()
+		warnf("Interrupted, run the scan again to hash the rest\n")
+		exit(exitInterrupted)
+	}
+
+	// The URL may hold a password
+	u, _ := url.Parse(path)
+	if summaryJSON != "" {
+		if err := writeSummary(summaryJSON, u.Redacted(), roots, prog); err != nil {
+			return err
+		}
+	}
+	logSummary(u.Redacted(), roots, prog)
+
+	if extStats {
+		printExtStats(os.Stdout, prog)
+	}
+	if traceSlowDirs > 0 {
+		printSlowDirs(os.Stdout, prog, traceSlowDirs)
+	}
+	if listEmptyDirs {
+		printEmptyDirs(os.Stdout)
+	}
+
+	if fileErrors > 0 {
+		reportErrors(0)
+		store.Close()
+		exit(exitFileErrors)
+	}
+	return nil
+}
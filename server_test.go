@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerInsertStatement(t *testing.T) {
+	tests := []struct {
+		dialect *dialect
+
+		// Parts of the statement, the updates in the order they must come
+		want    []string
+		notWant []string
+	}{
+		{mySQL, []string{
+			"VALUES (?, ?",
+			"ON DUPLICATE KEY UPDATE ",
+			"hash_prefix = COALESCE(VALUES(hash_prefix), CASE WHEN files.sha1 <=> COALESCE(VALUES(sha1), CASE WHEN VALUES(size) <=> files.size AND VALUES(mtime) <=> files.mtime THEN files.sha1 END) THEN files.hash_prefix END)",
+			"md5 = COALESCE(VALUES(md5), ",
+			"sha1 = COALESCE(VALUES(sha1), CASE WHEN VALUES(size) <=> files.size AND VALUES(mtime) <=> files.mtime THEN files.sha1 END)",
+			", size = VALUES(size)",
+			", mtime = VALUES(mtime)",
+		}, []string{"excluded.", " IS "}},
+		{postgreSQL, []string{
+			"VALUES ($1, $2",
+			"ON CONFLICT (path) DO UPDATE SET ",
+			"hash_prefix = COALESCE(excluded.hash_prefix, CASE WHEN files.sha1 IS NOT DISTINCT FROM COALESCE(excluded.sha1, CASE WHEN excluded.size IS NOT DISTINCT FROM files.size AND excluded.mtime IS NOT DISTINCT FROM files.mtime THEN files.sha1 END) THEN files.hash_prefix END)",
+			"md5 = COALESCE(excluded.md5, ",
+			"sha1 = COALESCE(excluded.sha1, CASE WHEN excluded.size IS NOT DISTINCT FROM files.size AND excluded.mtime IS NOT DISTINCT FROM files.mtime THEN files.sha1 END)",
+			", size = excluded.size",
+			", mtime = excluded.mtime",
+		}, []string{"VALUES(", "<=>"}},
+	}
+
+	for _, tt := range tests {
+		stmt := (&serverStore{dialect: tt.dialect}).insertStatement()
+
+		rest := stmt
+		for _, part := range tt.want {
+			i := strings.Index(rest, part)
+			if i < 0 {
+				t.Errorf("%s: %q missing or out of order in %s", tt.dialect.name, part, stmt)
+				break
+			}
+			rest = rest[i+len(part):]
+		}
+
+		updates := stmt[strings.Index(stmt, tt.dialect.upsert):]
+		for _, part := range tt.notWant {
+			if strings.Contains(updates, part) {
+				t.Errorf("%s: %q found in the updates %s", tt.dialect.name, part, updates)
+			}
+		}
+	}
+}
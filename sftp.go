@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jcrussell/sha1files/sha1files"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefix of the stored paths of files scanned over SFTP.
+const remotePrefix = "sftp://"
+
+// Remote directories to scan over SFTP, as [user@]host[:port]:/path.
+var sftpSources stringList
+
+func init() {
+	flag.Var(&sftpSources, "sftp", "also scan `[user@]host[:port]:/path` over SFTP (repeatable)")
+}
+
+// Check whether a stored path is that of a file scanned over SFTP or from S3,
+// which can't be checked on the local disk.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, remotePrefix) || strings.HasPrefix(path, s3Prefix)
+}
+
+// A directory on a remote host given to -sftp.
+type sftpSource struct {
+	user string
+	host string
+	dir  string
+}
+
+// Parse a -sftp source. The user defaults to the current one and the port to
+// 22.
+func parseSFTPSource(source string) (*sftpSource, error) {
+	s := &sftpSource{}
+
+	rest := source
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		s.user, rest = rest[:i], rest[i+1:]
+	} else if u, err := user.Current(); err == nil {
+		s.user = u.Username
+	}
+
+	i := strings.Index(rest, ":/")
+	if i <= 0 || s.user == "" {
+		return nil, fmt.Errorf("invalid -sftp %q, want [user@]host[:port]:/path", source)
+	}
+	s.host, s.dir = rest[:i], rest[i+1:]
+
+	return s, nil
+}
+
+// Move the DIRs given as sftp://[user@]host[:port]/path URLs to -sftp, and
+// those given as s3://bucket/prefix to -s3, so that a remote tree can be
+// scanned like a local one, e.g. sha1files scan sftp://backup@nas/srv/photos.
+// The URL is then also the stored path prefix of the files under it.
+func takeRemoteArgs() error {
+	dirs := []string{}
+	moved := false
+	for _, arg := range flag.Args() {
+		if strings.HasPrefix(arg, s3Prefix) {
+			s3Sources = append(s3Sources, arg)
+			moved = true
+			continue
+		}
+		if !strings.HasPrefix(arg, remotePrefix) {
+			dirs = append(dirs, arg)
+			continue
+		}
+
+		u, err := url.Parse(arg)
+		if err != nil || u.Host == "" || !strings.HasPrefix(u.Path, "/") {
+			return fmt.Errorf("invalid SFTP URL %q, want sftp://[user@]host[:port]/path", arg)
+		}
+		source := u.Host + ":" + u.Path
+		if u.User != nil {
+			source = u.User.Username() + "@" + source
+		}
+		sftpSources = append(sftpSources, source)
+		moved = true
+	}
+
+	if !moved {
+		return nil
+	}
+	// The remaining DIRs may look like flags, which Parse stops at "--" for
+	return flag.CommandLine.Parse(append([]string{"--"}, dirs...))
+}
+
+// Address to dial, with the default port added if none was given.
+func (s *sftpSource) addr() string {
+	if _, _, err := net.SplitHostPort(s.host); err == nil {
+		return s.host
+	}
+	return net.JoinHostPort(s.host, "22")
+}
+
+// Path a remote file is stored under.
+func (s *sftpSource) storedPath(path string) string {
+	return remotePrefix + s.user + "@" + s.host + path
+}
+
+// Authentication methods to try: the SSH agent if one is running, then any
+// unencrypted default key in ~/.ssh.
+func sshAuth() []ssh.AuthMethod {
+	methods := []ssh.AuthMethod{}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return methods
+	}
+
+	signers := []ssh.Signer{}
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	return methods
+}
+
+// Connect to the source's host, checking its key against ~/.ssh/known_hosts.
+func (s *sftpSource) dial() (*ssh.Client, *sftp.Client, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            s.user,
+		Auth:            sshAuth(),
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	}
+
+	conn, err := ssh.Dial("tcp", s.addr(), config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, client, nil
+}
+
+// Check that -sftp sources are valid and can be used with the other options.
+func checkSFTP() error {
+	if len(sftpSources) == 0 {
+		return nil
+	}
+
+	// Remote files are streamed through the hasher, not read into memory
+	if fingerprintBytes > 0 {
+		return errors.New("-sftp cannot be used with -fingerprint")
+	}
+	if backupTo != "" {
+		return errors.New("-sftp cannot be used with -backup-to")
+	}
+
+	for _, source := range sftpSources {
+		if _, err := parseSFTPSource(source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash every file under each -sftp source, then every object under each -s3
+// source, and send a record for each one to out. Hidden files, -prune-dir
+// and the name and size filters apply as for local scans. Files are
+// streamed through the hasher one at a time.
+func scanRemotes(out chan<- *record) {
+	for _, arg := range sftpSources {
+		if budgetSpent || diskIsFull() || isInterrupted() {
+			return
+		}
+
+		// Already checked by checkSFTP
+		source, _ := parseSFTPSource(arg)
+
+		if err := scanRemote(arg, source, out); err != nil {
+			fileError(arg, "Error scanning %s: %s\n", arg, err)
+		}
+	}
+
+	scanS3Sources(out)
+}
+
+// The -sftp and -s3 sources in the order they are scanned, after the local
+// roots. Checkpoints in them are under these roots.
+func remoteRoots() []string {
+	return append(append([]string{}, sftpSources...), s3Sources...)
+}
+
+// Hash the files under a single -sftp source, given as root. As for the
+// walk of local roots, the scan stops once interrupted, the disk is full or
+// -max-bytes is spent, and a resumed scan skips the files before the
+// checkpoint.
+func scanRemote(root string, source *sftpSource, out chan<- *record) error {
+	conn, client, err := source.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	return scanRemoteFiles(root, source, client, out)
+}
+
+// Hash the files of an -sftp source over a client connected to its host.
+func scanRemoteFiles(root string, source *sftpSource, client *sftp.Client, out chan<- *record) error {
+	err := walkRemote(client, source.dir, func(path string, info os.FileInfo, err error) error {
+		if diskIsFull() {
+			return errDiskFull
+		}
+		if isInterrupted() {
+			return errInterrupted
+		}
+
+		if err != nil {
+			fileError(source.storedPath(path), "Error walking: %s\n", err)
+			return nil
+		}
+
+		if path != source.dir && skipPath(path, info) {
+			return skipEntry(info)
+		}
+
+		if resumeSkip(root, path) {
+			return skipEntry(info)
+		}
+
+		if info.IsDir() {
+			infof("Descending into dir: %s\n", info.Name())
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || !wantFile(path, info) {
+			return nil
+		}
+
+		if !withinBudget(root, path, info.Size()) {
+			return errBudgetSpent
+		}
+
+		start := time.Now()
+		d, err := remoteHash(client, path)
+		if err != nil {
+			fileError(source.storedPath(path), "Error reading file: %s: %s\n", source.storedPath(path), err)
+			return nil
+		}
+		result := remoteRecord(source.storedPath(path), info, d)
+		result.walked = checkpoint{root: root, path: path}
+		result.setTiming(time.Since(start))
+		out <- result
+		return nil
+	})
+
+	if err == errDiskFull || err == errInterrupted || err == errBudgetSpent {
+		return nil
+	}
+	return err
+}
+
+// Walk a remote directory tree like filepath.Walk. The entries of each
+// directory are walked in lexical order, whatever order the server lists
+// them in, so that checkpoints can be resumed from.
+func walkRemote(client *sftp.Client, root string, fn filepath.WalkFunc) error {
+	info, err := client.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkRemoteDir(client, root, info, fn)
+	}
+
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkRemoteDir(client *sftp.Client, dir string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(dir, info, nil)
+	}
+
+	entries, err := client.ReadDir(dir)
+	if err := fn(dir, info, err); err != nil || entries == nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		err := walkRemoteDir(client, path.Join(dir, entry.Name()), entry, fn)
+		if err != nil && (!entry.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create the record for a remote file given its digests, nil for none.
+func remoteRecord(stored string, info os.FileInfo, d *sha1files.Digests) *record {
+	ext := filepath.Ext(info.Name())
+	result := &record{
+		extless: strings.Replace(info.Name(), ext, "", -1),
+		ext:     ext,
+		path:    stored,
+		size:    info.Size(),
+		mtime:   info.ModTime().Unix(),
+		seen:    time.Now().Unix(),
+		job:     jobLabel,
+	}
+
+	if d != nil {
+		result.sha1, result.hashes, result.contentID = d.SHA1, d.Hashes, d.ContentID
+	}
+
+	// SFTP servers report the mode and owner, S3 objects have neither
+	if st, ok := info.Sys().(*sftp.FileStat); ok {
+		result.mode, result.uid, result.gid, result.hasOwner = int64(st.Mode&07777), int64(st.UID), int64(st.GID), true
+	}
+
+	return result
+}
+
+// Hash a remote file with every -hash algorithm, decrypting it first if it
+// is encrypted.
+func remoteHash(client *sftp.Client, path string) (*sha1files.Digests, error) {
+	f, err := client.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return streamHash(path, f)
+}
+
+// Hash a remote file with every -hash algorithm as it is read from r,
+// decrypting it first if it is encrypted. The content ID is computed from
+// the same read.
+func streamHash(path string, r io.Reader) (*sha1files.Digests, error) {
+	return scanHasher().Hash(path, r, nil)
+}
@@ -0,0 +1,173 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newSigner(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, signer
+}
+
+// Serve SFTP over SSH on a local port, as a real host would, accepting only
+// the client key. The files served are those on the local disk.
+func sshServer(t *testing.T, clientKey ssh.PublicKey, hostKey ssh.Signer) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Serve the sftp subsystem of each session on an SSH connection.
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				// The payload is the subsystem's name as an SSH string
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+						server.Close()
+					}
+				}
+			}
+		}()
+	}
+}
+
+func TestScanRemote(t *testing.T) {
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	key, clientSigner := newSigner(t)
+	_, hostSigner := newSigner(t)
+	addr := sshServer(t, clientSigner.PublicKey(), hostSigner)
+
+	// A home with the client key and the host in known_hosts, and no agent
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostSigner.PublicKey())
+	writeTree(t, home, map[string]string{
+		".ssh/id_ed25519":  string(pem.EncodeToMemory(block)),
+		".ssh/known_hosts": known + "\n",
+	})
+
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "b/c.txt": "gamma"}
+	writeTree(t, dir, files)
+
+	root := "me@" + addr + ":" + dir
+	source, err := parseSFTPSource(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan *record)
+	go func() {
+		if err := scanRemote(root, source, out); err != nil {
+			t.Error(err)
+		}
+		close(out)
+	}()
+	records := []*record{}
+	for r := range out {
+		records = append(records, r)
+	}
+
+	// Indexed under their remote paths
+	db := testDB(t, records...)
+	got := []string{}
+	for name, contents := range files {
+		path := "sftp://me@" + addr + filepath.Join(dir, name)
+		if sum := storedSha1(t, db, path); sum != hashBytes([]byte(contents)) {
+			t.Errorf("%s: stored %q", path, sum)
+		}
+		got = append(got, path)
+	}
+	sort.Strings(got)
+
+	stored := []string{}
+	for _, r := range records {
+		stored = append(stored, r.path)
+	}
+	sort.Strings(stored)
+	if !reflect.DeepEqual(stored, got) {
+		t.Errorf("stored %v, want %v", stored, got)
+	}
+
+	// A host that isn't in known_hosts is refused
+	if err := ioutil.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := scanRemote(root, source, make(chan *record)); err == nil {
+		t.Error("scanned a host with an unknown key")
+	}
+}
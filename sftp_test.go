@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"github.com/pkg/sftp"
+	"io"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// A pipe's read end and another's write end, as one connection.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// A client of an in-memory SFTP server holding the files, named by their
+// absolute paths.
+func memSFTP(t *testing.T, files map[string]string) *sftp.Client {
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+
+	server := sftp.NewRequestServer(pipeConn{serverRead, serverWrite}, sftp.InMemHandler())
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Closing the server ends the client's reads
+		server.Close()
+		client.Close()
+	})
+
+	for name, contents := range files {
+		if err := client.MkdirAll(path.Dir(name)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := client.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	return client
+}
+
+func TestScanRemoteFiles(t *testing.T) {
+	defer func(saved []string) { extraHashes = saved }(extraHashes)
+	defer func(saved int64) { maxBytes = saved }(maxBytes)
+	defer func(saved *checkpoint) { resumeFrom = saved }(resumeFrom)
+	defer func(saved bool) { quiet = saved }(quiet)
+	defer func() { bytesQueued, budgetSpent, lastQueued = 0, false, checkpoint{} }()
+	extraHashes, quiet = []string{"md5"}, true
+
+	files := map[string]string{
+		"/data/a.txt":   "alpha",
+		"/data/b/c.txt": "gamma",
+		"/data/b/d.txt": "delta",
+		"/data/e.txt":   "epsilon",
+		"/data/.hidden": "hidden",
+	}
+	client := memSFTP(t, files)
+
+	const root = "me@host:/data"
+	source, err := parseSFTPSource(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		resumeFrom  *checkpoint
+		interrupted bool
+		want        []string
+	}{
+		{"all", 0, nil, false, []string{"/data/a.txt", "/data/b/c.txt", "/data/b/d.txt", "/data/e.txt"}},
+		{"max-bytes", 10, nil, false, []string{"/data/a.txt", "/data/b/c.txt"}},
+		{"resume", 0, &checkpoint{root: root, path: "/data/b/c.txt"}, false, []string{"/data/b/d.txt", "/data/e.txt"}},
+		{"resume next", 0, &checkpoint{root: root, path: "/data/b/c.txt", next: true}, false, []string{"/data/b/c.txt", "/data/b/d.txt", "/data/e.txt"}},
+		{"resume later root", 0, &checkpoint{root: "s3://bucket/", path: "x"}, false, []string{}},
+		{"interrupted", 0, nil, true, []string{}},
+	}
+
+	for _, tt := range tests {
+		maxBytes, resumeFrom = tt.maxBytes, tt.resumeFrom
+		bytesQueued, budgetSpent, lastQueued = 0, false, checkpoint{}
+		if tt.interrupted {
+			atomic.StoreInt32(&interrupted, 1)
+		}
+
+		out := make(chan *record)
+		go func() {
+			if err := scanRemoteFiles(root, source, client, out); err != nil {
+				t.Error(err)
+			}
+			close(out)
+		}()
+
+		got := []string{}
+		for r := range out {
+			got = append(got, r.walked.path)
+
+			sum := md5.Sum([]byte(files[r.walked.path]))
+			if r.sha1 != hashBytes([]byte(files[r.walked.path])) || r.hashes["md5"] != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s: %s has %s and %v", tt.name, r.walked.path, r.sha1, r.hashes)
+			}
+			if r.walked.root != root || r.path != source.storedPath(r.walked.path) {
+				t.Errorf("%s: %s recorded as %s under %s", tt.name, r.walked.path, r.path, r.walked.root)
+			}
+		}
+		atomic.StoreInt32(&interrupted, 0)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: scanned %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.maxBytes > 0 && (!budgetSpent || lastQueued != (checkpoint{root: root, path: "/data/b/c.txt"})) {
+			t.Errorf("%s: stopped with budgetSpent=%t at %s", tt.name, budgetSpent, lastQueued)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package sha1files_test
+
+import (
+	"fmt"
+	"github.com/jcrussell/sha1files/sha1files"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Prints the records it is given, sorted by name.
+type printStore struct{}
+
+func (printStore) Commit(records []*sha1files.Record) error {
+	sort.Slice(records, func(i, j int) bool { return records[i].Path < records[j].Path })
+	for _, r := range records {
+		fmt.Println(filepath.Base(r.Path), r.SHA1, r.Hashes["sha256"])
+	}
+	return nil
+}
+
+func ExampleScanner() {
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), nil, 0644)
+
+	s := sha1files.Scanner{
+		Hasher: sha1files.Hasher{Algorithms: []string{"sha256"}},
+		Store:  printStore{},
+	}
+	if err := s.Scan(dir); err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// a.txt aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+	// b.txt da39a3ee5e6b4b0d3255bfef95601890afd80709 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+}
@@ -0,0 +1,196 @@
+// Package sha1files is the scanning engine of the sha1files command. A
+// Hasher computes the SHA1 of file contents, along with the digests of other
+// algorithms and an optional content ID, in a single read. A Scanner walks
+// directory trees, hashes every regular file and commits the records to a
+// Store.
+//
+// The command builds its filters, pipelines and databases on top of this
+// package, other programs can embed the same engine with their own Store.
+package sha1files
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// DefaultBufSize is the size of the reads of a Hasher without a BufSize.
+const DefaultBufSize = 1 << 20
+
+// An Algorithm a Hasher can compute.
+type Algorithm struct {
+	New func() hash.Hash
+
+	// Width of the hex digest
+	Size int
+}
+
+// Algorithms a Hasher can compute, by name.
+var Algorithms = map[string]Algorithm{
+	"blake2b": {newBlake2b, 128},
+	"md5":     {md5.New, 32},
+	"sha1":    {sha1.New, 40},
+	"sha256":  {sha256.New, 64},
+	"sha512":  {sha512.New, 128},
+	"xxh64":   {func() hash.Hash { return xxhash.New() }, 16},
+}
+
+// BLAKE2b-512, which only fails to be created given a bad key.
+func newBlake2b() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// AlgorithmNames returns the names of the Algorithms, sorted.
+func AlgorithmNames() []string {
+	names := []string{}
+	for name := range Algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Hasher hashes file contents. The zero value computes only the SHA1.
+type Hasher struct {
+	// Algorithms to compute besides SHA1, names of Algorithms
+	Algorithms []string
+
+	// Size of the reads, DefaultBufSize if 0
+	BufSize int
+
+	// Optional function computing an extra identifier of the contents. It
+	// is given the path of the file and a reader over the same bytes that
+	// are hashed, so the file is not read twice. An error fails the Sum.
+	ContentID func(path string, r io.Reader) (string, error)
+
+	// Optional function returning the plaintext of a file, which Hash and
+	// HashFile hash instead of its contents. It may return r to hash a file
+	// as it is.
+	Decrypt func(path string, r io.Reader) (io.Reader, error)
+}
+
+// Digests of some contents.
+type Digests struct {
+	SHA1 string
+
+	// Hex digests of the Hasher's Algorithms by name, nil if it has none
+	Hashes map[string]string
+
+	// The result of the Hasher's ContentID, "" without one
+	ContentID string
+
+	// Number of bytes hashed
+	Size int64
+}
+
+// Check that the Hasher's algorithms exist.
+func (h *Hasher) check() error {
+	for _, name := range h.Algorithms {
+		if _, ok := Algorithms[name]; !ok {
+			return fmt.Errorf("sha1files: unknown algorithm %q", name)
+		}
+	}
+	return nil
+}
+
+// Sum hashes the contents read from r, which are also written to tee if it
+// isn't nil. path is only passed on to ContentID.
+func (h *Hasher) Sum(path string, r io.Reader, tee io.Writer) (*Digests, error) {
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+
+	whole := sha1.New()
+	writers := []io.Writer{whole}
+	extra := make([]hash.Hash, len(h.Algorithms))
+	for i, name := range h.Algorithms {
+		extra[i] = Algorithms[name].New()
+		writers = append(writers, extra[i])
+	}
+	if tee != nil {
+		writers = append(writers, tee)
+	}
+
+	// The content ID reads the same bytes through a pipe. Whatever it
+	// leaves unread is drained so that hashing goes on.
+	var id string
+	var idErr error
+	var pw *io.PipeWriter
+	done := make(chan struct{})
+	if h.ContentID != nil {
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		writers = append(writers, pw)
+		go func() {
+			defer close(done)
+			id, idErr = h.ContentID(path, pr)
+			io.Copy(ioutil.Discard, pr)
+		}()
+	}
+
+	bufSize := h.BufSize
+	if bufSize <= 0 {
+		bufSize = DefaultBufSize
+	}
+	n, err := io.CopyBuffer(io.MultiWriter(writers...), r, make([]byte, bufSize))
+
+	if pw != nil {
+		pw.CloseWithError(err)
+		<-done
+	}
+	if err != nil {
+		return nil, err
+	}
+	if idErr != nil {
+		return nil, fmt.Errorf("content ID: %s", idErr)
+	}
+
+	d := &Digests{SHA1: hex.EncodeToString(whole.Sum(nil)), ContentID: id, Size: n}
+	if len(extra) > 0 {
+		d.Hashes = map[string]string{}
+		for i, name := range h.Algorithms {
+			d.Hashes[name] = hex.EncodeToString(extra[i].Sum(nil))
+		}
+	}
+	return d, nil
+}
+
+// Open returns the reader to hash for the contents of the file at path: r
+// itself, or the plaintext if there is a Decrypt function.
+func (h *Hasher) Open(path string, r io.Reader) (io.Reader, error) {
+	if h.Decrypt == nil {
+		return r, nil
+	}
+	return h.Decrypt(path, r)
+}
+
+// Hash hashes the contents of the file at path read from r, decrypted first
+// if there is a Decrypt function.
+func (h *Hasher) Hash(path string, r io.Reader, tee io.Writer) (*Digests, error) {
+	plain, err := h.Open(path, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(path, plain, tee)
+}
+
+// HashFile hashes the file at path.
+func (h *Hasher) HashFile(path string) (*Digests, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return h.Hash(path, f, nil)
+}
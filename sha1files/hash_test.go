@@ -0,0 +1,159 @@
+package sha1files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	helloSha1   = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	helloSha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	helloMd5    = "5d41402abc4b2a76b9719d911017c592"
+)
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		hasher Hasher
+		want   *Digests
+	}{
+		{Hasher{}, &Digests{SHA1: helloSha1, Size: 5}},
+		{Hasher{BufSize: 2}, &Digests{SHA1: helloSha1, Size: 5}},
+		{
+			Hasher{Algorithms: []string{"sha256", "md5"}, BufSize: 1},
+			&Digests{SHA1: helloSha1, Hashes: map[string]string{"sha256": helloSha256, "md5": helloMd5}, Size: 5},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.hasher.Sum("hello.txt", strings.NewReader("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %+v, want %+v", tt.hasher, got, tt.want)
+		}
+	}
+}
+
+func TestSumUnknownAlgorithm(t *testing.T) {
+	h := Hasher{Algorithms: []string{"crc32"}}
+	if _, err := h.Sum("", strings.NewReader("hello"), nil); err == nil {
+		t.Error("hashed with an unknown algorithm")
+	}
+}
+
+func TestSumTee(t *testing.T) {
+	contents := strings.Repeat("0123456789", 1000)
+
+	copied := &bytes.Buffer{}
+	h := Hasher{BufSize: 7}
+	if _, err := h.Sum("", strings.NewReader(contents), copied); err != nil {
+		t.Fatal(err)
+	}
+	if copied.String() != contents {
+		t.Errorf("tee got %d bytes, want %d", copied.Len(), len(contents))
+	}
+}
+
+func TestContentID(t *testing.T) {
+	contents := strings.Repeat("hello", 1000)
+
+	tests := []struct {
+		name      string
+		contentID func(path string, r io.Reader) (string, error)
+		want      string
+		wantErr   bool
+	}{
+		{
+			"whole",
+			func(path string, r io.Reader) (string, error) {
+				data, err := ioutil.ReadAll(r)
+				return path + ":" + strings.Repeat("x", len(data)/1000), err
+			},
+			"a.txt:xxxxx",
+			false,
+		},
+		{
+			// The rest of the contents is still hashed
+			"prefix",
+			func(path string, r io.Reader) (string, error) {
+				head := make([]byte, 5)
+				_, err := io.ReadFull(r, head)
+				return string(head), err
+			},
+			"hello",
+			false,
+		},
+		{
+			"error",
+			func(path string, r io.Reader) (string, error) {
+				return "", errors.New("unsupported")
+			},
+			"",
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		h := Hasher{BufSize: 64, ContentID: tt.contentID}
+		got, err := h.Sum("a.txt", strings.NewReader(contents), nil)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		want, _ := (&Hasher{}).Sum("", strings.NewReader(contents), nil)
+		if got.ContentID != tt.want || got.SHA1 != want.SHA1 {
+			t.Errorf("%s: got %q and %s, want %q and %s", tt.name, got.ContentID, got.SHA1, tt.want, want.SHA1)
+		}
+	}
+}
+
+// Decrypts contents XORed with a key, as a stand-in for real decryption.
+func xorDecrypt(key byte) func(path string, r io.Reader) (io.Reader, error) {
+	return func(path string, r io.Reader) (io.Reader, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		for i := range data {
+			data[i] ^= key
+		}
+		return bytes.NewReader(data), nil
+	}
+}
+
+func TestHashDecrypt(t *testing.T) {
+	ciphertext := []byte("hello")
+	for i := range ciphertext {
+		ciphertext[i] ^= 0x5a
+	}
+
+	h := Hasher{Decrypt: xorDecrypt(0x5a)}
+	got, err := h.Hash("hello.x", bytes.NewReader(ciphertext), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SHA1 != helloSha1 {
+		t.Errorf("got %s, want the SHA1 of the plaintext %s", got.SHA1, helloSha1)
+	}
+
+	// Sum hashes the contents as they are
+	got, err = h.Sum("hello.x", bytes.NewReader(ciphertext), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SHA1 == helloSha1 {
+		t.Error("Sum decrypted the contents")
+	}
+}
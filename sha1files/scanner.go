@@ -0,0 +1,209 @@
+package sha1files
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DefaultBatchSize is the number of records per Commit of a Scanner without
+// a BatchSize.
+const DefaultBatchSize = 1000
+
+// A Record is a file hashed by a Scanner.
+type Record struct {
+	Path  string
+	Size  int64
+	Mtime time.Time
+	Mode  os.FileMode
+
+	SHA1 string
+
+	// Hex digests of the Hasher's Algorithms by name, nil if it has none
+	Hashes map[string]string
+
+	// The result of the Hasher's ContentID, "" without one
+	ContentID string
+}
+
+// A Store keeps the records of scans.
+type Store interface {
+	// Commit stores a batch of records. A path recorded again replaces its
+	// earlier record.
+	Commit(records []*Record) error
+}
+
+// A Scanner hashes every regular file under directory trees and commits
+// their records to its Store. Symbolic links are not followed.
+type Scanner struct {
+	Hasher
+
+	Store Store
+
+	// Number of files hashed concurrently, runtime.NumCPU() if 0
+	Workers int
+
+	// Records per Commit, DefaultBatchSize if 0
+	BatchSize int
+
+	// Optional function deciding whether to leave out a file, or a
+	// directory and everything under it
+	Skip func(path string, info os.FileInfo) bool
+
+	// Optional function called with the files and directories that cannot
+	// be read, after which the scan goes on. Without one, the first such
+	// error stops the scan.
+	Errors func(path string, err error)
+}
+
+// Returned by the walk once the scan is stopped.
+var errStopped = errors.New("sha1files: scan stopped")
+
+// Scan hashes the files under the roots, which may also be files. It returns
+// the first error of the Store, or the first file error if there is no
+// Errors function. Records hashed by then may have been committed.
+func (s *Scanner) Scan(roots ...string) error {
+	if s.Store == nil {
+		return errors.New("sha1files: Scanner without a Store")
+	}
+	if err := s.check(); err != nil {
+		return err
+	}
+
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	stop := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+	report := func(path string, err error) {
+		if s.Errors != nil {
+			s.Errors(path, err)
+		} else {
+			fail(err)
+		}
+	}
+
+	type file struct {
+		path string
+		info os.FileInfo
+	}
+	files := make(chan file, workers)
+	records := make(chan *Record, workers)
+
+	go func() {
+		defer close(files)
+
+		for _, root := range roots {
+			err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if stopped() {
+					return errStopped
+				}
+				if err != nil {
+					report(path, err)
+					return nil
+				}
+
+				if s.Skip != nil && s.Skip(path, info) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+
+				select {
+				case files <- file{path, info}:
+					return nil
+				case <-stop:
+					return errStopped
+				}
+			})
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	hashers := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		hashers.Add(1)
+		go func() {
+			defer hashers.Done()
+
+			for f := range files {
+				if stopped() {
+					continue
+				}
+
+				d, err := s.HashFile(f.path)
+				if err != nil {
+					report(f.path, err)
+					continue
+				}
+				records <- &Record{
+					Path:      f.path,
+					Size:      f.info.Size(),
+					Mtime:     f.info.ModTime(),
+					Mode:      f.info.Mode(),
+					SHA1:      d.SHA1,
+					Hashes:    d.Hashes,
+					ContentID: d.ContentID,
+				}
+			}
+		}()
+	}
+
+	go func() {
+		hashers.Wait()
+		close(records)
+	}()
+
+	// Records are still drained once stopped so that the hashers finish
+	batch := []*Record{}
+	for r := range records {
+		if stopped() {
+			continue
+		}
+
+		batch = append(batch, r)
+		if len(batch) == batchSize {
+			if err := s.Store.Commit(batch); err != nil {
+				fail(err)
+			}
+			batch = []*Record{}
+		}
+	}
+	if len(batch) > 0 && !stopped() {
+		if err := s.Store.Commit(batch); err != nil {
+			fail(err)
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,163 @@
+package sha1files
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Keeps the records committed in memory.
+type memStore struct {
+	mu      sync.Mutex
+	records map[string]*Record
+	commits int
+	err     error
+}
+
+func (m *memStore) Commit(records []*Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	if m.records == nil {
+		m.records = map[string]*Record{}
+	}
+	for _, r := range records {
+		m.records[r.Path] = r
+	}
+	m.commits++
+	return nil
+}
+
+// The SHA1s stored by path relative to root.
+func (m *memStore) sums(t *testing.T, root string) map[string]string {
+	sums := map[string]string{}
+	for path, r := range m.records {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[filepath.ToSlash(rel)] = r.SHA1
+	}
+	return sums
+}
+
+// Create the files under dir, named by their slash-separated paths.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.txt":         "hello",
+		"sub/b.txt":     "hello",
+		"sub/c.txt":     "",
+		"skip/d.txt":    "d",
+		"sub/skip.txt":  "e",
+		"sub/deep/f.md": "hello",
+	})
+
+	store := &memStore{}
+	s := Scanner{
+		Store:     store,
+		Workers:   3,
+		BatchSize: 2,
+		Skip: func(path string, info os.FileInfo) bool {
+			return strings.HasPrefix(info.Name(), "skip")
+		},
+	}
+	if err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"a.txt":         helloSha1,
+		"sub/b.txt":     helloSha1,
+		"sub/c.txt":     "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		"sub/deep/f.md": helloSha1,
+	}
+	if got := store.sums(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+	if store.commits != 2 {
+		t.Errorf("committed %d batches, want 2", store.commits)
+	}
+
+	r := store.records[filepath.Join(root, "a.txt")]
+	if r.Size != 5 || !r.Mode.IsRegular() || r.Mtime.IsZero() {
+		t.Errorf("a.txt recorded as %+v", r)
+	}
+}
+
+func TestScanErrors(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "hello"})
+	missing := filepath.Join(root, "missing")
+
+	// With an Errors function the scan goes on
+	var failed []string
+	store := &memStore{}
+	s := Scanner{Store: store, Errors: func(path string, err error) { failed = append(failed, path) }}
+	if err := s.Scan(missing, root); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failed, []string{missing}) {
+		t.Errorf("reported %v, want %v", failed, []string{missing})
+	}
+	if len(store.records) != 1 {
+		t.Errorf("stored %d records, want 1", len(store.records))
+	}
+
+	// Without one it stops
+	s = Scanner{Store: &memStore{}}
+	if err := s.Scan(missing, root); !os.IsNotExist(err) {
+		t.Errorf("got error %v, want one for the missing root", err)
+	}
+
+	// As it does when the store fails
+	broken := errors.New("disk full")
+	s = Scanner{Store: &memStore{err: broken}}
+	if err := s.Scan(root); err != broken {
+		t.Errorf("got error %v, want %v", err, broken)
+	}
+}
+
+func TestScanAlgorithms(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "hello", "b.txt": "hello"})
+
+	store := &memStore{}
+	s := Scanner{Hasher: Hasher{Algorithms: []string{"md5"}}, Store: store}
+	if err := s.Scan(root); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+	for path, r := range store.records {
+		paths = append(paths, filepath.Base(path))
+		if r.Hashes["md5"] != helloMd5 {
+			t.Errorf("%s: md5 %q, want %q", path, r.Hashes["md5"], helloMd5)
+		}
+	}
+	sort.Strings(paths)
+	if !reflect.DeepEqual(paths, []string{"a.txt", "b.txt"}) {
+		t.Errorf("stored %v", paths)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Number of hex characters of the hash kept in the indexed hash_prefix column.
+const hashPrefixLen = 8
+
+// Print the files whose hash starts with this prefix instead of scanning.
+var lookupHash string
+
+func init() {
+	flag.StringVar(&lookupHash, "lookup", "", "print the files whose hash starts with the hex `PREFIX`, like a git short hash, instead of scanning")
+}
+
+// First characters of a hash, stored in hash_prefix.
+func hashPrefix(hash string) string {
+	if len(hash) < hashPrefixLen {
+		return hash
+	}
+	return hash[:hashPrefixLen]
+}
+
+// Index hash_prefix, filling it in for the rows of a database from before the
+// column existed.
+func ensureHashPrefix(db *sql.DB, backfill bool) error {
+	if backfill {
+		fill := fmt.Sprintf("UPDATE files SET hash_prefix = substr(sha1, 1, %d) WHERE sha1 IS NOT NULL", hashPrefixLen)
+		if normalized {
+			fill = fmt.Sprintf("UPDATE files SET hash_prefix = (SELECT substr(sha1, 1, %d) FROM hashes WHERE id = files.hash_id)", hashPrefixLen)
+		}
+		if _, err := db.Exec(fill); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS files_hash_prefix ON files (hash_prefix)")
+	return err
+}
+
+// Check that a short hash is made of at least 4 hex digits, as git requires.
+func isShortHash(prefix string) bool {
+	return len(prefix) >= 4 && strings.Trim(strings.ToLower(prefix), "0123456789abcdef") == ""
+}
+
+// Check the -lookup prefix.
+func checkLookup() error {
+	if lookupHash != "" && !isShortHash(lookupHash) {
+		return fmt.Errorf("invalid -lookup %q, want at least 4 hex digits", lookupHash)
+	}
+	return nil
+}
+
+// Select matchColumns of the files whose hash starts with prefix, by hash
+// and path. The indexed hash_prefix column narrows the search down to a
+// range, which is then filtered on the full hash for longer prefixes.
+func queryShortHash(db *sql.DB, prefix string) (*sql.Rows, error) {
+	prefix = strings.ToLower(prefix)
+
+	// Hex digits sort before "g", so the range covers every hash_prefix
+	// starting with the prefix
+	short := hashPrefix(prefix)
+	query := "SELECT " + matchColumns + " FROM " + filesView() + " WHERE hash_prefix >= ? AND hash_prefix < ? AND sha1 LIKE ? ORDER BY sha1, path"
+	return db.Query(query, short, short+"g", prefix+"%")
+}
+
+// Print every file whose hash starts with prefix, in -query-format. A prefix
+// matching several different hashes is ambiguous, all the matches are
+// printed with a warning. Returns whether anything matched.
+func lookupShortHash(w io.Writer, db *sql.DB, prefix string) (bool, error) {
+	rows, err := queryShortHash(db, prefix)
+	if err != nil {
+		return false, err
+	}
+	hashes, err := printMatches(w, rows, anyPath)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case len(hashes) == 0:
+		log.Printf("No file has a hash starting with %s\n", prefix)
+	case len(hashes) > 1:
+		log.Printf("Short hash %s is ambiguous: it matches %d different hashes\n", prefix, len(hashes))
+	}
+	return len(hashes) > 0, nil
+}
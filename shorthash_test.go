@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLookupAfterNoHashScan(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+
+	for _, normalized = range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(path, []byte("contents"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := hashBytes([]byte("contents"))
+		hashed := statRecord(path, info)
+		hashed.sha1 = sum
+		db := testDB(t, hashed)
+
+		// Scanned again with -no-hash, the file is unchanged
+		if err := insertRecords(db, []*record{statRecord(path, info)}); err != nil {
+			t.Fatal(err)
+		}
+		if got := storedSha1(t, db, path); got != sum {
+			t.Errorf("normalized=%t: sha1 = %q, want %q", normalized, got, sum)
+		}
+
+		for _, prefix := range []string{sum[:4], sum[:hashPrefixLen], sum} {
+			rows, err := queryShortHash(db, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := 0
+			for rows.Next() {
+				found++
+			}
+			rows.Close()
+			if found != 1 {
+				t.Errorf("normalized=%t: %s matched %d files, want 1", normalized, prefix, found)
+			}
+		}
+	}
+}
+
+func TestLookupShortHash(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+	defer func(saved string) { queryFormat = saved }(queryFormat)
+	defer log.SetOutput(os.Stderr)
+	queryFormat = "text"
+
+	// Two hashes sharing the indexed prefix, and a third close to them
+	one := "abcd1234" + strings.Repeat("0", 32)
+	two := "abcd1234" + "1" + strings.Repeat("0", 31)
+	three := "abce" + strings.Repeat("0", 36)
+
+	tests := []struct {
+		prefix    string
+		found     bool
+		want      string
+		ambiguous bool
+	}{
+		{"abcd1234", true, one + "  /a\n" + one + "  /b\n" + two + "  /c\n", true},
+		{"abcd12340", true, one + "  /a\n" + one + "  /b\n", false},
+		{"ABCD12341", true, two + "  /c\n", false},
+		{"abce", true, three + "  /d\n", false},
+		{"ffff", false, "", false},
+	}
+
+	for _, normalized = range []bool{false, true} {
+		db := testDB(t,
+			&record{path: "/a", sha1: one, size: 1},
+			&record{path: "/b", sha1: one, size: 1},
+			&record{path: "/c", sha1: two, size: 1},
+			&record{path: "/d", sha1: three, size: 1},
+		)
+
+		var prefix string
+		var indexes int
+		if err := db.QueryRow("SELECT hash_prefix, (SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'files_hash_prefix') FROM files WHERE path = '/a'").Scan(&prefix, &indexes); err != nil {
+			t.Fatal(err)
+		}
+		if prefix != "abcd1234" || indexes != 1 {
+			t.Errorf("normalized=%t: stored hash_prefix %q with %d indexes", normalized, prefix, indexes)
+		}
+
+		for _, tt := range tests {
+			var out, logged bytes.Buffer
+			log.SetOutput(&logged)
+			found, err := lookupShortHash(&out, db, tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.found || out.String() != tt.want {
+				t.Errorf("normalized=%t: -lookup %s printed %q and returned %t, want %q and %t", normalized, tt.prefix, out.String(), found, tt.want, tt.found)
+			}
+			if ambiguous := strings.Contains(logged.String(), "is ambiguous"); ambiguous != tt.ambiguous {
+				t.Errorf("normalized=%t: -lookup %s logged %q", normalized, tt.prefix, logged.String())
+			}
+		}
+	}
+}
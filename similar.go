@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Print clusters of files with similar fuzzy hashes.
+	similarMode bool
+
+	// Lowest score, from 0 to 100, at which two files count as similar.
+	similarity int
+)
+
+func init() {
+	flag.BoolVar(&similarMode, "similar", false, "print clusters of files whose -fuzzy hashes score at least -similarity (after the scan if DIRs are given)")
+	flag.IntVar(&similarity, "similarity", 60, "with -similar, the lowest `SCORE` from 1 to 100 at which two files count as similar")
+}
+
+// Check the -similar options.
+func checkSimilar() error {
+	if similarMode && (similarity < 1 || similarity > 100) {
+		return errors.New("-similarity must be between 1 and 100")
+	}
+	return nil
+}
+
+// A fuzzy hash split into its parts, see fuzzyHash.
+type fuzzySig struct {
+	path       string
+	blockSize  uint32
+	sig1, sig2 string
+}
+
+// Parse a "BLOCKSIZE:SIG1:SIG2" fuzzy hash, dropping runs of more than three
+// identical characters as ssdeep does since they say little about the
+// contents and inflate the score.
+func parseFuzzy(path, hash string) (*fuzzySig, bool) {
+	parts := strings.SplitN(hash, ":", 3)
+	if len(parts) != 3 || parts[1] == "" {
+		return nil, false
+	}
+	bs, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	return &fuzzySig{path: path, blockSize: uint32(bs), sig1: squeezeRuns(parts[1]), sig2: squeezeRuns(parts[2])}, true
+}
+
+func squeezeRuns(s string) string {
+	b := []byte{}
+	for i := 0; i < len(s); i++ {
+		if i >= 3 && s[i] == s[i-1] && s[i] == s[i-2] && s[i] == s[i-3] {
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// Score the similarity of two fuzzy hashes from 0 to 100 the way ssdeep
+// does. Only hashes whose block sizes are equal or a factor of two apart can
+// be compared, by the signatures of the block size they share.
+func compareFuzzy(a, b *fuzzySig) int {
+	switch {
+	case a.blockSize == b.blockSize:
+		if a.sig1 == b.sig1 {
+			return 100
+		}
+		s1 := scoreSigs(a.sig1, b.sig1, a.blockSize)
+		s2 := scoreSigs(a.sig2, b.sig2, a.blockSize*2)
+		if s2 > s1 {
+			return s2
+		}
+		return s1
+	case a.blockSize == b.blockSize*2:
+		return scoreSigs(a.sig1, b.sig2, a.blockSize)
+	case b.blockSize == a.blockSize*2:
+		return scoreSigs(a.sig2, b.sig1, b.blockSize)
+	}
+	return 0
+}
+
+// Score two signatures of the same block size by their edit distance.
+// Signatures without a run of rollingWindow characters in common score 0,
+// and those of small block sizes are capped so that tiny files don't look
+// alike by chance.
+func scoreSigs(s1, s2 string, blockSize uint32) int {
+	if !haveCommonRun(s1, s2) {
+		return 0
+	}
+
+	score := editDistance(s1, s2) * spamsumLength / (len(s1) + len(s2))
+	score = 100 * score / spamsumLength
+	if score >= 100 {
+		return 0
+	}
+	score = 100 - score
+
+	if blockSize < (99+rollingWindow)/rollingWindow*minBlockSize {
+		shorter := len(s1)
+		if len(s2) < shorter {
+			shorter = len(s2)
+		}
+		if limit := int(blockSize) / minBlockSize * shorter; score > limit {
+			score = limit
+		}
+	}
+	return score
+}
+
+// Check whether two signatures share a substring of rollingWindow characters.
+func haveCommonRun(s1, s2 string) bool {
+	if len(s1) < rollingWindow || len(s2) < rollingWindow {
+		return false
+	}
+	runs := map[string]bool{}
+	for i := 0; i+rollingWindow <= len(s1); i++ {
+		runs[s1[i:i+rollingWindow]] = true
+	}
+	for i := 0; i+rollingWindow <= len(s2); i++ {
+		if runs[s2[i:i+rollingWindow]] {
+			return true
+		}
+	}
+	return false
+}
+
+// Weighted Levenshtein distance: insertions and deletions cost 1 and
+// substitutions 2, as in ssdeep.
+func editDistance(s1, s2 string) int {
+	prev := make([]int, len(s2)+1)
+	cur := make([]int, len(s2)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(s1); i++ {
+		cur[0] = i
+		for j := 1; j <= len(s2); j++ {
+			cost := prev[j-1]
+			if s1[i-1] != s2[j-1] {
+				cost += 2
+			}
+			if prev[j]+1 < cost {
+				cost = prev[j] + 1
+			}
+			if cur[j-1]+1 < cost {
+				cost = cur[j-1] + 1
+			}
+			cur[j] = cost
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(s2)]
+}
+
+// A set of files linked by similar pairs, each with its best score against
+// another file of the cluster.
+type similarCluster struct {
+	paths  []string
+	scores map[string]int
+}
+
+// Find the clusters of files whose fuzzy hashes score at least -similarity:
+// two files are in the same cluster if a chain of similar pairs links them.
+// Files are only compared with those of an equal, half or double block
+// size, but the search is still quadratic within a block size.
+func findSimilar(db *sql.DB) ([]*similarCluster, error) {
+	rows, err := db.Query("SELECT path, fuzzy FROM " + filesView() + " WHERE fuzzy IS NOT NULL" + knownCondition() + " ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := []*fuzzySig{}
+	byBlockSize := map[uint32][]int{}
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if sig, ok := parseFuzzy(path, hash); ok {
+			byBlockSize[sig.blockSize] = append(byBlockSize[sig.blockSize], len(sigs))
+			sigs = append(sigs, sig)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Union-find of the files by index
+	parent := make([]int, len(sigs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	best := map[int]int{}
+	link := func(i, j int) {
+		score := compareFuzzy(sigs[i], sigs[j])
+		if score < similarity {
+			return
+		}
+		if score > best[i] {
+			best[i] = score
+		}
+		if score > best[j] {
+			best[j] = score
+		}
+		parent[find(i)] = find(j)
+	}
+
+	for i, sig := range sigs {
+		for _, j := range byBlockSize[sig.blockSize] {
+			if j > i {
+				link(i, j)
+			}
+		}
+		for _, j := range byBlockSize[sig.blockSize*2] {
+			link(i, j)
+		}
+	}
+
+	byRoot := map[int]*similarCluster{}
+	clusters := []*similarCluster{}
+	for i, sig := range sigs {
+		if _, ok := best[i]; !ok {
+			continue
+		}
+		root := find(i)
+		cluster, ok := byRoot[root]
+		if !ok {
+			cluster = &similarCluster{scores: map[string]int{}}
+			byRoot[root] = cluster
+			clusters = append(clusters, cluster)
+		}
+		cluster.paths = append(cluster.paths, sig.path)
+		cluster.scores[sig.path] = best[i]
+	}
+
+	// Largest clusters first, then by their first path
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return len(clusters[i].paths) > len(clusters[j].paths)
+	})
+	return clusters, nil
+}
+
+// Print each cluster of similar files as a count line followed by the
+// indented paths, each with its best score against another file of the
+// cluster.
+func printSimilar(w io.Writer, db *sql.DB) error {
+	clusters, err := findSimilar(db)
+	if err != nil {
+		return err
+	}
+
+	for i, cluster := range clusters {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%d similar files\n", len(cluster.paths))
+		for _, path := range cluster.paths {
+			fmt.Fprintf(w, "  %3d  %s\n", cluster.scores[path], path)
+		}
+	}
+	return nil
+}
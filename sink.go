@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// File to stream records to as JSON lines, alongside the database.
+var alsoJSON string
+
+func init() {
+	flag.StringVar(&alsoJSON, "also-json", "", "also write every record as a line of JSON to `FILE` (gzip-compressed if FILE ends in .gz)")
+}
+
+// A destination for scanned records.
+type sink interface {
+	write(r *record) error
+	Close() error
+}
+
+// The JSON form of a record, as written by -also-json.
+type jsonRecord struct {
+	Path        string `json:"path"`
+	SHA1        string `json:"sha1,omitempty"`
+	Size        int64  `json:"size"`
+	Mtime       int64  `json:"mtime"`
+	Extless     string `json:"extless"`
+	Ext         string `json:"ext"`
+	Xattrs      string `json:"xattrs,omitempty"`
+	Sparse      bool   `json:"sparse,omitempty"`
+	ViaLink     bool   `json:"via_link,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Digests of the -hash algorithms besides SHA1
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+func newJSONRecord(r *record) *jsonRecord {
+	return &jsonRecord{
+		Path:    r.path,
+		SHA1:    r.sha1,
+		Size:    r.size,
+		Mtime:   r.mtime,
+		Extless: r.extless,
+		Ext:     r.ext,
+		Xattrs:  r.xattrs,
+		Sparse:  r.sparse,
+		ViaLink: r.viaLink,
+
+		Fingerprint: r.fingerprint,
+		Hashes:      r.hashes,
+	}
+}
+
+// Writes records as JSON lines, or NUL-terminated JSON with -print0.
+type jsonSink struct {
+	*outputFile
+}
+
+func createJSONSink(path string, appending bool) (*jsonSink, error) {
+	out, err := createOutput(path, appending)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonSink{out}, nil
+}
+
+func (s *jsonSink) write(r *record) error {
+	b, err := json.Marshal(newJSONRecord(r))
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.Write(b); err != nil {
+		return err
+	}
+	_, err = s.WriteString(lineEnd())
+	return err
+}
+
+// Sends every record to several sinks. A sink that fails is logged and no
+// longer written to, but the others keep receiving every record, and the
+// failure is returned by Close so the run still ends in an error.
+type fanout struct {
+	sinks  []sink
+	names  []string
+	failed []error
+}
+
+// Add a sink, named for error messages.
+func (f *fanout) add(name string, s sink) {
+	f.sinks = append(f.sinks, s)
+	f.names = append(f.names, name)
+	f.failed = append(f.failed, nil)
+}
+
+func (f *fanout) write(r *record) error {
+	for i, s := range f.sinks {
+		if f.failed[i] != nil {
+			continue
+		}
+
+		if err := s.write(r); err != nil {
+			errorf("Error writing to %s, no more records will be written to it: %s\n", f.names[i], err)
+			f.failed[i] = err
+		}
+	}
+
+	return nil
+}
+
+// A sink with pending records to commit on a timer, see -commit-every.
+type ticker interface {
+	tick(now time.Time) error
+}
+
+// Let every sink that commits on a timer check whether it is due. A sink that
+// fails is treated as for a failed write.
+func (f *fanout) tick(now time.Time) {
+	for i, s := range f.sinks {
+		t, ok := s.(ticker)
+		if !ok || f.failed[i] != nil {
+			continue
+		}
+
+		if err := t.tick(now); err != nil {
+			errorf("Error writing to %s, no more records will be written to it: %s\n", f.names[i], err)
+			f.failed[i] = err
+		}
+	}
+}
+
+// Close every sink, returning the first error from a failed write or close.
+func (f *fanout) Close() error {
+	var first error
+
+	for i, s := range f.sinks {
+		err := s.Close()
+		if err != nil && f.failed[i] == nil {
+			errorf("Error closing %s: %s\n", f.names[i], err)
+			f.failed[i] = err
+		}
+
+		if f.failed[i] != nil && first == nil {
+			first = fmt.Errorf("%s: %s", f.names[i], f.failed[i])
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// A sink that fails from the nth write on.
+type failingSink struct {
+	n, written int
+}
+
+func (s *failingSink) write(r *record) error {
+	if s.written >= s.n {
+		return errors.New("disk on fire")
+	}
+	s.written++
+	return nil
+}
+
+func (s *failingSink) Close() error {
+	return nil
+}
+
+func TestFanout(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openDB(filepath.Join(dir, "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	jsonPath := filepath.Join(dir, "records.json")
+	jsonOut, err := createJSONSink(jsonPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken := &failingSink{n: 2}
+	sinks := &fanout{}
+	sinks.add("database", newBatcher(db))
+	sinks.add("broken", broken)
+	sinks.add(jsonPath, jsonOut)
+
+	want := []string{}
+	for i := 0; i < 5; i++ {
+		path := fmt.Sprintf("/f%d.txt", i)
+		want = append(want, path)
+		sinks.write(&record{path: path, extless: fmt.Sprintf("f%d", i), ext: ".txt", sha1: emptySha1})
+	}
+	if err := sinks.Close(); err == nil {
+		t.Errorf("Close returned no error after a sink failed")
+	}
+	if broken.written != 2 {
+		t.Errorf("the failing sink got %d records, want 2", broken.written)
+	}
+
+	fromDB := []string{}
+	rows, err := db.Query("SELECT path FROM files ORDER BY path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			t.Fatal(err)
+		}
+		fromDB = append(fromDB, path)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(fromDB, want) {
+		t.Errorf("the database has %v, want %v", fromDB, want)
+	}
+
+	f, err := os.Open(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fromJSON := []string{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var r jsonRecord
+		if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+			t.Fatalf("%s: %q", err, lines.Text())
+		}
+		fromJSON = append(fromJSON, r.Path)
+	}
+	sort.Strings(fromJSON)
+	if !reflect.DeepEqual(fromJSON, want) {
+		t.Errorf("-also-json has %v, want %v", fromJSON, want)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	// Files taking longer than this to read and hash are logged and flagged,
+	// 0 to disable.
+	warnOnSlow time.Duration
+
+	// Store how long each file took to read and hash.
+	recordTiming bool
+)
+
+func init() {
+	flag.DurationVar(&warnOnSlow, "warn-on-slow", 0, "log files that take longer than `DURATION` to read and hash and set is_slow on their rows")
+	flag.BoolVar(&recordTiming, "record-timing", false, "store the milliseconds each file took to read and hash in hash_ms")
+}
+
+// Record how long a file took to read and hash: flag it if slow and, with
+// -record-timing, store the time itself.
+func (r *record) setTiming(elapsed time.Duration) {
+	r.elapsed = elapsed
+	r.slow = checkSlow(r.path, elapsed)
+	if recordTiming {
+		r.hashMS = elapsed.Milliseconds()
+	}
+}
+
+// Check whether a file took unusually long to read and hash, logging it if
+// so. Slow files often point to a failing disk or storage that had to be
+// woken up.
+func checkSlow(path string, elapsed time.Duration) bool {
+	if warnOnSlow <= 0 || elapsed <= warnOnSlow {
+		return false
+	}
+
+	logEvent(levelWarn, logFields{"event": "slow", "path": path, "ms": elapsed.Milliseconds()}, "Slow file: %s took %s\n", path, elapsed.Round(time.Millisecond))
+	return true
+}
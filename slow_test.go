@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Takes delay for every read.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.r.Read(p)
+}
+
+func TestWarnOnSlow(t *testing.T) {
+	defer func(saved time.Duration) { warnOnSlow = saved }(warnOnSlow)
+	defer log.SetOutput(os.Stderr)
+	warnOnSlow = 50 * time.Millisecond
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"fast.txt": "fast", "slow.txt": "slow"})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+
+	records := []*record{}
+	for _, tt := range []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"fast.txt", 0},
+		{"slow.txt", 100 * time.Millisecond},
+	} {
+		path := filepath.Join(dir, tt.name)
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := streamRecord(&job{path: path, info: info}, slowReader{f, tt.delay})
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slow := tt.delay > 0; r.slow != slow {
+			t.Errorf("%s: slow = %t after %s, want %t", tt.name, r.slow, r.elapsed, slow)
+		}
+		if warned := strings.Contains(logged.String(), "Slow file: "+path+" took "); warned != r.slow {
+			t.Errorf("%s: logged %q", tt.name, logged.String())
+		}
+		records = append(records, r)
+	}
+
+	db := testDB(t, records...)
+	for _, r := range records {
+		var slow bool
+		if err := db.QueryRow("SELECT is_slow FROM files WHERE path = ?", r.path).Scan(&slow); err != nil {
+			t.Fatal(err)
+		}
+		if slow != r.slow {
+			t.Errorf("%s: stored is_slow = %t", r.path, slow)
+		}
+	}
+}
+
+func TestRecordTiming(t *testing.T) {
+	defer func(saved bool) { recordTiming = saved }(recordTiming)
+	defer func(saved bool) { fuzzyHashes = saved }(fuzzyHashes)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	// Both files read whole, for -fuzzy, and hashed as they are read
+	for _, fuzzyHashes = range []bool{false, true} {
+		for _, recordTiming = range []bool{false, true} {
+			root := t.TempDir()
+			writeTree(t, root, map[string]string{"a.txt": "alpha", "b/c.txt": "gamma"})
+			records := scanRecords(t, root)
+			db := testDB(t, records["a.txt"], records["b/c.txt"])
+
+			rows, err := db.Query("SELECT path, hash_ms FROM files")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var path string
+				var ms sql.NullInt64
+				if err := rows.Scan(&path, &ms); err != nil {
+					t.Fatal(err)
+				}
+				if ms.Valid != recordTiming || ms.Int64 < 0 {
+					t.Errorf("-fuzzy=%t -record-timing=%t: %s has hash_ms %v", fuzzyHashes, recordTiming, path, ms)
+				}
+			}
+			rows.Close()
+		}
+	}
+
+	// A slow read takes at least as long as its delay
+	recordTiming = true
+	path := filepath.Join(t.TempDir(), "slow.txt")
+	writeTree(t, filepath.Dir(path), map[string]string{"slow.txt": "slow"})
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := streamRecord(&job{path: path, info: info}, slowReader{strings.NewReader("slow"), 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.hashMS < 20 {
+		t.Errorf("slow.txt took %d ms, want at least 20", r.hashMS)
+	}
+}
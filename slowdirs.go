@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Number of directories to list in the slow directories report, 0 to disable.
+var traceSlowDirs int
+
+func init() {
+	flag.IntVar(&traceSlowDirs, "trace-slow-dirs", 0, "after the scan, print the `N` directories whose files took longest to read and hash in total")
+}
+
+// Time spent on the files directly in one directory.
+type dirTiming struct {
+	files   int64
+	elapsed time.Duration
+	slowest time.Duration
+}
+
+// Count the time a file took towards its directory.
+func (p *progress) addDir(r *record) {
+	if traceSlowDirs <= 0 {
+		return
+	}
+	if p.dirs == nil {
+		p.dirs = map[string]*dirTiming{}
+	}
+
+	dir := filepath.Dir(r.path)
+	t, ok := p.dirs[dir]
+	if !ok {
+		t = &dirTiming{}
+		p.dirs[dir] = t
+	}
+	t.files++
+	t.elapsed += r.elapsed
+	if r.elapsed > t.slowest {
+		t.slowest = r.elapsed
+	}
+}
+
+// Print the directories that took longest in total, with the average and
+// slowest file in each to tell many small files from a few stalled reads.
+func printSlowDirs(w io.Writer, p *progress, n int) {
+	dirs := []string{}
+	for dir := range p.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		a, b := p.dirs[dirs[i]], p.dirs[dirs[j]]
+		if a.elapsed != b.elapsed {
+			return a.elapsed > b.elapsed
+		}
+		return dirs[i] < dirs[j]
+	})
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+
+	fmt.Fprintf(w, "%10s %8s %10s %10s  %s\n", "TIME", "FILES", "AVG", "SLOWEST", "DIR")
+	for _, dir := range dirs {
+		t := p.dirs[dir]
+		avg := t.elapsed / time.Duration(t.files)
+		fmt.Fprintf(w, "%10s %8d %10s %10s  %s\n", t.elapsed.Round(time.Millisecond), t.files,
+			avg.Round(time.Millisecond), t.slowest.Round(time.Millisecond), dir)
+	}
+}
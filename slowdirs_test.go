@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceSlowDirs(t *testing.T) {
+	defer func(saved int) { traceSlowDirs = saved }(traceSlowDirs)
+	defer func(saved func(string, io.Reader) (io.Reader, error)) { decryptor = saved }(decryptor)
+	defer func(saved stringList) { decryptExts = saved }(decryptExts)
+	defer func(saved bool) { quiet = saved }(quiet)
+	traceSlowDirs, quiet = 2, true
+
+	// Files ending in .slow take a while to read, as on a stalling disk
+	decryptor = func(path string, r io.Reader) (io.Reader, error) {
+		return slowReader{r, 20 * time.Millisecond}, nil
+	}
+	decryptExts = stringList{".slow"}
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"fast/a.txt":   "a",
+		"fast/b.txt":   "b",
+		"fast/c.txt":   "c",
+		"fast/d.txt":   "d",
+		"stall/e.slow": "e",
+		"stall/f.slow": "f",
+		"other/g.txt":  "g",
+	})
+
+	prog := &progress{start: time.Now(), last: time.Now()}
+	for _, r := range scanRecords(t, root) {
+		prog.add(r)
+	}
+
+	var out bytes.Buffer
+	printSlowDirs(&out, prog, traceSlowDirs)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("printed %q, want a header and 2 directories", out.String())
+	}
+
+	stall := prog.dirs[filepath.Join(root, "stall")]
+	if stall == nil || stall.files != 2 || stall.slowest < 20*time.Millisecond || stall.elapsed < 40*time.Millisecond {
+		t.Fatalf("timed stall as %+v", stall)
+	}
+	if fields := strings.Fields(lines[1]); fields[1] != "2" || fields[len(fields)-1] != filepath.Join(root, "stall") {
+		t.Errorf("the slowest directory is %q, want stall with 2 files", lines[1])
+	}
+}
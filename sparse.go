@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// What to do with sparse files: "hash" them fully, "skip" them or hash only
+// their allocated "extents".
+var sparseMode string
+
+func init() {
+	flag.StringVar(&sparseMode, "sparse", "hash", "how to handle sparse files: hash, skip or extents")
+}
+
+// Check that -sparse names a known mode.
+func checkSparseMode() error {
+	switch sparseMode {
+	case "hash", "skip", "extents":
+		return nil
+	}
+	return fmt.Errorf("invalid -sparse %q, want hash, skip or extents", sparseMode)
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSparse(t *testing.T) {
+	defer func(saved string) { sparseMode = saved }(sparseMode)
+
+	// 8 MiB with a few bytes of data in the middle and holes around them
+	const size = 8 << 20
+	root := t.TempDir()
+	path := filepath.Join(root, "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	writeTree(t, root, map[string]string{"dense.txt": "dense"})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSparse(info) {
+		t.Skip("the filesystem of the temporary directory doesn't keep holes")
+	}
+
+	contents := make([]byte, size)
+	copy(contents[1<<20:], "data")
+	extents, err := readExtents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(extents) >= size || !bytes.Contains(extents, []byte("data")) {
+		t.Fatalf("read %d bytes of extents, want fewer than %d holding the data", len(extents), size)
+	}
+
+	tests := []struct {
+		mode        string
+		recorded    bool
+		sha1        string
+		extentsSha1 string
+	}{
+		{"hash", true, hashBytes(contents), ""},
+		{"skip", false, "", ""},
+		{"extents", true, "", hashBytes(extents)},
+	}
+
+	for _, tt := range tests {
+		sparseMode = tt.mode
+
+		records := scanRecords(t, root)
+		if dense := records["dense.txt"]; dense == nil || dense.sparse {
+			t.Errorf("-sparse %s: dense.txt recorded as %+v", tt.mode, dense)
+		}
+
+		r, ok := records["disk.img"]
+		if ok != tt.recorded {
+			t.Errorf("-sparse %s: disk.img recorded=%t, want %t", tt.mode, ok, tt.recorded)
+			continue
+		}
+		if ok && (!r.sparse || r.sha1 != tt.sha1 || r.extentsSha1 != tt.extentsSha1) {
+			t.Errorf("-sparse %s: recorded sparse=%t, sha1 %q and extents_sha1 %q, want %q and %q", tt.mode, r.sparse, r.sha1, r.extentsSha1, tt.sha1, tt.extentsSha1)
+		}
+	}
+}
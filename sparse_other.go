@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// Sparse files are not detected on this platform.
+func isSparse(info os.FileInfo) bool {
+	return false
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Check whether a file occupies fewer blocks on disk than its size implies.
+// Filesystems that compress data (e.g. ZFS, btrfs) can report compressible
+// files as sparse too.
+func isSparse(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && allocatedSize(info) < info.Size()
+}
+
+// Bytes actually allocated on disk for a file.
+func allocatedSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return info.Size()
+}
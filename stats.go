@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// Print a summary of the database: totals by extension and top-level
+	// directory, duplicates, largest files and a histogram of sizes.
+	statsMode bool
+
+	// Output format of -stats: text or json.
+	statsFormat string
+
+	// Rows of each -stats list, 0 for all of them.
+	statsTop int
+)
+
+func init() {
+	flag.BoolVar(&statsMode, "stats", false, "print the files and bytes indexed by extension and top-level directory, the duplicates and wasted space, the largest files and a histogram of sizes (after the scan if DIRs are given)")
+	flag.StringVar(&statsFormat, "stats-format", "text", "`FORMAT` of -stats: text tables or json")
+	flag.IntVar(&statsTop, "stats-top", 10, "with -stats, the `N` biggest extensions, directories and files to list, 0 for all")
+}
+
+// Check the -stats options.
+func checkStats() error {
+	if statsFormat != "text" && statsFormat != "json" {
+		return fmt.Errorf("invalid -stats-format %q, want text or json", statsFormat)
+	}
+	if statsTop < 0 {
+		return errors.New("-stats-top cannot be negative")
+	}
+	return nil
+}
+
+// Summary of the database printed by -stats.
+type storageStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Contents found more than once, the copies beyond the first of each
+	// and the bytes they take up
+	Duplicates struct {
+		Groups int64 `json:"groups"`
+		Copies int64 `json:"copies"`
+		Wasted int64 `json:"wasted_bytes"`
+	} `json:"duplicates"`
+
+	Extensions  []*statsRow   `json:"extensions"`
+	Directories []*statsRow   `json:"directories"`
+	Largest     []statsFile   `json:"largest"`
+	Sizes       []*sizeBucket `json:"sizes"`
+}
+
+// Files and bytes of an extension or a directory.
+type statsRow struct {
+	Name  string `json:"name"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type statsFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// Files of at least Min and less than Max bytes, no upper bound if Max is 0.
+type sizeBucket struct {
+	Min   int64 `json:"min"`
+	Max   int64 `json:"max,omitempty"`
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Upper bounds of the size histogram, each 16 times the one before. The
+// first bucket only holds empty files.
+var sizeBounds = []int64{1, 1 << 10, 1 << 14, 1 << 18, 1 << 22, 1 << 26, 1 << 30, 1 << 34}
+
+// Gather the -stats of the database. Duplicates are counted as in -dupes,
+// leaving out empty files unless -include-empty is given, and hard links
+// found by the scan (see -rehash-links) don't count as wasting space.
+func collectStats(db *sql.DB) (*storageStats, error) {
+	stats := &storageStats{}
+	view := filesView()
+
+	for i, max := range sizeBounds {
+		min := int64(0)
+		if i > 0 {
+			min = sizeBounds[i-1]
+		}
+		stats.Sizes = append(stats.Sizes, &sizeBucket{Min: min, Max: max})
+	}
+	stats.Sizes = append(stats.Sizes, &sizeBucket{Min: sizeBounds[len(sizeBounds)-1]})
+
+	rows, err := db.Query("SELECT path, COALESCE(ext, ''), COALESCE(size, 0) FROM " + view)
+	if err != nil {
+		return nil, err
+	}
+
+	exts, dirs := map[string]*statsRow{}, map[string]*statsRow{}
+	for rows.Next() {
+		var path, ext string
+		var size int64
+		if err := rows.Scan(&path, &ext, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		stats.Files++
+		stats.Bytes += size
+		addStatsRow(exts, strings.ToLower(ext), size)
+		addStatsRow(dirs, filepath.Dir(path), size)
+
+		bucket := stats.Sizes[len(stats.Sizes)-1]
+		for _, b := range stats.Sizes {
+			if size < b.Max {
+				bucket = b
+				break
+			}
+		}
+		bucket.Files++
+		bucket.Bytes += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.Extensions = sortStatsRows(exts)
+	for _, row := range stats.Extensions {
+		if row.Name == "" {
+			row.Name = "(none)"
+		}
+	}
+	stats.Directories = sortStatsRows(topDirs(dirs))
+
+	// Hard links sharing an inode count once, as in -dupes
+	query := "SELECT COUNT(*), COALESCE(SUM(n - 1), 0), COALESCE(SUM((n - 1) * size), 0) FROM (" +
+		"SELECT COUNT(DISTINCT CASE WHEN inode IS NULL THEN 'p' || path ELSE 'i' || COALESCE(dev, 0) || ':' || inode END) AS n, MAX(COALESCE(size, 0)) AS size FROM " +
+		view + " WHERE sha1 IS NOT NULL AND link_of IS NULL"
+	args := []interface{}{}
+	if !includeEmpty {
+		query += " AND sha1 != ?"
+		args = append(args, emptySha1)
+	}
+	query += " GROUP BY sha1 HAVING n > 1)"
+	dupes := &stats.Duplicates
+	if err := db.QueryRow(query, args...).Scan(&dupes.Groups, &dupes.Copies, &dupes.Wasted); err != nil {
+		return nil, err
+	}
+
+	limit := statsTop
+	if limit == 0 {
+		limit = -1
+	}
+	rows, err = db.Query("SELECT path, COALESCE(size, 0) FROM "+view+" ORDER BY size DESC, path LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats.Largest = []statsFile{}
+	for rows.Next() {
+		var f statsFile
+		if err := rows.Scan(&f.Path, &f.Size); err != nil {
+			return nil, err
+		}
+		stats.Largest = append(stats.Largest, f)
+	}
+	return stats, rows.Err()
+}
+
+func addStatsRow(rows map[string]*statsRow, name string, size int64) {
+	row, ok := rows[name]
+	if !ok {
+		row = &statsRow{Name: name}
+		rows[name] = row
+	}
+	row.Files++
+	row.Bytes += size
+}
+
+// Roll the totals of each directory up into the top-level directories: the
+// subdirectories of the deepest directory that contains everything indexed,
+// which keeps the files directly in it under its own name.
+func topDirs(dirs map[string]*statsRow) map[string]*statsRow {
+	common := ""
+	for dir := range dirs {
+		if common == "" {
+			common = dir
+		}
+		for {
+			if _, ok := relativeDir(common, dir); ok {
+				break
+			}
+			parent := filepath.Dir(common)
+			if parent == common {
+				break
+			}
+			common = parent
+		}
+	}
+
+	tops := map[string]*statsRow{}
+	for dir, row := range dirs {
+		top := dir
+		if rel, ok := relativeDir(common, dir); ok && rel != "." {
+			top = filepath.Join(common, strings.SplitN(rel, string(filepath.Separator), 2)[0])
+		}
+
+		t, ok := tops[top]
+		if !ok {
+			t = &statsRow{Name: top}
+			tops[top] = t
+		}
+		t.Files += row.Files
+		t.Bytes += row.Bytes
+	}
+	return tops
+}
+
+// The path of dir relative to base, if dir is under it.
+func relativeDir(base, dir string) (string, bool) {
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// The rows biggest first, ties by name, cut to -stats-top.
+func sortStatsRows(byName map[string]*statsRow) []*statsRow {
+	rows := []*statsRow{}
+	for _, row := range byName {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Bytes != rows[j].Bytes {
+			return rows[i].Bytes > rows[j].Bytes
+		}
+		return rows[i].Name < rows[j].Name
+	})
+
+	if statsTop > 0 && len(rows) > statsTop {
+		rows = rows[:statsTop]
+	}
+	return rows
+}
+
+// Print the -stats of the database as tables, or as a JSON object with
+// -stats-format json.
+func printStats(w io.Writer, db *sql.DB) error {
+	stats, err := collectStats(db)
+	if err != nil {
+		return err
+	}
+
+	if statsFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	dupes := stats.Duplicates
+	fmt.Fprintf(w, "Files: %d\n", stats.Files)
+	fmt.Fprintf(w, "Size: %s (%d bytes)\n", formatBytes(stats.Bytes), stats.Bytes)
+	fmt.Fprintf(w, "Duplicates: %d copies in %d groups, wasting %s\n", dupes.Copies, dupes.Groups, formatBytes(dupes.Wasted))
+
+	printStatsRows(w, "EXT", stats.Extensions)
+	printStatsRows(w, "DIR", stats.Directories)
+
+	fmt.Fprintf(w, "\n%12s  %s\n", "SIZE", "LARGEST")
+	for _, f := range stats.Largest {
+		fmt.Fprintf(w, "%12s  %s\n", formatBytes(f.Size), f.Path)
+	}
+
+	fmt.Fprintf(w, "\n%-22s %10s %12s\n", "SIZES", "FILES", "BYTES")
+	for _, b := range stats.Sizes {
+		var name string
+		switch {
+		case b.Max == 1:
+			name = "empty"
+		case b.Max == 0:
+			name = ">= " + formatBytes(b.Min)
+		default:
+			name = formatBytes(b.Min) + " - " + formatBytes(b.Max)
+		}
+		fmt.Fprintf(w, "%-22s %10d %12s\n", name, b.Files, formatBytes(b.Bytes))
+	}
+	return nil
+}
+
+func printStatsRows(w io.Writer, title string, rows []*statsRow) {
+	fmt.Fprintf(w, "\n%10s %12s  %s\n", "FILES", "BYTES", title)
+	for _, row := range rows {
+		fmt.Fprintf(w, "%10d %12s  %s\n", row.Files, formatBytes(row.Bytes), row.Name)
+	}
+}
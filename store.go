@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// Where a scan commits its records and keeps the facts about the database as
+// a whole. The SQLite database is the default; a -db DSN naming a PostgreSQL
+// or MySQL server selects a serverStore instead, see server.go.
+type Store interface {
+	// Commit records in a single transaction, updating the rows of the
+	// paths that are already recorded.
+	Commit(records []*record) error
+
+	// Read and store a value of the metadata table.
+	Meta(key string) (string, bool, error)
+	SetMeta(key, value string) error
+
+	Close() error
+}
+
+// The SQLite database opened by openDB.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func (s sqliteStore) Commit(records []*record) error {
+	return commitRecords(s.db, records)
+}
+
+func (s sqliteStore) Meta(key string) (string, bool, error) {
+	return getMeta(s.db, key)
+}
+
+func (s sqliteStore) SetMeta(key, value string) error {
+	return setMeta(s.db, key, value)
+}
+
+func (s sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// Check the metadata of a store before scanning into it: the algorithm, the
+// -hash algorithms and the -hash-names salt must agree with the database's.
+func prepareStore(store Store) error {
+	if err := checkAlgorithm(store); err != nil {
+		return err
+	}
+	if err := recordHashes(store); err != nil {
+		return err
+	}
+	return checkNameSalt(store)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jcrussell/sha1files/sha1files"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of -bufsize chunks of a file that may be read ahead of its hasher.
+const readAhead = 4
+
+// Size of the reads when a file is hashed as it is read rather than whole.
+var bufSize int
+
+func init() {
+	flag.IntVar(&bufSize, "bufsize", 1<<20, "read files hashed as they are read `BYTES` at a time")
+}
+
+// Check that -bufsize can hold something.
+func checkBufSize() error {
+	if bufSize <= 0 {
+		return errors.New("-bufsize must be positive")
+	}
+	return nil
+}
+
+// Hash a file as it is read, -bufsize bytes at a time, so that memory use
+// doesn't grow with the size of the file.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	d, err := (&sha1files.Hasher{BufSize: bufSize}).Sum(path, f, nil)
+	if err != nil {
+		return "", err
+	}
+	return d.SHA1, nil
+}
+
+// Size of the chunks a file is read in: -bufsize, or less for a smaller file.
+func chunkSize(fileSize int64) int64 {
+	if fileSize < int64(bufSize) {
+		// One more byte so the end is found in the first read
+		return fileSize + 1
+	}
+	return int64(bufSize)
+}
+
+// The contents of a file passed from the I/O worker reading it to the hash
+// worker hashing it a chunk at a time. Chunks are recycled once hashed, so a
+// file never takes more than readAhead of them.
+type chunkPipe struct {
+	chunks chan []byte
+	free   chan []byte
+	done   chan struct{}
+	once   sync.Once
+
+	// Size of the chunks and the number allocated, by the reader
+	size int64
+	made int
+
+	// Error of the read, set before chunks is closed
+	err error
+
+	// The chunk the hasher is reading and what's left of it
+	chunk, rest []byte
+}
+
+func newChunkPipe(fileSize int64) *chunkPipe {
+	return &chunkPipe{
+		chunks: make(chan []byte, readAhead),
+		free:   make(chan []byte, readAhead),
+		done:   make(chan struct{}),
+		size:   chunkSize(fileSize),
+	}
+}
+
+// A chunk to read into, nil once the hasher has closed the pipe.
+func (p *chunkPipe) buffer() []byte {
+	select {
+	case buf := <-p.free:
+		return buf
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	if p.made < readAhead {
+		p.made++
+		return make([]byte, p.size)
+	}
+	select {
+	case buf := <-p.free:
+		return buf
+	case <-p.done:
+		return nil
+	}
+}
+
+// Read r into the pipe until its end, an error or the hasher closing the
+// pipe.
+func (p *chunkPipe) fill(r io.Reader) {
+	defer close(p.chunks)
+
+	for {
+		buf := p.buffer()
+		if buf == nil {
+			return
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			select {
+			case p.chunks <- buf[:n]:
+			case <-p.done:
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		} else if err != nil {
+			p.err = err
+			return
+		}
+	}
+}
+
+func (p *chunkPipe) Read(b []byte) (int, error) {
+	for len(p.rest) == 0 {
+		if p.chunk != nil {
+			p.free <- p.chunk[:cap(p.chunk)]
+			p.chunk = nil
+		}
+
+		chunk, ok := <-p.chunks
+		if !ok {
+			if p.err != nil {
+				return 0, p.err
+			}
+			return 0, io.EOF
+		}
+		p.chunk, p.rest = chunk, chunk
+	}
+
+	n := copy(b, p.rest)
+	p.rest = p.rest[n:]
+	return n, nil
+}
+
+// Stop the reader, which the hasher does once it's through with the file.
+func (p *chunkPipe) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// Create the record of a file by hashing its contents as they are read from
+// r, -bufsize bytes at a time, decrypting them first if the file is
+// encrypted. The -backup-to copy is written from the same read. What needs
+// the whole contents at once, the fuzzy hash, is left out; files that need it
+// are read whole unless they are larger than -max-read-size. The type is
+// sniffed from the first bytes. Returns nil if the file's type is excluded.
+func streamRecord(j *job, r io.Reader) (*record, error) {
+	start := time.Now()
+
+	// The copy is of the file as it is, ciphertext included
+	var backup *backupCopy
+	if backupTo != "" {
+		var err error
+		if backup, err = createBackup(j.path, j.info); err != nil {
+			fileError(storedPath(j.path), "Error backing up file: %s: %s\n", j.path, err)
+		} else {
+			r = io.TeeReader(r, backup)
+		}
+	}
+	fail := func() {
+		if backup != nil {
+			backup.abort()
+		}
+	}
+
+	hasher := scanHasher()
+	encrypted := isEncrypted(j.path)
+	plain, err := hasher.Open(j.path, r)
+	if err != nil {
+		fail()
+		return nil, fmt.Errorf("decrypting %s: %s", j.path, err)
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(plain, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		fail()
+		return nil, err
+	}
+	head = head[:n]
+
+	mime := sniffMime(head)
+	if !wantMime(mime) || !wantType(j.info.Name(), mime) {
+		fileSkipped("mime-excluded", j.path)
+		fail()
+		return nil, nil
+	}
+
+	result := statRecord(j.path, j.info)
+	result.sparse = j.sparse
+	result.walked = j.walked
+	result.encrypted = encrypted
+	result.mime = mime
+
+	// -verify can't rehash the plaintext of encrypted files a block at a
+	// time
+	var blocks *blockHasher
+	var tee io.Writer
+	if blockSize > 0 && j.info.Size() > blockSize && !encrypted {
+		blocks = newBlockHasher(blockSize)
+		tee = blocks
+	}
+
+	d, err := hasher.Sum(j.path, io.MultiReader(bytes.NewReader(head), plain), tee)
+	if err != nil {
+		fail()
+		return nil, err
+	}
+	result.sha1, result.hashes, result.contentID = d.SHA1, d.Hashes, d.ContentID
+	if blocks != nil {
+		result.blocks, result.blockSize = blocks.sums(), blockSize
+	}
+
+	result.setTiming(time.Since(start))
+	if backup != nil {
+		if err := backup.finish(result.sha1); err != nil {
+			fileError(storedPath(j.path), "Error backing up file: %s: %s\n", j.path, err)
+		}
+	}
+	return result, nil
+}
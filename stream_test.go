@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamedScan(t *testing.T) {
+	defer func(saved int) { bufSize = saved }(bufSize)
+	defer func(saved int64) { blockSize = saved }(blockSize)
+	defer func(saved int64) { bufferMem = saved }(bufferMem)
+	defer func(requested, extra []string) { requestedHashes, extraHashes = requested, extra }(requestedHashes, extraHashes)
+	defer func(saved stringList) { excludeMimes = saved }(excludeMimes)
+
+	// Chunks far smaller than the files, and less memory than two files
+	// take in flight
+	bufSize, blockSize, bufferMem = 7, 10, 100
+	extraHashes = []string{"sha256"}
+	excludeMimes = stringList{"image/png"}
+
+	files := map[string]string{"empty": ""}
+	for _, size := range []int{1, 7, 10, 14, 99, 1000} {
+		files[fmt.Sprintf("%d.txt", size)] = strings.Repeat(string(rune('a'+size%26)), size)
+	}
+	// Excluded once its head is read, long before the end
+	files["image.png"] = "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 10000)
+
+	root := t.TempDir()
+	writeTree(t, root, files)
+
+	records := scanRecords(t, root)
+	if _, ok := records["image.png"]; ok {
+		t.Error("image.png was recorded")
+	}
+	delete(files, "image.png")
+
+	for name, contents := range files {
+		r, ok := records[name]
+		if !ok {
+			t.Errorf("%s wasn't recorded", name)
+			continue
+		}
+
+		sum := sha256.Sum256([]byte(contents))
+		var blocks string
+		if len(contents) > 10 {
+			blocks = hashBlocks([]byte(contents), 10)
+		}
+		if r.sha1 != hashBytes([]byte(contents)) || r.hashes["sha256"] != hex.EncodeToString(sum[:]) || r.blocks != blocks {
+			t.Errorf("%s: got %s, %v and blocks %q", name, r.sha1, r.hashes, r.blocks)
+		}
+	}
+}
+
+// Never ends.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestChunkPipeClose(t *testing.T) {
+	defer func(saved int) { bufSize = saved }(bufSize)
+	bufSize = 16
+
+	p := newChunkPipe(1 << 30)
+	filled := make(chan struct{})
+	go func() {
+		p.fill(endless{})
+		close(filled)
+	}()
+
+	if _, err := io.ReadFull(p, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	select {
+	case <-filled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the reader kept reading after the pipe was closed")
+	}
+	if p.made > readAhead {
+		t.Errorf("allocated %d chunks, want at most %d", p.made, readAhead)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"flag"
+)
+
+// Also hash named streams: macOS resource forks and NTFS alternate data
+// streams.
+var includeStreams bool
+
+func init() {
+	flag.BoolVar(&includeStreams, "include-streams", false, "also hash resource forks (macOS) and alternate data streams (Windows) as separate rows")
+}
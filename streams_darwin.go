@@ -0,0 +1,19 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"path/filepath"
+)
+
+// Return the paths of the named streams of a file. On macOS this is the
+// resource fork, if the file has a non-empty one.
+func listStreams(path string) ([]string, error) {
+	size, err := unix.Lgetxattr(path, "com.apple.ResourceFork", nil)
+	if err == unix.ENOATTR || (err == nil && size == 0) || (err != nil && xattrUnsupported(err)) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []string{filepath.Join(path, "..namedfork", "rsrc")}, nil
+}
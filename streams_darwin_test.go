@@ -0,0 +1,29 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncludeStreams(t *testing.T) {
+	defer func(saved bool) { includeStreams = saved }(includeStreams)
+	includeStreams = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha"})
+	if err := unix.Setxattr(filepath.Join(root, "a.txt"), "com.apple.ResourceFork", []byte("fork"), 0); err != nil {
+		t.Skipf("resource forks not supported: %s", err)
+	}
+
+	records := scanRecords(t, root)
+	if r, ok := records["a.txt"]; !ok || r.sha1 != hashBytes([]byte("alpha")) {
+		t.Errorf("a.txt recorded as %+v", r)
+	}
+	if r, ok := records["a.txt/..namedfork/rsrc"]; !ok || r.sha1 != hashBytes([]byte("fork")) {
+		t.Errorf("the resource fork recorded as %+v", r)
+	}
+	if len(records) != 2 {
+		t.Errorf("recorded %d rows, want 2", len(records))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !windows
+
+package main
+
+// Named streams are not supported on this platform.
+func listStreams(path string) ([]string, error) {
+	return nil, nil
+}
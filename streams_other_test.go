@@ -0,0 +1,20 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIncludeStreamsUnsupported(t *testing.T) {
+	defer func(saved bool) { includeStreams = saved }(includeStreams)
+	includeStreams = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha"})
+
+	if got, want := scanPaths(t, root), []string{"a.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"strings"
+	"unsafe"
+)
+
+var (
+	kernel32         = windows.NewLazySystemDLL("kernel32.dll")
+	findFirstStreamW = kernel32.NewProc("FindFirstStreamW")
+	findNextStreamW  = kernel32.NewProc("FindNextStreamW")
+)
+
+// WIN32_FIND_STREAM_DATA
+type findStreamData struct {
+	size int64
+	name [windows.MAX_PATH + 36]uint16
+}
+
+// Return the paths (file:stream) of the alternate data streams of a file,
+// leaving out the unnamed default stream.
+func listStreams(path string) ([]string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var data findStreamData
+	// FindStreamInfoStandard is 0, flags must be 0
+	h, _, err := findFirstStreamW.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	if windows.Handle(h) == windows.InvalidHandle {
+		if err == windows.ERROR_HANDLE_EOF || err == windows.ERROR_INVALID_PARAMETER {
+			// No streams, or a filesystem without them (e.g. FAT)
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer windows.FindClose(windows.Handle(h))
+
+	streams := []string{}
+	for {
+		// Names look like ":name:$DATA", the default stream is "::$DATA"
+		name := windows.UTF16ToString(data.name[:])
+		name = strings.TrimSuffix(strings.TrimPrefix(name, ":"), ":$DATA")
+		if name != "" {
+			streams = append(streams, path+":"+name)
+		}
+
+		ok, _, err := findNextStreamW.Call(h, uintptr(unsafe.Pointer(&data)))
+		if ok == 0 {
+			if err == windows.ERROR_HANDLE_EOF {
+				break
+			}
+			return nil, err
+		}
+	}
+
+	return streams, nil
+}
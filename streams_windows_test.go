@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncludeStreams(t *testing.T) {
+	defer func(saved bool) { includeStreams = saved }(includeStreams)
+	includeStreams = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha"})
+	if err := ioutil.WriteFile(filepath.Join(root, "a.txt:hidden"), []byte("hidden"), 0644); err != nil {
+		t.Skipf("alternate data streams not supported: %s", err)
+	}
+
+	records := scanRecords(t, root)
+	if r, ok := records["a.txt"]; !ok || r.sha1 != hashBytes([]byte("alpha")) {
+		t.Errorf("a.txt recorded as %+v", r)
+	}
+	if r, ok := records["a.txt:hidden"]; !ok || r.sha1 != hashBytes([]byte("hidden")) {
+		t.Errorf("a.txt:hidden recorded as %+v", r)
+	}
+	if len(records) != 2 {
+		t.Errorf("recorded %d rows, want 2", len(records))
+	}
+}
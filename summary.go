@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// File to write a JSON summary of the run to.
+var summaryJSON string
+
+func init() {
+	flag.StringVar(&summaryJSON, "summary-json", "", "write a JSON summary of the run (counts, errors, duration) to `FILE`")
+}
+
+// Machine-readable result of a scan, written by -summary-json.
+type runSummary struct {
+	Run             int64     `json:"run"`
+	DB              string    `json:"db"`
+	Roots           []string  `json:"roots"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Files           int64     `json:"files"`
+	Bytes           int64     `json:"bytes"`
+	Errors          int64     `json:"errors"`
+
+	// Errors matching -ignore-errors-matching
+	Ignored int64 `json:"ignored"`
+
+	// Files left out on purpose, by reason (e.g. "locked", "sparse")
+	Skipped map[string]int64 `json:"skipped"`
+
+	// Files, bytes and time hashing them by extension
+	Extensions map[string]*extTotals `json:"extensions"`
+}
+
+// Summary of the scan so far, by the time it finished.
+func newSummary(db string, roots []string, prog *progress) *runSummary {
+	finished := time.Now()
+
+	return &runSummary{
+		Run:             currentRun,
+		DB:              db,
+		Roots:           roots,
+		Started:         prog.start,
+		Finished:        finished,
+		DurationSeconds: finished.Sub(prog.start).Seconds(),
+		Files:           prog.done.files,
+		Bytes:           prog.done.bytes,
+		Errors:          atomic.LoadInt64(&fileErrors),
+		Ignored:         atomic.LoadInt64(&ignoredErrors),
+		Skipped:         skippedCounts(),
+		Extensions:      prog.exts,
+	}
+}
+
+// Write the summary of a finished scan to path.
+func writeSummary(path, db string, roots []string, prog *progress) error {
+	b, err := json.MarshalIndent(newSummary(db, roots, prog), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteSummary(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.txt": "alpha", "b.txt": "beta", "c/d.jpg": "delta"})
+
+	prog := &progress{start: time.Now(), last: time.Now()}
+	for _, r := range scanRecords(t, root) {
+		prog.add(r)
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := writeSummary(path, "files.db", []string{root}, prog); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got runSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("%s: %s", data, err)
+	}
+
+	if got.Files != 3 || got.Bytes != 14 || got.DB != "files.db" || !reflect.DeepEqual(got.Roots, []string{root}) {
+		t.Errorf("got %s", data)
+	}
+	exts := map[string]int64{}
+	for ext, totals := range got.Extensions {
+		exts[ext] = totals.Files
+	}
+	if want := map[string]int64{".txt": 2, ".jpg": 1}; !reflect.DeepEqual(exts, want) {
+		t.Errorf("got files by extension %v, want %v", exts, want)
+	}
+	if got.DurationSeconds < 0 || got.Finished.Before(got.Started) {
+		t.Errorf("ran from %s to %s", got.Started, got.Finished)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+// Walk the directories symlinks point to as if they were under the link.
+var followSymlinks bool
+
+func init() {
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "walk the directories symlinks point to, recording their files under the link's path; each directory is walked once so link loops end")
+}
+
+// The stat of a file reached through a symlink: the stat of a link's target
+// under the link's name, or of a file under a linked directory.
+type linkedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i linkedInfo) Name() string {
+	return i.name
+}
+
+// Check whether a file was reached through a symlink, for the via_link column.
+func viaLink(info os.FileInfo) bool {
+	_, ok := info.(linkedInfo)
+	return ok
+}
+
+// A directory walked, by device and inode or, where those are unknown, by its
+// path with every link resolved.
+type dirID struct {
+	dev, inode int64
+	path       string
+}
+
+// Resolves the symlinks a walk finds. Links to files are passed on with the
+// stat of their target, so the size and mtime stored are those of the
+// contents hashed. Links to directories are walked with -follow-symlinks and
+// otherwise left out, except for the root which was asked for by name.
+type linkWalker struct {
+	root string
+	fn   filepath.WalkFunc
+
+	// Directories walked so far with -follow-symlinks
+	visited map[dirID]bool
+}
+
+// Wrap a walk function of root to resolve the symlinks found.
+func walkLinks(root string, fn filepath.WalkFunc) filepath.WalkFunc {
+	w := &linkWalker{root: root, fn: fn, visited: map[dirID]bool{}}
+	return func(path string, info os.FileInfo, err error) error {
+		return w.walk(path, info, err)
+	}
+}
+
+func (w *linkWalker) walk(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return w.follow(path, info)
+	}
+
+	if info.IsDir() && followSymlinks && w.seen(path, info) {
+		// Reached again through a link, or a link to one of its parents
+		infof("Not walking dir again: %s\n", path)
+		return filepath.SkipDir
+	}
+
+	return w.fn(path, info, nil)
+}
+
+// Walk what a symlink points to. A broken link is reported like any file that
+// can't be read.
+func (w *linkWalker) follow(path string, link os.FileInfo) error {
+	target, err := os.Stat(path)
+	if err != nil {
+		return w.fn(path, link, err)
+	}
+	if !target.IsDir() {
+		return w.fn(path, linkedInfo{target, link.Name()}, nil)
+	}
+
+	root := path == w.root
+	if !followSymlinks && !root {
+		infof("Not following symlink to dir: %s\n", path)
+		return nil
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return w.fn(path, link, err)
+	}
+
+	// SkipDir from the linked directory itself ends this walk only, not that
+	// of the directory holding the link
+	return filepath.Walk(real, func(p string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(real, p)
+		if relErr != nil {
+			return relErr
+		}
+		p = filepath.Join(path, rel)
+
+		// The files under a root are not marked, even if it is a link
+		switch {
+		case info == nil:
+		case p == path:
+			info = linkedInfo{info, link.Name()}
+		case !root:
+			info = linkedInfo{info, info.Name()}
+		}
+		return w.walk(p, info, err)
+	})
+}
+
+// Check whether a directory was walked already, marking it walked.
+func (w *linkWalker) seen(path string, info os.FileInfo) bool {
+	id := dirID{}
+	_, id.dev, id.inode = fileLinks(path, info)
+	if id.inode == 0 {
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return false
+		}
+		id = dirID{path: real}
+	}
+
+	if w.visited[id] {
+		return true
+	}
+	w.visited[id] = true
+	return false
+}
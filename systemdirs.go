@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	// Prune the usual OS and tooling directories that are not worth hashing.
+	skipSystemDirs bool
+
+	// Print the directories -skip-system-dirs prunes instead of scanning.
+	listSystemDirs bool
+)
+
+func init() {
+	flag.BoolVar(&skipSystemDirs, "skip-system-dirs", false, "skip OS pseudo-filesystems and tooling dirs such as /proc and node_modules (see -list-system-dirs)")
+	flag.BoolVar(&listSystemDirs, "list-system-dirs", false, "print the directories pruned by -skip-system-dirs on this platform and exit")
+}
+
+// Names of directories pruned by -skip-system-dirs wherever they appear. Dot
+// directories such as .git are always skipped already.
+var systemDirNames = []string{"node_modules", "__pycache__", "$RECYCLE.BIN", "System Volume Information", "lost+found"}
+
+// Absolute paths pruned by -skip-system-dirs on this platform.
+func systemDirPaths() []string {
+	switch runtime.GOOS {
+	case "linux":
+		return []string{"/proc", "/sys", "/dev", "/run", "/var/cache", "/var/lib/docker"}
+	case "darwin":
+		return []string{"/dev", "/private/var/vm", "/private/var/folders", "/System/Volumes", "/Volumes"}
+	case "windows":
+		// Matched on any drive
+		return []string{`\Windows`, `\pagefile.sys`, `\hiberfil.sys`, `\swapfile.sys`}
+	}
+	return []string{"/dev", "/proc"}
+}
+
+// Check whether a directory is one -skip-system-dirs prunes.
+func isSystemDir(path, name string) bool {
+	for _, dir := range systemDirNames {
+		if strings.EqualFold(name, dir) {
+			return true
+		}
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = strings.TrimPrefix(path, filepath.VolumeName(path))
+
+	for _, dir := range systemDirPaths() {
+		if path == dir || (caseInsensitiveFS() && strings.EqualFold(path, dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the directories pruned by -skip-system-dirs.
+func printSystemDirs() {
+	for _, dir := range systemDirPaths() {
+		fmt.Println(dir)
+	}
+	for _, name := range systemDirNames {
+		fmt.Printf("%s (anywhere)\n", name)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSkipSystemDirs(t *testing.T) {
+	defer func(saved bool) { skipSystemDirs = saved }(skipSystemDirs)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"src/main.go":               "main",
+		"src/node_modules/index.js": "index",
+		"__pycache__/a.pyc":         "pyc",
+		// Only the real /proc is pruned, not any directory of that name
+		"proc/cpuinfo": "cpu",
+	})
+
+	tests := []struct {
+		skip bool
+		want []string
+	}{
+		{false, []string{"__pycache__/a.pyc", "proc/cpuinfo", "src/main.go", "src/node_modules/index.js"}},
+		{true, []string{"proc/cpuinfo", "src/main.go"}},
+	}
+
+	for _, tt := range tests {
+		skipSystemDirs = tt.skip
+		if got := scanPaths(t, root); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-skip-system-dirs=%t: scanned %v, want %v", tt.skip, got, tt.want)
+		}
+	}
+
+	// The platform's own directories, such as /proc on Linux
+	for _, dir := range systemDirPaths() {
+		if !isSystemDir(dir, filepath.Base(dir)) {
+			t.Errorf("%s isn't pruned", dir)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"os"
+)
+
+// The size of the terminal is not read on this platform.
+func terminalWidth(f *os.File) int {
+	return 0
+}
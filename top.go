@@ -0,0 +1,79 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Print the largest files of the scan, 0 to disable.
+var topN int
+
+func init() {
+	flag.IntVar(&topN, "top", 0, "print the `N` largest files scanned, biggest first, after the scan")
+}
+
+// A scanned file's path and size.
+type sizedPath struct {
+	path string
+	size int64
+}
+
+// A min-heap by size, so the smallest of the largest files seen so far is
+// the one to drop.
+type sizeHeap []sizedPath
+
+func (h sizeHeap) Len() int            { return len(h) }
+func (h sizeHeap) Less(i, j int) bool  { return h[i].size < h[j].size }
+func (h sizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x interface{}) { *h = append(*h, x.(sizedPath)) }
+
+func (h *sizeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// A sink keeping the n largest files written to it and printing them when
+// closed. Memory stays proportional to n however many files are scanned.
+type topSink struct {
+	w     io.Writer
+	n     int
+	files sizeHeap
+}
+
+func newTopSink(n int) *topSink {
+	return &topSink{w: os.Stdout, n: n}
+}
+
+func (s *topSink) write(r *record) error {
+	if len(s.files) < s.n {
+		heap.Push(&s.files, sizedPath{path: r.path, size: r.size})
+	} else if r.size > s.files[0].size {
+		s.files[0] = sizedPath{path: r.path, size: r.size}
+		heap.Fix(&s.files, 0)
+	}
+	return nil
+}
+
+// Print the files by decreasing size, ties by path.
+func (s *topSink) Close() error {
+	files := append(sizeHeap{}, s.files...)
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].size != files[j].size {
+			return files[i].size > files[j].size
+		}
+		return files[i].path < files[j].path
+	})
+
+	for _, f := range files {
+		if _, err := fmt.Fprintf(s.w, "%10s  %s\n", formatBytes(f.size), f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
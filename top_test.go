@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTopSink(t *testing.T) {
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	files := map[string]string{}
+	for name, size := range map[string]int{"a": 10, "b/c": 3000, "d": 0, "e": 500, "f/g/h": 2048, "i": 20, "j": 499} {
+		files[name] = strings.Repeat("x", size)
+	}
+	writeTree(t, root, files)
+
+	var buf bytes.Buffer
+	sink := newTopSink(3)
+	sink.w = &buf
+	for _, r := range scanRecords(t, root) {
+		if err := sink.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.files) > 3 {
+		t.Errorf("kept %d files, want at most 3", len(sink.files))
+	}
+
+	want := "   2.9 KiB  " + filepath.Join(root, "b", "c") + "\n" +
+		"   2.0 KiB  " + filepath.Join(root, "f", "g", "h") + "\n" +
+		"     500 B  " + filepath.Join(root, "e") + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printed\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Compute an aggregate hash for every directory after the scan.
+var treeHash bool
+
+func init() {
+	flag.BoolVar(&treeHash, "tree-hash", false, "after the scan, store a hash of each directory computed from its contents in the dirs table")
+}
+
+// The recorded contents of a directory: file names with their hashes and the
+// names of subdirectories.
+type treeNode struct {
+	files map[string]string
+	dirs  map[string]bool
+}
+
+// Compute the hash of every directory under the roots and replace their rows
+// in the dirs table. A directory's hash covers the name and hash of each
+// file directly in it and the name and hash of each subdirectory, so it
+// changes exactly when something below it does and two scans can be compared
+// one subtree at a time. Files are taken from the database, so the hashes
+// reflect what is recorded rather than only what this run saw.
+func storeTreeHashes(db *sql.DB, roots []string) (int, error) {
+	stored := []string{}
+	for _, root := range roots {
+		stored = append(stored, storedPath(root))
+	}
+
+	nodes := map[string]*treeNode{}
+	node := func(dir string) *treeNode {
+		n, ok := nodes[dir]
+		if !ok {
+			n = &treeNode{files: map[string]string{}, dirs: map[string]bool{}}
+			nodes[dir] = n
+		}
+		return n
+	}
+
+	rows, err := db.Query("SELECT path, COALESCE(sha1, fingerprint, '') FROM " + filesView())
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		root := rootOf(path, stored)
+		if root == "" {
+			continue
+		}
+
+		dir := filepath.Dir(path)
+		node(dir).files[filepath.Base(path)] = hash
+
+		// Link the directory into its parents, up to the root
+		for dir != root && dir != filepath.Dir(dir) {
+			parent := filepath.Dir(dir)
+			node(parent).dirs[filepath.Base(dir)] = true
+			dir = parent
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	hashes := map[string]string{}
+	for _, root := range stored {
+		if _, ok := nodes[root]; ok {
+			dirHash(root, nodes, hashes)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	// Directories that are gone or now empty lose their rows
+	old := []string{}
+	rows, err = tx.Query("SELECT path FROM dirs")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		if rootOf(path, stored) != "" {
+			old = append(old, path)
+		}
+	}
+	rows.Close()
+
+	for _, path := range old {
+		if _, err := tx.Exec("DELETE FROM dirs WHERE path = ?", path); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	for dir, hash := range hashes {
+		n := nodes[dir]
+		if _, err := tx.Exec("INSERT INTO dirs (path, hash, files, dirs) VALUES (?, ?, ?, ?)", dir, hash, len(n.files), len(n.dirs)); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return len(hashes), tx.Commit()
+}
+
+// The first root a stored path lies under, or an empty string.
+func rootOf(path string, roots []string) string {
+	for _, root := range roots {
+		if underRoots(path, []string{root}) {
+			return root
+		}
+	}
+	return ""
+}
+
+// Compute the hash of a directory, and of every directory below it, into
+// hashes. The hash is the SHA1 of one sorted line per entry: "f" or "d", the
+// entry's hash and its name.
+func dirHash(dir string, nodes map[string]*treeNode, hashes map[string]string) string {
+	n := nodes[dir]
+
+	lines := []string{}
+	for name, hash := range n.files {
+		lines = append(lines, fmt.Sprintf("f %s %s\n", hash, name))
+	}
+	for name := range n.dirs {
+		lines = append(lines, fmt.Sprintf("d %s %s\n", dirHash(filepath.Join(dir, name), nodes, hashes), name))
+	}
+	sort.Strings(lines)
+
+	hash := hashBytes([]byte(strings.Join(lines, "")))
+	hashes[dir] = hash
+	return hash
+}
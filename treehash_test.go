@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// The hash of each directory in the dirs table.
+func dirHashes(t *testing.T, db *sql.DB) map[string]string {
+	rows, err := db.Query("SELECT path, hash FROM dirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	hashes := map[string]string{}
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			t.Fatal(err)
+		}
+		hashes[path] = hash
+	}
+	return hashes
+}
+
+func TestTreeHashes(t *testing.T) {
+	db := testDB(t,
+		&record{path: "/data/a/x", sha1: hashBytes([]byte("x"))},
+		&record{path: "/data/a/deep/y", sha1: hashBytes([]byte("y"))},
+		&record{path: "/data/b/z", sha1: hashBytes([]byte("z"))},
+		&record{path: "/other/w", sha1: hashBytes([]byte("w"))},
+	)
+	roots := []string{"/data"}
+
+	if n, err := storeTreeHashes(db, roots); err != nil || n != 4 {
+		t.Fatalf("stored %d directories, %v, want 4", n, err)
+	}
+	before := dirHashes(t, db)
+
+	tests := []struct {
+		name    string
+		change  *record
+		changed []string
+	}{
+		{"unchanged", nil, nil},
+		{"same contents", &record{path: "/data/a/x", sha1: hashBytes([]byte("x"))}, nil},
+		{"deep file", &record{path: "/data/a/deep/y", sha1: hashBytes([]byte("new y"))}, []string{"/data", "/data/a", "/data/a/deep"}},
+		{"new file", &record{path: "/data/b/new", sha1: emptySha1}, []string{"/data", "/data/b"}},
+		{"outside the roots", &record{path: "/other/w", sha1: emptySha1}, nil},
+	}
+
+	for _, tt := range tests {
+		if tt.change != nil {
+			if err := insertRecords(db, []*record{tt.change}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := storeTreeHashes(db, roots); err != nil {
+			t.Fatal(err)
+		}
+		after := dirHashes(t, db)
+
+		changed := map[string]bool{}
+		for _, dir := range tt.changed {
+			changed[dir] = true
+		}
+		for dir, hash := range after {
+			if (hash != before[dir]) != changed[dir] {
+				t.Errorf("%s: %s went from %s to %s", tt.name, dir, before[dir], hash)
+			}
+		}
+		if len(after) != 4 {
+			t.Errorf("%s: stored %v, want the 4 directories under /data", tt.name, after)
+		}
+		before = after
+	}
+}
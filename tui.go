@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the dashboard is redrawn.
+	tuiInterval = 250 * time.Millisecond
+
+	// Lines of the dashboard are cut to one character less than the width
+	// of the terminal so that they never wrap, which would break redrawing
+	// in place. Lines are cut to tuiWidth if the width can't be read.
+	tuiWidth = 79
+
+	// Number of extensions and log lines shown.
+	tuiExts = 8
+	tuiLogs = 5
+)
+
+// Show a live dashboard while scanning.
+var tuiMode bool
+
+func init() {
+	flag.BoolVar(&tuiMode, "tui", false, "show a live dashboard of the scan instead of log lines when stderr is a terminal")
+}
+
+// Check whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A live view of the scan drawn on a terminal: the current directory,
+// throughput, error count and a tally by extension. While it runs it also
+// receives the log output and shows the last few lines.
+type dashboard struct {
+	mu    sync.Mutex
+	start time.Time
+	dir   string
+	done  totals
+	exts  map[string]*totals
+	logs  []string
+
+	// The terminal drawn on, and the lines and width of the last drawing
+	out   *os.File
+	lines int
+	width int
+
+	stop, stopped chan struct{}
+	restored      sync.Once
+}
+
+func newDashboard(out *os.File) *dashboard {
+	return &dashboard{
+		start:   time.Now(),
+		exts:    map[string]*totals{},
+		out:     out,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Start drawing the dashboard, taking over the log output and hiding the
+// cursor until Close.
+func (d *dashboard) run() {
+	log.SetOutput(d)
+	io.WriteString(d.out, "\x1b[?25l")
+
+	go func() {
+		ticker := time.NewTicker(tuiInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.draw()
+			case <-d.stop:
+				d.draw()
+				close(d.stopped)
+				return
+			}
+		}
+	}()
+}
+
+// Draw the dashboard a last time and restore the terminal.
+func (d *dashboard) Close() {
+	close(d.stop)
+	<-d.stopped
+	d.restore()
+}
+
+// Show the cursor again and give the log output back. Deferred by the
+// caller of run so that a panic doesn't leave the terminal without a cursor
+// and the log going nowhere.
+func (d *dashboard) restore() {
+	d.restored.Do(func() {
+		io.WriteString(d.out, "\x1b[?25h")
+		log.SetOutput(os.Stderr)
+	})
+}
+
+// Count a hashed file.
+func (d *dashboard) add(r *record) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dir = filepath.Dir(r.path)
+	d.done.files++
+	d.done.bytes += r.size
+
+	ext := strings.ToLower(r.ext)
+	t, ok := d.exts[ext]
+	if !ok {
+		t = &totals{}
+		d.exts[ext] = t
+	}
+	t.files++
+	t.bytes += r.size
+}
+
+// Keep the last lines written to the log.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.logs = append(d.logs, line)
+	}
+	if len(d.logs) > tuiLogs {
+		d.logs = d.logs[len(d.logs)-tuiLogs:]
+	}
+	return len(p), nil
+}
+
+// Render the dashboard as of now, cutting lines to width characters.
+func (d *dashboard) view(now time.Time, width int) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elapsed := now.Sub(d.start)
+	rate := int64(0)
+	if elapsed > 0 {
+		rate = int64(float64(d.done.bytes) / elapsed.Seconds())
+	}
+
+	lines := []string{
+		fmt.Sprintf("sha1files, %s elapsed", elapsed.Truncate(time.Second)),
+		"Directory: " + d.dir,
+		fmt.Sprintf("Files:     %d (%s), %s/s", d.done.files, formatBytes(d.done.bytes), formatBytes(rate)),
+		fmt.Sprintf("Errors:    %d", atomic.LoadInt64(&fileErrors)),
+		"",
+		"By extension:",
+	}
+
+	// The most common extensions first
+	exts := []string{}
+	for ext := range d.exts {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		a, b := d.exts[exts[i]], d.exts[exts[j]]
+		if a.files != b.files {
+			return a.files > b.files
+		}
+		return exts[i] < exts[j]
+	})
+	if len(exts) > tuiExts {
+		exts = exts[:tuiExts]
+	}
+	for _, ext := range exts {
+		name := ext
+		if name == "" {
+			name = "(none)"
+		}
+		lines = append(lines, fmt.Sprintf("  %-10s %8d  %s", name, d.exts[ext].files, formatBytes(d.exts[ext].bytes)))
+	}
+
+	lines = append(lines, "", "Log:")
+	for _, line := range d.logs {
+		lines = append(lines, "  "+line)
+	}
+
+	for i, line := range lines {
+		if r := []rune(line); len(r) > width {
+			lines[i] = string(r[:width])
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Redraw the dashboard over the previous one, read the width of the
+// terminal each time so that resizing it is followed.
+func (d *dashboard) draw() {
+	width := terminalWidth(d.out) - 1
+	if width < 1 {
+		width = tuiWidth
+	}
+	view := d.view(time.Now(), width)
+
+	switch {
+	case d.lines > 0 && width != d.width:
+		// The terminal rewraps the last drawing when it is resized, so its
+		// lines can't be counted back up: start over on a clear screen
+		io.WriteString(d.out, "\x1b[H\x1b[2J")
+	case d.lines > 0:
+		// Move up to the first line and clear to the end of the screen
+		fmt.Fprintf(d.out, "\x1b[%dA\x1b[J", d.lines)
+	}
+	io.WriteString(d.out, view)
+	d.lines = strings.Count(view, "\n")
+	d.width = width
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardView(t *testing.T) {
+	defer func(saved int64) { fileErrors = saved }(fileErrors)
+	fileErrors = 3
+
+	d := newDashboard(nil)
+	start := d.start
+
+	for _, r := range []*record{
+		{path: "/data/a.jpg", ext: ".jpg", size: 1024},
+		{path: "/data/b.JPG", ext: ".JPG", size: 1024},
+		{path: "/data/c.txt", ext: ".txt", size: 100},
+		{path: "/data/sub/README", size: 900},
+	} {
+		d.add(r)
+	}
+	for i := 1; i <= tuiLogs+2; i++ {
+		fmt.Fprintf(d, "line %d\n", i)
+	}
+
+	want := strings.Join([]string{
+		"sha1files, 2s elapsed",
+		"Directory: /data/sub",
+		"Files:     4 (3.0 KiB), 1.5 KiB/s",
+		"Errors:    3",
+		"",
+		"By extension:",
+		"  .jpg              2  2.0 KiB",
+		"  (none)            1  900 B",
+		"  .txt              1  100 B",
+		"",
+		"Log:",
+		"  line 3",
+		"  line 4",
+		"  line 5",
+		"  line 6",
+		"  line 7",
+	}, "\n") + "\n"
+	if got := d.view(start.Add(2*time.Second), 80); got != want {
+		t.Errorf("view:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Lines are cut to the width of the terminal
+	for _, line := range strings.Split(strings.TrimSuffix(d.view(start.Add(2*time.Second), 12), "\n"), "\n") {
+		if len(line) > 12 {
+			t.Errorf("line %q is wider than 12", line)
+		}
+	}
+}
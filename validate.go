@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Check the schema and integrity of this database instead of scanning.
+var validateDB string
+
+func init() {
+	flag.StringVar(&validateDB, "validate-db", "", "check the integrity and schema of the database `FILE` and print what it holds")
+}
+
+// Columns without which a files table can't be used. The others are added
+// when the database is next opened.
+var requiredColumns = []string{"extless", "ext", "path"}
+
+// Check a database without changing it: run SQLite's integrity check, make
+// sure the files table has the columns needed, and print the schema, row
+// counts and metadata. Returns false if any problem was found.
+func validate(path string) (bool, error) {
+	// Opening a missing file would create it
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	ok := true
+	problem := func(format string, args ...interface{}) {
+		fmt.Printf("problem: "+format+"\n", args...)
+		ok = false
+	}
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		// Files that aren't databases at all fail here
+		problem("%s", err)
+		return false, nil
+	}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if result != "ok" {
+			problem("integrity: %s", result)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		problem("%s", err)
+		return false, nil
+	}
+	if ok {
+		fmt.Printf("integrity: ok\n")
+	}
+
+	columns, err := tableColumns(db, "files")
+	if err != nil {
+		return false, err
+	}
+	if len(columns) == 0 {
+		problem("no files table")
+		return false, nil
+	}
+
+	for _, name := range requiredColumns {
+		if !columns[name] {
+			problem("files table has no %s column", name)
+		}
+	}
+
+	schema := "flat"
+	switch {
+	case columns["hash_id"]:
+		schema = "normalized"
+	case !columns["sha1"]:
+		problem("files table has no sha1 or hash_id column")
+	}
+	fmt.Printf("schema: %s\n", schema)
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		problem("reading schema version: %s", err)
+	} else if version < schemaVersion {
+		fmt.Printf("schema version: %d (upgraded to %d on next open)\n", version, schemaVersion)
+	} else {
+		fmt.Printf("schema version: %d\n", version)
+	}
+
+	missing := []string{}
+	for _, c := range fileColumns {
+		if !columns[c.name] {
+			missing = append(missing, c.name)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Printf("columns added on next open: %s\n", strings.Join(missing, ", "))
+	}
+
+	tables := []string{"files"}
+	if schema == "normalized" {
+		tables = append(tables, "hashes")
+	}
+	for _, table := range tables {
+		var count int64
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			problem("counting %s: %s", table, err)
+			continue
+		}
+		fmt.Printf("%s: %d rows\n", table, count)
+	}
+
+	meta, err := readMetadata(db)
+	if err != nil {
+		problem("reading metadata: %s", err)
+	}
+	keys := []string{}
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("metadata %s: %s\n", key, meta[key])
+	}
+
+	return ok, nil
+}
+
+// Read every key of the metadata table, which databases from before it
+// existed lack.
+func readMetadata(db *sql.DB) (map[string]string, error) {
+	meta := map[string]string{}
+
+	columns, err := tableColumns(db, "metadata")
+	if err != nil || len(columns) == 0 {
+		return meta, err
+	}
+
+	rows, err := db.Query("SELECT key, value FROM metadata")
+	if err != nil {
+		return meta, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return meta, err
+		}
+		meta[key] = value.String
+	}
+	return meta, rows.Err()
+}
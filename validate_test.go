@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateFreshDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "files.db")
+	db, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	ok, err := validate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("validate(%s) found a problem in a new database", path)
+	}
+}
+
+func TestValidateBadDBs(t *testing.T) {
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := ioutil.WriteFile(garbage, []byte("this is not a database, it only has a .db name"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid database whose pages were overwritten past the header
+	corrupt := filepath.Join(dir, "corrupt.db")
+	db, err := openDB(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := db.Exec("INSERT INTO files (extless, ext, path, sha1) VALUES (?, '', ?, ?)", "f", fmt.Sprintf("%s/f%03d", dir, i), emptySha1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	os.Remove(corrupt + "-wal")
+	os.Remove(corrupt + "-shm")
+	f, err := os.OpenFile(corrupt, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := make([]byte, 4096)
+	for i := range junk {
+		junk[i] = 0xa5
+	}
+	if _, err := f.WriteAt(junk, 4096); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A SQLite database that isn't an index
+	other := filepath.Join(dir, "other.db")
+	odb, err := sql.Open("sqlite3", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := odb.Exec("CREATE TABLE notes (body TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	odb.Close()
+
+	for _, path := range []string{garbage, corrupt, other} {
+		ok, err := validate(path)
+		if err == nil && ok {
+			t.Errorf("validate(%s) found no problem", filepath.Base(path))
+		}
+	}
+
+	if _, err := validate(filepath.Join(dir, "missing.db")); err == nil {
+		t.Errorf("validate of a missing file succeeded")
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// Rehash the files recorded in the database instead of scanning.
+	verifyMode bool
+
+	// Only verify files modified at or after this time, see parseSince.
+	checkOnlyNew string
+
+	// Verify the files listed in a sha1sum-format manifest, without a db.
+	manifestPath string
+
+	// Number of files rehashed concurrently when verifying.
+	verifyWorkers int
+
+	// Update the rows of files found to have changed.
+	verifyFix bool
+)
+
+func init() {
+	flag.BoolVar(&verifyMode, "verify", false, "rehash the files recorded in the db and report any that changed or went missing")
+	flag.StringVar(&manifestPath, "verify-manifest", "", "rehash the files listed in a sha1sum-format `FILE` and report any that changed or went missing")
+	flag.IntVar(&verifyWorkers, "verify-workers", 4, "number of files to rehash concurrently with -verify and -verify-manifest")
+	flag.BoolVar(&verifyFix, "verify-fix", false, "with -verify, update the hashes of changed files in the db (and remove missing ones with -prune-missing)")
+	flag.StringVar(&checkOnlyNew, "check-only-new", "", "with -verify, only check files modified `SINCE` a date, RFC 3339 time or duration ago (e.g. 24h)")
+}
+
+// Parse the -check-only-new value. It may be a duration before now (e.g. 36h),
+// a date (2006-01-02) or an RFC 3339 timestamp.
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -check-only-new %q, want a duration, date or RFC 3339 time", since)
+	}
+	return t, nil
+}
+
+// Counts of verification results.
+type tally struct {
+	ok, changed, missing int
+
+	// Files that could not be read, so whether they changed is unknown
+	errors int
+
+	// Files found under the roots given to -verify that have no row
+	added int
+
+	// With -verify-fix, the files to update or remove
+	changedItems, missingItems []*verifyItem
+}
+
+// A file to verify against its recorded hash and, if it has them, block
+// hashes (see -block-size).
+type verifyItem struct {
+	path       string
+	want       string
+	wantBlocks string
+	blockSize  int64
+
+	// Result of rehashing the file, with its stat for -verify-fix
+	got, gotBlocks string
+	info           os.FileInfo
+	err            error
+
+	// Closed once the file has been rehashed
+	done chan struct{}
+}
+
+// Rehash the item's file.
+func (item *verifyItem) rehash() {
+	defer close(item.done)
+
+	if verifyFix {
+		if item.info, item.err = os.Stat(localPath(item.path)); item.err != nil {
+			return
+		}
+	}
+
+	if item.wantBlocks != "" && item.blockSize > 0 {
+		item.got, item.gotBlocks, item.err = calcBlocks(localPath(item.path), item.blockSize)
+	} else {
+		item.got, item.err = calcSha1(localPath(item.path))
+	}
+}
+
+// Rehash the files sent to items with -verify-workers goroutines and print
+// the results in the order the files were sent, returning once items is
+// closed and every file is reported.
+func (t *tally) checkAll(items <-chan *verifyItem) {
+	workers := verifyWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// The queue keeps the order for reporting, at most a few files ahead
+	queue := make(chan *verifyItem, workers)
+	work := make(chan *verifyItem)
+
+	go func() {
+		for item := range items {
+			item.done = make(chan struct{})
+			queue <- item
+			work <- item
+		}
+		close(queue)
+		close(work)
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for item := range work {
+				item.rehash()
+			}
+		}()
+	}
+
+	for item := range queue {
+		<-item.done
+		t.record(item)
+	}
+}
+
+// Compare a rehashed file to the expected hash, printing the stored path
+// with its status: OK, CHANGED if the hash differs, MISSING if the file is
+// gone or ERROR if it could not be read. If block hashes were stored for the
+// file, the blocks that changed are listed too.
+func (t *tally) record(item *verifyItem) {
+	path, want, wantBlocks := item.path, item.want, item.wantBlocks
+	got, gotBlocks, err := item.got, item.gotBlocks, item.err
+
+	status := "OK"
+	if os.IsNotExist(err) {
+		status = "MISSING"
+		t.missing++
+		t.missingItems = append(t.missingItems, item)
+	} else if err != nil {
+		fileError(path, "Error reading file: %s\n", err)
+		status = "ERROR"
+		t.errors++
+	} else if got != want {
+		status = "CHANGED"
+		if gotBlocks != "" {
+			status += " (" + changedBlocks(wantBlocks, gotBlocks) + ")"
+		}
+		t.changed++
+		t.changedItems = append(t.changedItems, item)
+	} else {
+		t.ok++
+	}
+
+	fmt.Printf("%s: %s%s", path, status, lineEnd())
+}
+
+// Log the totals and return whether every file verified OK. New files are
+// reported but don't count as failures.
+func (t *tally) report() bool {
+	log.Printf("Verified %d files: %d OK, %d changed, %d missing, %d errors, %d new\n", t.ok+t.changed+t.missing+t.errors, t.ok, t.changed, t.missing, t.errors, t.added)
+	return t.changed+t.missing+t.errors == 0
+}
+
+// Walk the roots and print "<path>: NEW" for every file that would be
+// scanned but has no row yet.
+func (t *tally) findNew(db *sql.DB, roots []string) error {
+	stmt, err := db.Prepare("SELECT COUNT(*) FROM files WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fileError(path, "Error walking: %s\n", err)
+				t.errors++
+				return nil
+			}
+			if skipPath(path, info) || isIgnored(path, info) {
+				return skipEntry(info)
+			}
+			if info.IsDir() || !wantFile(path, info) {
+				return nil
+			}
+
+			var count int
+			if err := stmt.QueryRow(storedPath(path)).Scan(&count); err != nil {
+				return err
+			}
+			if count == 0 {
+				fmt.Printf("%s: NEW%s", storedPath(path), lineEnd())
+				t.added++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rehash every file in the database, printing one line per file with its
+// status. Returns false if any file failed verification. Given roots, only
+// the files under them are rehashed and the roots are walked for new files
+// too.
+func verify(db *sql.DB, roots []string) (bool, error) {
+	if hashed, err := namesHashed(db); err != nil || hashed {
+		if hashed {
+			err = errors.New("cannot verify a database of hashed paths (see -hash-names)")
+		}
+		return false, err
+	}
+
+	// Rows from -fingerprint scans have no full hash to verify, and remote
+	// files can't be read from here
+	query := "SELECT path, sha1, COALESCE(blocks, ''), COALESCE(block_size, 0) FROM " + filesView() +
+		" WHERE sha1 IS NOT NULL AND archive IS NULL AND path NOT LIKE '" + remotePrefix + "%' AND path NOT LIKE '" + s3Prefix + "%'"
+
+	args := []interface{}{}
+	if checkOnlyNew != "" {
+		since, err := parseSince(checkOnlyNew)
+		if err != nil {
+			return false, err
+		}
+
+		query += " AND mtime >= ?"
+		args = append(args, since.Unix())
+	}
+
+	// Path order keeps the report the same however many workers there are
+	query += " ORDER BY path"
+
+	stored := []string{}
+	for _, root := range roots {
+		stored = append(stored, storedPath(root))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	t := &tally{}
+	items := make(chan *verifyItem)
+	done := make(chan struct{})
+	go func() {
+		t.checkAll(items)
+		close(done)
+	}()
+
+	for rows.Next() {
+		item := &verifyItem{}
+		if err = rows.Scan(&item.path, &item.want, &item.wantBlocks, &item.blockSize); err != nil {
+			break
+		}
+		if len(roots) > 0 && !underRoots(item.path, stored) {
+			continue
+		}
+		items <- item
+	}
+	close(items)
+	<-done
+
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	if len(roots) > 0 {
+		if err := t.findNew(db, roots); err != nil {
+			return false, err
+		}
+	}
+
+	if verifyFix {
+		if err := t.fix(db); err != nil {
+			return false, err
+		}
+	}
+
+	// A read-only database can still be verified
+	if t.errors > 0 {
+		if _, err := storeErrors(db); err != nil {
+			errorf("Error recording the errors in the errors table: %s\n", err)
+		}
+	}
+	return t.report(), nil
+}
+
+// Columns of digests of the contents that -verify-fix doesn't recompute: the
+// -hash digests, -fuzzy hash, -fingerprint, content ID and -sparse extents
+// hash.
+func staleColumns() []string {
+	names := []string{"fuzzy", "fingerprint", "content_id", "extents_sha1"}
+	for _, c := range hashColumns() {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// Reconcile the database with the files found by -verify-fix: changed files
+// get their new hash, size and modification time, the digests that aren't
+// recomputed are cleared rather than left stale, and with -prune-missing
+// the rows of missing files are removed. The size of a bundle (see
+// -bundle-ext) is that of its contents, so only its hash is updated.
+func (t *tally) fix(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	update := "UPDATE files SET sha1 = ?1, hash_prefix = ?7, size = COALESCE(?2, size), mtime = ?3, blocks = ?4, last_seen = ?5"
+	if normalized {
+		update = "UPDATE files SET hash_id = (SELECT id FROM hashes WHERE sha1 = ?1 AND size = COALESCE(?2, files.size)), hash_prefix = ?7, size = COALESCE(?2, size), mtime = ?3, blocks = ?4, last_seen = ?5"
+	}
+	for _, name := range staleColumns() {
+		update += ", " + name + " = NULL"
+	}
+	update += " WHERE path = ?6"
+
+	now := time.Now().Unix()
+	for _, item := range t.changedItems {
+		var size interface{} = item.info.Size()
+		if isBundle(item.path) {
+			size = nil
+		}
+
+		if normalized {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO hashes (sha1, size) SELECT ?, COALESCE(?, size) FROM files WHERE path = ?", item.got, size, item.path); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(update, item.got, size, item.info.ModTime().Unix(), nullString(item.gotBlocks), now, item.path, hashPrefix(item.got)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	removed := 0
+	if pruneMissing {
+		for _, item := range t.missingItems {
+			if _, err := tx.Exec("DELETE FROM files WHERE path = ?", item.path); err != nil {
+				tx.Rollback()
+				return err
+			}
+			removed++
+		}
+	}
+
+	if normalized {
+		if _, err := tx.Exec("DELETE FROM hashes WHERE id NOT IN (SELECT hash_id FROM files)"); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Fixed %d rows of changed files, removed %d rows of missing files\n", len(t.changedItems), removed)
+	return nil
+}
+
+// Parse a line of a sha1sum-format manifest: the hash, two spaces (or a space
+// and "*" for binary mode) and the path. Lines starting with a backslash have
+// "\\" and "\n" escapes in the path, as written by sha1sum for names
+// containing those characters. The hash must be a SHA1, which is what the
+// files are rehashed with.
+func parseManifestLine(line string) (hash, path string, err error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+
+	i := strings.Index(line, " ")
+	if i < 0 || i+2 > len(line) || (line[i+1] != ' ' && line[i+1] != '*') {
+		return "", "", fmt.Errorf("malformed manifest line: %q", line)
+	}
+
+	hash, path = strings.ToLower(line[:i]), line[i+2:]
+	if !isSha1(hash) {
+		if algorithm, ok := hashLengths[len(hash)]; ok && algorithm != "sha1" {
+			return "", "", fmt.Errorf("%s looks like a %s digest, want a SHA1 as sha1sum writes", line[:i], algorithm)
+		}
+		return "", "", fmt.Errorf("%s is not a SHA1 of 40 hex digits", line[:i])
+	}
+	if escaped {
+		path = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(path)
+	}
+
+	return hash, path, nil
+}
+
+// Rehash every file listed in a sha1sum-format manifest, printing one line
+// per file with its status. Returns false if any file failed verification.
+func verifyManifest(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	t := &tally{}
+	items := make(chan *verifyItem)
+	done := make(chan struct{})
+	go func() {
+		t.checkAll(items)
+		close(done)
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		var hash, file string
+		if hash, file, err = parseManifestLine(scanner.Text()); err != nil {
+			err = fmt.Errorf("%s:%d: %s", path, n, err)
+			break
+		}
+
+		items <- &verifyItem{path: file, want: hash}
+	}
+	close(items)
+	<-done
+
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return t.report(), nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseManifestLine(t *testing.T) {
+	const sum = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	tests := []struct {
+		line       string
+		hash, path string
+		wantErr    bool
+	}{
+		{line: sum + "  a.txt", hash: sum, path: "a.txt"},
+		{line: sum + " *bin/a.out", hash: sum, path: "bin/a.out"},
+		{line: "DA39A3EE5E6B4B0D3255BFEF95601890AFD80709  upper", hash: sum, path: "upper"},
+		{line: sum + "  two  spaces", hash: sum, path: "two  spaces"},
+		{line: "\\" + sum + "  new\\nline\\\\back", hash: sum, path: "new\nline\\back"},
+		{line: sum, wantErr: true},
+		{line: sum + " a.txt", wantErr: true},
+		{line: "da39a3ee  short", wantErr: true},
+		{line: "zz39a3ee5e6b4b0d3255bfef95601890afd80709  not-hex", wantErr: true},
+		{line: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  sha256", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		hash, path, err := parseManifestLine(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseManifestLine(%q) = %q, %q, want an error", tt.line, hash, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseManifestLine(%q): %s", tt.line, err)
+			continue
+		}
+		if hash != tt.hash || path != tt.path {
+			t.Errorf("parseManifestLine(%q) = %q, %q, want %q, %q", tt.line, hash, path, tt.hash, tt.path)
+		}
+	}
+}
+
+func TestVerifyFix(t *testing.T) {
+	defer func(saved bool) { normalized = saved }(normalized)
+	defer func(saved bool) { verifyFix = saved }(verifyFix)
+	defer func(saved bool) { pruneMissing = saved }(pruneMissing)
+	verifyFix, pruneMissing = true, true
+
+	for _, normalized = range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := statRecord(path, info)
+		r.sha1 = hashBytes([]byte("old"))
+		r.hashes = map[string]string{"md5": "149603e6c03516362a8da23f624db945"}
+		r.fuzzy, r.fingerprint, r.contentID = "3:old:old", r.sha1, "old-id"
+		gone := filepath.Join(dir, "gone")
+		db := testDB(t, r, &record{path: gone, sha1: hashBytes([]byte("gone")), size: 4})
+
+		if err := ioutil.WriteFile(path, []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		// What changed is still reported
+		var ok bool
+		printed := captureStdout(t, func() { ok, err = verify(db, nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("normalized=%t: verified OK after the file changed", normalized)
+		}
+		if !strings.Contains(printed, path+": CHANGED") || !strings.Contains(printed, gone+": MISSING") {
+			t.Errorf("normalized=%t: printed %q", normalized, printed)
+		}
+
+		var rows int
+		if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE path = ?", gone).Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != 0 {
+			t.Errorf("normalized=%t: the missing file's row was kept with -prune-missing", normalized)
+		}
+
+		want := hashBytes([]byte("changed"))
+		if got := storedSha1(t, db, path); got != want {
+			t.Errorf("normalized=%t: sha1 = %q, want %q", normalized, got, want)
+		}
+
+		var prefix string
+		var size, stored int64
+		var md5, fuzzy, fingerprint, contentID sql.NullString
+		row := db.QueryRow("SELECT hash_prefix, size, mtime, md5, fuzzy, fingerprint, content_id FROM files WHERE path = ?", path)
+		if err := row.Scan(&prefix, &size, &stored, &md5, &fuzzy, &fingerprint, &contentID); err != nil {
+			t.Fatal(err)
+		}
+		if prefix != hashPrefix(want) || size != int64(len("changed")) || stored != mtime.Unix() {
+			t.Errorf("normalized=%t: hash_prefix %q, size %d and mtime %d, want %q, %d and %d", normalized, prefix, size, stored, hashPrefix(want), len("changed"), mtime.Unix())
+		}
+		for name, digest := range map[string]sql.NullString{"md5": md5, "fuzzy": fuzzy, "fingerprint": fingerprint, "content_id": contentID} {
+			if digest.Valid {
+				t.Errorf("normalized=%t: the stale %s %q was kept", normalized, name, digest.String)
+			}
+		}
+	}
+}
+
+// What f prints to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved *os.File) { os.Stdout = saved }(os.Stdout)
+	os.Stdout = w
+
+	printed := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		printed <- data
+	}()
+	f()
+	w.Close()
+	return string(<-printed)
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	same := filepath.Join(dir, "same.txt")
+	changed := filepath.Join(dir, "changed.txt")
+	missing := filepath.Join(dir, "missing.txt")
+	writeTree(t, dir, map[string]string{"same.txt": "same", "changed.txt": "changed"})
+
+	tests := []struct {
+		name   string
+		lines  []string
+		ok     bool
+		report []string
+	}{
+		{"all OK", []string{
+			hashBytes([]byte("same")) + "  " + same,
+		}, true, []string{same + ": OK"}},
+		{"one changed", []string{
+			hashBytes([]byte("same")) + "  " + same,
+			hashBytes([]byte("before")) + "  " + changed,
+		}, false, []string{changed + ": CHANGED", same + ": OK"}},
+		{"one missing", []string{
+			hashBytes([]byte("same")) + "  " + same,
+			hashBytes([]byte("missing")) + "  " + missing,
+		}, false, []string{missing + ": MISSING", same + ": OK"}},
+	}
+
+	for i, tt := range tests {
+		manifest := filepath.Join(dir, fmt.Sprintf("manifest%d.sha1", i))
+		if err := ioutil.WriteFile(manifest, []byte(strings.Join(tt.lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var ok bool
+		var err error
+		printed := captureStdout(t, func() { ok, err = verifyManifest(manifest) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.ok {
+			t.Errorf("%s: verified %t, want %t", tt.name, ok, tt.ok)
+		}
+
+		report := strings.Split(strings.TrimSuffix(printed, "\n"), "\n")
+		sort.Strings(report)
+		if !reflect.DeepEqual(report, tt.report) {
+			t.Errorf("%s: reported %q, want %q", tt.name, report, tt.report)
+		}
+	}
+}
+
+func TestVerifyCheckOnlyNew(t *testing.T) {
+	defer func(saved string) { checkOnlyNew = saved }(checkOnlyNew)
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"old.txt": "old", "new.txt": "new", "gone.txt": "gone"})
+	old := time.Now().AddDate(-1, 0, 0)
+	for _, name := range []string{"old.txt", "gone.txt"} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := scanRecords(t, dir)
+	db := testDB(t, records["old.txt"], records["new.txt"], records["gone.txt"])
+	os.Remove(filepath.Join(dir, "gone.txt"))
+
+	tests := []struct {
+		since  string
+		ok     bool
+		report []string
+	}{
+		{"", false, []string{"gone.txt: MISSING", "new.txt: OK", "old.txt: OK"}},
+		{"24h", true, []string{"new.txt: OK"}},
+		{old.AddDate(0, 0, -1).Format("2006-01-02"), false, []string{"gone.txt: MISSING", "new.txt: OK", "old.txt: OK"}},
+		{time.Now().Add(time.Hour).Format(time.RFC3339), true, []string{}},
+	}
+
+	for _, tt := range tests {
+		checkOnlyNew = tt.since
+
+		var ok bool
+		var err error
+		printed := captureStdout(t, func() { ok, err = verify(db, nil) })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := []string{}
+		for _, line := range strings.Split(printed, "\n") {
+			if line != "" {
+				report = append(report, strings.TrimPrefix(line, dir+string(filepath.Separator)))
+			}
+		}
+		sort.Strings(report)
+		if ok != tt.ok || !reflect.DeepEqual(report, tt.report) {
+			t.Errorf("-check-only-new %q: reported %q and %t, want %q and %t", tt.since, report, ok, tt.report, tt.ok)
+		}
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		since   string
+		want    time.Time
+		wantErr bool
+	}{
+		{since: "2024-03-01", want: day},
+		{since: "2024-03-01T12:00:00Z", want: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{since: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSince(tt.since)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSince(%q) = %s, want an error", tt.since, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseSince(%q) = %s, %v, want %s", tt.since, got, err, tt.want)
+		}
+	}
+
+	// A duration counts back from now
+	got, err := parseSince("2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ago := time.Since(got); ago < 2*time.Hour || ago > 2*time.Hour+time.Minute {
+		t.Errorf("parseSince(\"2h\") is %s ago", ago)
+	}
+}
+
+func TestVerifyWorkers(t *testing.T) {
+	defer func(saved int) { verifyWorkers = saved }(verifyWorkers)
+	defer func(saved bool) { quiet = saved }(quiet)
+	quiet = true
+
+	root := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("%02d/file.txt", i)] = strings.Repeat("x", i*100)
+	}
+	writeTree(t, root, files)
+
+	all := []*record{}
+	for _, r := range scanRecords(t, root) {
+		all = append(all, r)
+	}
+	db := testDB(t, all...)
+
+	for i := 0; i < 50; i += 7 {
+		path := filepath.Join(root, fmt.Sprintf("%02d", i), "file.txt")
+		if i%2 == 0 {
+			if err := ioutil.WriteFile(path, []byte("changed"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want string
+	for _, verifyWorkers = range []int{1, 8} {
+		var ok bool
+		var err error
+		printed := captureStdout(t, func() { ok, err = verify(db, nil) })
+		if err != nil || ok {
+			t.Fatalf("-verify-workers %d: verified %t, %v, want changes found", verifyWorkers, ok, err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(printed, "\n"), "\n")
+		if len(lines) != 50 || !sort.StringsAreSorted(lines) {
+			t.Errorf("-verify-workers %d: printed %d lines out of path order:\n%s", verifyWorkers, len(lines), printed)
+		}
+		if want == "" {
+			want = printed
+		} else if printed != want {
+			t.Errorf("-verify-workers %d printed\n%s\nwant, as one worker did,\n%s", verifyWorkers, printed, want)
+		}
+	}
+	if n := strings.Count(want, ": CHANGED") + strings.Count(want, ": MISSING"); n != 8 {
+		t.Errorf("found %d changes, want 8", n)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	// Keep the database up to date with the DIRs after the scan.
+	watchMode bool
+
+	// How long a file must go without changes before it is hashed.
+	watchDelay time.Duration
+)
+
+func init() {
+	flag.BoolVar(&watchMode, "watch", false, "after the scan, keep watching the DIRs and hash files as they are created or changed, deleting the rows of removed ones, until interrupted")
+	flag.DurationVar(&watchDelay, "watch-delay", 2*time.Second, "with -watch, how long a file must go unchanged before it is hashed")
+}
+
+// Check the -watch options. Watching never ends on its own, so it can't wait
+// for the end of the run as -atomic and -db-per-root do, nor stop at a
+// -max-bytes budget. Removed files are forgotten by path, which -hash-names
+// hides.
+func checkWatch() error {
+	if !watchMode {
+		return nil
+	}
+	switch {
+	case atomicSwap || dbPerRoot != "":
+		return errors.New("-watch cannot be combined with -atomic or -db-per-root")
+	case maxBytes > 0:
+		return errors.New("-watch cannot be combined with -max-bytes")
+	case hashNames:
+		return errors.New("-watch cannot be combined with -hash-names")
+	case watchDelay <= 0:
+		return errors.New("-watch-delay must be positive")
+	}
+	return nil
+}
+
+// Watch the local roots until interrupted, hashing the files created or
+// written to once they have been left alone for -watch-delay and deleting
+// the rows of those removed or renamed away. New directories are watched
+// and scanned as they appear. The files hashed count towards the run the
+// watch started with, whose row is updated on the way out.
+func watch(db *sql.DB, roots []string, prog *progress) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs := 0
+	for _, root := range roots {
+		if isRemote(root) {
+			warnf("Not watching remote root: %s\n", root)
+			continue
+		}
+		dirs += addWatches(watcher, root)
+	}
+	log.Printf("Watching %d directories for changes\n", dirs)
+
+	done := prog.done
+	defer func() {
+		if err := finishRun(db, done); err != nil {
+			errorf("Error recording the run: %s\n", err)
+		}
+	}()
+
+	// Changed paths by the time of their latest event
+	pending := map[string]time.Time{}
+
+	interval := watchDelay / 2
+	if interval <= 0 {
+		interval = watchDelay
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			switch {
+			case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+				// A file renamed within the DIRs also gets a Create event
+				// for its new name
+				delete(pending, event.Name)
+				if err := forgetPath(db, event.Name); err != nil {
+					return err
+				}
+			case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+				pending[event.Name] = time.Now()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if err == fsnotify.ErrEventOverflow {
+				warnf("Too many changes at once, some were missed: scan the DIRs again to catch up\n")
+				continue
+			}
+			errorf("Error watching: %s\n", err)
+		case now := <-ticker.C:
+			if isInterrupted() {
+				log.Printf("Stopped watching\n")
+				return nil
+			}
+
+			ready := []string{}
+			for path, changed := range pending {
+				if now.Sub(changed) >= watchDelay {
+					ready = append(ready, path)
+					delete(pending, path)
+				}
+			}
+			if len(ready) == 0 {
+				continue
+			}
+
+			hashed, err := hashChanged(db, watcher, ready)
+			if err != nil {
+				return err
+			}
+			done.files += hashed.files
+			done.bytes += hashed.bytes
+		}
+	}
+}
+
+// Watch root and every directory below it that a scan would walk, returning
+// how many are watched. Directories that can't be watched, e.g. past the
+// inotify limit, are logged as errors.
+func addWatches(watcher *fsnotify.Watcher, root string) int {
+	dirs := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			fileError(storedPath(path), "Error walking: %s\n", err)
+			return nil
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if skipPath(path, info) || isIgnored(path, info) {
+			return filepath.SkipDir
+		}
+
+		if err := watcher.Add(path); err != nil {
+			fileError(storedPath(path), "Error watching: %s: %s\n", path, err)
+			return nil
+		}
+		dirs++
+		return nil
+	})
+	return dirs
+}
+
+// Scan the changed paths, storing the records of those that still exist and
+// watching the new directories among them. Returns the files hashed.
+func hashChanged(db *sql.DB, watcher *fsnotify.Watcher, paths []string) (totals, error) {
+	sort.Strings(paths)
+
+	roots := []string{}
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			// Removed since, its rows went with the Remove event
+			continue
+		}
+		if info.IsDir() {
+			addWatches(watcher, path)
+		}
+		roots = append(roots, path)
+	}
+
+	results := make(chan *record, resultsBuffer)
+	go func() {
+		scan(roots, results)
+		close(results)
+	}()
+
+	hashed := totals{}
+	store := newBatcher(db)
+	for result := range results {
+		if !filterKnown(result) {
+			continue
+		}
+		if err := store.add(result); err != nil {
+			return hashed, err
+		}
+		hashed.files++
+		hashed.bytes += result.size
+	}
+	if err := store.Close(); err != nil {
+		return hashed, err
+	}
+
+	if hashed.files > 0 {
+		infof("Hashed %d changed files (%s)\n", hashed.files, formatBytes(hashed.bytes))
+	}
+	return hashed, nil
+}
+
+// Delete the rows of a removed file, or of every file under a removed
+// directory.
+func forgetPath(db *sql.DB, path string) error {
+	stored := storedPath(path)
+	prefix := stored + string(filepath.Separator)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM files WHERE path = ?1 OR archive = ?1 OR substr(path, 1, length(?2)) = ?2", stored, prefix)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		infof("Forgetting %d rows of removed %s\n", n, stored)
+	}
+
+	if normalized {
+		// Drop content no file refers to anymore
+		if _, err := tx.Exec("DELETE FROM hashes WHERE id NOT IN (SELECT hash_id FROM files)"); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+)
+
+// Read extended attributes of each file and store them as JSON.
+var readXattrs bool
+
+func init() {
+	flag.BoolVar(&readXattrs, "xattrs", false, "store extended attributes of each file as JSON in the xattrs column")
+}
+
+// Read the extended attributes of a file and encode them as a JSON object of
+// name to value. Returns an empty string if the file has no attributes or the
+// filesystem does not support them.
+func xattrsJSON(path string) (string, error) {
+	attrs, err := listXattrs(path)
+	if err != nil || len(attrs) == 0 {
+		return "", err
+	}
+
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/sys/unix"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	defer func(saved bool) { readXattrs = saved }(readXattrs)
+	readXattrs = true
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"tagged.txt": "tagged", "plain.txt": "plain"})
+	if err := unix.Setxattr(filepath.Join(root, "tagged.txt"), "user.origin", []byte("https://example.com/"), 0); err != nil {
+		if xattrUnsupported(err) {
+			t.Skip("the filesystem of the temporary directory has no user xattrs")
+		}
+		t.Fatal(err)
+	}
+
+	records := scanRecords(t, root)
+	db := testDB(t, records["tagged.txt"], records["plain.txt"])
+
+	var stored string
+	if err := db.QueryRow("SELECT xattrs FROM files WHERE path = ?", filepath.Join(root, "tagged.txt")).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal([]byte(stored), &got); err != nil {
+		t.Fatalf("%s: %s", err, stored)
+	}
+	if want := map[string]string{"user.origin": "https://example.com/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stored xattrs %v, want %v", got, want)
+	}
+
+	var none *string
+	if err := db.QueryRow("SELECT xattrs FROM files WHERE path = ?", filepath.Join(root, "plain.txt")).Scan(&none); err != nil {
+		t.Fatal(err)
+	}
+	if none != nil {
+		t.Errorf("plain.txt has xattrs %s, want NULL", *none)
+	}
+}
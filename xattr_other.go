@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// Extended attributes are not supported on this platform.
+func listXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
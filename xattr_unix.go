@@ -0,0 +1,65 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+)
+
+// Check whether an error means the filesystem has no xattr support.
+func xattrUnsupported(err error) bool {
+	return err == unix.ENOTSUP || err == unix.EOPNOTSUPP
+}
+
+// Read all extended attributes of a file without following symlinks.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]string{}
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		value, err := getXattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+
+	return attrs, nil
+}
+
+// Read a single extended attribute, trimming the NUL terminator that some
+// attributes (e.g. security.selinux) carry.
+func getXattr(path, name string) (string, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimRight(buf[:size], "\x00")), nil
+}